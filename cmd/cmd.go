@@ -18,11 +18,14 @@ func AsciiArt() {
 	fmt.Printf("\t\t            v%s\n", Version)
 }
 
-func ParseFlags() (configPath string, clearEphemeral bool) {
+func ParseFlags() (configPath string, clearEphemeral bool, encryptConfig bool, exportPnpmStore string, verifyPnpmStore bool) {
 	configPathPtr := flag.String("config", "./config.json", "path to config file")
 	help := flag.Bool("help", false, "print help and exit")
 	version := flag.Bool("version", false, "print version and exit")
 	clearEphemeralPtr := flag.Bool("clear-ephemeral-dir", false, "remove ephemeral build/cache directories")
+	encryptConfigPtr := flag.Bool("encrypt-config", false, "encrypt (or re-encrypt with the current key) the secrets in the config file and exit")
+	exportPnpmStorePtr := flag.String("export-pnpm-store", "", "write the pnpm store to a .tar.gz archive at this path, for the npm.storeArchive of offline hosts, and exit")
+	verifyPnpmStorePtr := flag.Bool("verify-pnpm-store", false, "check the pnpm store (loading npm.storeArchive first) holds every package needed to build offline and exit")
 
 	flag.Parse()
 
@@ -36,5 +39,5 @@ func ParseFlags() (configPath string, clearEphemeral bool) {
 		os.Exit(0)
 	}
 
-	return *configPathPtr, *clearEphemeralPtr
+	return *configPathPtr, *clearEphemeralPtr, *encryptConfigPtr, *exportPnpmStorePtr, *verifyPnpmStorePtr
 }
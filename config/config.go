@@ -2,7 +2,11 @@ package config
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
+	"strings"
+
+	"git.difuse.io/Difuse/kalmia/secrets"
 )
 
 type User struct {
@@ -41,20 +45,102 @@ type GoogleOAuth struct {
 	RedirectURL  string `json:"callbackUrl"`
 }
 
+// Npm configures where pnpm installs the packages of rspress from. With
+// offline, nothing is fetched and packages only come from the pnpm store,
+// which can be loaded from storeArchive (see -export-pnpm-store).
+type Npm struct {
+	Registry     string `json:"registry"`
+	AuthToken    string `json:"authToken"`
+	StoreArchive string `json:"storeArchive"`
+	Offline      bool   `json:"offline"`
+}
+
+// Cluster lets several instances share a Postgres database. Builds are
+// claimed by locking their documentation, periodic jobs run on the instance
+// holding the leader lease and built sites are shared through the database.
+type Cluster struct {
+	Enabled      bool   `json:"enabled"`
+	InstanceID   string `json:"instanceId"`   // defaults to the hostname
+	SyncInterval int    `json:"syncInterval"` // in seconds
+}
+
+// SiteStorage selects where built sites are served from. With "s3" every
+// build is uploaded under a prefix of its own in the S3 bucket, and sites are
+// served from the active one, or redirected to CdnURL in front of the bucket.
+type SiteStorage struct {
+	Type         string `json:"type"`         // "local" or "s3"
+	Prefix       string `json:"prefix"`       // defaults to "sites"
+	CdnURL       string `json:"cdnUrl"`       // optional
+	KeepReleases int    `json:"keepReleases"` // defaults to 5
+}
+
+// Cache bounds the memory taken by the files of built sites kept in memory.
+type Cache struct {
+	MaxSize      int64 `json:"maxSize"`      // in MB, defaults to 256
+	MaxEntrySize int64 `json:"maxEntrySize"` // in MB, defaults to 8
+}
+
+// TLS serves HTTPS on Port, with the certificate in CertFile and KeyFile,
+// with certificates for Hosts and the verified custom domains obtained from
+// an ACME CA when ACME is set, or with both, the files being used for the
+// hosts they cover. Plain HTTP is then only redirected to HTTPS.
+type TLS struct {
+	Enabled      bool     `json:"enabled"`
+	Port         int      `json:"port"` // defaults to 443
+	CertFile     string   `json:"certFile"`
+	KeyFile      string   `json:"keyFile"`
+	ACME         bool     `json:"acme"`
+	Email        string   `json:"email"`
+	Hosts        []string `json:"hosts"`        // the hosts of Kalmia itself
+	DirectoryURL string   `json:"directoryUrl"` // defaults to Let's Encrypt
+	DirectoryCA  string   `json:"directoryCa"`  // PEM file, for test CAs such as Pebble
+	HSTSMaxAge   int      `json:"hstsMaxAge"`   // in seconds, defaults to a year, -1 to disable
+}
+
+// Metrics serves Prometheus metrics on /metrics, only to requests bearing
+// AuthToken when it is set.
+type Metrics struct {
+	Enabled   bool   `json:"enabled"`
+	AuthToken string `json:"authToken"` // sent as a bearer token
+}
+
+// Tracing exports OpenTelemetry traces of requests, builds and the work they
+// do to an OTLP/HTTP collector.
+type Tracing struct {
+	Enabled     bool              `json:"enabled"`
+	Endpoint    string            `json:"endpoint"`    // defaults to http://localhost:4318/v1/traces
+	Headers     map[string]string `json:"headers"`     // sent along with the spans, such as an API key
+	ServiceName string            `json:"serviceName"` // defaults to "kalmia"
+	SampleRatio float64           `json:"sampleRatio"` // of the traces started here, defaults to 1
+}
+
 type Config struct {
-	Environment    string         `json:"environment"`
-	Port           int            `json:"port"`
-	Database       string         `json:"database"`
-	LogLevel       string         `json:"logLevel"`
-	AssetStorage   string         `json:"assetStorage"`
-	MaxFileSize    int64          `json:"maxFileSize"` // in MB
-	SessionSecret  string         `json:"sessionSecret"`
-	Admins         []User         `json:"users"`
-	DataPath       string         `json:"dataPath"`
-	S3             S3             `json:"s3"`
-	GithubOAuth    GithubOAuth    `json:"githubOAuth"`
-	MicrosoftOAuth MicrosoftOAuth `json:"microsoftOAuth"`
-	GoogleOAuth    GoogleOAuth    `json:"googleOAuth"`
+	Environment         string         `json:"environment"`
+	Port                int            `json:"port"`
+	Database            string         `json:"database"`
+	LogLevel            string         `json:"logLevel"`
+	AssetStorage        string         `json:"assetStorage"`
+	MaxFileSize         int64          `json:"maxFileSize"` // in MB
+	SessionSecret       string         `json:"sessionSecret"`
+	Admins              []User         `json:"users"`
+	DataPath            string         `json:"dataPath"`
+	GitSyncInterval     int            `json:"gitSyncInterval"` // in seconds
+	BuildWorkers        int            `json:"buildWorkers"`
+	PreviewTTL          int            `json:"previewTtl"`      // in seconds
+	ShutdownTimeout     int            `json:"shutdownTimeout"` // in seconds
+	SecretsKey          string         `json:"secretsKey"`
+	PreviousSecretsKeys []string       `json:"previousSecretsKeys"`
+	S3                  S3             `json:"s3"`
+	Npm                 Npm            `json:"npm"`
+	Cluster             Cluster        `json:"cluster"`
+	SiteStorage         SiteStorage    `json:"siteStorage"`
+	Cache               Cache          `json:"cache"`
+	TLS                 TLS            `json:"tls"`
+	Metrics             Metrics        `json:"metrics"`
+	Tracing             Tracing        `json:"tracing"`
+	GithubOAuth         GithubOAuth    `json:"githubOAuth"`
+	MicrosoftOAuth      MicrosoftOAuth `json:"microsoftOAuth"`
+	GoogleOAuth         GoogleOAuth    `json:"googleOAuth"`
 }
 
 var ParsedConfig *Config
@@ -79,6 +165,11 @@ func ParseConfig(path string) *Config {
 		panic(err)
 	}
 
+	err = SetupSecrets()
+	if err != nil {
+		panic(err)
+	}
+
 	if ParsedConfig.AssetStorage == "local" {
 		SetupLocalS3Storage()
 	}
@@ -89,9 +180,216 @@ func ParseConfig(path string) *Config {
 		ParsedConfig.MaxFileSize = 10
 	}
 
+	if ParsedConfig.GitSyncInterval == 0 {
+		ParsedConfig.GitSyncInterval = 60
+	}
+
+	if ParsedConfig.BuildWorkers <= 0 {
+		ParsedConfig.BuildWorkers = 2
+	}
+
+	if ParsedConfig.PreviewTTL <= 0 {
+		ParsedConfig.PreviewTTL = 24 * 60 * 60
+	}
+
+	if ParsedConfig.ShutdownTimeout <= 0 {
+		ParsedConfig.ShutdownTimeout = 60
+	}
+
+	err = SetupCluster()
+	if err != nil {
+		panic(err)
+	}
+
+	if ParsedConfig.SiteStorage.Type == "" {
+		ParsedConfig.SiteStorage.Type = "local"
+	}
+
+	if ParsedConfig.SiteStorage.Prefix == "" {
+		ParsedConfig.SiteStorage.Prefix = "sites"
+	}
+
+	if ParsedConfig.SiteStorage.KeepReleases <= 0 {
+		ParsedConfig.SiteStorage.KeepReleases = 5
+	}
+
+	if ParsedConfig.Cache.MaxSize <= 0 {
+		ParsedConfig.Cache.MaxSize = 256
+	}
+
+	if ParsedConfig.Cache.MaxEntrySize <= 0 {
+		ParsedConfig.Cache.MaxEntrySize = 8
+	}
+
+	if ParsedConfig.TLS.Port <= 0 {
+		ParsedConfig.TLS.Port = 443
+	}
+
+	if ParsedConfig.TLS.HSTSMaxAge == 0 {
+		ParsedConfig.TLS.HSTSMaxAge = 365 * 24 * 60 * 60
+	}
+
+	if ParsedConfig.Tracing.Endpoint == "" {
+		ParsedConfig.Tracing.Endpoint = "http://localhost:4318/v1/traces"
+	}
+
+	if ParsedConfig.Tracing.ServiceName == "" {
+		ParsedConfig.Tracing.ServiceName = "kalmia"
+	}
+
+	if ParsedConfig.Tracing.SampleRatio <= 0 || ParsedConfig.Tracing.SampleRatio > 1 {
+		ParsedConfig.Tracing.SampleRatio = 1
+	}
+
+	if ParsedConfig.TLS.Enabled && !ParsedConfig.TLS.ACME && (ParsedConfig.TLS.CertFile == "" || ParsedConfig.TLS.KeyFile == "") {
+		panic(fmt.Errorf("tls.certFile and tls.keyFile are required unless tls.acme is set"))
+	}
+
 	return ParsedConfig
 }
 
+// secretPaths lists the JSON paths of config values that may be stored
+// encrypted.
+var secretPaths = [][]string{
+	{"s3", "secretAccessKey"},
+	{"githubOAuth", "clientSecret"},
+	{"microsoftOAuth", "clientSecret"},
+	{"googleOAuth", "clientSecret"},
+	{"npm", "authToken"},
+	{"metrics", "authToken"},
+}
+
+func (c *Config) secretFields() []*string {
+	return []*string{
+		&c.S3.SecretAccessKey,
+		&c.GithubOAuth.ClientSecret,
+		&c.MicrosoftOAuth.ClientSecret,
+		&c.GoogleOAuth.ClientSecret,
+		&c.Npm.AuthToken,
+		&c.Metrics.AuthToken,
+	}
+}
+
+// SetupSecrets loads the keys used for secrets at rest and decrypts the
+// secrets held in the config. KAL_SECRETS_KEY takes precedence over
+// secretsKey, and without either the session secret is used. Older keys in
+// previousSecretsKeys (or KAL_PREVIOUS_SECRETS_KEYS, comma separated) are
+// only used for decryption, so that keys can be rotated.
+func SetupSecrets() error {
+	if envKey := os.Getenv("KAL_SECRETS_KEY"); envKey != "" {
+		ParsedConfig.SecretsKey = envKey
+	}
+
+	if envKeys := os.Getenv("KAL_PREVIOUS_SECRETS_KEYS"); envKeys != "" {
+		ParsedConfig.PreviousSecretsKeys = append(ParsedConfig.PreviousSecretsKeys, strings.Split(envKeys, ",")...)
+	}
+
+	currentKey := ParsedConfig.SecretsKey
+	previousKeys := ParsedConfig.PreviousSecretsKeys
+
+	if currentKey == "" {
+		currentKey = ParsedConfig.SessionSecret
+	} else {
+		// Secrets written before a dedicated key was set used the session secret
+		previousKeys = append(previousKeys, ParsedConfig.SessionSecret)
+	}
+
+	if err := secrets.SetKeys(currentKey, previousKeys...); err != nil {
+		return err
+	}
+
+	for _, field := range ParsedConfig.secretFields() {
+		plaintext, err := secrets.Decrypt(*field)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt config secret: %v", err)
+		}
+		*field = plaintext
+	}
+
+	return nil
+}
+
+// EncryptConfigFile encrypts the plaintext secrets in a config file in place,
+// and re-encrypts ones sealed with an old key. It returns how many values
+// were changed.
+func EncryptConfigFile(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return 0, err
+	}
+
+	changed := 0
+	for _, secretPath := range secretPaths {
+		section, ok := raw[secretPath[0]].(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		value, ok := section[secretPath[1]].(string)
+		if !ok || value == "" {
+			continue
+		}
+
+		rotated, didRotate, err := secrets.Rotate(value)
+		if err != nil {
+			return changed, fmt.Errorf("failed to encrypt %s: %v", strings.Join(secretPath, "."), err)
+		}
+
+		if didRotate {
+			section[secretPath[1]] = rotated
+			changed++
+		}
+	}
+
+	if changed == 0 {
+		return 0, nil
+	}
+
+	encoded, err := json.MarshalIndent(raw, "", "  ")
+	if err != nil {
+		return changed, err
+	}
+
+	return changed, os.WriteFile(path, append(encoded, '\n'), 0600)
+}
+
+// SetupCluster checks the cluster settings and fills in their defaults.
+// KAL_INSTANCE_ID takes precedence over instanceId, so that replicas can
+// share a config file.
+func SetupCluster() error {
+	cluster := &ParsedConfig.Cluster
+	if !cluster.Enabled {
+		return nil
+	}
+
+	if ParsedConfig.Database == "sqlite" {
+		return fmt.Errorf("cluster mode needs a postgres database")
+	}
+
+	if envID := os.Getenv("KAL_INSTANCE_ID"); envID != "" {
+		cluster.InstanceID = envID
+	}
+
+	if cluster.InstanceID == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("failed to get hostname for the instance id: %v", err)
+		}
+		cluster.InstanceID = hostname
+	}
+
+	if cluster.SyncInterval <= 0 {
+		cluster.SyncInterval = 5
+	}
+
+	return nil
+}
+
 func SetupDataPath() error {
 	if ParsedConfig.DataPath == "" {
 		ParsedConfig.DataPath = "./data"
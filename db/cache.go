@@ -1,69 +1,323 @@
 package db
 
 import (
+	"bytes"
+	"compress/gzip"
+	"container/list"
 	"errors"
+	"os"
+	"sort"
 	"strings"
 	"sync"
 
 	"git.difuse.io/Difuse/kalmia/logger"
+	"github.com/andybalholm/brotli"
+	"go.uber.org/zap"
 )
 
-var (
-	Cache *sync.Map
-)
+// Cache holds the files of built sites and the base URLs of documentations,
+// within a memory budget.
+var Cache *LRUCache
+
+// Files smaller than this are not worth compressing.
+const minCompressSize = 1024
+
+var compressibleTypes = []string{
+	"text/",
+	"application/javascript",
+	"application/json",
+	"application/xml",
+	"image/svg+xml",
+}
 
 type CacheEntry struct {
 	Data        []byte
+	Gzip        []byte // nil unless smaller than Data
+	Brotli      []byte // nil unless smaller than Data
 	ContentType string
 }
 
-func InitCache() {
-	Cache = &sync.Map{}
-	logger.Info("Cache initialized")
+func (entry CacheEntry) size() int64 {
+	return int64(len(entry.Data) + len(entry.Gzip) + len(entry.Brotli))
 }
 
-func SetKey(key []byte, value []byte, contentType string) error {
-	Cache.Store(string(key), CacheEntry{
-		Data:        value,
-		ContentType: contentType,
-	})
+type CacheStats struct {
+	Entries      int          `json:"entries"`
+	Size         int64        `json:"size"`
+	MaxSize      int64        `json:"maxSize"`
+	MaxEntrySize int64        `json:"maxEntrySize"`
+	Hits         uint64       `json:"hits"`
+	Misses       uint64       `json:"misses"`
+	Loads        uint64       `json:"loads"`
+	Evictions    uint64       `json:"evictions"`
+	Sites        []CacheUsage `json:"sites"`
+}
+
+// CacheUsage is the part of the cache taken by the keys sharing a prefix,
+// such as the files of one site.
+type CacheUsage struct {
+	Prefix  string `json:"prefix"`
+	Entries int    `json:"entries"`
+	Size    int64  `json:"size"`
+}
+
+// LRUCache evicts the least recently used entries once the entries in it
+// take more than its maximum size. Entries larger than its maximum entry
+// size are never kept.
+type LRUCache struct {
+	mu           sync.Mutex
+	maxSize      int64
+	maxEntrySize int64
+	size         int64
+	items        map[string]*list.Element
+	order        *list.List // most recently used first
+	hits         uint64
+	misses       uint64
+	loads        uint64
+	evictions    uint64
+}
+
+type cacheItem struct {
+	key   string
+	entry CacheEntry
+	size  int64
+}
+
+var (
+	ErrKeyNotFound   = errors.New("key not found")
+	ErrEntryTooLarge = errors.New("entry too large for the cache")
+)
+
+func NewLRUCache(maxSize int64, maxEntrySize int64) *LRUCache {
+	if maxEntrySize <= 0 || maxEntrySize > maxSize {
+		maxEntrySize = maxSize
+	}
+
+	return &LRUCache{
+		maxSize:      maxSize,
+		maxEntrySize: maxEntrySize,
+		items:        make(map[string]*list.Element),
+		order:        list.New(),
+	}
+}
+
+func InitCache(maxSize int64, maxEntrySize int64) {
+	Cache = NewLRUCache(maxSize, maxEntrySize)
+	logger.Info("Cache initialized", zap.Int64("max_size", Cache.maxSize), zap.Int64("max_entry_size", Cache.maxEntrySize))
+}
+
+func (c *LRUCache) Get(key string) (CacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.items[key]
+	if !ok {
+		c.misses++
+		return CacheEntry{}, false
+	}
+
+	c.hits++
+	c.order.MoveToFront(element)
+	return element.Value.(*cacheItem).entry, true
+}
+
+// Set stores data under key, along with its compressed variants, evicting
+// other entries to make room for it.
+func (c *LRUCache) Set(key string, data []byte, contentType string) error {
+	if int64(len(data)) > c.maxEntrySize {
+		return ErrEntryTooLarge
+	}
+
+	c.store(key, newCacheEntry(data, contentType))
 	return nil
 }
 
-func GetValue(key []byte) (CacheEntry, error) {
-	if entry, ok := Cache.Load(string(key)); ok {
-		return entry.(CacheEntry), nil
+// Load returns the entry under key, calling load to fill it in on a miss.
+// Entries too large for the cache are returned without being kept.
+func (c *LRUCache) Load(key string, load func() ([]byte, string, error)) (CacheEntry, error) {
+	if entry, ok := c.Get(key); ok {
+		return entry, nil
+	}
+
+	data, contentType, err := load()
+	if err != nil {
+		return CacheEntry{}, err
+	}
+
+	c.mu.Lock()
+	c.loads++
+	c.mu.Unlock()
+
+	if int64(len(data)) > c.maxEntrySize {
+		return CacheEntry{Data: data, ContentType: contentType}, nil
 	}
-	return CacheEntry{}, ErrKeyNotFound
+
+	entry := newCacheEntry(data, contentType)
+	c.store(key, entry)
+	return entry, nil
 }
 
-func ClearCache() {
-	Cache.Range(func(k, v interface{}) bool {
-		Cache.Delete(k)
-		return true
+// LoadFile is Load for the file at path. Files too large for the cache are
+// not read, ErrEntryTooLarge is returned instead so they can be served from
+// disk.
+func (c *LRUCache) LoadFile(key string, path string, contentType string) (CacheEntry, error) {
+	return c.Load(key, func() ([]byte, string, error) {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, "", err
+		}
+
+		if info.IsDir() {
+			return nil, "", os.ErrNotExist
+		}
+
+		if info.Size() > c.maxEntrySize {
+			return nil, "", ErrEntryTooLarge
+		}
+
+		data, err := os.ReadFile(path)
+		return data, contentType, err
 	})
 }
 
-func ClearCacheByPrefix(prefix string) error {
-	Cache.Range(func(k, v interface{}) bool {
-		if strings.HasPrefix(k.(string), prefix) {
-			Cache.Delete(k)
+func (c *LRUCache) store(key string, entry CacheEntry) {
+	item := &cacheItem{key: key, entry: entry, size: int64(len(key)) + entry.size()}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.items[key]; ok {
+		c.remove(element)
+	}
+
+	c.items[key] = c.order.PushFront(item)
+	c.size += item.size
+
+	for c.size > c.maxSize && c.order.Len() > 1 {
+		c.remove(c.order.Back())
+		c.evictions++
+	}
+}
+
+func (c *LRUCache) remove(element *list.Element) {
+	item := c.order.Remove(element).(*cacheItem)
+	delete(c.items, item.key)
+	c.size -= item.size
+}
+
+func (c *LRUCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.items[key]; ok {
+		c.remove(element)
+	}
+}
+
+// DeletePrefix removes every entry whose key starts with prefix, and returns
+// how many there were.
+func (c *LRUCache) DeletePrefix(prefix string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	removed := 0
+	for key, element := range c.items {
+		if strings.HasPrefix(key, prefix) {
+			c.remove(element)
+			removed++
 		}
-		return true
-	})
-	return nil
+	}
+
+	return removed
 }
 
-func GetCacheByPrefix(prefix string) (map[string]string, error) {
+func (c *LRUCache) Clear() {
+	c.DeletePrefix("")
+}
+
+// Values returns the data of every entry whose key starts with prefix, as
+// strings, without marking them used.
+func (c *LRUCache) Values(prefix string) map[string]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	result := make(map[string]string)
-	Cache.Range(func(k, v interface{}) bool {
-		if strings.HasPrefix(k.(string), prefix) {
-			entry := v.(CacheEntry)
-			result[k.(string)] = string(entry.Data)
+	for key, element := range c.items {
+		if strings.HasPrefix(key, prefix) {
+			result[key] = string(element.Value.(*cacheItem).entry.Data)
 		}
-		return true
-	})
-	return result, nil
+	}
+
+	return result
 }
 
-var ErrKeyNotFound = errors.New("key not found")
+// Stats returns the counters of the cache, with its usage grouped by the
+// first two parts of the keys, which name the site for cached files.
+func (c *LRUCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	usage := make(map[string]*CacheUsage)
+	for key, element := range c.items {
+		parts := strings.SplitN(key, "|", 3)
+		prefix := strings.Join(parts[:min(len(parts), 2)], "|")
+
+		if usage[prefix] == nil {
+			usage[prefix] = &CacheUsage{Prefix: prefix}
+		}
+		usage[prefix].Entries++
+		usage[prefix].Size += element.Value.(*cacheItem).size
+	}
+
+	sites := make([]CacheUsage, 0, len(usage))
+	for _, site := range usage {
+		sites = append(sites, *site)
+	}
+	sort.Slice(sites, func(i, j int) bool { return sites[i].Size > sites[j].Size })
+
+	return CacheStats{
+		Entries:      len(c.items),
+		Size:         c.size,
+		MaxSize:      c.maxSize,
+		MaxEntrySize: c.maxEntrySize,
+		Hits:         c.hits,
+		Misses:       c.misses,
+		Loads:        c.loads,
+		Evictions:    c.evictions,
+		Sites:        sites,
+	}
+}
+
+func newCacheEntry(data []byte, contentType string) CacheEntry {
+	entry := CacheEntry{Data: data, ContentType: contentType}
+	if len(data) < minCompressSize || !Compressible(contentType) {
+		return entry
+	}
+
+	var gzipped bytes.Buffer
+	gzipWriter, _ := gzip.NewWriterLevel(&gzipped, gzip.BestCompression)
+	gzipWriter.Write(data)
+	if gzipWriter.Close() == nil && gzipped.Len() < len(data) {
+		entry.Gzip = gzipped.Bytes()
+	}
+
+	var brotlied bytes.Buffer
+	brotliWriter := brotli.NewWriterLevel(&brotlied, brotli.DefaultCompression)
+	brotliWriter.Write(data)
+	if brotliWriter.Close() == nil && brotlied.Len() < len(data) {
+		entry.Brotli = brotlied.Bytes()
+	}
+
+	return entry
+}
+
+// Compressible reports whether files of contentType are worth compressing.
+func Compressible(contentType string) bool {
+	for _, prefix := range compressibleTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,158 @@
+package db
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestLRUCacheEviction(t *testing.T) {
+	cache := NewLRUCache(100, 0)
+
+	cache.Set("a", make([]byte, 40), "text/plain")
+	cache.Set("b", make([]byte, 40), "text/plain")
+
+	// a is now the most recently used
+	if _, ok := cache.Get("a"); !ok {
+		t.Fatal("Expected a to be cached")
+	}
+
+	cache.Set("c", make([]byte, 40), "text/plain")
+
+	if _, ok := cache.Get("b"); ok {
+		t.Error("Expected the least recently used entry to be evicted")
+	}
+
+	for _, key := range []string{"a", "c"} {
+		if _, ok := cache.Get(key); !ok {
+			t.Errorf("Expected %s to be cached", key)
+		}
+	}
+
+	stats := cache.Stats()
+	if stats.Size > 100 || stats.Evictions != 1 || stats.Entries != 2 {
+		t.Errorf("Stats() got = %+v, want at most 100 bytes in 2 entries after 1 eviction", stats)
+	}
+
+	if stats.Hits != 3 || stats.Misses != 1 {
+		t.Errorf("Stats() got = %d hits, %d misses, want 3 hits, 1 miss", stats.Hits, stats.Misses)
+	}
+}
+
+func TestLRUCacheEntrySize(t *testing.T) {
+	cache := NewLRUCache(100, 10)
+
+	if err := cache.Set("large", make([]byte, 11), "text/plain"); !errors.Is(err, ErrEntryTooLarge) {
+		t.Errorf("Set() error = %v, want ErrEntryTooLarge", err)
+	}
+
+	entry, err := cache.Load("loaded", func() ([]byte, string, error) {
+		return make([]byte, 11), "text/plain", nil
+	})
+	if err != nil || len(entry.Data) != 11 {
+		t.Errorf("Load() got = %d bytes, %v, want 11 bytes", len(entry.Data), err)
+	}
+
+	if _, ok := cache.Get("loaded"); ok {
+		t.Error("Expected entries over the maximum entry size not to be kept")
+	}
+
+	path := filepath.Join(t.TempDir(), "large.bin")
+	if err := os.WriteFile(path, make([]byte, 11), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := cache.LoadFile("file", path, "application/octet-stream"); !errors.Is(err, ErrEntryTooLarge) {
+		t.Errorf("LoadFile() error = %v, want ErrEntryTooLarge", err)
+	}
+
+	if _, err := cache.LoadFile("missing", filepath.Join(t.TempDir(), "missing"), "text/plain"); !os.IsNotExist(err) {
+		t.Errorf("LoadFile() error = %v, want a not exist error", err)
+	}
+}
+
+func TestLRUCacheLoad(t *testing.T) {
+	cache := NewLRUCache(1<<20, 0)
+
+	calls := 0
+	load := func() ([]byte, string, error) {
+		calls++
+		return []byte("content"), "text/plain", nil
+	}
+
+	for i := 0; i < 3; i++ {
+		entry, err := cache.Load("key", load)
+		if err != nil || string(entry.Data) != "content" {
+			t.Fatalf("Load() got = %q, %v, want %q", entry.Data, err, "content")
+		}
+	}
+
+	if calls != 1 || cache.Stats().Loads != 1 {
+		t.Errorf("Expected the entry to be loaded once, got %d calls", calls)
+	}
+}
+
+func TestLRUCacheCompression(t *testing.T) {
+	cache := NewLRUCache(1<<20, 0)
+	content := []byte(strings.Repeat("function compressed() { return true; }\n", 100))
+
+	cache.Set("script.js", content, "application/javascript")
+	cache.Set("image.png", content, "image/png")
+	cache.Set("small.js", []byte("var a;"), "application/javascript")
+
+	entry, _ := cache.Get("script.js")
+	if entry.Gzip == nil || entry.Brotli == nil {
+		t.Fatal("Expected gzip and brotli variants of a compressible file")
+	}
+
+	gzipReader, err := gzip.NewReader(bytes.NewReader(entry.Gzip))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded, _ := io.ReadAll(gzipReader); !bytes.Equal(decoded, content) {
+		t.Error("Expected the gzip variant to decode to the content")
+	}
+
+	if decoded, _ := io.ReadAll(brotli.NewReader(bytes.NewReader(entry.Brotli))); !bytes.Equal(decoded, content) {
+		t.Error("Expected the brotli variant to decode to the content")
+	}
+
+	for _, key := range []string{"image.png", "small.js"} {
+		if entry, _ := cache.Get(key); entry.Gzip != nil || entry.Brotli != nil {
+			t.Errorf("Expected no compressed variants for %s", key)
+		}
+	}
+}
+
+func TestLRUCacheDeletePrefix(t *testing.T) {
+	cache := NewLRUCache(1<<20, 0)
+
+	cache.Set("rs|doc_1|index.html", []byte("1"), "text/html")
+	cache.Set("rs|doc_1|main.js", []byte("1"), "application/javascript")
+	cache.Set("rs|doc_10|index.html", []byte("10"), "text/html")
+
+	if removed := cache.DeletePrefix("rs|doc_1|"); removed != 2 {
+		t.Errorf("DeletePrefix() got = %d, want 2", removed)
+	}
+
+	if values := cache.Values("rs|"); len(values) != 1 || values["rs|doc_10|index.html"] != "10" {
+		t.Errorf("Values() got = %v, want only doc_10", values)
+	}
+
+	sites := cache.Stats().Sites
+	if len(sites) != 1 || sites[0].Prefix != "rs|doc_10" || sites[0].Entries != 1 {
+		t.Errorf("Stats().Sites got = %+v, want one entry for rs|doc_10", sites)
+	}
+
+	cache.Clear()
+	if stats := cache.Stats(); stats.Entries != 0 || stats.Size != 0 {
+		t.Errorf("Stats() after Clear() got = %+v, want an empty cache", stats)
+	}
+}
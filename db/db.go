@@ -52,6 +52,23 @@ func SetupDatabase(env string, database string, dataPath string) *gorm.DB {
 		&models.BuildTriggers{},
 		&models.PageGroup{},
 		&models.Page{},
+		&models.GitSyncState{},
+		&models.GitSyncFile{},
+		&models.GitSyncConflict{},
+		&models.BuildRun{},
+		&models.BuildRunPhase{},
+		&models.BuildRunLog{},
+		&models.Webhook{},
+		&models.WebhookDelivery{},
+		&models.InboundHook{},
+		&models.PageDraft{},
+		&models.PageReview{},
+		&models.PreviewBuild{},
+		&models.Lease{},
+		&models.OAuthCode{},
+		&models.PublishedSite{},
+		&models.SiteRelease{},
+		&models.DocumentationDomain{},
 	)
 
 	if err != nil {
@@ -70,6 +87,17 @@ func SetupDatabase(env string, database string, dataPath string) *gorm.DB {
 	return db
 }
 
+// CloseDatabase closes the connections to the database once the queries
+// running on them are done.
+func CloseDatabase(db *gorm.DB) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+
+	return sqlDB.Close()
+}
+
 func SetupBasicData(db *gorm.DB, admins []config.User) {
 	for _, admin := range admins {
 		var user models.User
@@ -0,0 +1,116 @@
+package models
+
+import (
+	"time"
+
+	jsonx "github.com/clarketm/json"
+)
+
+const (
+	BuildRunQueued    = "queued"
+	BuildRunRunning   = "running"
+	BuildRunSucceeded = "succeeded"
+	BuildRunFailed    = "failed"
+	BuildRunCanceled  = "canceled"
+)
+
+// BuildRun is one build of a documentation, covering every trigger that was
+// pending when it started. Its output is kept in BuildRunLog chunks.
+type BuildRun struct {
+	ID              uint            `gorm:"primarykey" json:"id"`
+	DocumentationID uint            `gorm:"index" json:"documentationId"`
+	Status          string          `gorm:"index" json:"status"`
+	Manual          bool            `gorm:"default:false" json:"manual"`
+	ExitCode        *int            `json:"exitCode,omitempty"`
+	Error           string          `json:"error,omitempty"`
+	Instance        string          `json:"instance,omitempty"`
+	Phases          []BuildRunPhase `gorm:"foreignKey:BuildRunID;constraint:OnDelete:CASCADE" json:"phases,omitempty"`
+	CreatedAt       *time.Time      `gorm:"autoCreateTime" json:"createdAt"`
+	StartedAt       *time.Time      `json:"startedAt,omitempty"`
+	FinishedAt      *time.Time      `json:"finishedAt,omitempty"`
+}
+
+func (s BuildRun) MarshalJSON() ([]byte, error) {
+	type TmpStruct BuildRun
+	return jsonx.Marshal(TmpStruct(s))
+}
+
+type BuildRunPhase struct {
+	ID         uint       `gorm:"primarykey" json:"id"`
+	BuildRunID uint       `gorm:"index" json:"buildRunId"`
+	Name       string     `json:"name"`
+	Status     string     `json:"status"`
+	StartedAt  *time.Time `json:"startedAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	DurationMs int64      `json:"durationMs"`
+}
+
+func (s BuildRunPhase) MarshalJSON() ([]byte, error) {
+	type TmpStruct BuildRunPhase
+	return jsonx.Marshal(TmpStruct(s))
+}
+
+// BuildRunLog is a chunk of the output of a build run, covering the bytes
+// from StartOffset up to EndOffset of its log.
+type BuildRunLog struct {
+	ID          uint   `gorm:"primarykey" json:"id"`
+	BuildRunID  uint   `gorm:"index" json:"buildRunId"`
+	StartOffset int64  `json:"startOffset"`
+	EndOffset   int64  `gorm:"index" json:"endOffset"`
+	Data        []byte `json:"-"`
+}
+
+func (s BuildRunLog) MarshalJSON() ([]byte, error) {
+	type TmpStruct BuildRunLog
+	return jsonx.Marshal(TmpStruct(s))
+}
+
+const (
+	PreviewBuildRunning = "running"
+	PreviewBuildReady   = "ready"
+	PreviewBuildFailed  = "failed"
+)
+
+// PreviewBuild is an on-demand build of a documentation with its pending
+// drafts applied, served under its token until it expires.
+type PreviewBuild struct {
+	ID              uint       `gorm:"primarykey" json:"id"`
+	DocumentationID uint       `gorm:"index" json:"documentationId"`
+	RootID          uint       `gorm:"index" json:"rootId"`
+	Token           string     `gorm:"uniqueIndex" json:"token"`
+	Status          string     `json:"status"`
+	Error           string     `json:"error,omitempty"`
+	PreviewAt       *time.Time `json:"previewAt,omitempty"`
+	Instance        string     `json:"instance,omitempty"`
+	CreatedByID     uint       `json:"createdById"`
+	CreatedAt       *time.Time `gorm:"autoCreateTime" json:"createdAt"`
+	ExpiresAt       time.Time  `gorm:"index" json:"expiresAt"`
+}
+
+func (s PreviewBuild) MarshalJSON() ([]byte, error) {
+	type TmpStruct PreviewBuild
+	return jsonx.Marshal(TmpStruct(s))
+}
+
+// SiteRelease is a build of a documentation kept under a prefix of its own,
+// in object storage or in the folder of the documentation when sites are
+// served from disk. Releases are never modified, the site is served from the
+// one that is active. Pinned releases are never pruned, and builds do not
+// replace an active release that is pinned unless they are started by hand.
+type SiteRelease struct {
+	ID              uint       `gorm:"primarykey" json:"id"`
+	DocumentationID uint       `gorm:"index" json:"documentationId"`
+	BuildRunID      *uint      `json:"buildRunId,omitempty"`
+	Prefix          string     `json:"prefix"`
+	Hash            string     `json:"hash"`
+	Files           int        `json:"files"`
+	Size            int64      `json:"size"`
+	Active          bool       `gorm:"index;default:false" json:"active"`
+	Pinned          bool       `gorm:"default:false" json:"pinned"`
+	CreatedAt       *time.Time `gorm:"autoCreateTime" json:"createdAt"`
+}
+
+func (s SiteRelease) MarshalJSON() ([]byte, error) {
+	type TmpStruct SiteRelease
+	return jsonx.Marshal(TmpStruct(s))
+}
@@ -0,0 +1,37 @@
+package models
+
+import "time"
+
+// Lease is held by one instance at a time until it expires, unless renewed
+// by its holder. Instances hold a lease of their own as a heartbeat, and the
+// one holding LeaderLease runs the periodic jobs.
+type Lease struct {
+	Name      string    `gorm:"primaryKey" json:"name"`
+	Holder    string    `gorm:"index" json:"holder"`
+	ExpiresAt time.Time `gorm:"index" json:"expiresAt"`
+}
+
+const LeaderLease = "leader"
+
+// InstanceLeasePrefix is followed by the id of the instance in the name of
+// its heartbeat lease.
+const InstanceLeasePrefix = "instance:"
+
+// OAuthCode is exchanged once, before it expires, for the token of a user
+// who signed in through an OAuth provider.
+type OAuthCode struct {
+	Code      string    `gorm:"primaryKey" json:"-"`
+	Token     string    `gorm:"type:text" json:"-"`
+	ExpiresAt time.Time `gorm:"index" json:"expiresAt"`
+}
+
+// PublishedSite is the latest output of a build, as a gzipped tar archive,
+// for every instance to serve. Sites are named after the folder they are
+// built in, doc_<id> for documentations and preview_<token> for previews.
+type PublishedSite struct {
+	Name      string    `gorm:"primaryKey" json:"name"`
+	Hash      string    `json:"hash"`
+	Archive   []byte    `json:"-"`
+	Instance  string    `json:"instance"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
@@ -22,6 +22,9 @@ type Page struct {
 	LastEditorID    *uint      `json:"lastEditorId,omitempty"`
 	IsIntroPage     bool       `json:"isIntroPage,omitempty" gorm:"default:false"`
 	IsPage          bool       `json:"isPage" gorm:"default:true"`
+	PublishAt       *time.Time `gorm:"index" json:"publishAt,omitempty"`
+	UnpublishAt     *time.Time `gorm:"index" json:"unpublishAt,omitempty"`
+	IsDraft         bool       `json:"isDraft" gorm:"default:false"`
 }
 
 func (s Page) MarshalJSON() ([]byte, error) {
@@ -43,6 +46,8 @@ type PageGroup struct {
 	LastEditorID    *uint      `json:"lastEditorId,omitempty"`
 	Pages           []Page     `json:"pages,omitempty" gorm:"foreignKey:PageGroupID;constraint:OnDelete:CASCADE"`
 	IsPageGroup     bool       `json:"isPagGroup" gorm:"default:true"`
+	PublishAt       *time.Time `gorm:"index" json:"publishAt,omitempty"`
+	UnpublishAt     *time.Time `gorm:"index" json:"unpublishAt,omitempty"`
 }
 
 func (s PageGroup) MarshalJSON() ([]byte, error) {
@@ -74,6 +79,7 @@ type Documentation struct {
 	CreatedAt        *time.Time  `gorm:"autoCreateTime" json:"createdAt,omitempty"`
 	UpdatedAt        *time.Time  `gorm:"autoUpdateTime" json:"updatedAt,omitempty"`
 	Editors          []User      `gorm:"many2many:documentation_editors;" json:"editors,omitempty"`
+	Reviewers        []User      `gorm:"many2many:documentation_reviewers;" json:"reviewers,omitempty"`
 	LastEditorID     *uint       `json:"lastEditorId,omitempty"`
 	PageGroups       []PageGroup `gorm:"foreignKey:DocumentationID;constraint:OnDelete:CASCADE" json:"pageGroups,omitempty"`
 	Pages            []Page      `gorm:"foreignKey:DocumentationID;constraint:OnDelete:CASCADE" json:"pages,omitempty"`
@@ -81,9 +87,18 @@ type Documentation struct {
 	GitRepo          string      `json:"gitRepo,omitempty"`
 	GitEmail         string      `json:"gitEmail,omitempty"`
 	GitUser          string      `json:"gitUser,omitempty"`
-	GitPassword      string      `json:"gitPassword,omitempty"`
+	GitPassword      string      `json:"-"`
+	GitSSHPrivateKey string      `json:"-"`
+	GitPasswordSet   bool        `gorm:"->;-:migration" json:"gitPasswordSet"`
+	GitSSHKeySet     bool        `gorm:"->;-:migration" json:"gitSSHKeySet"`
+	GitSSHPublicKey  string      `json:"gitSSHPublicKey,omitempty"`
+	GitSSHKnownHosts string      `json:"gitSSHKnownHosts,omitempty"`
 	GitBranch        string      `json:"gitBranch,omitempty"`
+	GitSyncEnabled   bool        `json:"gitSyncEnabled" gorm:"default:false"`
+	GitSyncRepo      string      `json:"gitSyncRepo,omitempty"`
+	GitSyncBranch    string      `json:"gitSyncBranch,omitempty"`
 	DisableAutoBuild bool        `json:"disableAutoBuild" gorm:"default:false"`
+	Generator        string      `json:"generator" gorm:"default:rspress"`
 }
 
 func (s Documentation) MarshalJSON() ([]byte, error) {
@@ -91,12 +106,30 @@ func (s Documentation) MarshalJSON() ([]byte, error) {
 	return jsonx.Marshal(TmpStruct(s))
 }
 
+// Static site generators a documentation can be built with.
+const (
+	GeneratorRsPress = "rspress"
+	GeneratorHTML    = "html"
+)
+
+const (
+	BuildTriggerPending    = "pending"
+	BuildTriggerRunning    = "running"
+	BuildTriggerCompleted  = "completed"
+	BuildTriggerFailed     = "failed"
+	BuildTriggerSuperseded = "superseded"
+)
+
 type BuildTriggers struct {
 	ID              uint       `gorm:"primarykey" json:"id"`
-	DocumentationID uint       `json:"documentationId"`
-	Triggered       bool       `json:"triggered"`
+	DocumentationID uint       `gorm:"index" json:"documentationId"`
+	Triggered       bool       `gorm:"index" json:"triggered"`
 	IsDelete        bool       `json:"isDelete"`
+	Manual          bool       `gorm:"default:false" json:"manual"`
+	Status          string     `json:"status"`
+	ClaimedBy       string     `gorm:"index" json:"claimedBy,omitempty"`
 	CreatedAt       *time.Time `gorm:"autoCreateTime" json:"createdAt"`
+	StartedAt       *time.Time `json:"startedAt"`
 	CompletedAt     *time.Time `json:"completedAt"`
 }
 
@@ -0,0 +1,25 @@
+package models
+
+import (
+	"time"
+
+	jsonx "github.com/clarketm/json"
+)
+
+// DocumentationDomain is a hostname the site of a documentation is served on,
+// at its root. Domains are only served once verified, through a DNS TXT
+// record holding their token.
+type DocumentationDomain struct {
+	ID              uint       `gorm:"primarykey" json:"id"`
+	DocumentationID uint       `gorm:"index" json:"documentationId"`
+	Domain          string     `gorm:"uniqueIndex" json:"domain"`
+	Token           string     `json:"token"`
+	Verified        bool       `gorm:"default:false" json:"verified"`
+	VerifiedAt      *time.Time `json:"verifiedAt,omitempty"`
+	CreatedAt       *time.Time `gorm:"autoCreateTime" json:"createdAt"`
+}
+
+func (s DocumentationDomain) MarshalJSON() ([]byte, error) {
+	type TmpStruct DocumentationDomain
+	return jsonx.Marshal(TmpStruct(s))
+}
@@ -0,0 +1,61 @@
+package models
+
+import (
+	"time"
+
+	jsonx "github.com/clarketm/json"
+)
+
+const (
+	PageDraftEditing          = "draft"
+	PageDraftInReview         = "in_review"
+	PageDraftChangesRequested = "changes_requested"
+	PageDraftApproved         = "approved"
+)
+
+const (
+	PageReviewRequested        = "review_requested"
+	PageReviewApproved         = "approved"
+	PageReviewChangesRequested = "changes_requested"
+	PageReviewPublished        = "published"
+)
+
+// PageDraft holds unpublished edits to a page. Drafts are never written to
+// the site; publishing one copies it onto its page.
+type PageDraft struct {
+	ID                uint       `gorm:"primarykey" json:"id"`
+	PageID            uint       `gorm:"uniqueIndex" json:"pageId"`
+	Title             string     `json:"title"`
+	Slug              string     `json:"slug"`
+	Content           string     `json:"content,omitempty"`
+	Status            string     `json:"status"`
+	AuthorID          uint       `json:"authorId,omitempty"`
+	LastEditorID      *uint      `json:"lastEditorId,omitempty"`
+	ReviewRequestedAt *time.Time `json:"reviewRequestedAt,omitempty"`
+	ApprovedAt        *time.Time `json:"approvedAt,omitempty"`
+	ApprovedByID      *uint      `json:"approvedById,omitempty"`
+	CreatedAt         *time.Time `gorm:"autoCreateTime" json:"createdAt,omitempty"`
+	UpdatedAt         *time.Time `gorm:"autoUpdateTime" json:"updatedAt,omitempty"`
+}
+
+func (s PageDraft) MarshalJSON() ([]byte, error) {
+	type TmpStruct PageDraft
+	return jsonx.Marshal(TmpStruct(s))
+}
+
+// PageReview records a step of the review workflow of a page.
+type PageReview struct {
+	ID        uint       `gorm:"primarykey" json:"id"`
+	PageID    uint       `gorm:"index" json:"pageId"`
+	DraftID   uint       `json:"draftId"`
+	UserID    uint       `json:"userId"`
+	User      User       `gorm:"foreignKey:UserID" json:"user,omitempty"`
+	Action    string     `json:"action"`
+	Comment   string     `json:"comment,omitempty"`
+	CreatedAt *time.Time `gorm:"autoCreateTime" json:"createdAt,omitempty"`
+}
+
+func (s PageReview) MarshalJSON() ([]byte, error) {
+	type TmpStruct PageReview
+	return jsonx.Marshal(TmpStruct(s))
+}
@@ -0,0 +1,53 @@
+package models
+
+import (
+	"time"
+
+	jsonx "github.com/clarketm/json"
+)
+
+type GitSyncState struct {
+	ID              uint       `gorm:"primarykey" json:"id"`
+	DocumentationID uint       `gorm:"uniqueIndex" json:"documentationId"`
+	LastCommit      string     `json:"lastCommit,omitempty"`
+	LastError       string     `json:"lastError,omitempty"`
+	LastSyncedAt    *time.Time `json:"lastSyncedAt,omitempty"`
+}
+
+func (s GitSyncState) MarshalJSON() ([]byte, error) {
+	type TmpStruct GitSyncState
+	return jsonx.Marshal(TmpStruct(s))
+}
+
+// GitSyncFile records what a page or page group looked like, both in the
+// repository and in the database, the last time they were in sync.
+type GitSyncFile struct {
+	ID              uint   `gorm:"primarykey" json:"id"`
+	DocumentationID uint   `gorm:"index:idx_sync_doc_key,unique:true,composite:true" json:"documentationId"`
+	Key             string `gorm:"index:idx_sync_doc_key,unique:true,composite:true" json:"key"`
+	Path            string `json:"path"`
+	FileHash        string `json:"fileHash"`
+	ContentHash     string `json:"contentHash"`
+}
+
+func (s GitSyncFile) MarshalJSON() ([]byte, error) {
+	type TmpStruct GitSyncFile
+	return jsonx.Marshal(TmpStruct(s))
+}
+
+type GitSyncConflict struct {
+	ID              uint       `gorm:"primarykey" json:"id"`
+	DocumentationID uint       `gorm:"index" json:"documentationId"`
+	Key             string     `json:"key"`
+	Path            string     `json:"path"`
+	UpstreamCommit  string     `json:"upstreamCommit"`
+	Reason          string     `json:"reason"`
+	CreatedAt       *time.Time `gorm:"autoCreateTime" json:"createdAt"`
+	ResolvedAt      *time.Time `json:"resolvedAt,omitempty"`
+	Resolution      string     `json:"resolution,omitempty"`
+}
+
+func (s GitSyncConflict) MarshalJSON() ([]byte, error) {
+	type TmpStruct GitSyncConflict
+	return jsonx.Marshal(TmpStruct(s))
+}
@@ -0,0 +1,81 @@
+package models
+
+import (
+	"time"
+
+	jsonx "github.com/clarketm/json"
+)
+
+const (
+	WebhookDeliveryPending   = "pending"
+	WebhookDeliverySucceeded = "succeeded"
+	WebhookDeliveryFailed    = "failed"
+)
+
+// Webhook posts documentation events to an external URL. Webhooks without a
+// documentation receive the events of every documentation.
+type Webhook struct {
+	ID              uint       `gorm:"primarykey" json:"id"`
+	DocumentationID *uint      `gorm:"index" json:"documentationId"`
+	URL             string     `json:"url"`
+	Secret          string     `json:"-"`
+	SecretSet       bool       `gorm:"->;-:migration" json:"secretSet"`
+	Events          string     `json:"events"`
+	Enabled         bool       `gorm:"default:true" json:"enabled"`
+	AuthorID        uint       `json:"authorId,omitempty"`
+	CreatedAt       *time.Time `gorm:"autoCreateTime" json:"createdAt,omitempty"`
+	UpdatedAt       *time.Time `gorm:"autoUpdateTime" json:"updatedAt,omitempty"`
+}
+
+func (s Webhook) MarshalJSON() ([]byte, error) {
+	type TmpStruct Webhook
+	return jsonx.Marshal(TmpStruct(s))
+}
+
+type WebhookDelivery struct {
+	ID            uint       `gorm:"primarykey" json:"id"`
+	WebhookID     uint       `gorm:"index" json:"webhookId"`
+	Event         string     `json:"event"`
+	Payload       string     `json:"payload"`
+	Status        string     `gorm:"index" json:"status"`
+	Attempts      int        `json:"attempts"`
+	ResponseCode  int        `json:"responseCode,omitempty"`
+	ResponseBody  string     `json:"responseBody,omitempty"`
+	Error         string     `json:"error,omitempty"`
+	NextAttemptAt *time.Time `gorm:"index" json:"nextAttemptAt,omitempty"`
+	CreatedAt     *time.Time `gorm:"autoCreateTime" json:"createdAt"`
+	DeliveredAt   *time.Time `json:"deliveredAt,omitempty"`
+}
+
+func (s WebhookDelivery) MarshalJSON() ([]byte, error) {
+	type TmpStruct WebhookDelivery
+	return jsonx.Marshal(TmpStruct(s))
+}
+
+const (
+	InboundHookActionNone          = ""
+	InboundHookActionGitSync       = "git_sync"
+	InboundHookActionCreateVersion = "create_version"
+)
+
+// InboundHook lets external systems trigger a build of a documentation
+// through a secret URL. Only a hash of the URL token is stored; when Secret
+// is set, callers must also sign their payload with it.
+type InboundHook struct {
+	ID              uint       `gorm:"primarykey" json:"id"`
+	DocumentationID uint       `gorm:"index" json:"documentationId"`
+	TokenHash       string     `gorm:"uniqueIndex" json:"-"`
+	TokenHint       string     `json:"tokenHint"`
+	Secret          string     `json:"-"`
+	SecretSet       bool       `gorm:"->;-:migration" json:"secretSet"`
+	Action          string     `json:"action"`
+	AuthorID        uint       `json:"authorId,omitempty"`
+	LastTriggeredAt *time.Time `json:"lastTriggeredAt,omitempty"`
+	CreatedAt       *time.Time `gorm:"autoCreateTime" json:"createdAt,omitempty"`
+	UpdatedAt       *time.Time `gorm:"autoUpdateTime" json:"updatedAt,omitempty"`
+}
+
+func (s InboundHook) MarshalJSON() ([]byte, error) {
+	type TmpStruct InboundHook
+	return jsonx.Marshal(TmpStruct(s))
+}
@@ -16,6 +16,11 @@ import (
 //go:embed rspress
 var RspressFS embed.FS
 
+// HTMLFS holds the templates and assets of the built-in HTML site generator.
+//
+//go:embed html
+var HTMLFS embed.FS
+
 func ReadEmbeddedFile(path string) ([]byte, error) {
 	content, err := RspressFS.ReadFile("rspress/" + path)
 	if err != nil {
@@ -0,0 +1,103 @@
+(function () {
+  var root = document.body.dataset.root || "";
+
+  var toggle = document.querySelector(".theme-toggle");
+  if (toggle) {
+    toggle.addEventListener("click", function () {
+      var theme = document.documentElement.dataset.theme === "dark" ? "light" : "dark";
+      document.documentElement.dataset.theme = theme;
+      localStorage.setItem("kalmia-theme", theme);
+    });
+  }
+
+  var switcher = document.querySelector(".version-switcher");
+  if (switcher) {
+    switcher.addEventListener("change", function () {
+      window.location.href = switcher.value;
+    });
+  }
+
+  var input = document.querySelector(".search-input");
+  var results = document.querySelector(".search-results");
+  var index = null;
+
+  function loadIndex() {
+    if (!index) {
+      index = fetch(root + "/search-index.json")
+        .then(function (response) {
+          return response.ok ? response.json() : [];
+        })
+        .catch(function () {
+          return [];
+        });
+    }
+
+    return index;
+  }
+
+  function excerpt(text, query) {
+    var at = text.toLowerCase().indexOf(query);
+    if (at < 0) {
+      return text.slice(0, 120);
+    }
+
+    var start = Math.max(0, at - 40);
+    return (start > 0 ? "…" : "") + text.slice(start, at + query.length + 80);
+  }
+
+  function search() {
+    var query = input.value.trim().toLowerCase();
+    if (!query) {
+      results.hidden = true;
+      return;
+    }
+
+    loadIndex().then(function (pages) {
+      var matches = pages.filter(function (page) {
+        return page.title.toLowerCase().indexOf(query) >= 0 || page.text.toLowerCase().indexOf(query) >= 0;
+      });
+
+      results.textContent = "";
+      matches.slice(0, 10).forEach(function (page) {
+        var item = document.createElement("li");
+        var link = document.createElement("a");
+        var title = document.createElement("strong");
+        var text = document.createElement("span");
+
+        link.href = page.link;
+        title.textContent = page.title;
+        text.textContent = excerpt(page.text, query);
+
+        link.appendChild(title);
+        link.appendChild(text);
+        item.appendChild(link);
+        results.appendChild(item);
+      });
+
+      if (!matches.length) {
+        var empty = document.createElement("li");
+        empty.className = "search-empty";
+        empty.textContent = "No results";
+        results.appendChild(empty);
+      }
+
+      results.hidden = false;
+    });
+  }
+
+  if (input && results) {
+    input.addEventListener("focus", loadIndex);
+    input.addEventListener("input", search);
+    input.addEventListener("keydown", function (event) {
+      if (event.key === "Escape") {
+        input.value = "";
+        results.hidden = true;
+      }
+    });
+    document.addEventListener("click", function (event) {
+      if (!event.target.closest(".search")) {
+        results.hidden = true;
+      }
+    });
+  }
+})();
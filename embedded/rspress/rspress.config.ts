@@ -2,7 +2,7 @@ import * as path from 'path';
 import { defineConfig } from 'rspress/config';
 
 export default defineConfig({
-  root: path.join(__dirname, 'docs'),
+  root: path.join(__dirname, '__ROOT_DIR__'),
   globalStyles: path.join(__dirname, 'styles/output.css'),
   title: '__TITLE__',
   base: '__BASE_URL__',
@@ -391,7 +391,7 @@ func GithubCallback(aS *services.AuthService, w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	oauthCode, err := services.StoreOAuthToken(tokenDetails)
+	oauthCode, err := aS.StoreOAuthToken(tokenDetails)
 	if err != nil {
 		http.Redirect(w, r, "/admin/error/401", http.StatusTemporaryRedirect)
 		return
@@ -492,7 +492,7 @@ func MicrosoftCallback(aS *services.AuthService, w http.ResponseWriter, r *http.
 		return
 	}
 
-	oauthCode, err := services.StoreOAuthToken(tokenDetails)
+	oauthCode, err := aS.StoreOAuthToken(tokenDetails)
 	if err != nil {
 		http.Redirect(w, r, "/admin/error/401", http.StatusTemporaryRedirect)
 		return
@@ -575,7 +575,7 @@ func GoogleCallback(aS *services.AuthService, w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	oauthCode, err := services.StoreOAuthToken(tokenDetails)
+	oauthCode, err := aS.StoreOAuthToken(tokenDetails)
 	if err != nil {
 		http.Redirect(w, r, "/admin/error/401", http.StatusTemporaryRedirect)
 		return
@@ -639,7 +639,7 @@ func ExchangeOAuthCode(aS *services.AuthService, w http.ResponseWriter, r *http.
 		return
 	}
 
-	token, err := services.ExchangeOAuthCode(req.Code)
+	token, err := aS.ExchangeOAuthCode(req.Code)
 	if err != nil {
 		SendJSONResponse(http.StatusBadRequest, w, map[string]string{"status": "error", "message": err.Error()})
 		return
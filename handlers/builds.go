@@ -0,0 +1,190 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"git.difuse.io/Difuse/kalmia/services"
+	"git.difuse.io/Difuse/kalmia/utils"
+)
+
+func GetBuildRuns(service *services.DocService, w http.ResponseWriter, r *http.Request) {
+	type Request struct {
+		ID uint `json:"id" validate:"required"`
+	}
+	req, err := ValidateRequest[Request](w, r)
+	if err != nil {
+		return
+	}
+
+	runs, err := service.GetBuildRuns(req.ID)
+	if err != nil {
+		SendJSONResponse(http.StatusInternalServerError, w, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+
+	SendJSONResponse(http.StatusOK, w, map[string]interface{}{
+		"status": "success",
+		"builds": runs,
+	})
+}
+
+func GetBuildLog(service *services.DocService, w http.ResponseWriter, r *http.Request) {
+	type Request struct {
+		ID     uint  `json:"id" validate:"required"`
+		Offset int64 `json:"offset" validate:"min=0"`
+	}
+	req, err := ValidateRequest[Request](w, r)
+	if err != nil {
+		return
+	}
+
+	log, offset, finished, err := service.GetBuildLog(req.ID, req.Offset)
+	if err != nil {
+		SendJSONResponse(http.StatusInternalServerError, w, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+
+	SendJSONResponse(http.StatusOK, w, map[string]interface{}{
+		"status":   "success",
+		"log":      log,
+		"offset":   offset,
+		"finished": finished,
+	})
+}
+
+// GetStreamToken returns the token of a request to a build stream. EventSource
+// cannot set headers, so streams may pass the token as a query parameter
+// instead. Other routes only take it from the Authorization header.
+func GetStreamToken(r *http.Request) (string, error) {
+	if token, err := GetTokenFromHeader(r); err == nil {
+		return token, nil
+	}
+
+	if token := r.URL.Query().Get("token"); token != "" {
+		return utils.RemoveSpaces(token), nil
+	}
+
+	return "", fmt.Errorf("no token provided")
+}
+
+// StreamBuildLog writes the log of a build run as plain text and keeps the
+// response open, following the log, until the run has finished.
+func StreamBuildLog(service *services.DocService, w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+	if err != nil || id == 0 {
+		SendJSONResponse(http.StatusBadRequest, w, map[string]string{"status": "error", "message": "invalid_build_run_id"})
+		return
+	}
+
+	log, offset, finished, err := service.GetBuildLog(uint(id), 0)
+	if err != nil {
+		SendJSONResponse(http.StatusNotFound, w, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+
+	flusher, _ := w.(http.Flusher)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+
+	for {
+		if log != "" {
+			if _, err := w.Write([]byte(log)); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+
+		if finished {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(500 * time.Millisecond):
+		}
+
+		log, offset, finished, err = service.GetBuildLog(uint(id), offset)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func RetryBuild(service *services.DocService, w http.ResponseWriter, r *http.Request) {
+	type Request struct {
+		ID uint `json:"id" validate:"required"`
+	}
+	req, err := ValidateRequest[Request](w, r)
+	if err != nil {
+		return
+	}
+
+	if err := service.RetryBuild(req.ID); err != nil {
+		SendJSONResponse(http.StatusBadRequest, w, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+
+	SendJSONResponse(http.StatusOK, w, map[string]string{"status": "success", "message": "build_triggered"})
+}
+
+// StreamBuildEvents sends the build events of a documentation as
+// Server-Sent Events until the client disconnects.
+func StreamBuildEvents(service *services.DocService, w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+	if err != nil || id == 0 {
+		SendJSONResponse(http.StatusBadRequest, w, map[string]string{"status": "error", "message": "invalid_documentation_id"})
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		SendJSONResponse(http.StatusInternalServerError, w, map[string]string{"status": "error", "message": "streaming_unsupported"})
+		return
+	}
+
+	events, unsubscribe, err := service.SubscribeBuildEvents(uint(id))
+	if err != nil {
+		SendJSONResponse(http.StatusNotFound, w, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case event := <-events:
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+		}
+
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,35 @@
+package handlers
+
+import (
+	"net/http"
+
+	"git.difuse.io/Difuse/kalmia/db"
+)
+
+func GetCacheStats(w http.ResponseWriter, r *http.Request) {
+	SendJSONResponse(http.StatusOK, w, map[string]interface{}{
+		"status": "success",
+		"cache":  db.Cache.Stats(),
+	})
+}
+
+// FlushCache removes the cache entries whose key starts with the prefix in
+// the request, or all of them without one. Site files are loaded again when
+// next requested.
+func FlushCache(w http.ResponseWriter, r *http.Request) {
+	type Request struct {
+		Prefix string `json:"prefix"`
+	}
+	req, err := ValidateRequest[Request](w, r)
+	if err != nil {
+		return
+	}
+
+	removed := db.Cache.DeletePrefix(req.Prefix)
+
+	SendJSONResponse(http.StatusOK, w, map[string]interface{}{
+		"status":  "success",
+		"message": "cache_flushed",
+		"removed": removed,
+	})
+}
@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"git.difuse.io/Difuse/kalmia/db/models"
 	"git.difuse.io/Difuse/kalmia/logger"
@@ -84,6 +85,12 @@ func CreateDocumentation(service *services.ServiceRegistry, w http.ResponseWrite
 		GitUser          string `json:"gitUser"`
 		GitPassword      string `json:"gitPassword"`
 		GitEmail         string `json:"gitEmail"`
+		GitSSHPrivateKey string `json:"gitSSHPrivateKey"`
+		GitSSHKnownHosts string `json:"gitSSHKnownHosts"`
+		GitSyncEnabled   bool   `json:"gitSyncEnabled"`
+		GitSyncRepo      string `json:"gitSyncRepo"`
+		GitSyncBranch    string `json:"gitSyncBranch"`
+		Generator        string `json:"generator"`
 
 		BucketFavicon      string `json:"bucketFavicon"`
 		BucketMetaImage    string `json:"bucketMetaImage"`
@@ -123,6 +130,12 @@ func CreateDocumentation(service *services.ServiceRegistry, w http.ResponseWrite
 		GitUser:          req.GitUser,
 		GitPassword:      req.GitPassword,
 		GitEmail:         req.GitEmail,
+		GitSSHPrivateKey: req.GitSSHPrivateKey,
+		GitSSHKnownHosts: req.GitSSHKnownHosts,
+		GitSyncEnabled:   req.GitSyncEnabled,
+		GitSyncRepo:      req.GitSyncRepo,
+		GitSyncBranch:    req.GitSyncBranch,
+		Generator:        req.Generator,
 	}
 
 	err = service.DocService.CreateDocumentation(documentation, user, map[string]string{
@@ -164,6 +177,15 @@ func EditDocumentation(services *services.ServiceRegistry, w http.ResponseWriter
 		GitEmail         string `json:"gitEmail"`
 		GitUser          string `json:"gitUser"`
 		GitPassword      string `json:"gitPassword"`
+		GitSSHPrivateKey string `json:"gitSSHPrivateKey"`
+		GitSSHKnownHosts string `json:"gitSSHKnownHosts"`
+		GitSyncEnabled   bool   `json:"gitSyncEnabled"`
+		GitSyncRepo      string `json:"gitSyncRepo"`
+		GitSyncBranch    string `json:"gitSyncBranch"`
+		Generator        string `json:"generator"`
+
+		ClearGitPassword      bool `json:"clearGitPassword"`
+		ClearGitSSHPrivateKey bool `json:"clearGitSSHPrivateKey"`
 
 		BucketFavicon      string `json:"bucketFavicon"`
 		BucketMetaImage    string `json:"bucketMetaImage"`
@@ -212,6 +234,14 @@ func EditDocumentation(services *services.ServiceRegistry, w http.ResponseWriter
 		req.GitUser,
 		req.GitPassword,
 		req.GitEmail,
+		req.GitSSHPrivateKey,
+		req.GitSSHKnownHosts,
+		req.ClearGitPassword,
+		req.ClearGitSSHPrivateKey,
+		req.GitSyncEnabled,
+		req.GitSyncRepo,
+		req.GitSyncBranch,
+		req.Generator,
 		map[string]string{
 			"favicon":      req.BucketFavicon,
 			"metaImage":    req.BucketMetaImage,
@@ -297,12 +327,15 @@ func GetPage(service *services.DocService, w http.ResponseWriter, r *http.Reques
 
 func CreatePage(services *services.ServiceRegistry, w http.ResponseWriter, r *http.Request) {
 	type Request struct {
-		Title           string `json:"title" validate:"required"`
-		Slug            string `json:"slug" validate:"required"`
-		Content         string `json:"content" validate:"required"`
-		DocumentationID uint   `json:"documentationId" validate:"required"`
-		PageGroupID     *uint  `json:"pageGroupId"`
-		Order           *uint  `json:"order"`
+		Title           string     `json:"title" validate:"required"`
+		Slug            string     `json:"slug" validate:"required"`
+		Content         string     `json:"content" validate:"required"`
+		DocumentationID uint       `json:"documentationId" validate:"required"`
+		PageGroupID     *uint      `json:"pageGroupId"`
+		Order           *uint      `json:"order"`
+		PublishAt       *time.Time `json:"publishAt"`
+		UnpublishAt     *time.Time `json:"unpublishAt"`
+		Draft           bool       `json:"draft"`
 	}
 
 	req, err := ValidateRequest[Request](w, r)
@@ -331,6 +364,9 @@ func CreatePage(services *services.ServiceRegistry, w http.ResponseWriter, r *ht
 		Author:          user,
 		Editors:         []models.User{user},
 		LastEditorID:    &user.ID,
+		PublishAt:       req.PublishAt,
+		UnpublishAt:     req.UnpublishAt,
+		IsDraft:         req.Draft || (!user.Admin && services.DocService.ReviewRequired(req.DocumentationID)),
 	}
 
 	if req.PageGroupID != nil {
@@ -377,6 +413,15 @@ func EditPage(services *services.ServiceRegistry, w http.ResponseWriter, r *http
 		return
 	}
 
+	// Edits to reviewed documentations go through drafts
+	if !user.Admin {
+		docId, err := services.DocService.GetDocumentationIDOfPage(req.ID)
+		if err == nil && services.DocService.ReviewRequired(docId) {
+			SendJSONResponse(http.StatusForbidden, w, map[string]string{"status": "error", "message": "review_required"})
+			return
+		}
+	}
+
 	err = services.DocService.EditPage(user, req.ID, req.Title, req.Slug, req.Content, req.Order, req.PageGroupId)
 	if err != nil {
 		SendJSONResponse(http.StatusInternalServerError, w, map[string]string{"status": "error", "message": err.Error()})
@@ -386,7 +431,7 @@ func EditPage(services *services.ServiceRegistry, w http.ResponseWriter, r *http
 	SendJSONResponse(http.StatusOK, w, map[string]string{"status": "success", "message": "page_updated", "id": fmt.Sprint(req.ID)})
 }
 
-func DeletePage(service *services.DocService, w http.ResponseWriter, r *http.Request) {
+func DeletePage(services *services.ServiceRegistry, w http.ResponseWriter, r *http.Request) {
 	type Request struct {
 		ID uint `json:"id" validate:"required"`
 	}
@@ -396,7 +441,21 @@ func DeletePage(service *services.DocService, w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	err = service.DeletePage(req.ID)
+	user, ok := requestUser(services, w, r)
+	if !ok {
+		return
+	}
+
+	// Deletions from reviewed documentations are left to admins, like edits
+	if !user.Admin {
+		docId, err := services.DocService.GetDocumentationIDOfPage(req.ID)
+		if err == nil && services.DocService.ReviewRequired(docId) {
+			SendJSONResponse(http.StatusForbidden, w, map[string]string{"status": "error", "message": "review_required"})
+			return
+		}
+	}
+
+	err = services.DocService.DeletePage(req.ID)
 	if err != nil {
 		switch err.Error() {
 		case "page_not_found":
@@ -449,10 +508,12 @@ func GetPageGroup(service *services.DocService, w http.ResponseWriter, r *http.R
 
 func CreatePageGroup(services *services.ServiceRegistry, w http.ResponseWriter, r *http.Request) {
 	type Request struct {
-		Name            string `json:"name" validate:"required"`
-		DocumentationID uint   `json:"documentationId" validate:"required"`
-		ParentID        *uint  `json:"parentId"`
-		Order           *uint  `json:"order"`
+		Name            string     `json:"name" validate:"required"`
+		DocumentationID uint       `json:"documentationId" validate:"required"`
+		ParentID        *uint      `json:"parentId"`
+		Order           *uint      `json:"order"`
+		PublishAt       *time.Time `json:"publishAt"`
+		UnpublishAt     *time.Time `json:"unpublishAt"`
 	}
 
 	req, err := ValidateRequest[Request](w, r)
@@ -479,6 +540,8 @@ func CreatePageGroup(services *services.ServiceRegistry, w http.ResponseWriter,
 		Author:          user,
 		Editors:         []models.User{user},
 		LastEditorID:    &user.ID,
+		PublishAt:       req.PublishAt,
+		UnpublishAt:     req.UnpublishAt,
 	}
 
 	if req.ParentID != nil {
@@ -533,7 +596,7 @@ func EditPageGroup(services *services.ServiceRegistry, w http.ResponseWriter, r
 	SendJSONResponse(http.StatusOK, w, map[string]string{"status": "success", "message": "page_group_updated", "id": fmt.Sprint(req.ID)})
 }
 
-func DeletePageGroup(service *services.DocService, w http.ResponseWriter, r *http.Request) {
+func DeletePageGroup(services *services.ServiceRegistry, w http.ResponseWriter, r *http.Request) {
 	type Request struct {
 		ID uint `json:"id" validate:"required"`
 	}
@@ -543,7 +606,21 @@ func DeletePageGroup(service *services.DocService, w http.ResponseWriter, r *htt
 		return
 	}
 
-	err = service.DeletePageGroup(req.ID)
+	user, ok := requestUser(services, w, r)
+	if !ok {
+		return
+	}
+
+	// Deleting a group deletes its pages, so it is held to the same review
+	if !user.Admin {
+		docId, err := services.DocService.GetDocumentationIDOfPageGroup(req.ID)
+		if err == nil && services.DocService.ReviewRequired(docId) {
+			SendJSONResponse(http.StatusForbidden, w, map[string]string{"status": "error", "message": "review_required"})
+			return
+		}
+	}
+
+	err = services.DocService.DeletePageGroup(req.ID)
 	if err != nil {
 		SendJSONResponse(http.StatusInternalServerError, w, map[string]string{"status": "error", "message": err.Error()})
 		return
@@ -662,3 +739,133 @@ func TriggerManualBuild(service *services.DocService, w http.ResponseWriter, r *
 
 	SendJSONResponse(http.StatusOK, w, map[string]string{"status": "success", "message": "build_triggered"})
 }
+
+func GenerateGitSSHKey(service *services.DocService, w http.ResponseWriter, r *http.Request) {
+	type Request struct {
+		ID uint `json:"id" validate:"required"`
+	}
+	req, err := ValidateRequest[Request](w, r)
+	if err != nil {
+		return
+	}
+
+	publicKey, err := service.GenerateGitSSHKey(req.ID)
+	if err != nil {
+		SendJSONResponse(http.StatusInternalServerError, w, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+
+	SendJSONResponse(http.StatusOK, w, map[string]string{"status": "success", "publicKey": publicKey})
+}
+
+func GitSourceSync(service *services.DocService, w http.ResponseWriter, r *http.Request) {
+	type Request struct {
+		ID uint `json:"id" validate:"required"`
+	}
+	req, err := ValidateRequest[Request](w, r)
+	if err != nil {
+		return
+	}
+
+	result, err := service.GitSourceSync(req.ID)
+	if err != nil {
+		SendJSONResponse(http.StatusInternalServerError, w, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+
+	if result.Pulled > 0 {
+		if err := service.AddBuildTrigger(req.ID, false); err != nil {
+			SendJSONResponse(http.StatusInternalServerError, w, map[string]string{"status": "error", "message": err.Error()})
+			return
+		}
+	}
+
+	SendJSONResponse(http.StatusOK, w, map[string]interface{}{
+		"status": "success",
+		"result": result,
+	})
+}
+
+func GetGitSyncStatus(service *services.DocService, w http.ResponseWriter, r *http.Request) {
+	type Request struct {
+		ID uint `json:"id" validate:"required"`
+	}
+	req, err := ValidateRequest[Request](w, r)
+	if err != nil {
+		return
+	}
+
+	state, conflicts, err := service.GetGitSyncStatus(req.ID)
+	if err != nil {
+		SendJSONResponse(http.StatusInternalServerError, w, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+
+	SendJSONResponse(http.StatusOK, w, map[string]interface{}{
+		"status":    "success",
+		"state":     state,
+		"conflicts": conflicts,
+	})
+}
+
+func ResolveGitSyncConflict(service *services.DocService, w http.ResponseWriter, r *http.Request) {
+	type Request struct {
+		ID       uint   `json:"id" validate:"required"`
+		Strategy string `json:"strategy" validate:"required,oneof=local upstream"`
+	}
+	req, err := ValidateRequest[Request](w, r)
+	if err != nil {
+		return
+	}
+
+	result, err := service.ResolveGitSyncConflict(req.ID, req.Strategy)
+	if err != nil {
+		SendJSONResponse(http.StatusInternalServerError, w, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+
+	SendJSONResponse(http.StatusOK, w, map[string]interface{}{
+		"status": "success",
+		"result": result,
+	})
+}
+
+func SetPageSchedule(service *services.DocService, w http.ResponseWriter, r *http.Request) {
+	type Request struct {
+		ID          uint       `json:"id" validate:"required"`
+		PublishAt   *time.Time `json:"publishAt"`
+		UnpublishAt *time.Time `json:"unpublishAt"`
+	}
+
+	req, err := ValidateRequest[Request](w, r)
+	if err != nil {
+		return
+	}
+
+	if err := service.SetPageSchedule(req.ID, req.PublishAt, req.UnpublishAt); err != nil {
+		SendJSONResponse(http.StatusBadRequest, w, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+
+	SendJSONResponse(http.StatusOK, w, map[string]string{"status": "success", "message": "page_schedule_updated"})
+}
+
+func SetPageGroupSchedule(service *services.DocService, w http.ResponseWriter, r *http.Request) {
+	type Request struct {
+		ID          uint       `json:"id" validate:"required"`
+		PublishAt   *time.Time `json:"publishAt"`
+		UnpublishAt *time.Time `json:"unpublishAt"`
+	}
+
+	req, err := ValidateRequest[Request](w, r)
+	if err != nil {
+		return
+	}
+
+	if err := service.SetPageGroupSchedule(req.ID, req.PublishAt, req.UnpublishAt); err != nil {
+		SendJSONResponse(http.StatusBadRequest, w, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+
+	SendJSONResponse(http.StatusOK, w, map[string]string{"status": "success", "message": "page_group_schedule_updated"})
+}
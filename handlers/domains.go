@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"net/http"
+
+	"git.difuse.io/Difuse/kalmia/services"
+)
+
+// GetDomains lists the domains of the documentation in the request, or of
+// every documentation without one.
+func GetDomains(service *services.DocService, w http.ResponseWriter, r *http.Request) {
+	type Request struct {
+		ID uint `json:"id"`
+	}
+	req, err := ValidateRequest[Request](w, r)
+	if err != nil {
+		return
+	}
+
+	domains, err := service.GetDomains(req.ID)
+	if err != nil {
+		SendJSONResponse(http.StatusBadRequest, w, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+
+	SendJSONResponse(http.StatusOK, w, map[string]interface{}{
+		"status":  "success",
+		"domains": domains,
+	})
+}
+
+func AddDomain(service *services.DocService, w http.ResponseWriter, r *http.Request) {
+	type Request struct {
+		ID     uint   `json:"id" validate:"required"`
+		Domain string `json:"domain" validate:"required"`
+	}
+	req, err := ValidateRequest[Request](w, r)
+	if err != nil {
+		return
+	}
+
+	domain, err := service.AddDomain(req.ID, req.Domain)
+	if err != nil {
+		SendJSONResponse(http.StatusBadRequest, w, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+
+	SendJSONResponse(http.StatusOK, w, map[string]interface{}{
+		"status": "success",
+		"domain": domain,
+		"record": map[string]string{
+			"type":  "TXT",
+			"name":  services.DomainChallengeRecord(domain.Domain),
+			"value": domain.Token,
+		},
+	})
+}
+
+func VerifyDomain(service *services.DocService, w http.ResponseWriter, r *http.Request) {
+	type Request struct {
+		ID uint `json:"id" validate:"required"`
+	}
+	req, err := ValidateRequest[Request](w, r)
+	if err != nil {
+		return
+	}
+
+	domain, err := service.VerifyDomain(req.ID)
+	if err != nil {
+		SendJSONResponse(http.StatusBadRequest, w, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+
+	SendJSONResponse(http.StatusOK, w, map[string]interface{}{
+		"status": "success",
+		"domain": domain,
+	})
+}
+
+func DeleteDomain(service *services.DocService, w http.ResponseWriter, r *http.Request) {
+	type Request struct {
+		ID uint `json:"id" validate:"required"`
+	}
+	req, err := ValidateRequest[Request](w, r)
+	if err != nil {
+		return
+	}
+
+	if err := service.DeleteDomain(req.ID); err != nil {
+		SendJSONResponse(http.StatusBadRequest, w, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+
+	SendJSONResponse(http.StatusOK, w, map[string]string{"status": "success", "message": "domain_deleted"})
+}
@@ -0,0 +1,234 @@
+package handlers
+
+import (
+	"net/http"
+
+	"git.difuse.io/Difuse/kalmia/db/models"
+	"git.difuse.io/Difuse/kalmia/services"
+)
+
+// requestUser returns the user making the request, replying with an error
+// when there is none.
+func requestUser(services *services.ServiceRegistry, w http.ResponseWriter, r *http.Request) (models.User, bool) {
+	token, err := GetTokenFromHeader(r)
+	if err != nil {
+		SendJSONResponse(http.StatusUnauthorized, w, map[string]string{"status": "error", "message": "invalid_request"})
+		return models.User{}, false
+	}
+
+	user, err := services.AuthService.GetUserFromToken(token)
+	if err != nil {
+		SendJSONResponse(http.StatusUnauthorized, w, map[string]string{"status": "error", "message": "invalid_request"})
+		return models.User{}, false
+	}
+
+	return user, true
+}
+
+func GetDraft(service *services.DocService, w http.ResponseWriter, r *http.Request) {
+	type Request struct {
+		PageID uint `json:"pageId" validate:"required"`
+	}
+	req, err := ValidateRequest[Request](w, r)
+	if err != nil {
+		return
+	}
+
+	draft, err := service.GetDraft(req.PageID)
+	if err != nil {
+		SendJSONResponse(http.StatusNotFound, w, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+
+	SendJSONResponse(http.StatusOK, w, draft)
+}
+
+func SaveDraft(services *services.ServiceRegistry, w http.ResponseWriter, r *http.Request) {
+	type Request struct {
+		PageID  uint   `json:"pageId" validate:"required"`
+		Title   string `json:"title" validate:"required"`
+		Slug    string `json:"slug" validate:"required"`
+		Content string `json:"content"`
+	}
+	req, err := ValidateRequest[Request](w, r)
+	if err != nil {
+		return
+	}
+
+	user, ok := requestUser(services, w, r)
+	if !ok {
+		return
+	}
+
+	draft, err := services.DocService.SaveDraft(user, req.PageID, req.Title, req.Slug, req.Content)
+	if err != nil {
+		SendJSONResponse(http.StatusBadRequest, w, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+
+	SendJSONResponse(http.StatusOK, w, map[string]interface{}{
+		"status":  "success",
+		"message": "draft_saved",
+		"draft":   draft,
+	})
+}
+
+func DiscardDraft(service *services.DocService, w http.ResponseWriter, r *http.Request) {
+	type Request struct {
+		PageID uint `json:"pageId" validate:"required"`
+	}
+	req, err := ValidateRequest[Request](w, r)
+	if err != nil {
+		return
+	}
+
+	if err := service.DiscardDraft(req.PageID); err != nil {
+		SendJSONResponse(http.StatusBadRequest, w, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+
+	SendJSONResponse(http.StatusOK, w, map[string]string{"status": "success", "message": "draft_discarded"})
+}
+
+func PreviewDraft(service *services.DocService, w http.ResponseWriter, r *http.Request) {
+	type Request struct {
+		PageID uint `json:"pageId" validate:"required"`
+	}
+	req, err := ValidateRequest[Request](w, r)
+	if err != nil {
+		return
+	}
+
+	preview, err := service.PreviewDraft(req.PageID)
+	if err != nil {
+		SendJSONResponse(http.StatusBadRequest, w, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+
+	SendJSONResponse(http.StatusOK, w, map[string]string{"status": "success", "preview": preview})
+}
+
+// reviewAction handles the review workflow endpoints, which all take a page
+// and an optional comment from the current user.
+func reviewAction(services *services.ServiceRegistry, w http.ResponseWriter, r *http.Request,
+	action func(models.User, uint, string) error, message string) {
+	type Request struct {
+		PageID  uint   `json:"pageId" validate:"required"`
+		Comment string `json:"comment"`
+	}
+	req, err := ValidateRequest[Request](w, r)
+	if err != nil {
+		return
+	}
+
+	user, ok := requestUser(services, w, r)
+	if !ok {
+		return
+	}
+
+	if err := action(user, req.PageID, req.Comment); err != nil {
+		code := http.StatusBadRequest
+		if err.Error() == "not_a_reviewer" || err.Error() == "cannot_review_own_draft" {
+			code = http.StatusForbidden
+		}
+
+		SendJSONResponse(code, w, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+
+	SendJSONResponse(http.StatusOK, w, map[string]string{"status": "success", "message": message})
+}
+
+func RequestDraftReview(services *services.ServiceRegistry, w http.ResponseWriter, r *http.Request) {
+	reviewAction(services, w, r, services.DocService.RequestDraftReview, "review_requested")
+}
+
+func ApproveDraft(services *services.ServiceRegistry, w http.ResponseWriter, r *http.Request) {
+	reviewAction(services, w, r, services.DocService.ApproveDraft, "draft_approved")
+}
+
+func RequestDraftChanges(services *services.ServiceRegistry, w http.ResponseWriter, r *http.Request) {
+	reviewAction(services, w, r, services.DocService.RequestDraftChanges, "changes_requested")
+}
+
+func PublishDraft(services *services.ServiceRegistry, w http.ResponseWriter, r *http.Request) {
+	type Request struct {
+		PageID uint `json:"pageId" validate:"required"`
+	}
+	req, err := ValidateRequest[Request](w, r)
+	if err != nil {
+		return
+	}
+
+	user, ok := requestUser(services, w, r)
+	if !ok {
+		return
+	}
+
+	if err := services.DocService.PublishDraft(user, req.PageID); err != nil {
+		SendJSONResponse(http.StatusBadRequest, w, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+
+	SendJSONResponse(http.StatusOK, w, map[string]string{"status": "success", "message": "draft_published"})
+}
+
+func GetPageReviews(service *services.DocService, w http.ResponseWriter, r *http.Request) {
+	type Request struct {
+		PageID uint `json:"pageId" validate:"required"`
+	}
+	req, err := ValidateRequest[Request](w, r)
+	if err != nil {
+		return
+	}
+
+	reviews, err := service.GetPageReviews(req.PageID)
+	if err != nil {
+		SendJSONResponse(http.StatusInternalServerError, w, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+
+	SendJSONResponse(http.StatusOK, w, map[string]interface{}{
+		"status":  "success",
+		"reviews": reviews,
+	})
+}
+
+func GetReviewers(service *services.DocService, w http.ResponseWriter, r *http.Request) {
+	type Request struct {
+		ID uint `json:"id" validate:"required"`
+	}
+	req, err := ValidateRequest[Request](w, r)
+	if err != nil {
+		return
+	}
+
+	reviewers, err := service.GetReviewers(req.ID)
+	if err != nil {
+		SendJSONResponse(http.StatusBadRequest, w, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+
+	SendJSONResponse(http.StatusOK, w, map[string]interface{}{
+		"status":    "success",
+		"reviewers": reviewers,
+	})
+}
+
+func SetReviewers(service *services.DocService, w http.ResponseWriter, r *http.Request) {
+	type Request struct {
+		ID      uint   `json:"id" validate:"required"`
+		UserIDs []uint `json:"userIds"`
+	}
+	req, err := ValidateRequest[Request](w, r)
+	if err != nil {
+		return
+	}
+
+	if err := service.SetReviewers(req.ID, req.UserIDs); err != nil {
+		SendJSONResponse(http.StatusBadRequest, w, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+
+	SendJSONResponse(http.StatusOK, w, map[string]string{"status": "success", "message": "reviewers_updated"})
+}
@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+
+	"git.difuse.io/Difuse/kalmia/services"
+	"github.com/gorilla/mux"
+)
+
+// maxHookBodySize bounds the payloads accepted by inbound hooks. Release
+// and push events from GitHub or Gitea fit well within it.
+const maxHookBodySize = 5 << 20
+
+func GetInboundHooks(service *services.DocService, w http.ResponseWriter, r *http.Request) {
+	type Request struct {
+		DocumentationID uint `json:"documentationId" validate:"required"`
+	}
+	req, err := ValidateRequest[Request](w, r)
+	if err != nil {
+		return
+	}
+
+	hooks, err := service.GetInboundHooks(req.DocumentationID)
+	if err != nil {
+		SendJSONResponse(http.StatusInternalServerError, w, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+
+	SendJSONResponse(http.StatusOK, w, map[string]interface{}{
+		"status": "success",
+		"hooks":  hooks,
+	})
+}
+
+func CreateInboundHook(services *services.ServiceRegistry, w http.ResponseWriter, r *http.Request) {
+	type Request struct {
+		DocumentationID uint   `json:"documentationId" validate:"required"`
+		Secret          string `json:"secret"`
+		Action          string `json:"action"`
+	}
+	req, err := ValidateRequest[Request](w, r)
+	if err != nil {
+		return
+	}
+
+	user, ok := requestUser(services, w, r)
+	if !ok {
+		return
+	}
+
+	hook, hookToken, err := services.DocService.CreateInboundHook(user, req.DocumentationID, req.Secret, req.Action)
+	if err != nil {
+		SendJSONResponse(http.StatusBadRequest, w, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+
+	SendJSONResponse(http.StatusOK, w, map[string]interface{}{
+		"status": "success",
+		"id":     hook.ID,
+		"token":  hookToken,
+		"path":   "/kal-api/hooks/" + hookToken,
+	})
+}
+
+func DeleteInboundHook(service *services.DocService, w http.ResponseWriter, r *http.Request) {
+	type Request struct {
+		ID uint `json:"id" validate:"required"`
+	}
+	req, err := ValidateRequest[Request](w, r)
+	if err != nil {
+		return
+	}
+
+	if err := service.DeleteInboundHook(req.ID); err != nil {
+		SendJSONResponse(http.StatusBadRequest, w, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+
+	SendJSONResponse(http.StatusOK, w, map[string]string{"status": "success", "message": "inbound_hook_deleted"})
+}
+
+// firstHeader returns the first of the given headers that is set.
+func firstHeader(r *http.Request, names ...string) string {
+	for _, name := range names {
+		if value := r.Header.Get(name); value != "" {
+			return value
+		}
+	}
+
+	return ""
+}
+
+// TriggerInboundHook is called by external systems, authenticated by the
+// token in its URL and, when the hook has a secret, a GitHub or Gitea style
+// payload signature.
+func TriggerInboundHook(service *services.DocService, w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxHookBodySize))
+	if err != nil {
+		SendJSONResponse(http.StatusBadRequest, w, map[string]string{"status": "error", "message": "invalid_request"})
+		return
+	}
+
+	signature := firstHeader(r, "X-Hub-Signature-256", "X-Gitea-Signature", "X-Gogs-Signature", "X-Kalmia-Signature")
+	event := firstHeader(r, "X-GitHub-Event", "X-Gitea-Event", "X-Gogs-Event", "X-Kalmia-Event")
+
+	_, err = service.TriggerInboundHook(mux.Vars(r)["token"], event, signature, body)
+	if err != nil {
+		code := http.StatusBadRequest
+		switch err.Error() {
+		case "inbound_hook_not_found":
+			code = http.StatusNotFound
+		case "invalid_signature":
+			code = http.StatusUnauthorized
+		case "failed_to_verify_signature":
+			code = http.StatusInternalServerError
+		}
+
+		SendJSONResponse(code, w, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+
+	if event == "ping" {
+		SendJSONResponse(http.StatusOK, w, map[string]string{"status": "success", "message": "pong"})
+		return
+	}
+
+	SendJSONResponse(http.StatusAccepted, w, map[string]string{"status": "success", "message": "build_triggered"})
+}
@@ -10,9 +10,11 @@ import (
 
 func ImportGitbook(services *services.ServiceRegistry, w http.ResponseWriter, r *http.Request, cfg *config.Config) {
 	var request struct {
-		URL      string `json:"url"`
-		Username string `json:"username"`
-		Password string `json:"password"`
+		URL           string `json:"url"`
+		Username      string `json:"username"`
+		Password      string `json:"password"`
+		SSHPrivateKey string `json:"sshPrivateKey"`
+		SSHKnownHosts string `json:"sshKnownHosts"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
@@ -25,7 +27,7 @@ func ImportGitbook(services *services.ServiceRegistry, w http.ResponseWriter, r
 		return
 	}
 
-	jsonString, err := services.DocService.ImportGitbook(request.URL, request.Username, request.Password, cfg)
+	jsonString, err := services.DocService.ImportGitbook(request.URL, request.Username, request.Password, request.SSHPrivateKey, request.SSHKnownHosts, cfg)
 
 	if err != nil {
 		SendJSONResponse(http.StatusInternalServerError, w, map[string]string{"status": "error", "message": "gitbook_proccessing_failed", "error": err.Error()})
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"net/http"
+
+	"git.difuse.io/Difuse/kalmia/services"
+)
+
+func GetSiteReleases(service *services.DocService, w http.ResponseWriter, r *http.Request) {
+	type Request struct {
+		ID uint `json:"id" validate:"required"`
+	}
+	req, err := ValidateRequest[Request](w, r)
+	if err != nil {
+		return
+	}
+
+	releases, err := service.GetSiteReleases(req.ID)
+	if err != nil {
+		SendJSONResponse(http.StatusBadRequest, w, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+
+	SendJSONResponse(http.StatusOK, w, map[string]interface{}{
+		"status":   "success",
+		"releases": releases,
+	})
+}
+
+func ActivateSiteRelease(service *services.DocService, w http.ResponseWriter, r *http.Request) {
+	type Request struct {
+		ID        uint `json:"id" validate:"required"`
+		ReleaseID uint `json:"releaseId" validate:"required"`
+	}
+	req, err := ValidateRequest[Request](w, r)
+	if err != nil {
+		return
+	}
+
+	if err := service.ActivateSiteRelease(req.ID, req.ReleaseID); err != nil {
+		SendJSONResponse(http.StatusBadRequest, w, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+
+	SendJSONResponse(http.StatusOK, w, map[string]string{"status": "success", "message": "site_release_activated"})
+}
+
+func PinSiteRelease(service *services.DocService, w http.ResponseWriter, r *http.Request) {
+	type Request struct {
+		ID        uint `json:"id" validate:"required"`
+		ReleaseID uint `json:"releaseId" validate:"required"`
+		Pinned    bool `json:"pinned"`
+	}
+	req, err := ValidateRequest[Request](w, r)
+	if err != nil {
+		return
+	}
+
+	if err := service.PinSiteRelease(req.ID, req.ReleaseID, req.Pinned); err != nil {
+		SendJSONResponse(http.StatusBadRequest, w, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+
+	message := "site_release_unpinned"
+	if req.Pinned {
+		message = "site_release_pinned"
+	}
+
+	SendJSONResponse(http.StatusOK, w, map[string]string{"status": "success", "message": message})
+}
@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"net/http"
+
+	"git.difuse.io/Difuse/kalmia/services"
+)
+
+func GetWebhooks(service *services.DocService, w http.ResponseWriter, r *http.Request) {
+	type Request struct {
+		DocumentationID *uint `json:"documentationId"`
+	}
+	req, err := ValidateRequest[Request](w, r)
+	if err != nil {
+		return
+	}
+
+	webhooks, err := service.GetWebhooks(req.DocumentationID)
+	if err != nil {
+		SendJSONResponse(http.StatusInternalServerError, w, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+
+	SendJSONResponse(http.StatusOK, w, map[string]interface{}{
+		"status":   "success",
+		"webhooks": webhooks,
+	})
+}
+
+func CreateWebhook(services *services.ServiceRegistry, w http.ResponseWriter, r *http.Request) {
+	type Request struct {
+		DocumentationID *uint    `json:"documentationId"`
+		URL             string   `json:"url" validate:"required,url"`
+		Secret          string   `json:"secret"`
+		Events          []string `json:"events"`
+	}
+	req, err := ValidateRequest[Request](w, r)
+	if err != nil {
+		return
+	}
+
+	user, ok := requestUser(services, w, r)
+	if !ok {
+		return
+	}
+
+	webhook, err := services.DocService.CreateWebhook(user, req.DocumentationID, req.URL, req.Secret, req.Events)
+	if err != nil {
+		SendJSONResponse(http.StatusBadRequest, w, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+
+	SendJSONResponse(http.StatusOK, w, map[string]interface{}{
+		"status":  "success",
+		"message": "webhook_created",
+		"id":      webhook.ID,
+	})
+}
+
+func EditWebhook(service *services.DocService, w http.ResponseWriter, r *http.Request) {
+	type Request struct {
+		ID      uint     `json:"id" validate:"required"`
+		URL     string   `json:"url" validate:"required,url"`
+		Secret  string   `json:"secret"`
+		Events  []string `json:"events"`
+		Enabled *bool    `json:"enabled" validate:"required"`
+	}
+	req, err := ValidateRequest[Request](w, r)
+	if err != nil {
+		return
+	}
+
+	if err := service.EditWebhook(req.ID, req.URL, req.Secret, req.Events, *req.Enabled); err != nil {
+		SendJSONResponse(http.StatusBadRequest, w, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+
+	SendJSONResponse(http.StatusOK, w, map[string]string{"status": "success", "message": "webhook_updated"})
+}
+
+func DeleteWebhook(service *services.DocService, w http.ResponseWriter, r *http.Request) {
+	type Request struct {
+		ID uint `json:"id" validate:"required"`
+	}
+	req, err := ValidateRequest[Request](w, r)
+	if err != nil {
+		return
+	}
+
+	if err := service.DeleteWebhook(req.ID); err != nil {
+		SendJSONResponse(http.StatusBadRequest, w, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+
+	SendJSONResponse(http.StatusOK, w, map[string]string{"status": "success", "message": "webhook_deleted"})
+}
+
+func GetWebhookDeliveries(service *services.DocService, w http.ResponseWriter, r *http.Request) {
+	type Request struct {
+		ID uint `json:"id" validate:"required"`
+	}
+	req, err := ValidateRequest[Request](w, r)
+	if err != nil {
+		return
+	}
+
+	deliveries, err := service.GetWebhookDeliveries(req.ID)
+	if err != nil {
+		SendJSONResponse(http.StatusInternalServerError, w, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+
+	SendJSONResponse(http.StatusOK, w, map[string]interface{}{
+		"status":     "success",
+		"deliveries": deliveries,
+	})
+}
+
+func RedeliverWebhook(service *services.DocService, w http.ResponseWriter, r *http.Request) {
+	type Request struct {
+		ID uint `json:"id" validate:"required"`
+	}
+	req, err := ValidateRequest[Request](w, r)
+	if err != nil {
+		return
+	}
+
+	if err := service.RedeliverWebhook(req.ID); err != nil {
+		SendJSONResponse(http.StatusBadRequest, w, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+
+	SendJSONResponse(http.StatusOK, w, map[string]string{"status": "success", "message": "webhook_redelivery_queued"})
+}
+
+func PingWebhook(service *services.DocService, w http.ResponseWriter, r *http.Request) {
+	type Request struct {
+		ID uint `json:"id" validate:"required"`
+	}
+	req, err := ValidateRequest[Request](w, r)
+	if err != nil {
+		return
+	}
+
+	if err := service.PingWebhook(req.ID); err != nil {
+		SendJSONResponse(http.StatusBadRequest, w, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+
+	SendJSONResponse(http.StatusOK, w, map[string]string{"status": "success", "message": "webhook_ping_queued"})
+}
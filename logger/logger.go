@@ -1,11 +1,13 @@
 package logger
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
 	"time"
 
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
@@ -91,3 +93,30 @@ func Fatal(msg string, fields ...zap.Field) {
 func Panic(msg string, fields ...zap.Field) {
 	Logger.Panic(msg, fields...)
 }
+
+// withTrace adds the ids of the span in ctx to fields, so logs can be found
+// from a trace and the other way around.
+func withTrace(ctx context.Context, fields []zap.Field) []zap.Field {
+	spanContext := trace.SpanContextFromContext(ctx)
+	if !spanContext.IsValid() {
+		return fields
+	}
+
+	return append(fields, zap.String("trace_id", spanContext.TraceID().String()), zap.String("span_id", spanContext.SpanID().String()))
+}
+
+func InfoContext(ctx context.Context, msg string, fields ...zap.Field) {
+	Logger.Info(msg, withTrace(ctx, fields)...)
+}
+
+func DebugContext(ctx context.Context, msg string, fields ...zap.Field) {
+	Logger.Debug(msg, withTrace(ctx, fields)...)
+}
+
+func WarnContext(ctx context.Context, msg string, fields ...zap.Field) {
+	Logger.Warn(msg, withTrace(ctx, fields)...)
+}
+
+func ErrorContext(ctx context.Context, msg string, fields ...zap.Field) {
+	Logger.Error(msg, withTrace(ctx, fields)...)
+}
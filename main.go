@@ -1,14 +1,19 @@
 package main
 
 import (
+	"context"
 	"embed"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"slices"
 	"sync"
+	"syscall"
 	"time"
 
 	"git.difuse.io/Difuse/kalmia/cmd"
@@ -16,10 +21,15 @@ import (
 	"git.difuse.io/Difuse/kalmia/db"
 	"git.difuse.io/Difuse/kalmia/handlers"
 	"git.difuse.io/Difuse/kalmia/logger"
+	"git.difuse.io/Difuse/kalmia/metrics"
 	"git.difuse.io/Difuse/kalmia/middleware"
 	"git.difuse.io/Difuse/kalmia/services"
+	"git.difuse.io/Difuse/kalmia/tracing"
+	"git.difuse.io/Difuse/kalmia/utils"
 	"github.com/gorilla/mux"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.uber.org/zap"
+	"gorm.io/gorm"
 )
 
 //go:embed web/build
@@ -29,9 +39,21 @@ var startupWg sync.WaitGroup
 
 func main() {
 	cmd.AsciiArt()
-	cfgPath, clearEphemeral := cmd.ParseFlags()
+	cfgPath, clearEphemeral, encryptConfig, exportPnpmStore, verifyPnpmStore := cmd.ParseFlags()
 	cfg := config.ParseConfig(cfgPath)
 
+	if encryptConfig {
+		fmt.Println("Encrypting config secrets...")
+		changed, err := config.EncryptConfigFile(cfgPath)
+		if err != nil {
+			fmt.Println("Failed to encrypt config secrets:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Encrypted %d secret(s).\n", changed)
+		fmt.Println("Done.")
+		os.Exit(0)
+	}
+
 	if clearEphemeral {
 		fmt.Println("Clearing ephemeral directories...")
 		clearEphemeralDirs(cfg.DataPath)
@@ -39,18 +61,67 @@ func main() {
 		os.Exit(0)
 	}
 
+	if exportPnpmStore != "" {
+		fmt.Println("Exporting pnpm store...")
+		if err := services.ExportPnpmStore(exportPnpmStore); err != nil {
+			fmt.Println("Failed to export pnpm store:", err)
+			os.Exit(1)
+		}
+		fmt.Println("Done.")
+		os.Exit(0)
+	}
+
+	if verifyPnpmStore {
+		fmt.Println("Verifying pnpm store...")
+		if _, err := services.LoadPnpmStore(); err != nil {
+			fmt.Println("Failed to load pnpm store archive:", err)
+			os.Exit(1)
+		}
+		if err := services.VerifyPnpmStore(os.Stdout); err != nil {
+			fmt.Println("Failed to verify pnpm store:", err)
+			os.Exit(1)
+		}
+		fmt.Println("Done.")
+		os.Exit(0)
+	}
+
 	logger.InitializeLogger(cfg.Environment, cfg.LogLevel, cfg.DataPath)
 
+	stopTracing := func(context.Context) error { return nil }
+	if cfg.Tracing.Enabled {
+		var err error
+		stopTracing, err = tracing.Setup(cfg.Tracing, cmd.Version, cfg.Cluster.InstanceID)
+		if err != nil {
+			logger.Fatal("Failed to set up tracing", zap.Error(err))
+		}
+	}
+
 	/* Setup database */
 	d := db.SetupDatabase(cfg.Environment, cfg.Database, cfg.DataPath)
+	if cfg.Tracing.Enabled {
+		if err := d.Use(tracing.GORMPlugin{}); err != nil {
+			logger.Fatal("Failed to trace database queries", zap.Error(err))
+		}
+	}
 	db.SetupBasicData(d, cfg.Admins)
 
-	db.InitCache()
+	db.InitCache(cfg.Cache.MaxSize<<20, cfg.Cache.MaxEntrySize<<20)
 
 	serviceRegistry := services.NewServiceRegistry(d)
 	aS := serviceRegistry.AuthService
 	dS := serviceRegistry.DocService
 
+	if err := dS.MigrateSecrets(); err != nil {
+		logger.Error("Failed to encrypt stored secrets", zap.Error(err))
+	}
+
+	// The background jobs stop on SIGINT or SIGTERM, see shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	dS.StartCluster(ctx)
+	aS.StartOAuthCleanup(ctx)
+
 	startupWg.Add(1)
 	go func() {
 		dS.StartupCheck()
@@ -59,15 +130,27 @@ func main() {
 
 	go func() {
 		startupWg.Wait()
-		for {
-			dS.DeleteJob()
-			dS.BuildJob()
-			time.Sleep(10 * time.Second)
+		if ctx.Err() == nil {
+			dS.StartBuildQueue(ctx, cfg.BuildWorkers)
 		}
 	}()
 
+	dS.StartWebhookDispatcher(ctx)
+	dS.StartPublishScheduler(ctx)
+	dS.StartPreviewCleanup(ctx)
+
 	/* Setup router */
 	r := mux.NewRouter()
+
+	if cfg.Metrics.Enabled {
+		if err := serviceRegistry.RegisterMetrics(metrics.Registry); err != nil {
+			logger.Error("Failed to register service metrics", zap.Error(err))
+		}
+
+		// INFO: metrics are authenticated by the token in the config, if any
+		r.Handle("/metrics", metrics.Handler(cfg.Metrics.AuthToken)).Methods("GET")
+	}
+
 	kRouter := r.PathPrefix("/kal-api").Subrouter()
 
 	// INFO: files could be fetched without authentication
@@ -80,6 +163,9 @@ func main() {
 	healthRouter.HandleFunc("/ping", handlers.HealthPing).Methods("GET")
 	healthRouter.HandleFunc("/last-trigger", func(w http.ResponseWriter, r *http.Request) { handlers.TriggerCheck(dS, w, r) }).Methods("GET")
 
+	// INFO: inbound hooks are authenticated by the token in their URL
+	kRouter.HandleFunc("/hooks/{token}", func(w http.ResponseWriter, r *http.Request) { handlers.TriggerInboundHook(dS, w, r) }).Methods("POST")
+
 	oAuthRouter := kRouter.PathPrefix("/oauth").Subrouter()
 	oAuthRouter.HandleFunc("/github", func(w http.ResponseWriter, r *http.Request) { handlers.GithubLogin(aS, w, r) }).Methods("GET")
 	oAuthRouter.HandleFunc("/github/callback", func(w http.ResponseWriter, r *http.Request) { handlers.GithubCallback(aS, w, r) }).Methods("GET")
@@ -107,6 +193,12 @@ func main() {
 	authRouter.HandleFunc("/jwt/validate", func(w http.ResponseWriter, r *http.Request) { handlers.ValidateJWT(aS, w, r) }).Methods("POST")
 	authRouter.HandleFunc("/jwt/revoke", func(w http.ResponseWriter, r *http.Request) { handlers.RevokeJWT(aS, w, r) }).Methods("POST")
 
+	// INFO: the build streams are the only routes taking the token in the query
+	streamRouter := kRouter.PathPrefix("/docs/documentation/build").Subrouter()
+	streamRouter.Use(middleware.EnsureStreamAuthenticated(aS))
+	streamRouter.HandleFunc("/log/stream", func(w http.ResponseWriter, r *http.Request) { handlers.StreamBuildLog(dS, w, r) }).Methods("GET")
+	streamRouter.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) { handlers.StreamBuildEvents(dS, w, r) }).Methods("GET")
+
 	docsRouter := kRouter.PathPrefix("/docs").Subrouter()
 	docsRouter.Use(middleware.EnsureAuthenticated(aS))
 	docsRouter.HandleFunc("/documentations", func(w http.ResponseWriter, r *http.Request) { handlers.GetDocumentations(dS, w, r) }).Methods("GET")
@@ -119,6 +211,34 @@ func main() {
 	docsRouter.HandleFunc("/documentation/root-parent-id", func(w http.ResponseWriter, r *http.Request) { handlers.GetRootParentId(dS, w, r) }).Methods("GET")
 	docsRouter.HandleFunc("/documentation/toggle-auto-build", func(w http.ResponseWriter, r *http.Request) { handlers.ToggleAutoBuild(dS, w, r) }).Methods("POST")
 	docsRouter.HandleFunc("/documentation/trigger-build", func(w http.ResponseWriter, r *http.Request) { handlers.TriggerManualBuild(dS, w, r) }).Methods("POST")
+	docsRouter.HandleFunc("/documentation/builds", func(w http.ResponseWriter, r *http.Request) { handlers.GetBuildRuns(dS, w, r) }).Methods("POST")
+	docsRouter.HandleFunc("/documentation/build/log", func(w http.ResponseWriter, r *http.Request) { handlers.GetBuildLog(dS, w, r) }).Methods("POST")
+	docsRouter.HandleFunc("/documentation/build/retry", func(w http.ResponseWriter, r *http.Request) { handlers.RetryBuild(dS, w, r) }).Methods("POST")
+	docsRouter.HandleFunc("/documentation/previews", func(w http.ResponseWriter, r *http.Request) { handlers.GetPreviews(dS, w, r) }).Methods("POST")
+	docsRouter.HandleFunc("/documentation/preview/create", func(w http.ResponseWriter, r *http.Request) { handlers.CreatePreview(serviceRegistry, w, r) }).Methods("POST")
+	docsRouter.HandleFunc("/documentation/preview/delete", func(w http.ResponseWriter, r *http.Request) { handlers.DeletePreview(dS, w, r) }).Methods("POST")
+	docsRouter.HandleFunc("/documentation/site-releases", func(w http.ResponseWriter, r *http.Request) { handlers.GetSiteReleases(dS, w, r) }).Methods("POST")
+	docsRouter.HandleFunc("/documentation/site-release/activate", func(w http.ResponseWriter, r *http.Request) { handlers.ActivateSiteRelease(dS, w, r) }).Methods("POST")
+	docsRouter.HandleFunc("/documentation/site-release/pin", func(w http.ResponseWriter, r *http.Request) { handlers.PinSiteRelease(dS, w, r) }).Methods("POST")
+	docsRouter.HandleFunc("/documentation/git-ssh-key", func(w http.ResponseWriter, r *http.Request) { handlers.GenerateGitSSHKey(dS, w, r) }).Methods("POST")
+	docsRouter.HandleFunc("/documentation/git-sync", func(w http.ResponseWriter, r *http.Request) { handlers.GitSourceSync(dS, w, r) }).Methods("POST")
+	docsRouter.HandleFunc("/documentation/git-sync/status", func(w http.ResponseWriter, r *http.Request) { handlers.GetGitSyncStatus(dS, w, r) }).Methods("POST")
+	docsRouter.HandleFunc("/documentation/git-sync/resolve", func(w http.ResponseWriter, r *http.Request) { handlers.ResolveGitSyncConflict(dS, w, r) }).Methods("POST")
+
+	docsRouter.HandleFunc("/documentation/reviewers", func(w http.ResponseWriter, r *http.Request) { handlers.GetReviewers(dS, w, r) }).Methods("POST")
+	docsRouter.HandleFunc("/documentation/reviewers/set", func(w http.ResponseWriter, r *http.Request) { handlers.SetReviewers(dS, w, r) }).Methods("POST")
+
+	docsRouter.HandleFunc("/documentation/hooks", func(w http.ResponseWriter, r *http.Request) { handlers.GetInboundHooks(dS, w, r) }).Methods("POST")
+	docsRouter.HandleFunc("/documentation/hook/create", func(w http.ResponseWriter, r *http.Request) { handlers.CreateInboundHook(serviceRegistry, w, r) }).Methods("POST")
+	docsRouter.HandleFunc("/documentation/hook/delete", func(w http.ResponseWriter, r *http.Request) { handlers.DeleteInboundHook(dS, w, r) }).Methods("POST")
+
+	docsRouter.HandleFunc("/webhooks", func(w http.ResponseWriter, r *http.Request) { handlers.GetWebhooks(dS, w, r) }).Methods("POST")
+	docsRouter.HandleFunc("/webhook/create", func(w http.ResponseWriter, r *http.Request) { handlers.CreateWebhook(serviceRegistry, w, r) }).Methods("POST")
+	docsRouter.HandleFunc("/webhook/edit", func(w http.ResponseWriter, r *http.Request) { handlers.EditWebhook(dS, w, r) }).Methods("POST")
+	docsRouter.HandleFunc("/webhook/delete", func(w http.ResponseWriter, r *http.Request) { handlers.DeleteWebhook(dS, w, r) }).Methods("POST")
+	docsRouter.HandleFunc("/webhook/deliveries", func(w http.ResponseWriter, r *http.Request) { handlers.GetWebhookDeliveries(dS, w, r) }).Methods("POST")
+	docsRouter.HandleFunc("/webhook/redeliver", func(w http.ResponseWriter, r *http.Request) { handlers.RedeliverWebhook(dS, w, r) }).Methods("POST")
+	docsRouter.HandleFunc("/webhook/ping", func(w http.ResponseWriter, r *http.Request) { handlers.PingWebhook(dS, w, r) }).Methods("POST")
 
 	importRouter := docsRouter.PathPrefix("/import").Subrouter()
 	importRouter.Use(middleware.EnsureAuthenticated(aS))
@@ -130,33 +250,152 @@ func main() {
 	docsRouter.HandleFunc("/page", func(w http.ResponseWriter, r *http.Request) { handlers.GetPage(dS, w, r) }).Methods("POST")
 	docsRouter.HandleFunc("/page/create", func(w http.ResponseWriter, r *http.Request) { handlers.CreatePage(serviceRegistry, w, r) }).Methods("POST")
 	docsRouter.HandleFunc("/page/edit", func(w http.ResponseWriter, r *http.Request) { handlers.EditPage(serviceRegistry, w, r) }).Methods("POST")
-	docsRouter.HandleFunc("/page/delete", func(w http.ResponseWriter, r *http.Request) { handlers.DeletePage(dS, w, r) }).Methods("POST")
+	docsRouter.HandleFunc("/page/delete", func(w http.ResponseWriter, r *http.Request) { handlers.DeletePage(serviceRegistry, w, r) }).Methods("POST")
+	docsRouter.HandleFunc("/page/schedule", func(w http.ResponseWriter, r *http.Request) { handlers.SetPageSchedule(dS, w, r) }).Methods("POST")
+	docsRouter.HandleFunc("/page/draft", func(w http.ResponseWriter, r *http.Request) { handlers.GetDraft(dS, w, r) }).Methods("POST")
+	docsRouter.HandleFunc("/page/draft/save", func(w http.ResponseWriter, r *http.Request) { handlers.SaveDraft(serviceRegistry, w, r) }).Methods("POST")
+	docsRouter.HandleFunc("/page/draft/discard", func(w http.ResponseWriter, r *http.Request) { handlers.DiscardDraft(dS, w, r) }).Methods("POST")
+	docsRouter.HandleFunc("/page/draft/preview", func(w http.ResponseWriter, r *http.Request) { handlers.PreviewDraft(dS, w, r) }).Methods("POST")
+	docsRouter.HandleFunc("/page/draft/request-review", func(w http.ResponseWriter, r *http.Request) { handlers.RequestDraftReview(serviceRegistry, w, r) }).Methods("POST")
+	docsRouter.HandleFunc("/page/draft/approve", func(w http.ResponseWriter, r *http.Request) { handlers.ApproveDraft(serviceRegistry, w, r) }).Methods("POST")
+	docsRouter.HandleFunc("/page/draft/request-changes", func(w http.ResponseWriter, r *http.Request) { handlers.RequestDraftChanges(serviceRegistry, w, r) }).Methods("POST")
+	docsRouter.HandleFunc("/page/draft/publish", func(w http.ResponseWriter, r *http.Request) { handlers.PublishDraft(serviceRegistry, w, r) }).Methods("POST")
+	docsRouter.HandleFunc("/page/reviews", func(w http.ResponseWriter, r *http.Request) { handlers.GetPageReviews(dS, w, r) }).Methods("POST")
 
 	docsRouter.HandleFunc("/page-groups", func(w http.ResponseWriter, r *http.Request) { handlers.GetPageGroups(dS, w, r) }).Methods("GET")
 	docsRouter.HandleFunc("/page-group", func(w http.ResponseWriter, r *http.Request) { handlers.GetPageGroup(dS, w, r) }).Methods("POST")
 	docsRouter.HandleFunc("/page-group/create", func(w http.ResponseWriter, r *http.Request) { handlers.CreatePageGroup(serviceRegistry, w, r) }).Methods("POST")
 	docsRouter.HandleFunc("/page-group/edit", func(w http.ResponseWriter, r *http.Request) { handlers.EditPageGroup(serviceRegistry, w, r) }).Methods("POST")
-	docsRouter.HandleFunc("/page-group/delete", func(w http.ResponseWriter, r *http.Request) { handlers.DeletePageGroup(dS, w, r) }).Methods("POST")
+	docsRouter.HandleFunc("/page-group/delete", func(w http.ResponseWriter, r *http.Request) { handlers.DeletePageGroup(serviceRegistry, w, r) }).Methods("POST")
+	docsRouter.HandleFunc("/page-group/schedule", func(w http.ResponseWriter, r *http.Request) { handlers.SetPageGroupSchedule(dS, w, r) }).Methods("POST")
+
+	// INFO: routes without a permission in middleware.hasPermissionForRoute are for admins only
+	adminRouter := kRouter.PathPrefix("/admin").Subrouter()
+	adminRouter.Use(middleware.EnsureAuthenticated(aS))
+	adminRouter.HandleFunc("/cache", handlers.GetCacheStats).Methods("GET")
+	adminRouter.HandleFunc("/cache/flush", handlers.FlushCache).Methods("POST")
+	adminRouter.HandleFunc("/domains", func(w http.ResponseWriter, r *http.Request) { handlers.GetDomains(dS, w, r) }).Methods("POST")
+	adminRouter.HandleFunc("/domain/add", func(w http.ResponseWriter, r *http.Request) { handlers.AddDomain(dS, w, r) }).Methods("POST")
+	adminRouter.HandleFunc("/domain/verify", func(w http.ResponseWriter, r *http.Request) { handlers.VerifyDomain(dS, w, r) }).Methods("POST")
+	adminRouter.HandleFunc("/domain/delete", func(w http.ResponseWriter, r *http.Request) { handlers.DeleteDomain(dS, w, r) }).Methods("POST")
+
 	// rsPressMiddleware := middleware.RsPressMiddleware(dS)
 	// r.PathPrefix("/").Handler(rsPressMiddleware(spaHandler))
 
+	r.Use(middleware.MetricsMiddleware)
+	r.Use(middleware.TracingMiddleware)
+
 	rsPressMiddleware := middleware.RsPressMiddleware(dS)
 	r.Use(rsPressMiddleware)
 
 	spaHandler := createSPAHandler()
 	r.PathPrefix("/").HandlerFunc(spaHandler)
 
-	logger.Info("Starting server", zap.Int("port", cfg.Port))
-
 	http.Handle("/", r)
-	http.ListenAndServe(fmt.Sprintf(":%d", cfg.Port), middleware.CorsMiddleware(r))
 
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	<-c
+	var handler http.Handler = middleware.CorsMiddleware(r)
+	if cfg.Tracing.Enabled {
+		// INFO: spans are named after their route by TracingMiddleware
+		handler = otelhttp.NewHandler(handler, "HTTP request")
+	}
+
+	var servers []*http.Server
+	if cfg.TLS.Enabled {
+		servers = serveTLS(cfg, dS, handler)
+	} else {
+		server := &http.Server{Addr: fmt.Sprintf(":%d", cfg.Port), Handler: handler}
+		logger.Info("Starting server", zap.Int("port", cfg.Port))
+		listen(server, server.ListenAndServe)
+		servers = []*http.Server{server}
+	}
+
+	<-ctx.Done()
+	stop()
+
+	shutdown(cfg, d, serviceRegistry, servers, stopTracing)
+}
+
+// listen runs serve, the ListenAndServe method of server, in the background.
+// Requests still streaming when the server shuts down have their context
+// cancelled, as they would otherwise never finish.
+func listen(server *http.Server, serve func() error) {
+	streamsCtx, cancelStreams := context.WithCancel(context.Background())
+	server.BaseContext = func(net.Listener) context.Context { return streamsCtx }
+	server.RegisterOnShutdown(cancelStreams)
+
+	go func() {
+		if err := serve(); !errors.Is(err, http.ErrServerClosed) {
+			logger.Fatal("Server failed", zap.String("addr", server.Addr), zap.Error(err))
+		}
+	}()
+}
+
+// shutdown stops accepting requests and waits for the ones in progress, then
+// for the background jobs and builds, and sends the spans left before
+// closing the database. Builds still running once the shutdown timeout has
+// passed are cancelled and queued again for the next start.
+func shutdown(cfg *config.Config, d *gorm.DB, serviceRegistry *services.ServiceRegistry, servers []*http.Server, stopTracing func(context.Context) error) {
+	logger.Info("Shutting down server", zap.Int("timeout", cfg.ShutdownTimeout))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout)*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Go(func() {
+			if err := server.Shutdown(ctx); err != nil {
+				logger.Warn("Server did not shut down cleanly", zap.String("addr", server.Addr), zap.Error(err))
+				server.Close()
+			}
+		})
+	}
+	wg.Wait()
+
+	if err := serviceRegistry.Shutdown(ctx); err != nil {
+		logger.Warn("Background jobs did not stop in time", zap.Error(err))
+	}
+
+	if err := stopTracing(ctx); err != nil {
+		logger.Warn("Failed to send the remaining spans", zap.Error(err))
+	}
+
+	if err := db.CloseDatabase(d); err != nil {
+		logger.Error("Failed to close database", zap.Error(err))
+	}
+
+	logger.Info("Server stopped")
+}
+
+// serveTLS serves handler over HTTPS on the TLS port, and redirects plain
+// HTTP on the port of the config to it. It returns the servers started.
+func serveTLS(cfg *config.Config, dS *services.DocService, handler http.Handler) []*http.Server {
+	hostPolicy := func(ctx context.Context, host string) error {
+		if slices.Contains(cfg.TLS.Hosts, host) || dS.IsSiteDomain(host) {
+			return nil
+		}
+		return fmt.Errorf("no certificate is requested for host %q", host)
+	}
+
+	tlsConfig, httpHandler, err := utils.TLSConfig(cfg.TLS, cfg.DataPath, hostPolicy, middleware.HTTPSRedirect(cfg.TLS.Port))
+	if err != nil {
+		logger.Fatal("Failed to set up TLS", zap.Error(err))
+	}
+
+	server := &http.Server{
+		Addr:      fmt.Sprintf(":%d", cfg.TLS.Port),
+		Handler:   middleware.HSTSMiddleware(cfg.TLS.HSTSMaxAge)(handler),
+		TLSConfig: tlsConfig,
+	}
+
+	logger.Info("Starting HTTPS server", zap.Int("port", cfg.TLS.Port))
+	listen(server, func() error { return server.ListenAndServeTLS("", "") })
+
+	redirectServer := &http.Server{Addr: fmt.Sprintf(":%d", cfg.Port), Handler: httpHandler}
+
+	logger.Info("Starting server", zap.Int("port", cfg.Port), zap.Bool("redirect_to_https", true))
+	listen(redirectServer, redirectServer.ListenAndServe)
 
-	logger.Info("Shutting down server")
-	os.Exit(0)
+	return []*http.Server{server, redirectServer}
 }
 
 func createSPAHandler() http.HandlerFunc {
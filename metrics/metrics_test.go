@@ -0,0 +1,44 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	GitDeploys.WithLabelValues("success").Inc()
+
+	tests := []struct {
+		name          string
+		token         string
+		authorization string
+		status        int
+	}{
+		{"Without a token", "", "", http.StatusOK},
+		{"Missing token", "secret", "", http.StatusUnauthorized},
+		{"Wrong token", "secret", "Bearer other", http.StatusUnauthorized},
+		{"Right token", "secret", "Bearer secret", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+
+			w := httptest.NewRecorder()
+			Handler(tt.token).ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status got = %d, want %d", w.Code, tt.status)
+			}
+
+			if tt.status == http.StatusOK && !strings.Contains(w.Body.String(), `kalmia_git_deploys_total{result="success"}`) {
+				t.Errorf("Expected the metrics in the response, got %q", w.Body.String())
+			}
+		})
+	}
+}
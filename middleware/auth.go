@@ -9,6 +9,16 @@ import (
 )
 
 func EnsureAuthenticated(authService *services.AuthService) func(http.Handler) http.Handler {
+	return ensureAuthenticated(authService, handlers.GetTokenFromHeader)
+}
+
+// EnsureStreamAuthenticated is EnsureAuthenticated for the build streams,
+// which also take the token as a query parameter, see handlers.GetStreamToken.
+func EnsureStreamAuthenticated(authService *services.AuthService) func(http.Handler) http.Handler {
+	return ensureAuthenticated(authService, handlers.GetStreamToken)
+}
+
+func ensureAuthenticated(authService *services.AuthService, getToken func(*http.Request) (string, error)) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			if r.URL.Path == "/kal-api/auth/jwt/create" ||
@@ -19,7 +29,7 @@ func EnsureAuthenticated(authService *services.AuthService) func(http.Handler) h
 				return
 			}
 
-			token, err := handlers.GetTokenFromHeader(r)
+			token, err := getToken(r)
 
 			if err != nil || !authService.VerifyTokenInDb(token, false) {
 				handlers.SendJSONResponse(http.StatusUnauthorized, w, map[string]string{"error": "invalid_token"})
@@ -50,29 +60,55 @@ func hasPermissionForRoute(path string, permissions []string, isAdmin bool) bool
 	}
 
 	routePermissions := map[string]string{
-		"/kal-api/auth/user":                       "read",
-		"/kal-api/auth/users":                      "read",
-		"/kal-api/auth/user/edit":                  "read",
-		"/kal-api/auth/jwt/revoke":                 "read",
-		"/kal-api/auth/jwt/validate":               "read",
-		"/kal-api/auth/user/upload-file":           "read",
-		"/kal-api/docs/documentations":             "read",
-		"/kal-api/docs/pages":                      "read",
-		"/kal-api/docs/page-groups":                "read",
-		"/kal-api/docs/documentation":              "read",
-		"/kal-api/docs/page":                       "read",
-		"/kal-api/docs/page-group":                 "read",
-		"/kal-api/docs/documentation/create":       "write",
-		"/kal-api/docs/documentation/edit":         "write",
-		"/kal-api/docs/documentation/version":      "write",
-		"/kal-api/docs/documentation/reorder-bulk": "write",
-		"/kal-api/docs/page/create":                "write",
-		"/kal-api/docs/page/edit":                  "write",
-		"/kal-api/docs/page-group/create":          "write",
-		"/kal-api/docs/page-group/edit":            "write",
-		"/kal-api/docs/documentation/delete":       "delete",
-		"/kal-api/docs/page/delete":                "delete",
-		"/kal-api/docs/page-group/delete":          "delete",
+		"/kal-api/auth/user":                                "read",
+		"/kal-api/auth/users":                               "read",
+		"/kal-api/auth/user/edit":                           "read",
+		"/kal-api/auth/jwt/revoke":                          "read",
+		"/kal-api/auth/jwt/validate":                        "read",
+		"/kal-api/auth/user/upload-file":                    "read",
+		"/kal-api/docs/documentations":                      "read",
+		"/kal-api/docs/pages":                               "read",
+		"/kal-api/docs/page-groups":                         "read",
+		"/kal-api/docs/documentation":                       "read",
+		"/kal-api/docs/page":                                "read",
+		"/kal-api/docs/page-group":                          "read",
+		"/kal-api/docs/documentation/git-sync/status":       "read",
+		"/kal-api/docs/documentation/builds":                "read",
+		"/kal-api/docs/documentation/build/log":             "read",
+		"/kal-api/docs/documentation/build/log/stream":      "read",
+		"/kal-api/docs/documentation/build/events":          "read",
+		"/kal-api/docs/documentation/previews":              "read",
+		"/kal-api/docs/documentation/site-releases":         "read",
+		"/kal-api/docs/page/draft":                          "read",
+		"/kal-api/docs/page/draft/preview":                  "read",
+		"/kal-api/docs/page/reviews":                        "read",
+		"/kal-api/docs/documentation/reviewers":             "read",
+		"/kal-api/docs/documentation/create":                "write",
+		"/kal-api/docs/documentation/edit":                  "write",
+		"/kal-api/docs/documentation/version":               "write",
+		"/kal-api/docs/documentation/reorder-bulk":          "write",
+		"/kal-api/docs/page/create":                         "write",
+		"/kal-api/docs/page/edit":                           "write",
+		"/kal-api/docs/page-group/create":                   "write",
+		"/kal-api/docs/page-group/edit":                     "write",
+		"/kal-api/docs/page/schedule":                       "write",
+		"/kal-api/docs/page-group/schedule":                 "write",
+		"/kal-api/docs/page/draft/save":                     "write",
+		"/kal-api/docs/page/draft/discard":                  "write",
+		"/kal-api/docs/page/draft/request-review":           "write",
+		"/kal-api/docs/page/draft/approve":                  "write",
+		"/kal-api/docs/page/draft/request-changes":          "write",
+		"/kal-api/docs/page/draft/publish":                  "write",
+		"/kal-api/docs/documentation/git-ssh-key":           "write",
+		"/kal-api/docs/documentation/git-sync":              "write",
+		"/kal-api/docs/documentation/git-sync/resolve":      "write",
+		"/kal-api/docs/documentation/preview/create":        "write",
+		"/kal-api/docs/documentation/preview/delete":        "write",
+		"/kal-api/docs/documentation/site-release/activate": "write",
+		"/kal-api/docs/documentation/site-release/pin":      "write",
+		"/kal-api/docs/documentation/delete":                "delete",
+		"/kal-api/docs/page/delete":                         "delete",
+		"/kal-api/docs/page-group/delete":                   "delete",
 	}
 
 	requiredPermission, exists := routePermissions[path]
@@ -0,0 +1,34 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"git.difuse.io/Difuse/kalmia/metrics"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsMiddleware(t *testing.T) {
+	r := mux.NewRouter()
+	r.Use(MetricsMiddleware)
+	r.HandleFunc("/metrics-test/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(http.Flusher); !ok {
+			t.Errorf("Expected the response writer to be a http.Flusher")
+		}
+		http.Error(w, "not found", http.StatusNotFound)
+	})
+
+	for _, path := range []string{"/metrics-test/1", "/metrics-test/2"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	if got := testutil.ToFloat64(metrics.HTTPRequests.WithLabelValues("/metrics-test/{id}", "GET", "404")); got != 2 {
+		t.Errorf("requests counted for the route = %v, want 2", got)
+	}
+
+	if got := testutil.CollectAndCount(metrics.HTTPRequestDuration, "kalmia_http_request_duration_seconds"); got == 0 {
+		t.Errorf("Expected request durations to be observed")
+	}
+}
@@ -1,13 +1,12 @@
 package middleware
 
 import (
-	"fmt"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
 
-	"git.difuse.io/Difuse/kalmia/db"
 	"git.difuse.io/Difuse/kalmia/services"
 	"git.difuse.io/Difuse/kalmia/utils"
 )
@@ -16,65 +15,149 @@ func RsPressMiddleware(dS *services.DocService) func(http.Handler) http.Handler
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			urlPath := r.URL.Path
-			docId, docPath, baseURL, reqAuth, err := dS.GetRsPress(urlPath)
-			cookieToken := ""
 
-			for _, cookie := range r.Cookies() {
-				if cookie.Name == "viewToken" {
-					cookieToken = cookie.Value
-					break
+			// Nothing but the site is served on a domain of its own
+			if docId, docPath, reqAuth, err := dS.GetRsPressByHost(r.Host); err == nil {
+				if reqAuth {
+					http.Error(w, "this documentation requires a login", http.StatusForbidden)
+					return
 				}
-			}
 
-			if err != nil {
-				next.ServeHTTP(w, r)
+				serveSite(dS, http.NotFoundHandler(), w, r, docId, docPath, "", false)
 				return
 			}
 
-			fileKey := strings.TrimPrefix(urlPath, baseURL)
-			fullPath := filepath.Join(docPath, fileKey)
-			cleanRoot := filepath.Clean(docPath)
+			if token, filePath, ok := services.SplitPreviewPath(urlPath); ok {
+				servePreview(dS, w, r, token, filePath)
+				return
+			}
 
-			if !strings.HasPrefix(filepath.Clean(fullPath), cleanRoot+string(filepath.Separator)) &&
-				filepath.Clean(fullPath) != cleanRoot {
+			docId, docPath, baseURL, reqAuth, err := dS.GetRsPress(urlPath)
+			if err != nil {
 				next.ServeHTTP(w, r)
 				return
 			}
 
-			if strings.HasPrefix(fullPath, docPath+string(filepath.Separator)) {
-				fileKey = strings.TrimPrefix(fullPath, docPath+string(filepath.Separator))
+			if domain := dS.SiteDomainOf(docId); domain != "" {
+				http.Redirect(w, r, siteDomainURL(r, domain, strings.TrimPrefix(urlPath, baseURL)), http.StatusMovedPermanently)
+				return
 			}
 
-			if strings.HasSuffix(fileKey, "guides.html") {
-				fileKey = strings.TrimSuffix(fileKey, ".html")
-			}
+			serveSite(dS, next, w, r, docId, docPath, baseURL, reqAuth)
+		})
+	}
+}
 
-			if filepath.Ext(fileKey) == "" {
-				fileKey = filepath.Join(fileKey, "index.html")
-			}
+// siteDomainURL is the URL of sitePath on the domain of a site, in the scheme
+// of the request.
+func siteDomainURL(r *http.Request, domain string, sitePath string) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
 
-			fileKey = fmt.Sprintf("rs|doc_%d|%s", docId, strings.TrimPrefix(fileKey, "/"))
-			value, err := db.GetValue([]byte(fileKey))
-			if err == nil {
-				if reqAuth && cookieToken == "" {
-					http.Redirect(w, r, "/admin/login?docAuth="+utils.ToBase64(r.URL.Path), http.StatusTemporaryRedirect)
-					return
-				}
-				w.Header().Set("Content-Type", value.ContentType)
-				w.Write(value.Data)
-				return
-			}
+	target := url.URL{Scheme: scheme, Host: domain, Path: "/" + strings.TrimPrefix(sitePath, "/"), RawQuery: r.URL.RawQuery}
+	return target.String()
+}
 
-			if _, err := os.Stat(fullPath); os.IsNotExist(err) {
-				fullPath = filepath.Join(docPath, "index.html")
-			}
+// serveSite serves the file of the site of a documentation at the path of r,
+// under baseURL. Paths outside of the site are left to next.
+func serveSite(dS *services.DocService, next http.Handler, w http.ResponseWriter, r *http.Request, docId uint, docPath string, baseURL string, reqAuth bool) {
+	urlPath := r.URL.Path
+	cookieToken := ""
 
-			if reqAuth && cookieToken == "" {
-				http.Redirect(w, r, "/admin/login?docAuth="+utils.ToBase64(r.URL.Path), http.StatusTemporaryRedirect)
-				return
-			} else {
-				http.ServeFile(w, r, fullPath)
-			}
-		})
+	for _, cookie := range r.Cookies() {
+		if cookie.Name == "viewToken" {
+			cookieToken = cookie.Value
+			break
+		}
+	}
+
+	fileKey := strings.TrimPrefix(urlPath, baseURL)
+	fullPath := filepath.Join(docPath, fileKey)
+	cleanRoot := filepath.Clean(docPath)
+
+	if !strings.HasPrefix(filepath.Clean(fullPath), cleanRoot+string(filepath.Separator)) &&
+		filepath.Clean(fullPath) != cleanRoot {
+		next.ServeHTTP(w, r)
+		return
 	}
+
+	if strings.HasPrefix(fullPath, docPath+string(filepath.Separator)) {
+		fileKey = strings.TrimPrefix(fullPath, docPath+string(filepath.Separator))
+	}
+
+	if strings.HasSuffix(fileKey, "guides.html") {
+		fileKey = strings.TrimSuffix(fileKey, ".html")
+	}
+
+	if filepath.Ext(fileKey) == "" {
+		fileKey = filepath.Join(fileKey, "index.html")
+	}
+
+	if reqAuth && cookieToken == "" {
+		http.Redirect(w, r, "/admin/login?docAuth="+utils.ToBase64(r.URL.Path), http.StatusTemporaryRedirect)
+		return
+	}
+
+	sitePath := strings.TrimPrefix(fileKey, "/")
+	value, redirectURL, err := dS.GetSiteFile(docId, sitePath)
+
+	var build *services.SiteBuild
+	if siteBuild, err := dS.GetSiteBuild(docId); err == nil {
+		build = &siteBuild
+	}
+
+	if err == nil {
+		if redirectURL != "" {
+			http.Redirect(w, r, redirectURL, http.StatusFound)
+			return
+		}
+		serveCachedFile(w, r, sitePath, value, build, reqAuth)
+		return
+	}
+
+	if dS.SitesInObjectStorage() {
+		if err.Error() == "site_file_not_found" {
+			http.NotFound(w, r)
+		} else {
+			http.Error(w, "failed to fetch site file", http.StatusBadGateway)
+		}
+		return
+	}
+
+	// Files too large for the cache are served from disk
+	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
+		fullPath = filepath.Join(docPath, "index.html")
+	}
+
+	if build != nil {
+		w.Header().Set("ETag", siteETag(*build, ""))
+	}
+	w.Header().Set("Cache-Control", siteCacheControl(fullPath, utils.GetContentType(fullPath), reqAuth))
+	serveFileCompressed(w, r, fullPath)
+}
+
+// servePreview serves a file of a preview build. Knowing the token is enough
+// to see a preview, so they are kept out of caches and search engines.
+func servePreview(dS *services.DocService, w http.ResponseWriter, r *http.Request, token string, filePath string) {
+	buildPath, err := dS.GetPreviewBuild(token)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Robots-Tag", "noindex, nofollow")
+
+	fullPath := filepath.Join(buildPath, filepath.Clean("/"+filePath))
+	if filepath.Ext(fullPath) == "" {
+		fullPath = filepath.Join(fullPath, "index.html")
+	}
+
+	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
+		fullPath = filepath.Join(buildPath, "index.html")
+	}
+
+	serveFileCompressed(w, r, fullPath)
 }
@@ -0,0 +1,27 @@
+package middleware
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSiteDomainURL(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/docs/guides/index.html?q=1", nil)
+	if got := siteDomainURL(r, "docs.example.com", "/guides/index.html"); got != "http://docs.example.com/guides/index.html?q=1" {
+		t.Errorf("siteDomainURL() got = %q", got)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/docs", nil)
+	r.TLS = &tls.ConnectionState{}
+	if got := siteDomainURL(r, "docs.example.com", ""); got != "https://docs.example.com/" {
+		t.Errorf("siteDomainURL() got = %q", got)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/docs/", nil)
+	r.Header.Set("X-Forwarded-Proto", "https")
+	if got := siteDomainURL(r, "docs.example.com", "/"); got != "https://docs.example.com/" {
+		t.Errorf("siteDomainURL() got = %q", got)
+	}
+}
@@ -0,0 +1,200 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.difuse.io/Difuse/kalmia/db"
+	"git.difuse.io/Difuse/kalmia/services"
+	"git.difuse.io/Difuse/kalmia/utils"
+	"github.com/andybalholm/brotli"
+)
+
+// rspress names the bundles it emits after a hash of their content, e.g.
+// static/js/index.3f2a9c1b.js, so they never change under the same name.
+var hashedAssetName = regexp.MustCompile(`\.[0-9a-f]{8,}\.[a-z0-9]+$`)
+
+// siteCacheControl returns how long browsers may reuse a file of a site
+// without checking it changed. Pages are checked often, as they keep their
+// URL across builds, while hashed assets never change.
+func siteCacheControl(sitePath string, contentType string, private bool) string {
+	scope := "public"
+	if private {
+		scope = "private"
+	}
+
+	switch {
+	case strings.HasPrefix(contentType, "text/html"):
+		return scope + ", max-age=60"
+	case hashedAssetName.MatchString(path.Base(sitePath)):
+		return scope + ", max-age=31536000, immutable"
+	default:
+		return scope + ", max-age=3600"
+	}
+}
+
+// siteETag derives the entity tag of the files of a build from its hash.
+// Every encoding of a file gets a tag of its own.
+func siteETag(build services.SiteBuild, encoding string) string {
+	sum := sha256.Sum256([]byte(build.Hash))
+	tag := hex.EncodeToString(sum[:10])
+
+	if encoding != "" {
+		tag += "-" + encoding
+	}
+
+	return `"` + tag + `"`
+}
+
+// negotiateEncoding picks the first of encodings the client accepts, or ""
+// for none.
+func negotiateEncoding(r *http.Request, encodings ...string) string {
+	accepted := make(map[string]bool)
+	wildcard := false
+
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if weight, err := strconv.ParseFloat(q, 64); err == nil && weight == 0 {
+				accepted[name] = false
+				continue
+			}
+		}
+
+		if name == "*" {
+			wildcard = true
+		} else if name != "" {
+			accepted[name] = true
+		}
+	}
+
+	for _, encoding := range encodings {
+		if ok, listed := accepted[encoding]; ok || (!listed && wildcard) {
+			return encoding
+		}
+	}
+
+	return ""
+}
+
+// serveCachedFile serves a cached file of a site in the best encoding the
+// client accepts, answering conditional and range requests.
+func serveCachedFile(w http.ResponseWriter, r *http.Request, sitePath string, entry db.CacheEntry, build *services.SiteBuild, private bool) {
+	data := entry.Data
+	var available []string
+	if entry.Brotli != nil {
+		available = append(available, "br")
+	}
+	if entry.Gzip != nil {
+		available = append(available, "gzip")
+	}
+
+	encoding := ""
+	if len(available) > 0 {
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding = negotiateEncoding(r, available...)
+	}
+
+	switch encoding {
+	case "br":
+		data = entry.Brotli
+	case "gzip":
+		data = entry.Gzip
+	}
+
+	if encoding != "" {
+		w.Header().Set("Content-Encoding", encoding)
+	}
+
+	var modTime time.Time
+	if build != nil {
+		w.Header().Set("ETag", siteETag(*build, encoding))
+		modTime = build.BuiltAt
+	}
+
+	w.Header().Set("Content-Type", entry.ContentType)
+	w.Header().Set("Cache-Control", siteCacheControl(sitePath, entry.ContentType, private))
+	http.ServeContent(w, r, sitePath, modTime, bytes.NewReader(data))
+}
+
+// serveFileCompressed is http.ServeFile, compressing text files on the fly
+// for clients that accept it. Range requests are answered uncompressed.
+func serveFileCompressed(w http.ResponseWriter, r *http.Request, filePath string) {
+	contentType := utils.GetContentType(filePath)
+	if !db.Compressible(contentType) {
+		http.ServeFile(w, r, filePath)
+		return
+	}
+
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	encoding := ""
+	if r.Header.Get("Range") == "" {
+		encoding = negotiateEncoding(r, "br", "gzip")
+	}
+
+	if encoding == "" {
+		http.ServeFile(w, r, filePath)
+		return
+	}
+
+	if etag := w.Header().Get("ETag"); etag != "" {
+		w.Header().Set("ETag", strings.TrimSuffix(etag, `"`)+"-"+encoding+`"`)
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Encoding", encoding)
+
+	cw := &compressWriter{ResponseWriter: w, encoding: encoding}
+	defer cw.Close()
+
+	http.ServeFile(cw, r, filePath)
+}
+
+// compressWriter compresses what is written to it, unless the response
+// dropped its Content-Encoding, as http.ServeFile does for errors.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	encoder  io.WriteCloser
+	checked  bool
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if !cw.checked {
+		cw.checked = true
+		if cw.Header().Get("Content-Encoding") == cw.encoding {
+			switch cw.encoding {
+			case "br":
+				cw.encoder = brotli.NewWriter(cw.ResponseWriter)
+			case "gzip":
+				cw.encoder = gzip.NewWriter(cw.ResponseWriter)
+			}
+		}
+	}
+
+	if cw.encoder == nil {
+		return cw.ResponseWriter.Write(p)
+	}
+
+	return cw.encoder.Write(p)
+}
+
+func (cw *compressWriter) Close() error {
+	if cw.encoder == nil {
+		return nil
+	}
+
+	return cw.encoder.Close()
+}
@@ -0,0 +1,152 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"git.difuse.io/Difuse/kalmia/db"
+	"git.difuse.io/Difuse/kalmia/services"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		want           string
+	}{
+		{"", ""},
+		{"gzip, deflate, br", "br"},
+		{"gzip", "gzip"},
+		{"br;q=0, gzip", "gzip"},
+		{"*", "br"},
+		{"*, br;q=0", "gzip"},
+		{"identity", ""},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Encoding", tt.acceptEncoding)
+
+		if got := negotiateEncoding(r, "br", "gzip"); got != tt.want {
+			t.Errorf("negotiateEncoding(%q) got = %q, want %q", tt.acceptEncoding, got, tt.want)
+		}
+	}
+}
+
+func TestSiteCacheControl(t *testing.T) {
+	tests := []struct {
+		sitePath    string
+		contentType string
+		private     bool
+		want        string
+	}{
+		{"index.html", "text/html", false, "public, max-age=60"},
+		{"guide/index.html", "text/html", true, "private, max-age=60"},
+		{"static/js/index.3f2a9c1b.js", "application/javascript", false, "public, max-age=31536000, immutable"},
+		{"logo.png", "image/png", false, "public, max-age=3600"},
+	}
+
+	for _, tt := range tests {
+		if got := siteCacheControl(tt.sitePath, tt.contentType, tt.private); got != tt.want {
+			t.Errorf("siteCacheControl(%q) got = %q, want %q", tt.sitePath, got, tt.want)
+		}
+	}
+}
+
+func TestServeCachedFile(t *testing.T) {
+	content := []byte(strings.Repeat("<p>cached page</p>\n", 100))
+	cache := db.NewLRUCache(1<<20, 0)
+	cache.Set("index.html", content, "text/html")
+	cached, _ := cache.Get("index.html")
+
+	build := &services.SiteBuild{Hash: "build", BuiltAt: time.Now()}
+
+	serve := func(headers map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/docs/index.html", nil)
+		for name, value := range headers {
+			r.Header.Set(name, value)
+		}
+
+		w := httptest.NewRecorder()
+		serveCachedFile(w, r, "index.html", cached, build, false)
+		return w
+	}
+
+	w := serve(map[string]string{"Accept-Encoding": "gzip"})
+	if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Expected a gzip encoded response, got %d %q", w.Code, w.Header().Get("Content-Encoding"))
+	}
+
+	gzipReader, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded, _ := io.ReadAll(gzipReader); !bytes.Equal(decoded, content) {
+		t.Error("Expected the response to decode to the content")
+	}
+
+	etag := w.Header().Get("ETag")
+	if etag != siteETag(*build, "gzip") {
+		t.Errorf("ETag got = %q, want %q", etag, siteETag(*build, "gzip"))
+	}
+
+	if w := serve(map[string]string{"Accept-Encoding": "gzip", "If-None-Match": etag}); w.Code != http.StatusNotModified {
+		t.Errorf("Expected a matching ETag to get 304, got %d", w.Code)
+	}
+
+	if w := serve(map[string]string{"If-None-Match": etag}); w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), content) {
+		t.Errorf("Expected the ETag of another encoding to get the content, got %d", w.Code)
+	}
+
+	if w := serve(map[string]string{"Range": "bytes=0-2"}); w.Code != http.StatusPartialContent || w.Body.String() != "<p>" {
+		t.Errorf("Expected a range request to get 206 %q, got %d %q", "<p>", w.Code, w.Body.String())
+	}
+}
+
+func TestServeFileCompressed(t *testing.T) {
+	content := []byte(strings.Repeat("body { color: black; }\n", 100))
+	filePath := filepath.Join(t.TempDir(), "style.css")
+	if err := os.WriteFile(filePath, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(headers map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/docs/style.css", nil)
+		for name, value := range headers {
+			r.Header.Set(name, value)
+		}
+
+		w := httptest.NewRecorder()
+		w.Header().Set("ETag", `"build"`)
+		serveFileCompressed(w, r, filePath)
+		return w
+	}
+
+	w := serve(map[string]string{"Accept-Encoding": "gzip"})
+	if w.Header().Get("Content-Encoding") != "gzip" || w.Header().Get("ETag") != `"build-gzip"` {
+		t.Fatalf("Expected a gzip encoded response, got %q %q", w.Header().Get("Content-Encoding"), w.Header().Get("ETag"))
+	}
+
+	gzipReader, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded, _ := io.ReadAll(gzipReader); !bytes.Equal(decoded, content) {
+		t.Error("Expected the response to decode to the content")
+	}
+
+	if w := serve(map[string]string{"Accept-Encoding": "gzip", "If-None-Match": `"build-gzip"`}); w.Code != http.StatusNotModified {
+		t.Errorf("Expected a matching ETag to get 304, got %d", w.Code)
+	}
+
+	if w := serve(map[string]string{"Accept-Encoding": "gzip", "Range": "bytes=0-3"}); w.Code != http.StatusPartialContent || w.Body.String() != "body" {
+		t.Errorf("Expected an uncompressed range, got %d %q", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,45 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// HSTSMiddleware tells browsers to only reach the host of HTTPS responses
+// over HTTPS for the next maxAge seconds. A negative maxAge disables it.
+func HSTSMiddleware(maxAge int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if maxAge >= 0 && r.TLS != nil {
+				w.Header().Set("Strict-Transport-Security", "max-age="+strconv.Itoa(maxAge))
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// HTTPSRedirect redirects requests to the same URL over HTTPS on port.
+func HTTPSRedirect(port int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			host = hostname
+		}
+
+		if port != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(port))
+		}
+
+		target := "https://" + host + r.URL.RequestURI()
+
+		// Browsers only repeat the method and body of a request on a 307
+		status := http.StatusMovedPermanently
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			status = http.StatusTemporaryRedirect
+		}
+
+		http.Redirect(w, r, target, status)
+	})
+}
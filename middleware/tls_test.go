@@ -0,0 +1,55 @@
+package middleware
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHSTSMiddleware(t *testing.T) {
+	handler := HSTSMiddleware(3600)(http.NotFoundHandler())
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if got := w.Header().Get("Strict-Transport-Security"); got != "" {
+		t.Errorf("Expected no HSTS header over plain HTTP, got %q", got)
+	}
+
+	r.TLS = &tls.ConnectionState{}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if got := w.Header().Get("Strict-Transport-Security"); got != "max-age=3600" {
+		t.Errorf("Strict-Transport-Security got = %q, want %q", got, "max-age=3600")
+	}
+
+	w = httptest.NewRecorder()
+	HSTSMiddleware(-1)(http.NotFoundHandler()).ServeHTTP(w, r)
+	if got := w.Header().Get("Strict-Transport-Security"); got != "" {
+		t.Errorf("Expected no HSTS header when disabled, got %q", got)
+	}
+}
+
+func TestHTTPSRedirect(t *testing.T) {
+	tests := []struct {
+		method   string
+		target   string
+		port     int
+		status   int
+		location string
+	}{
+		{http.MethodGet, "http://docs.example.com/guides/?q=1", 443, http.StatusMovedPermanently, "https://docs.example.com/guides/?q=1"},
+		{http.MethodGet, "http://docs.example.com:8080/", 8443, http.StatusMovedPermanently, "https://docs.example.com:8443/"},
+		{http.MethodPost, "http://docs.example.com/kal-api/auth/login", 443, http.StatusTemporaryRedirect, "https://docs.example.com/kal-api/auth/login"},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		HTTPSRedirect(tt.port).ServeHTTP(w, httptest.NewRequest(tt.method, tt.target, nil))
+
+		if w.Code != tt.status || w.Header().Get("Location") != tt.location {
+			t.Errorf("HTTPSRedirect(%s %s) got = %d %q, want %d %q", tt.method, tt.target, w.Code, w.Header().Get("Location"), tt.status, tt.location)
+		}
+	}
+}
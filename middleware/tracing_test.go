@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracingMiddleware(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	defer provider.Shutdown(context.Background())
+
+	r := mux.NewRouter()
+	r.Use(TracingMiddleware)
+	r.HandleFunc("/tracing-test/{id}", func(w http.ResponseWriter, r *http.Request) {})
+
+	ctx, span := provider.Tracer("test").Start(context.Background(), "HTTP request")
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/tracing-test/1", nil).WithContext(ctx))
+	span.End()
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("Expected 1 span, got %d", len(spans))
+	}
+
+	if got := spans[0].Name(); got != "GET /tracing-test/{id}" {
+		t.Errorf("span name = %q, want %q", got, "GET /tracing-test/{id}")
+	}
+
+	found := false
+	for _, kv := range spans[0].Attributes() {
+		if kv == attribute.String("http.route", "/tracing-test/{id}") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected the route in the span attributes, got %v", spans[0].Attributes())
+	}
+}
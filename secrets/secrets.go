@@ -0,0 +1,221 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Encrypted values are stored as "enc:v1:<key id>:<base64 nonce+ciphertext>".
+const prefix = "enc:v1:"
+
+type key struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// Keyring encrypts with its current key and decrypts with any of its keys,
+// so that values sealed before a key rotation stay readable until they are
+// re-encrypted.
+type Keyring struct {
+	current key
+	keys    map[string]key
+}
+
+var (
+	defaultKeyring *Keyring
+	defaultMu      sync.RWMutex
+)
+
+func newKey(secret string) (key, error) {
+	sum := sha256.Sum256([]byte(secret))
+
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return key{}, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return key{}, err
+	}
+
+	id := sha256.Sum256(sum[:])
+
+	return key{id: hex.EncodeToString(id[:4]), aead: aead}, nil
+}
+
+func NewKeyring(current string, previous ...string) (*Keyring, error) {
+	if current == "" {
+		return nil, fmt.Errorf("secrets key is empty")
+	}
+
+	currentKey, err := newKey(current)
+	if err != nil {
+		return nil, err
+	}
+
+	keyring := &Keyring{current: currentKey, keys: map[string]key{currentKey.id: currentKey}}
+
+	for _, secret := range previous {
+		if secret == "" {
+			continue
+		}
+
+		previousKey, err := newKey(secret)
+		if err != nil {
+			return nil, err
+		}
+
+		keyring.keys[previousKey.id] = previousKey
+	}
+
+	return keyring, nil
+}
+
+// SetKeys replaces the keyring used by the package level functions.
+func SetKeys(current string, previous ...string) error {
+	keyring, err := NewKeyring(current, previous...)
+	if err != nil {
+		return err
+	}
+
+	defaultMu.Lock()
+	defaultKeyring = keyring
+	defaultMu.Unlock()
+
+	return nil
+}
+
+func getDefault() (*Keyring, error) {
+	defaultMu.RLock()
+	defer defaultMu.RUnlock()
+
+	if defaultKeyring == nil {
+		return nil, fmt.Errorf("secrets keyring is not initialised")
+	}
+
+	return defaultKeyring, nil
+}
+
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, prefix)
+}
+
+// Encrypt seals plaintext with the current key. Empty values stay empty so
+// that "not set" remains distinguishable.
+func (k *Keyring) Encrypt(plaintext string) (string, error) {
+	if plaintext == "" {
+		return plaintext, nil
+	}
+
+	nonce := make([]byte, k.current.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	sealed := k.current.aead.Seal(nonce, nonce, []byte(plaintext), nil)
+
+	return prefix + k.current.id + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func open(k key, data string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return "", fmt.Errorf("invalid encrypted value: %v", err)
+	}
+
+	nonceSize := k.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return "", fmt.Errorf("invalid encrypted value")
+	}
+
+	plaintext, err := k.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt value: %v", err)
+	}
+
+	return string(plaintext), nil
+}
+
+// Decrypt opens a value sealed with any key in the keyring. Values that were
+// never encrypted are returned as they are.
+func (k *Keyring) Decrypt(value string) (string, error) {
+	if !IsEncrypted(value) {
+		return value, nil
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(value, prefix), ":", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("invalid encrypted value")
+	}
+
+	decryptKey, ok := k.keys[parts[0]]
+	if !ok {
+		return "", fmt.Errorf("no key for encrypted value (key id %s)", parts[0])
+	}
+
+	return open(decryptKey, parts[1])
+}
+
+// NeedsRotation reports whether value is not yet sealed with the current key.
+func (k *Keyring) NeedsRotation(value string) bool {
+	if value == "" {
+		return false
+	}
+
+	return !strings.HasPrefix(value, prefix+k.current.id+":")
+}
+
+// Rotate re-encrypts value with the current key if needed.
+func (k *Keyring) Rotate(value string) (string, bool, error) {
+	if !k.NeedsRotation(value) {
+		return value, false, nil
+	}
+
+	plaintext, err := k.Decrypt(value)
+	if err != nil {
+		return value, false, err
+	}
+
+	encrypted, err := k.Encrypt(plaintext)
+	if err != nil {
+		return value, false, err
+	}
+
+	return encrypted, true, nil
+}
+
+func Encrypt(plaintext string) (string, error) {
+	keyring, err := getDefault()
+	if err != nil {
+		return "", err
+	}
+
+	return keyring.Encrypt(plaintext)
+}
+
+func Decrypt(value string) (string, error) {
+	keyring, err := getDefault()
+	if err != nil {
+		return "", err
+	}
+
+	return keyring.Decrypt(value)
+}
+
+func Rotate(value string) (string, bool, error) {
+	keyring, err := getDefault()
+	if err != nil {
+		return value, false, err
+	}
+
+	return keyring.Rotate(value)
+}
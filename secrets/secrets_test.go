@@ -0,0 +1,111 @@
+package secrets
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	keyring, err := NewKeyring("secret")
+	if err != nil {
+		t.Fatalf("NewKeyring() error = %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		plaintext string
+	}{
+		{"Simple", "hunter2"},
+		{"Multiline", "-----BEGIN KEY-----\nabc\n-----END KEY-----\n"},
+		{"Unicode", "pässwörd"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encrypted, err := keyring.Encrypt(tt.plaintext)
+			if err != nil {
+				t.Fatalf("Encrypt() error = %v", err)
+			}
+
+			if !IsEncrypted(encrypted) || strings.Contains(encrypted, tt.plaintext) {
+				t.Errorf("Encrypt() = %q, expected an encrypted value", encrypted)
+			}
+
+			decrypted, err := keyring.Decrypt(encrypted)
+			if err != nil {
+				t.Fatalf("Decrypt() error = %v", err)
+			}
+
+			if decrypted != tt.plaintext {
+				t.Errorf("Decrypt() = %q, want %q", decrypted, tt.plaintext)
+			}
+		})
+	}
+}
+
+func TestDecryptEdgeCases(t *testing.T) {
+	keyring, _ := NewKeyring("secret")
+	other, _ := NewKeyring("other-secret")
+
+	if encrypted, err := keyring.Encrypt(""); encrypted != "" || err != nil {
+		t.Errorf("Encrypt(\"\") = %q, %v; want empty", encrypted, err)
+	}
+
+	if plain, err := keyring.Decrypt("legacy-plaintext"); plain != "legacy-plaintext" || err != nil {
+		t.Errorf("Decrypt() on plaintext = %q, %v", plain, err)
+	}
+
+	encrypted, _ := keyring.Encrypt("value")
+	if _, err := other.Decrypt(encrypted); err == nil {
+		t.Errorf("Decrypt() with wrong key expected error")
+	}
+
+	if _, err := keyring.Decrypt("enc:v1:" + "00000000:abc"); err == nil {
+		t.Errorf("Decrypt() expected error for unknown key id")
+	}
+
+	if _, err := keyring.Decrypt("enc:v1:not-a-key-id"); err == nil {
+		t.Errorf("Decrypt() expected error for malformed value")
+	}
+
+	if _, err := NewKeyring(""); err == nil {
+		t.Errorf("NewKeyring() expected error for empty key")
+	}
+}
+
+func TestRotate(t *testing.T) {
+	oldKeyring, _ := NewKeyring("old")
+	sealed, _ := oldKeyring.Encrypt("value")
+
+	keyring, err := NewKeyring("new", "old")
+	if err != nil {
+		t.Fatalf("NewKeyring() error = %v", err)
+	}
+
+	if !keyring.NeedsRotation(sealed) {
+		t.Errorf("NeedsRotation() = false for a value sealed with an old key")
+	}
+
+	rotated, changed, err := keyring.Rotate(sealed)
+	if err != nil || !changed {
+		t.Fatalf("Rotate() = %q, %v, %v", rotated, changed, err)
+	}
+
+	if keyring.NeedsRotation(rotated) {
+		t.Errorf("NeedsRotation() = true after rotation")
+	}
+
+	newOnly, _ := NewKeyring("new")
+	if plain, err := newOnly.Decrypt(rotated); plain != "value" || err != nil {
+		t.Errorf("Decrypt() after rotation = %q, %v", plain, err)
+	}
+
+	if _, changed, _ := keyring.Rotate(rotated); changed {
+		t.Errorf("Rotate() changed a value already sealed with the current key")
+	}
+
+	plainRotated, changed, err := keyring.Rotate("plaintext")
+	if err != nil || !changed || !IsEncrypted(plainRotated) {
+		t.Errorf("Rotate() on plaintext = %q, %v, %v", plainRotated, changed, err)
+	}
+}
@@ -3,6 +3,7 @@ package services
 import (
 	"encoding/json"
 	"fmt"
+	"sync"
 
 	"git.difuse.io/Difuse/kalmia/config"
 	"git.difuse.io/Difuse/kalmia/db/models"
@@ -11,7 +12,8 @@ import (
 )
 
 type AuthService struct {
-	DB *gorm.DB
+	DB         *gorm.DB
+	background sync.WaitGroup
 }
 
 func NewAuthService(db *gorm.DB) *AuthService {
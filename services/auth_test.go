@@ -348,3 +348,34 @@ func TestGetUserPermissions(t *testing.T) {
 		}
 	})
 }
+
+func TestOAuthCodes(t *testing.T) {
+	code, err := TestAuthService.StoreOAuthToken("token")
+	if err != nil {
+		t.Fatalf("StoreOAuthToken returned an error: %v", err)
+	}
+
+	token, err := TestAuthService.ExchangeOAuthCode(code)
+	if err != nil || token != "token" {
+		t.Errorf("ExchangeOAuthCode() got = %q, %v, want %q", token, err, "token")
+	}
+
+	if _, err := TestAuthService.ExchangeOAuthCode(code); err == nil {
+		t.Error("Expected an error exchanging a code twice, but got none")
+	}
+
+	expired, err := TestAuthService.StoreOAuthToken("expired")
+	if err != nil {
+		t.Fatalf("StoreOAuthToken returned an error: %v", err)
+	}
+
+	TestAuthService.DB.Model(&models.OAuthCode{}).Where("code = ?", expired).Update("expires_at", time.Now().Add(-time.Minute))
+
+	if _, err := TestAuthService.ExchangeOAuthCode(expired); err == nil || err.Error() != "code_expired" {
+		t.Errorf("ExchangeOAuthCode() error = %v, want code_expired", err)
+	}
+
+	if err := TestAuthService.CleanupOAuthCodes(); err != nil {
+		t.Errorf("CleanupOAuthCodes returned an error: %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	BuildEventQueued   = "queued"
+	BuildEventStarted  = "started"
+	BuildEventPhase    = "phase"
+	BuildEventLog      = "log"
+	BuildEventFinished = "finished"
+)
+
+// buildEventBuffer is how many events a slow subscriber may fall behind
+// before further events are dropped for it.
+const buildEventBuffer = 256
+
+type BuildEvent struct {
+	Type            string    `json:"type"`
+	DocumentationID uint      `json:"documentationId"`
+	RunID           uint      `json:"runId,omitempty"`
+	Phase           string    `json:"phase,omitempty"`
+	Status          string    `json:"status,omitempty"`
+	Line            string    `json:"line,omitempty"`
+	Error           string    `json:"error,omitempty"`
+	Time            time.Time `json:"time"`
+}
+
+// buildEventBus fans out build events to the subscribers of a root
+// documentation. Publishing never blocks a build.
+type buildEventBus struct {
+	mu          sync.RWMutex
+	subscribers map[uint]map[chan BuildEvent]struct{}
+}
+
+func newBuildEventBus() *buildEventBus {
+	return &buildEventBus{subscribers: make(map[uint]map[chan BuildEvent]struct{})}
+}
+
+func (bus *buildEventBus) subscribe(docId uint) (chan BuildEvent, func()) {
+	events := make(chan BuildEvent, buildEventBuffer)
+
+	bus.mu.Lock()
+	if bus.subscribers[docId] == nil {
+		bus.subscribers[docId] = make(map[chan BuildEvent]struct{})
+	}
+	bus.subscribers[docId][events] = struct{}{}
+	bus.mu.Unlock()
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			bus.mu.Lock()
+			delete(bus.subscribers[docId], events)
+			if len(bus.subscribers[docId]) == 0 {
+				delete(bus.subscribers, docId)
+			}
+			bus.mu.Unlock()
+		})
+	}
+
+	return events, unsubscribe
+}
+
+func (bus *buildEventBus) publish(event BuildEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	bus.mu.RLock()
+	defer bus.mu.RUnlock()
+
+	for events := range bus.subscribers[event.DocumentationID] {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+// SubscribeBuildEvents streams the build events of a documentation and its
+// versions until the returned function is called.
+func (service *DocService) SubscribeBuildEvents(docId uint) (<-chan BuildEvent, func(), error) {
+	rootId, err := service.GetRootParentID(docId)
+	if err != nil {
+		return nil, nil, fmt.Errorf("documentation_not_found")
+	}
+
+	events, unsubscribe := service.buildEvents.subscribe(rootId)
+	return events, unsubscribe, nil
+}
+
+// lineWriter splits build output into lines for log events, holding back a
+// trailing partial line until it is completed.
+type lineWriter struct {
+	partial strings.Builder
+	emit    func(line string)
+}
+
+func (lw *lineWriter) Write(p []byte) (int, error) {
+	data := string(p)
+
+	for {
+		index := strings.IndexByte(data, '\n')
+		if index == -1 {
+			lw.partial.WriteString(data)
+			return len(p), nil
+		}
+
+		lw.partial.WriteString(data[:index])
+		lw.emit(strings.TrimRight(lw.partial.String(), "\r"))
+		lw.partial.Reset()
+		data = data[index+1:]
+	}
+}
+
+func (lw *lineWriter) flush() {
+	if lw.partial.Len() > 0 {
+		lw.emit(lw.partial.String())
+		lw.partial.Reset()
+	}
+}
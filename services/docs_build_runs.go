@@ -0,0 +1,464 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"git.difuse.io/Difuse/kalmia/db/models"
+	"git.difuse.io/Difuse/kalmia/logger"
+	"git.difuse.io/Difuse/kalmia/metrics"
+	"git.difuse.io/Difuse/kalmia/tracing"
+	"git.difuse.io/Difuse/kalmia/utils"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+const buildRunsToKeep = 50
+
+// Build output is stored in chunks of at most buildLogChunkSize bytes, and
+// at the latest buildLogFlushInterval after it was written so that it can be
+// followed from any instance.
+const (
+	buildLogChunkSize     = 64 << 10
+	buildLogFlushInterval = 500 * time.Millisecond
+)
+
+const (
+	BuildPhaseWrite     = "write"
+	BuildPhaseInstall   = "install"
+	BuildPhaseTailwind  = "tailwind"
+	BuildPhaseBuild     = "rspress_build"
+	BuildPhaseUpload    = "upload"
+	BuildPhaseGitDeploy = "git_deploy"
+)
+
+type buildRecorderKey struct{}
+
+// buildRecorder stores the phases and output of a running build. It travels
+// in the build context so that the build steps can report to it; all of its
+// methods are no-ops on a nil recorder.
+type buildRecorder struct {
+	service *DocService
+	run     *models.BuildRun
+	lines   *lineWriter // nil once the log is closed
+	phase   *models.BuildRunPhase
+	mu      sync.Mutex
+
+	log       []byte // output not stored yet
+	logOffset int64  // length of the stored output
+	logTimer  *time.Timer
+
+	span      trace.Span // of the build, set by claimBuild
+	phaseSpan trace.Span
+}
+
+func withBuildRecorder(ctx context.Context, recorder *buildRecorder) context.Context {
+	return context.WithValue(ctx, buildRecorderKey{}, recorder)
+}
+
+func buildRecorderFrom(ctx context.Context) *buildRecorder {
+	recorder, _ := ctx.Value(buildRecorderKey{}).(*buildRecorder)
+	return recorder
+}
+
+func (r *buildRecorder) Write(p []byte) (int, error) {
+	if r == nil {
+		return len(p), nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.lines == nil {
+		return len(p), nil
+	}
+
+	r.lines.Write(p)
+	r.log = append(r.log, p...)
+
+	if len(r.log) >= buildLogChunkSize {
+		r.flushLog()
+	} else if r.logTimer == nil {
+		r.logTimer = time.AfterFunc(buildLogFlushInterval, func() {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			r.flushLog()
+		})
+	}
+
+	return len(p), nil
+}
+
+// flushLog stores the output written since the last flush. Output that
+// cannot be stored is kept for the next flush. r.mu must be held.
+func (r *buildRecorder) flushLog() {
+	if r.logTimer != nil {
+		r.logTimer.Stop()
+		r.logTimer = nil
+	}
+
+	if len(r.log) == 0 {
+		return
+	}
+
+	chunk := models.BuildRunLog{
+		BuildRunID:  r.run.ID,
+		StartOffset: r.logOffset,
+		EndOffset:   r.logOffset + int64(len(r.log)),
+		Data:        r.log,
+	}
+	if err := r.service.DB.Create(&chunk).Error; err != nil {
+		logger.Error("Failed to store build log", zap.Uint("run_id", r.run.ID), zap.Error(err))
+		return
+	}
+
+	r.log = nil
+	r.logOffset = chunk.EndOffset
+}
+
+func (r *buildRecorder) publish(event BuildEvent) {
+	event.DocumentationID = r.run.DocumentationID
+	event.RunID = r.run.ID
+	r.service.buildEvents.publish(event)
+}
+
+// output returns the writer build commands should copy their output to.
+func (r *buildRecorder) output() io.Writer {
+	if r == nil {
+		return nil
+	}
+
+	return r
+}
+
+func (r *buildRecorder) logf(format string, args ...interface{}) {
+	if r == nil {
+		return
+	}
+
+	fmt.Fprintf(r, "[%s] %s\n", time.Now().UTC().Format(time.RFC3339), fmt.Sprintf(format, args...))
+}
+
+// runID returns the id of the build run being recorded, if any.
+func (r *buildRecorder) runID() *uint {
+	if r == nil || r.run == nil {
+		return nil
+	}
+
+	return &r.run.ID
+}
+
+// manual reports whether the build being recorded was started by hand.
+func (r *buildRecorder) manual() bool {
+	return r != nil && r.run != nil && r.run.Manual
+}
+
+// startPhase ends the current phase successfully and starts the next one.
+// It returns ctx with the span of the phase, for the work done in it.
+func (r *buildRecorder) startPhase(ctx context.Context, name string) context.Context {
+	if r == nil {
+		return ctx
+	}
+
+	r.endPhase(models.BuildRunSucceeded)
+
+	phase := &models.BuildRunPhase{
+		BuildRunID: r.run.ID,
+		Name:       name,
+		Status:     models.BuildRunRunning,
+		StartedAt:  utils.TimePtr(time.Now()),
+	}
+
+	if err := r.service.DB.Create(phase).Error; err != nil {
+		logger.Error("Failed to save build phase", zap.Uint("run_id", r.run.ID), zap.Error(err))
+		return ctx
+	}
+
+	r.phase = phase
+	r.publish(BuildEvent{Type: BuildEventPhase, Phase: name, Status: models.BuildRunRunning})
+	r.logf("Phase %s started", name)
+
+	// Phases are children of the build, not of the phase before them
+	_, r.phaseSpan = tracing.Start(trace.ContextWithSpan(ctx, r.span), "build phase "+name,
+		attribute.String("kalmia.build.phase", name))
+
+	return trace.ContextWithSpan(ctx, r.phaseSpan)
+}
+
+func (r *buildRecorder) endPhase(status string) {
+	if r == nil || r.phase == nil {
+		return
+	}
+
+	phase := r.phase
+	r.phase = nil
+
+	finishedAt := time.Now()
+	duration := finishedAt.Sub(*phase.StartedAt)
+
+	if err := r.service.DB.Model(phase).Updates(map[string]interface{}{
+		"status":      status,
+		"finished_at": finishedAt,
+		"duration_ms": duration.Milliseconds(),
+	}).Error; err != nil {
+		logger.Error("Failed to save build phase", zap.Uint("run_id", r.run.ID), zap.Error(err))
+	}
+
+	metrics.BuildPhaseDuration.WithLabelValues(phase.Name, status).Observe(duration.Seconds())
+
+	if r.phaseSpan != nil {
+		r.phaseSpan.SetAttributes(attribute.String("kalmia.build.status", status))
+		if status != models.BuildRunSucceeded {
+			r.phaseSpan.SetStatus(codes.Error, status)
+		}
+		r.phaseSpan.End()
+		r.phaseSpan = nil
+	}
+
+	r.publish(BuildEvent{Type: BuildEventPhase, Phase: phase.Name, Status: status})
+	r.logf("Phase %s %s in %s", phase.Name, status, duration.Round(time.Millisecond))
+}
+
+// finish records the outcome of the build and closes its log.
+func (r *buildRecorder) finish(status string, buildErr error) {
+	if r == nil {
+		return
+	}
+
+	r.endPhase(status)
+
+	updates := map[string]interface{}{
+		"status":      status,
+		"finished_at": time.Now(),
+	}
+
+	var commandErr *utils.CommandError
+	if errors.As(buildErr, &commandErr) {
+		updates["exit_code"] = commandErr.ExitCode
+	} else if buildErr == nil {
+		updates["exit_code"] = 0
+	}
+
+	if buildErr != nil {
+		updates["error"] = buildErr.Error()
+		r.logf("Build %s: %v", status, buildErr)
+	} else {
+		r.logf("Build %s", status)
+	}
+
+	// The whole log is stored before the run reads as finished
+	r.mu.Lock()
+	if r.lines != nil {
+		r.lines.flush()
+		r.lines = nil
+		r.flushLog()
+	}
+	r.mu.Unlock()
+
+	if err := r.service.DB.Model(&models.BuildRun{}).Where("id = ?", r.run.ID).Updates(updates).Error; err != nil {
+		logger.Error("Failed to save build run", zap.Uint("run_id", r.run.ID), zap.Error(err))
+	}
+
+	event := BuildEvent{Type: BuildEventFinished, Status: status}
+	if buildErr != nil {
+		event.Error = buildErr.Error()
+	}
+	r.publish(event)
+
+	r.service.pruneBuildRuns(r.run.DocumentationID)
+}
+
+// queueBuildRun makes sure a documentation has a queued build run to show
+// for its pending triggers.
+func (service *DocService) queueBuildRun(docId uint, manual bool) error {
+	var run models.BuildRun
+	err := service.DB.Where("documentation_id = ? AND status = ?", docId, models.BuildRunQueued).First(&run).Error
+	if err == nil {
+		if manual && !run.Manual {
+			return service.DB.Model(&run).Update("manual", true).Error
+		}
+		return nil
+	}
+
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+
+	run = models.BuildRun{
+		DocumentationID: docId,
+		Status:          models.BuildRunQueued,
+		Manual:          manual,
+	}
+	if err := service.DB.Create(&run).Error; err != nil {
+		return err
+	}
+
+	service.buildEvents.publish(BuildEvent{
+		Type:            BuildEventQueued,
+		DocumentationID: docId,
+		RunID:           run.ID,
+		Status:          models.BuildRunQueued,
+	})
+
+	return nil
+}
+
+// startBuildRun moves the queued run of a documentation to running and starts
+// its log.
+func (service *DocService) startBuildRun(docId uint, manual bool) (*buildRecorder, error) {
+	var run models.BuildRun
+	err := service.DB.Where("documentation_id = ? AND status = ?", docId, models.BuildRunQueued).
+		Order("id ASC").First(&run).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		run = models.BuildRun{DocumentationID: docId, Manual: manual}
+		err = service.DB.Create(&run).Error
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	run.Status = models.BuildRunRunning
+	run.StartedAt = utils.TimePtr(time.Now())
+	run.Instance = instanceID()
+	if err := service.DB.Model(&run).Updates(map[string]interface{}{
+		"status":     run.Status,
+		"started_at": run.StartedAt,
+		"instance":   run.Instance,
+	}).Error; err != nil {
+		return nil, err
+	}
+
+	if err := service.DB.Where("build_run_id = ?", run.ID).Delete(&models.BuildRunLog{}).Error; err != nil {
+		return nil, err
+	}
+
+	recorder := &buildRecorder{service: service, run: &run}
+	recorder.lines = &lineWriter{emit: func(line string) {
+		recorder.publish(BuildEvent{Type: BuildEventLog, Line: line})
+	}}
+
+	recorder.publish(BuildEvent{Type: BuildEventStarted, Status: models.BuildRunRunning})
+	recorder.logf("Build %d of documentation %d started", run.ID, docId)
+
+	return recorder, nil
+}
+
+// requeueInterruptedBuildRuns marks the runs cut short by a restart as
+// failed. Their triggers are queued again and get a new run.
+func (service *DocService) requeueInterruptedBuildRuns() error {
+	query := service.DB.Model(&models.BuildRun{}).Where("status = ?", models.BuildRunRunning)
+	if clusterEnabled() {
+		query = query.Where("instance = ?", instanceID())
+	}
+
+	return query.
+		Updates(map[string]interface{}{
+			"status":      models.BuildRunFailed,
+			"error":       "interrupted_by_restart",
+			"finished_at": time.Now(),
+		}).Error
+}
+
+func (service *DocService) pruneBuildRuns(docId uint) {
+	var ids []uint
+	if err := service.DB.Model(&models.BuildRun{}).
+		Where("documentation_id = ? AND status NOT IN ?", docId, []string{models.BuildRunQueued, models.BuildRunRunning}).
+		Order("id DESC").Offset(buildRunsToKeep).Pluck("id", &ids).Error; err != nil || len(ids) == 0 {
+		return
+	}
+
+	if err := service.DB.Where("build_run_id IN ?", ids).Delete(&models.BuildRunLog{}).Error; err != nil {
+		logger.Error("Failed to prune build logs", zap.Uint("doc_id", docId), zap.Error(err))
+		return
+	}
+
+	if err := service.DB.Where("build_run_id IN ?", ids).Delete(&models.BuildRunPhase{}).Error; err != nil {
+		logger.Error("Failed to prune build phases", zap.Uint("doc_id", docId), zap.Error(err))
+		return
+	}
+
+	if err := service.DB.Where("id IN ?", ids).Delete(&models.BuildRun{}).Error; err != nil {
+		logger.Error("Failed to prune build runs", zap.Uint("doc_id", docId), zap.Error(err))
+	}
+}
+
+func (service *DocService) GetBuildRuns(docId uint) ([]models.BuildRun, error) {
+	rootId, err := service.GetRootParentID(docId)
+	if err != nil {
+		return nil, fmt.Errorf("documentation_not_found")
+	}
+
+	var runs []models.BuildRun
+	if err := service.DB.Preload("Phases", func(db *gorm.DB) *gorm.DB {
+		return db.Order("id ASC")
+	}).Where("documentation_id = ?", rootId).Order("id DESC").Limit(buildRunsToKeep).Find(&runs).Error; err != nil {
+		return nil, fmt.Errorf("failed_to_get_build_runs")
+	}
+
+	return runs, nil
+}
+
+func (service *DocService) GetBuildRun(runId uint) (models.BuildRun, error) {
+	var run models.BuildRun
+	if err := service.DB.Preload("Phases", func(db *gorm.DB) *gorm.DB {
+		return db.Order("id ASC")
+	}).First(&run, runId).Error; err != nil {
+		return models.BuildRun{}, fmt.Errorf("build_run_not_found")
+	}
+
+	return run, nil
+}
+
+// GetBuildLog returns the log of a build run from offset on, the offset to
+// continue from and whether the run has finished, so that the log can be
+// followed while the build is running.
+func (service *DocService) GetBuildLog(runId uint, offset int64) (string, int64, bool, error) {
+	run, err := service.GetBuildRun(runId)
+	if err != nil {
+		return "", offset, false, err
+	}
+
+	finished := run.Status != models.BuildRunQueued && run.Status != models.BuildRunRunning
+
+	var chunks []models.BuildRunLog
+	if err := service.DB.Where("build_run_id = ? AND end_offset > ?", runId, offset).
+		Order("start_offset ASC").Find(&chunks).Error; err != nil {
+		return "", offset, finished, fmt.Errorf("failed_to_read_build_log")
+	}
+
+	var data []byte
+	for _, chunk := range chunks {
+		if skip := offset - chunk.StartOffset; skip > 0 {
+			chunk.Data = chunk.Data[min(skip, int64(len(chunk.Data))):]
+		}
+		data = append(data, chunk.Data...)
+	}
+
+	return string(data), offset + int64(len(data)), finished, nil
+}
+
+// RetryBuild queues a failed or cancelled build again, ahead of automatic
+// builds.
+func (service *DocService) RetryBuild(runId uint) error {
+	run, err := service.GetBuildRun(runId)
+	if err != nil {
+		return err
+	}
+
+	if run.Status != models.BuildRunFailed && run.Status != models.BuildRunCanceled {
+		return fmt.Errorf("build_run_not_retryable")
+	}
+
+	if !service.IsDocIdValid(run.DocumentationID) {
+		return fmt.Errorf("invalid_documentation_id")
+	}
+
+	return service.AddBuildTrigger(run.DocumentationID, false, true)
+}
@@ -0,0 +1,373 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"git.difuse.io/Difuse/kalmia/config"
+	"git.difuse.io/Difuse/kalmia/db/models"
+	"git.difuse.io/Difuse/kalmia/logger"
+	"git.difuse.io/Difuse/kalmia/metrics"
+	"git.difuse.io/Difuse/kalmia/tracing"
+	"git.difuse.io/Difuse/kalmia/utils"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+const buildPollInterval = 10 * time.Second
+
+// errBuildInterrupted is recorded for the builds cancelled by Shutdown.
+var errBuildInterrupted = errors.New("interrupted_by_shutdown")
+
+// buildQueue tracks the builds running in this process. Pending builds are
+// the untriggered rows of build_triggers, so they survive restarts.
+type buildQueue struct {
+	mu      sync.Mutex
+	running map[uint]*runningBuild
+	wake    chan struct{}
+}
+
+type runningBuild struct {
+	cancel     context.CancelFunc
+	superseded bool
+}
+
+type buildJob struct {
+	ctx      context.Context
+	docId    uint
+	triggers []models.BuildTriggers
+	recorder *buildRecorder
+	started  time.Time
+	span     trace.Span
+}
+
+func newBuildQueue() *buildQueue {
+	return &buildQueue{
+		running: make(map[uint]*runningBuild),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// notify wakes up an idle worker without waiting for the next poll.
+func (q *buildQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *buildQueue) isRunning(docId uint) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	_, ok := q.running[docId]
+	return ok
+}
+
+// supersede cancels the running build of docId, if any, for a manual
+// trigger. The trigger is picked up once the cancelled build has stopped.
+func (q *buildQueue) supersede(docId uint) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if build, ok := q.running[docId]; ok && !build.superseded {
+		build.superseded = true
+		build.cancel()
+	}
+}
+
+// StartBuildQueue starts the build workers and the loop running the
+// periodic delete and git sync jobs. At most one build runs per root
+// documentation at a time and manual triggers are built first. The workers
+// stop claiming builds once ctx is done, see Shutdown.
+func (service *DocService) StartBuildQueue(ctx context.Context, workers int) {
+	if err := service.requeueInterruptedBuilds(); err != nil {
+		logger.Error("Failed to requeue interrupted builds", zap.Error(err))
+	}
+
+	if err := service.requeueInterruptedBuildRuns(); err != nil {
+		logger.Error("Failed to update interrupted build runs", zap.Error(err))
+	}
+
+	for i := 0; i < workers; i++ {
+		service.background.Go(func() { service.buildWorker(ctx) })
+	}
+
+	service.background.Go(func() {
+		for {
+			if service.isLeader() {
+				service.DeleteJob()
+				service.GitSyncJob(ctx)
+			}
+			service.builds.notify()
+
+			if !sleepContext(ctx, buildPollInterval) {
+				return
+			}
+		}
+	})
+
+	logger.Info("Build queue started", zap.Int("workers", workers))
+}
+
+// requeueInterruptedBuilds puts back the builds that were running when the
+// process stopped. In cluster mode, only the ones of this instance are, the
+// leader puts back the ones of instances that are gone.
+func (service *DocService) requeueInterruptedBuilds() error {
+	query := service.DB.Model(&models.BuildTriggers{}).
+		Where("triggered = ? AND status = ?", false, models.BuildTriggerRunning)
+	if clusterEnabled() {
+		query = query.Where("claimed_by = ?", instanceID())
+	}
+
+	return query.Update("status", models.BuildTriggerPending).Error
+}
+
+func (service *DocService) buildWorker(ctx context.Context) {
+	for ctx.Err() == nil {
+		job, err := service.claimBuild()
+		if err != nil {
+			logger.Error("Failed to claim build", zap.Error(err))
+		}
+
+		if job == nil {
+			select {
+			case <-ctx.Done():
+			case <-service.builds.wake:
+			case <-time.After(buildPollInterval):
+			}
+			continue
+		}
+
+		service.runBuild(job)
+	}
+}
+
+// claimBuild takes the highest priority pending build whose documentation
+// is not already being built, here or by another instance, together with
+// every other pending trigger of that documentation. It returns nil when
+// there is nothing to build.
+func (service *DocService) claimBuild() (*buildJob, error) {
+	q := service.builds
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var triggers []models.BuildTriggers
+	if err := service.DB.
+		Where("triggered = ? AND is_delete = ? AND status IN ?", false, false, []string{"", models.BuildTriggerPending}).
+		Order("manual DESC, created_at ASC, id ASC").
+		Find(&triggers).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch build triggers: %w", err)
+	}
+
+	var docIds []uint
+	byDoc := make(map[uint][]models.BuildTriggers)
+	var skipped []uint
+
+	for _, trigger := range triggers {
+		if _, busy := q.running[trigger.DocumentationID]; busy {
+			continue
+		}
+
+		if _, seen := byDoc[trigger.DocumentationID]; !seen {
+			// Versions are built with their root documentation, which gets
+			// its own trigger
+			if !service.IsDocIdValid(trigger.DocumentationID) {
+				skipped = append(skipped, trigger.ID)
+				continue
+			}
+
+			docIds = append(docIds, trigger.DocumentationID)
+		}
+
+		byDoc[trigger.DocumentationID] = append(byDoc[trigger.DocumentationID], trigger)
+	}
+
+	if len(skipped) > 0 {
+		if err := service.DB.Model(&models.BuildTriggers{}).Where("id IN ?", skipped).Updates(map[string]interface{}{
+			"triggered":    true,
+			"status":       models.BuildTriggerSuperseded,
+			"completed_at": time.Now(),
+		}).Error; err != nil {
+			logger.Error("Failed to skip build triggers", zap.Error(err))
+		}
+	}
+
+	var docId uint
+	var claimed []models.BuildTriggers
+
+	for _, candidate := range docIds {
+		var err error
+		claimed, err = service.claimTriggers(candidate, byDoc[candidate])
+		if err != nil {
+			return nil, err
+		}
+
+		if len(claimed) > 0 {
+			docId = candidate
+			break
+		}
+	}
+
+	if docId == 0 {
+		return nil, nil
+	}
+
+	manual := false
+	for _, trigger := range claimed {
+		manual = manual || trigger.Manual
+	}
+
+	recorder, err := service.startBuildRun(docId, manual)
+	if err != nil {
+		logger.Error("Failed to start build run", zap.Uint("doc_id", docId), zap.Error(err))
+	}
+
+	ctx, cancel := context.WithCancel(service.buildCtx)
+	ctx, span := tracing.Start(ctx, "build",
+		attribute.Int64("kalmia.documentation.id", int64(docId)),
+		attribute.Bool("kalmia.build.manual", manual),
+		attribute.Int("kalmia.build.triggers", len(claimed)),
+	)
+	if recorder != nil {
+		recorder.span = span
+		span.SetAttributes(attribute.Int64("kalmia.build.run_id", int64(recorder.run.ID)))
+	}
+
+	ctx = withBuildRecorder(ctx, recorder)
+	q.running[docId] = &runningBuild{cancel: cancel}
+
+	return &buildJob{ctx: ctx, docId: docId, triggers: claimed, recorder: recorder, started: time.Now(), span: span}, nil
+}
+
+// finishBuild records the outcome of a claimed build and releases its
+// documentation for the next one.
+func (service *DocService) finishBuild(job *buildJob, buildErr error) {
+	q := service.builds
+	q.mu.Lock()
+	build := q.running[job.docId]
+	delete(q.running, job.docId)
+	q.mu.Unlock()
+
+	status, runStatus := models.BuildTriggerCompleted, models.BuildRunSucceeded
+	if build != nil && build.superseded && errors.Is(buildErr, context.Canceled) {
+		status, runStatus = models.BuildTriggerSuperseded, models.BuildRunCanceled
+	} else if errors.Is(buildErr, context.Canceled) && service.buildsInterrupted() {
+		// The triggers are built again on the next start
+		status, runStatus = models.BuildTriggerPending, models.BuildRunCanceled
+		buildErr = errBuildInterrupted
+	} else if buildErr != nil {
+		status, runStatus = models.BuildTriggerFailed, models.BuildRunFailed
+	}
+
+	job.recorder.finish(runStatus, buildErr)
+	metrics.BuildDuration.WithLabelValues(runStatus).Observe(time.Since(job.started).Seconds())
+
+	job.span.SetAttributes(attribute.String("kalmia.build.status", runStatus))
+	tracing.End(job.span, buildErr)
+
+	if runStatus == models.BuildRunSucceeded || runStatus == models.BuildRunFailed {
+		event := WebhookEventBuildSucceeded
+		data := map[string]interface{}{"triggerCount": len(job.triggers)}
+		if job.recorder != nil {
+			data["runId"] = job.recorder.run.ID
+		}
+		if buildErr != nil {
+			event = WebhookEventBuildFailed
+			data["error"] = buildErr.Error()
+		}
+
+		service.EmitWebhookEvent(job.docId, event, data)
+	}
+
+	if build != nil {
+		build.cancel()
+	}
+
+	ids := make([]uint, 0, len(job.triggers))
+	for _, trigger := range job.triggers {
+		ids = append(ids, trigger.ID)
+	}
+
+	updates := map[string]interface{}{
+		"triggered":    true,
+		"status":       status,
+		"completed_at": time.Now(),
+	}
+	if status == models.BuildTriggerPending {
+		updates = map[string]interface{}{"status": status, "claimed_by": ""}
+	}
+
+	if err := service.DB.Model(&models.BuildTriggers{}).Where("id IN ?", ids).Updates(updates).Error; err != nil {
+		logger.Error("Failed to save build triggers",
+			zap.Uint("doc_id", job.docId),
+			zap.Error(err),
+			zap.Int("trigger_count", len(job.triggers)))
+	}
+
+	q.notify()
+}
+
+func (service *DocService) runBuild(job *buildJob) {
+	docID := job.docId
+
+	service.gitSyncForBuild(job.ctx, docID)
+
+	start := time.Now()
+	err := service.UpdateWriteBuild(job.ctx, docID)
+	elapsed := time.Since(start)
+
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			logger.InfoContext(job.ctx, "RsPress Build cancelled", zap.Uint("doc_id", docID), zap.Duration("elapsed", elapsed))
+
+			// The output of a killed build is incomplete
+			tmpBuildPath := filepath.Join(utils.GetDocPathByID(docID, config.ParsedConfig), "build_tmp")
+			if removeErr := utils.RemovePath(tmpBuildPath); removeErr != nil {
+				logger.ErrorContext(job.ctx, "Failed to remove cancelled build output", zap.Uint("doc_id", docID), zap.Error(removeErr))
+			}
+		} else {
+			logger.ErrorContext(job.ctx, "Failed to update write build",
+				zap.Uint("doc_id", docID),
+				zap.Error(err),
+				zap.Duration("elapsed", elapsed),
+				zap.Int("trigger_count", len(job.triggers)))
+		}
+
+		service.finishBuild(job, err)
+		return
+	}
+
+	logger.InfoContext(job.ctx, "RsPress Build completed",
+		zap.Uint("doc_id", docID),
+		zap.Duration("elapsed", elapsed),
+		zap.Int("trigger_count", len(job.triggers)))
+
+	gitTime := time.Now()
+	err = service.GitDeploy(job.ctx, docID)
+	gitElapsed := time.Since(gitTime)
+
+	if err != nil {
+		logger.ErrorContext(job.ctx, "Failed to deploy to git", zap.Error(err))
+	} else {
+		logger.InfoContext(job.ctx, "Git Deploy completed", zap.Uint("doc_id", docID), zap.Duration("elapsed", gitElapsed), zap.Int("trigger_count", len(job.triggers)))
+	}
+	logger.InfoContext(job.ctx, fmt.Sprintf("moving static assets to docs in doc_%d", docID))
+
+	docPath := utils.GetDocPathByID(docID, config.ParsedConfig)
+	docPublicAssetPath := filepath.Join(docPath, "public")
+	docsInternalPublicAssetPath := filepath.Join(docPath, "docs", "public")
+	if copyErr := utils.CopyOrOveriteDir(docPublicAssetPath, docsInternalPublicAssetPath); copyErr != nil {
+		logger.ErrorContext(job.ctx, fmt.Sprintf("error copying files from %s to %s", docPublicAssetPath, docsInternalPublicAssetPath), zap.Error(copyErr))
+	} else {
+		logger.InfoContext(job.ctx, "successfully copied files to target", zap.Uint("doc_id", docID))
+	}
+
+	// The site is live by now, a failed deploy is only recorded in its phase
+	service.finishBuild(job, nil)
+}
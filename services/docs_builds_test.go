@@ -0,0 +1,465 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"git.difuse.io/Difuse/kalmia/db/models"
+	"git.difuse.io/Difuse/kalmia/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestBuildQueue(t *testing.T) {
+	// Leave only the triggers created by this test in the queue
+	require.NoError(t, TestDocService.DB.Model(&models.BuildTriggers{}).
+		Where("triggered = ?", false).Update("triggered", true).Error)
+
+	docA := models.Documentation{Name: "Queue A", Version: "1.0.0", BaseURL: "/queue-a", AuthorID: 1}
+	require.NoError(t, TestDocService.DB.Create(&docA).Error)
+	docB := models.Documentation{Name: "Queue B", Version: "1.0.0", BaseURL: "/queue-b", AuthorID: 1}
+	require.NoError(t, TestDocService.DB.Create(&docB).Error)
+
+	triggerStatus := func(docId uint) []string {
+		var statuses []string
+		TestDocService.DB.Model(&models.BuildTriggers{}).Where("documentation_id = ?", docId).
+			Order("id").Pluck("status", &statuses)
+		return statuses
+	}
+
+	require.NoError(t, TestDocService.AddBuildTrigger(docA.ID, false))
+	require.NoError(t, TestDocService.AddBuildTrigger(docA.ID, false))
+	require.NoError(t, TestDocService.AddBuildTrigger(docB.ID, false, true))
+
+	var jobA, jobB *buildJob
+
+	t.Run("Manual builds first", func(t *testing.T) {
+		var err error
+		jobB, err = TestDocService.claimBuild()
+		require.NoError(t, err)
+		require.NotNil(t, jobB)
+		assert.Equal(t, docB.ID, jobB.docId)
+
+		jobA, err = TestDocService.claimBuild()
+		require.NoError(t, err)
+		require.NotNil(t, jobA)
+		assert.Equal(t, docA.ID, jobA.docId)
+		assert.Len(t, jobA.triggers, 2)
+		assert.Equal(t, []string{models.BuildTriggerRunning, models.BuildTriggerRunning}, triggerStatus(docA.ID))
+	})
+
+	t.Run("One build per documentation", func(t *testing.T) {
+		require.NoError(t, TestDocService.AddBuildTrigger(docA.ID, false))
+
+		job, err := TestDocService.claimBuild()
+		require.NoError(t, err)
+		assert.Nil(t, job)
+	})
+
+	t.Run("New trigger waits for the running build", func(t *testing.T) {
+		assert.NoError(t, jobA.ctx.Err())
+		assert.NoError(t, jobB.ctx.Err())
+	})
+
+	t.Run("Manual trigger supersedes the running build", func(t *testing.T) {
+		require.NoError(t, TestDocService.AddBuildTrigger(docA.ID, false, true))
+		assert.ErrorIs(t, jobA.ctx.Err(), context.Canceled)
+		assert.NoError(t, jobB.ctx.Err())
+
+		TestDocService.finishBuild(jobA, jobA.ctx.Err())
+		assert.Equal(t, []string{
+			models.BuildTriggerSuperseded,
+			models.BuildTriggerSuperseded,
+			models.BuildTriggerPending,
+			models.BuildTriggerPending,
+		}, triggerStatus(docA.ID))
+
+		job, err := TestDocService.claimBuild()
+		require.NoError(t, err)
+		require.NotNil(t, job)
+		assert.Equal(t, docA.ID, job.docId)
+		assert.Len(t, job.triggers, 2)
+
+		TestDocService.finishBuild(job, errors.New("build failed"))
+		assert.Equal(t, models.BuildTriggerFailed, triggerStatus(docA.ID)[2])
+		assert.Equal(t, models.BuildTriggerFailed, triggerStatus(docA.ID)[3])
+	})
+
+	t.Run("Interrupted builds are requeued", func(t *testing.T) {
+		require.NoError(t, TestDocService.requeueInterruptedBuilds())
+		assert.Equal(t, []string{models.BuildTriggerPending}, triggerStatus(docB.ID))
+
+		TestDocService.builds.mu.Lock()
+		delete(TestDocService.builds.running, docB.ID)
+		TestDocService.builds.mu.Unlock()
+
+		job, err := TestDocService.claimBuild()
+		require.NoError(t, err)
+		require.NotNil(t, job)
+		assert.Equal(t, docB.ID, job.docId)
+
+		TestDocService.finishBuild(job, nil)
+		assert.Equal(t, []string{models.BuildTriggerCompleted}, triggerStatus(docB.ID))
+	})
+}
+
+func TestBuildRuns(t *testing.T) {
+	require.NoError(t, TestDocService.DB.Model(&models.BuildTriggers{}).
+		Where("triggered = ?", false).Update("triggered", true).Error)
+
+	spans := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans))
+	otel.SetTracerProvider(provider)
+	defer func() {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		provider.Shutdown(context.Background())
+	}()
+
+	doc := models.Documentation{Name: "Build Runs", Version: "1.0.0", BaseURL: "/build-runs", AuthorID: 1}
+	require.NoError(t, TestDocService.DB.Create(&doc).Error)
+
+	require.NoError(t, TestDocService.AddBuildTrigger(doc.ID, false))
+	require.NoError(t, TestDocService.AddBuildTrigger(doc.ID, false))
+
+	runs, err := TestDocService.GetBuildRuns(doc.ID)
+	require.NoError(t, err)
+	require.Len(t, runs, 1)
+	assert.Equal(t, models.BuildRunQueued, runs[0].Status)
+
+	job, err := TestDocService.claimBuild()
+	require.NoError(t, err)
+	require.NotNil(t, job)
+	require.NotNil(t, job.recorder)
+	assert.Equal(t, runs[0].ID, job.recorder.run.ID)
+
+	recorder := buildRecorderFrom(job.ctx)
+	recorder.startPhase(job.ctx, BuildPhaseWrite)
+	recorder.startPhase(job.ctx, BuildPhaseInstall)
+	_, err = recorder.output().Write([]byte("ERR_PNPM_FETCH_404\n"))
+	require.NoError(t, err)
+
+	t.Run("Log can be followed while running", func(t *testing.T) {
+		var log string
+		var offset int64
+		var finished bool
+		require.Eventually(t, func() bool {
+			log, offset, finished, err = TestDocService.GetBuildLog(runs[0].ID, 0)
+			return err == nil && strings.Contains(log, "ERR_PNPM_FETCH_404")
+		}, 5*time.Second, 50*time.Millisecond)
+		assert.False(t, finished)
+
+		tail, _, _, err := TestDocService.GetBuildLog(runs[0].ID, offset-int64(len("ERR_PNPM_FETCH_404\n")))
+		require.NoError(t, err)
+		assert.Equal(t, "ERR_PNPM_FETCH_404\n", tail)
+
+		log, _, _, err = TestDocService.GetBuildLog(runs[0].ID, offset)
+		require.NoError(t, err)
+		assert.Empty(t, log)
+	})
+
+	TestDocService.finishBuild(job, &utils.CommandError{Tool: "npm", Command: "install", Retries: 3, ExitCode: 1})
+
+	t.Run("Failed run is recorded", func(t *testing.T) {
+		run, err := TestDocService.GetBuildRun(runs[0].ID)
+		require.NoError(t, err)
+		assert.Equal(t, models.BuildRunFailed, run.Status)
+		require.NotNil(t, run.ExitCode)
+		assert.Equal(t, 1, *run.ExitCode)
+		assert.Contains(t, run.Error, "npm command 'install' failed")
+
+		require.Len(t, run.Phases, 2)
+		assert.Equal(t, BuildPhaseWrite, run.Phases[0].Name)
+		assert.Equal(t, models.BuildRunSucceeded, run.Phases[0].Status)
+		assert.Equal(t, BuildPhaseInstall, run.Phases[1].Name)
+		assert.Equal(t, models.BuildRunFailed, run.Phases[1].Status)
+		assert.NotNil(t, run.Phases[1].FinishedAt)
+
+		log, _, finished, err := TestDocService.GetBuildLog(run.ID, 0)
+		require.NoError(t, err)
+		assert.True(t, finished)
+		assert.Contains(t, log, "Build failed")
+	})
+
+	t.Run("Build and its phases are traced", func(t *testing.T) {
+		statuses := map[string]codes.Code{}
+		var build sdktrace.ReadOnlySpan
+		for _, span := range spans.Ended() {
+			statuses[span.Name()] = span.Status().Code
+			if span.Name() == "build" {
+				build = span
+			}
+		}
+
+		require.NotNil(t, build)
+		require.Contains(t, statuses, "build phase "+BuildPhaseWrite)
+		require.Contains(t, statuses, "build phase "+BuildPhaseInstall)
+		assert.Equal(t, codes.Error, build.Status().Code)
+		assert.Equal(t, codes.Unset, statuses["build phase "+BuildPhaseWrite])
+		assert.Equal(t, codes.Error, statuses["build phase "+BuildPhaseInstall])
+
+		for _, span := range spans.Ended() {
+			if span.Name() != "build" {
+				assert.Equal(t, build.SpanContext().SpanID(), span.Parent().SpanID(), span.Name())
+			}
+		}
+	})
+
+	t.Run("Retry a failed run", func(t *testing.T) {
+		require.NoError(t, TestDocService.RetryBuild(runs[0].ID))
+
+		runs, err := TestDocService.GetBuildRuns(doc.ID)
+		require.NoError(t, err)
+		require.Len(t, runs, 2)
+		assert.Equal(t, models.BuildRunQueued, runs[0].Status)
+		assert.True(t, runs[0].Manual)
+
+		assert.Error(t, TestDocService.RetryBuild(runs[0].ID))
+
+		job, err := TestDocService.claimBuild()
+		require.NoError(t, err)
+		require.NotNil(t, job)
+		TestDocService.finishBuild(job, nil)
+
+		run, err := TestDocService.GetBuildRun(runs[0].ID)
+		require.NoError(t, err)
+		assert.Equal(t, models.BuildRunSucceeded, run.Status)
+		assert.Equal(t, 0, *run.ExitCode)
+	})
+}
+
+func TestBuildEvents(t *testing.T) {
+	require.NoError(t, TestDocService.DB.Model(&models.BuildTriggers{}).
+		Where("triggered = ?", false).Update("triggered", true).Error)
+
+	doc := models.Documentation{Name: "Build Events", Version: "1.0.0", BaseURL: "/build-events", AuthorID: 1}
+	require.NoError(t, TestDocService.DB.Create(&doc).Error)
+
+	events, unsubscribe, err := TestDocService.SubscribeBuildEvents(doc.ID)
+	require.NoError(t, err)
+	defer unsubscribe()
+
+	require.NoError(t, TestDocService.AddBuildTrigger(doc.ID, false, true))
+
+	job, err := TestDocService.claimBuild()
+	require.NoError(t, err)
+	require.NotNil(t, job)
+
+	recorder := buildRecorderFrom(job.ctx)
+	recorder.startPhase(context.Background(), BuildPhaseInstall)
+	recorder.output().Write([]byte("Progress: resolved 1"))
+	recorder.output().Write([]byte("0, reused 10\r\nDone\n"))
+	TestDocService.finishBuild(job, nil)
+
+	var received []BuildEvent
+	for len(received) == 0 || received[len(received)-1].Type != BuildEventFinished {
+		select {
+		case event := <-events:
+			assert.Equal(t, doc.ID, event.DocumentationID)
+			received = append(received, event)
+		default:
+			t.Fatalf("missing finished event, got %+v", received)
+		}
+	}
+
+	assert.Equal(t, BuildEventQueued, received[0].Type)
+	assert.Equal(t, BuildEventStarted, received[1].Type)
+	assert.Equal(t, models.BuildRunSucceeded, received[len(received)-1].Status)
+
+	var lines []string
+	var phases []string
+	for _, event := range received {
+		switch event.Type {
+		case BuildEventLog:
+			lines = append(lines, event.Line)
+		case BuildEventPhase:
+			phases = append(phases, event.Phase+":"+event.Status)
+		}
+	}
+
+	assert.Contains(t, lines, "Progress: resolved 10, reused 10")
+	assert.Contains(t, lines, "Done")
+	assert.Equal(t, []string{"install:running", "install:succeeded"}, phases)
+
+	unsubscribe()
+	TestDocService.buildEvents.publish(BuildEvent{Type: BuildEventQueued, DocumentationID: doc.ID})
+	assert.Len(t, events, 0)
+}
+
+func TestIncrementalWrite(t *testing.T) {
+	doc := models.Documentation{Name: "Incremental", Version: "1.0.0", BaseURL: "/incremental", AuthorID: 1}
+	require.NoError(t, TestDocService.DB.Create(&doc).Error)
+
+	intro := models.Page{DocumentationID: doc.ID, Title: "Intro", Slug: "/intro", Content: "[]", AuthorID: 1}
+	require.NoError(t, TestDocService.DB.Create(&intro).Error)
+
+	setup := models.Page{DocumentationID: doc.ID, Title: "Setup", Slug: "/setup", Content: "[]", AuthorID: 1}
+	require.NoError(t, TestDocService.DB.Create(&setup).Error)
+
+	docsPath := t.TempDir()
+	guidesPath := filepath.Join(docsPath, doc.Version, "guides")
+	setupPath := filepath.Join(guidesPath, utils.StringToFileString("Setup")+".mdx")
+
+	files, err := TestDocService.writeVersions(context.Background(), publishedView(time.Now()), doc.ID, docsPath)
+	require.NoError(t, err)
+	assert.True(t, files.hasChanges())
+	assert.True(t, utils.PathExists(setupPath))
+
+	t.Run("Unchanged content is not rewritten", func(t *testing.T) {
+		files, err := TestDocService.writeVersions(context.Background(), publishedView(time.Now()), doc.ID, docsPath)
+		require.NoError(t, err)
+		assert.False(t, files.hasChanges())
+	})
+
+	t.Run("Only the edited page changes", func(t *testing.T) {
+		require.NoError(t, TestDocService.DB.Model(&setup).Update("content",
+			`[{"type":"paragraph","content":[{"type":"text","text":"Run it","styles":{}}],"children":[]}]`).Error)
+
+		files, err := TestDocService.writeVersions(context.Background(), publishedView(time.Now()), doc.ID, docsPath)
+		require.NoError(t, err)
+		assert.Equal(t, []string{setupPath}, files.changed)
+		assert.Empty(t, files.removed)
+	})
+
+	t.Run("Unpublished pages are pruned", func(t *testing.T) {
+		require.NoError(t, TestDocService.DB.Model(&setup).Update("is_draft", true).Error)
+
+		files, err := TestDocService.writeVersions(context.Background(), publishedView(time.Now()), doc.ID, docsPath)
+		require.NoError(t, err)
+		assert.Equal(t, []string{setupPath}, files.removed)
+		assert.False(t, utils.PathExists(setupPath))
+	})
+}
+
+func TestBuildSteps(t *testing.T) {
+	docPath := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(docPath, "package.json"), []byte(`{"name":"docs"}`), 0644))
+
+	assert.False(t, buildStepDone(docPath, installStamp, installInputs...))
+
+	require.NoError(t, markBuildStepDone(docPath, installStamp, installInputs...))
+	assert.True(t, buildStepDone(docPath, installStamp, installInputs...))
+
+	require.NoError(t, os.WriteFile(filepath.Join(docPath, "package.json"), []byte(`{"name":"docs","version":"2"}`), 0644))
+	assert.False(t, buildStepDone(docPath, installStamp, installInputs...))
+}
+
+func TestShutdown(t *testing.T) {
+	require.NoError(t, TestDocService.DB.Model(&models.BuildTriggers{}).
+		Where("triggered = ?", false).Update("triggered", true).Error)
+
+	doc := models.Documentation{Name: "Shutdown", Version: "1.0.0", BaseURL: "/shutdown", AuthorID: 1}
+	require.NoError(t, TestDocService.DB.Create(&doc).Error)
+
+	// Builds are interrupted for good once shut down, so the shared service
+	// is left alone
+	service := NewDocService(TestDocService.DB)
+
+	t.Run("Stops the background jobs", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		service.StartWebhookDispatcher(ctx)
+		service.StartPreviewCleanup(ctx)
+		cancel()
+
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer shutdownCancel()
+		assert.NoError(t, service.Shutdown(shutdownCtx))
+		assert.False(t, service.buildsInterrupted())
+	})
+
+	t.Run("Running builds are requeued once the timeout has passed", func(t *testing.T) {
+		require.NoError(t, service.AddBuildTrigger(doc.ID, false, true))
+
+		job, err := service.claimBuild()
+		require.NoError(t, err)
+		require.NotNil(t, job)
+
+		service.background.Go(func() {
+			<-job.ctx.Done()
+			service.finishBuild(job, job.ctx.Err())
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		assert.ErrorIs(t, service.Shutdown(ctx), context.DeadlineExceeded)
+		assert.False(t, service.builds.isRunning(doc.ID))
+
+		var trigger models.BuildTriggers
+		require.NoError(t, service.DB.Where("documentation_id = ?", doc.ID).First(&trigger).Error)
+		assert.False(t, trigger.Triggered)
+		assert.Equal(t, models.BuildTriggerPending, trigger.Status)
+		assert.True(t, trigger.Manual)
+
+		run, err := service.GetBuildRun(job.recorder.run.ID)
+		require.NoError(t, err)
+		assert.Equal(t, models.BuildRunCanceled, run.Status)
+		assert.Equal(t, "interrupted_by_shutdown", run.Error)
+
+		// The next start builds it
+		job, err = TestDocService.claimBuild()
+		require.NoError(t, err)
+		require.NotNil(t, job)
+		assert.Equal(t, doc.ID, job.docId)
+		TestDocService.finishBuild(job, nil)
+	})
+
+	t.Run("Jobs that ignore the cancellation are abandoned", func(t *testing.T) {
+		gracePeriod := shutdownGracePeriod
+		shutdownGracePeriod = 50 * time.Millisecond
+		defer func() { shutdownGracePeriod = gracePeriod }()
+
+		hungService := NewDocService(TestDocService.DB)
+
+		hung := make(chan struct{})
+		defer close(hung)
+		hungService.background.Go(func() { <-hung })
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		assert.ErrorIs(t, hungService.Shutdown(ctx), context.DeadlineExceeded)
+		assert.Less(t, time.Since(start), 5*time.Second)
+	})
+}
+
+func TestGitDeployFailureKeepsBuild(t *testing.T) {
+	require.NoError(t, TestDocService.DB.Model(&models.BuildTriggers{}).
+		Where("triggered = ?", false).Update("triggered", true).Error)
+
+	doc := models.Documentation{Name: "Git Deploy Failure", Version: "1.0.0", BaseURL: "/git-deploy-failure", AuthorID: 1,
+		Generator: models.GeneratorHTML, GitRepo: "file:///nonexistent/kalmia-deploy.git", GitBranch: "main"}
+	require.NoError(t, TestDocService.DB.Create(&doc).Error)
+	defer TestDocService.DB.Model(&doc).Update("git_repo", "")
+
+	require.NoError(t, TestDocService.AddBuildTrigger(doc.ID, false, true))
+
+	job, err := TestDocService.claimBuild()
+	require.NoError(t, err)
+	require.NotNil(t, job)
+	require.Equal(t, doc.ID, job.docId)
+
+	TestDocService.runBuild(job)
+
+	var trigger models.BuildTriggers
+	require.NoError(t, TestDocService.DB.Where("documentation_id = ?", doc.ID).First(&trigger).Error)
+	assert.Equal(t, models.BuildTriggerCompleted, trigger.Status)
+
+	run, err := TestDocService.GetBuildRun(job.recorder.run.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.BuildRunSucceeded, run.Status)
+
+	require.NotEmpty(t, run.Phases)
+	deploy := run.Phases[len(run.Phases)-1]
+	assert.Equal(t, BuildPhaseGitDeploy, deploy.Name)
+	assert.Equal(t, models.BuildRunFailed, deploy.Status)
+}
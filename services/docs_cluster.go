@@ -0,0 +1,468 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.difuse.io/Difuse/kalmia/config"
+	"git.difuse.io/Difuse/kalmia/db"
+	"git.difuse.io/Difuse/kalmia/db/models"
+	"git.difuse.io/Difuse/kalmia/logger"
+	"git.difuse.io/Difuse/kalmia/utils"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	leaseTTL           = 30 * time.Second
+	leaseRenewInterval = 10 * time.Second
+)
+
+// publishedStamp records, next to a build folder, the hash of the build it
+// holds as last published or synced.
+const publishedStamp = ".published_hash"
+
+// previewRestoreMu keeps concurrent requests for a preview from restoring it
+// over each other.
+var previewRestoreMu sync.Mutex
+
+func clusterEnabled() bool {
+	return config.ParsedConfig.Cluster.Enabled
+}
+
+// instanceID is the id this instance claims builds under. It is empty
+// outside of cluster mode.
+func instanceID() string {
+	if !clusterEnabled() {
+		return ""
+	}
+
+	return config.ParsedConfig.Cluster.InstanceID
+}
+
+func docSiteName(docId uint) string {
+	return fmt.Sprintf("doc_%d", docId)
+}
+
+func previewSiteName(token string) string {
+	return "preview_" + token
+}
+
+// isLeader reports whether this instance runs the periodic jobs, which it
+// always does outside of cluster mode.
+func (service *DocService) isLeader() bool {
+	return !clusterEnabled() || service.leader.Load()
+}
+
+// acquireLease takes the lease name for holder, or renews it if holder
+// already has it. It reports whether holder has the lease.
+func (service *DocService) acquireLease(name string, holder string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	lease := models.Lease{Name: name, Holder: holder, ExpiresAt: now.Add(ttl)}
+
+	result := service.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "name"}},
+		DoUpdates: clause.AssignmentColumns([]string{"holder", "expires_at"}),
+		Where: clause.Where{Exprs: []clause.Expression{clause.Or(
+			clause.Eq{Column: clause.Column{Table: "leases", Name: "holder"}, Value: holder},
+			clause.Lt{Column: clause.Column{Table: "leases", Name: "expires_at"}, Value: now},
+		)}},
+	}).Create(&lease)
+
+	return result.RowsAffected > 0, result.Error
+}
+
+// StartCluster keeps the heartbeat of this instance, competes for the
+// leader lease and keeps the sites it serves in sync with the ones other
+// instances publish, until ctx is done. It does nothing outside of cluster
+// mode.
+func (service *DocService) StartCluster(ctx context.Context) {
+	if !clusterEnabled() {
+		return
+	}
+
+	service.renewLeases()
+
+	service.background.Go(func() {
+		for sleepContext(ctx, leaseRenewInterval) {
+			service.renewLeases()
+		}
+	})
+
+	service.background.Go(func() {
+		for {
+			if service.SitesInObjectStorage() {
+				service.syncSiteReleases()
+			}
+			service.SyncPublishedSites()
+			// Domains may have been verified or removed on another instance
+			service.loadSiteDomains()
+
+			if !sleepContext(ctx, time.Duration(config.ParsedConfig.Cluster.SyncInterval)*time.Second) {
+				return
+			}
+		}
+	})
+
+	logger.Info("Cluster mode started", zap.String("instance_id", instanceID()))
+}
+
+func (service *DocService) renewLeases() {
+	id := instanceID()
+
+	if _, err := service.acquireLease(models.InstanceLeasePrefix+id, id, leaseTTL); err != nil {
+		logger.Error("Failed to renew instance lease", zap.Error(err))
+	}
+
+	leader, err := service.acquireLease(models.LeaderLease, id, leaseTTL)
+	if err != nil {
+		logger.Error("Failed to renew leader lease", zap.Error(err))
+		leader = false
+	}
+
+	if service.leader.Swap(leader) != leader {
+		if leader {
+			logger.Info("Leader lease acquired, running periodic jobs", zap.String("instance_id", id))
+		} else {
+			logger.Info("Leader lease lost", zap.String("instance_id", id))
+		}
+	}
+
+	if leader {
+		if err := service.requeueOrphanedBuilds(); err != nil {
+			logger.Error("Failed to requeue builds of stopped instances", zap.Error(err))
+		}
+	}
+}
+
+// releaseLeases gives up the leases of this instance when it stops, so that
+// another one takes over the periodic jobs without waiting for them to
+// expire.
+func (service *DocService) releaseLeases() {
+	if !clusterEnabled() {
+		return
+	}
+
+	id := instanceID()
+	if err := service.DB.Where("(name = ? OR name = ?) AND holder = ?", models.InstanceLeasePrefix+id, models.LeaderLease, id).
+		Delete(&models.Lease{}).Error; err != nil {
+		logger.Error("Failed to release leases", zap.Error(err))
+	}
+
+	service.leader.Store(false)
+}
+
+// requeueOrphanedBuilds puts back the builds claimed by instances that
+// stopped renewing their heartbeat, and fails their build runs and previews.
+func (service *DocService) requeueOrphanedBuilds() error {
+	live := service.DB.Model(&models.Lease{}).Select("holder").
+		Where("name LIKE ? AND expires_at > ?", models.InstanceLeasePrefix+"%", time.Now())
+
+	if err := service.DB.Model(&models.BuildTriggers{}).
+		Where("triggered = ? AND status = ? AND claimed_by NOT IN (?)", false, models.BuildTriggerRunning, live).
+		Updates(map[string]interface{}{"status": models.BuildTriggerPending, "claimed_by": ""}).Error; err != nil {
+		return err
+	}
+
+	if err := service.DB.Model(&models.BuildRun{}).
+		Where("status = ? AND instance NOT IN (?)", models.BuildRunRunning, live).
+		Updates(map[string]interface{}{
+			"status":      models.BuildRunFailed,
+			"error":       "interrupted_by_instance_loss",
+			"finished_at": time.Now(),
+		}).Error; err != nil {
+		return err
+	}
+
+	return service.DB.Model(&models.PreviewBuild{}).
+		Where("status = ? AND instance NOT IN (?)", models.PreviewBuildRunning, live).
+		Updates(map[string]interface{}{"status": models.PreviewBuildFailed, "error": "interrupted"}).Error
+}
+
+// claimTriggers marks the pending triggers of a documentation as running
+// for this instance. In cluster mode the documentation is locked while they
+// are claimed, and nothing is claimed while another instance is building
+// it, in which case it returns nil.
+func (service *DocService) claimTriggers(docId uint, triggers []models.BuildTriggers) ([]models.BuildTriggers, error) {
+	updates := map[string]interface{}{
+		"status":     models.BuildTriggerRunning,
+		"started_at": time.Now(),
+		"claimed_by": instanceID(),
+	}
+
+	if !clusterEnabled() {
+		ids := make([]uint, 0, len(triggers))
+		for _, trigger := range triggers {
+			ids = append(ids, trigger.ID)
+		}
+
+		if err := service.DB.Model(&models.BuildTriggers{}).Where("id IN ?", ids).Updates(updates).Error; err != nil {
+			return nil, fmt.Errorf("failed to claim build triggers: %w", err)
+		}
+
+		return triggers, nil
+	}
+
+	var claimed []models.BuildTriggers
+
+	err := service.DB.Transaction(func(tx *gorm.DB) error {
+		// Instances that do not get the lock right away leave the
+		// documentation to the one that did. SQLite, which cluster mode does
+		// not run on, has no row locks and locks the database for writes
+		query := tx.Select("id").Where("id = ?", docId)
+		if tx.Dialector.Name() == "postgres" {
+			query = query.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"})
+		}
+
+		var locked []models.Documentation
+		if err := query.Find(&locked).Error; err != nil {
+			return err
+		}
+
+		if len(locked) == 0 {
+			return nil
+		}
+
+		var running int64
+		if err := tx.Model(&models.BuildTriggers{}).
+			Where("documentation_id = ? AND triggered = ? AND status = ?", docId, false, models.BuildTriggerRunning).
+			Count(&running).Error; err != nil {
+			return err
+		}
+
+		if running > 0 {
+			return nil
+		}
+
+		if err := tx.Where("documentation_id = ? AND triggered = ? AND is_delete = ? AND status IN ?",
+			docId, false, false, []string{"", models.BuildTriggerPending}).
+			Order("manual DESC, created_at ASC, id ASC").Find(&claimed).Error; err != nil {
+			return err
+		}
+
+		if len(claimed) == 0 {
+			return nil
+		}
+
+		ids := make([]uint, 0, len(claimed))
+		for _, trigger := range claimed {
+			ids = append(ids, trigger.ID)
+		}
+
+		return tx.Model(&models.BuildTriggers{}).Where("id IN ?", ids).Updates(updates).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim build triggers: %w", err)
+	}
+
+	return claimed, nil
+}
+
+// publishSite shares the build in dir with the other instances under name,
+// unless it is the build last published from dir. It does nothing outside
+// of cluster mode.
+func (service *DocService) publishSite(name string, dir string) error {
+	if !clusterEnabled() {
+		return nil
+	}
+
+	hash, err := utils.DirHash(dir)
+	if err != nil {
+		return err
+	}
+
+	stampPath := filepath.Join(filepath.Dir(dir), publishedStamp)
+	if published, err := os.ReadFile(stampPath); err == nil && string(published) == hash {
+		return nil
+	}
+
+	var archive bytes.Buffer
+	if err := utils.WriteTarGz(dir, &archive); err != nil {
+		return err
+	}
+
+	site := models.PublishedSite{
+		Name:      name,
+		Hash:      hash,
+		Archive:   archive.Bytes(),
+		Instance:  instanceID(),
+		UpdatedAt: time.Now(),
+	}
+
+	if err := service.DB.Clauses(clause.OnConflict{UpdateAll: true}).Create(&site).Error; err != nil {
+		return fmt.Errorf("failed to publish site: %w", err)
+	}
+
+	return utils.WriteToFile(stampPath, hash)
+}
+
+// restoreSite replaces the build in dir with the one published under name.
+// It returns the files that changed and the ones removed, relative to dir.
+func (service *DocService) restoreSite(name string, dir string) ([]string, []string, error) {
+	var site models.PublishedSite
+	if err := service.DB.Where("name = ?", name).First(&site).Error; err != nil {
+		return nil, nil, err
+	}
+
+	tmpDir := dir + "_sync"
+	if err := utils.RemovePath(tmpDir); err != nil {
+		return nil, nil, err
+	}
+
+	if err := utils.MakeDir(tmpDir); err != nil {
+		return nil, nil, err
+	}
+
+	if err := utils.ReadTarGz(bytes.NewReader(site.Archive), tmpDir); err != nil {
+		utils.RemovePath(tmpDir)
+		return nil, nil, err
+	}
+
+	changed, removed, err := utils.SyncDir(tmpDir, dir)
+	if err != nil {
+		utils.RemovePath(tmpDir)
+		return nil, nil, err
+	}
+
+	return changed, removed, utils.WriteToFile(filepath.Join(filepath.Dir(dir), publishedStamp), site.Hash)
+}
+
+// restorePreviewSite restores the build of a preview into buildPath, unless
+// it was built or restored here already. It does nothing outside of cluster
+// mode.
+func (service *DocService) restorePreviewSite(token string, buildPath string) error {
+	if !clusterEnabled() {
+		return nil
+	}
+
+	previewRestoreMu.Lock()
+	defer previewRestoreMu.Unlock()
+
+	if utils.PathExists(filepath.Join(filepath.Dir(buildPath), publishedStamp)) {
+		return nil
+	}
+
+	_, _, err := service.restoreSite(previewSiteName(token), buildPath)
+	return err
+}
+
+// unpublishSite stops sharing the site published under name.
+func (service *DocService) unpublishSite(name string) error {
+	if !clusterEnabled() {
+		return nil
+	}
+
+	return service.DB.Where("name = ?", name).Delete(&models.PublishedSite{}).Error
+}
+
+// SyncPublishedSites replaces the builds this instance serves with the ones
+// other instances published since, and removes the documentations and
+// previews other instances deleted.
+func (service *DocService) SyncPublishedSites() {
+	var sites []models.PublishedSite
+	if err := service.DB.Select("name", "hash").Find(&sites).Error; err != nil {
+		logger.Error("Failed to fetch published sites", zap.Error(err))
+		return
+	}
+
+	published := make(map[string]bool, len(sites))
+	for _, site := range sites {
+		published[site.Name] = true
+
+		// Previews are restored when they are first requested
+		idString, ok := strings.CutPrefix(site.Name, "doc_")
+		if !ok {
+			continue
+		}
+
+		id, err := strconv.Atoi(idString)
+		if err != nil {
+			continue
+		}
+
+		if err := service.syncDocSite(uint(id), site.Hash); err != nil {
+			logger.Error("Failed to sync published site", zap.Uint("doc_id", uint(id)), zap.Error(err))
+		}
+	}
+
+	rsPressDataPath := filepath.Join(config.ParsedConfig.DataPath, "rspress_data")
+	entries, err := os.ReadDir(rsPressDataPath)
+	if err != nil {
+		logger.Error("Failed to read rspress_data directory", zap.Error(err))
+		return
+	}
+
+	for _, entry := range entries {
+		docPath := filepath.Join(rsPressDataPath, entry.Name())
+		if !entry.IsDir() {
+			continue
+		}
+
+		// Only documentations published before can have been deleted since
+		if !published[entry.Name()] && utils.PathExists(filepath.Join(docPath, publishedStamp)) {
+			logger.Info("Removing documentation deleted by another instance", zap.String("doc", entry.Name()))
+			if err := utils.RemovePath(docPath); err != nil {
+				logger.Error("Failed to remove doc folder", zap.String("doc", entry.Name()), zap.Error(err))
+			}
+			db.Cache.DeletePrefix("rs|" + entry.Name() + "|")
+			db.Cache.DeletePrefix("burl|" + entry.Name() + "|")
+			continue
+		}
+
+		service.removeDeletedPreviews(docPath)
+	}
+}
+
+func (service *DocService) syncDocSite(docId uint, hash string) error {
+	docPath := utils.GetDocPathByID(docId, config.ParsedConfig)
+	if synced, err := os.ReadFile(filepath.Join(docPath, publishedStamp)); err == nil && string(synced) == hash {
+		return nil
+	}
+
+	// A build of the documentation running here publishes its own site
+	mutexI, _ := service.UWBMutexMap.LoadOrStore(fmt.Sprintf("update_write_build_%d", docId), &sync.Mutex{})
+	mutex := mutexI.(*sync.Mutex)
+	if !mutex.TryLock() {
+		return nil
+	}
+	defer mutex.Unlock()
+
+	buildPath := filepath.Join(docPath, "build")
+	changed, removed, err := service.restoreSite(docSiteName(docId), buildPath)
+	if err != nil {
+		return err
+	}
+
+	logger.Debug("Synced published site", zap.Uint("doc_id", docId), zap.Int("changed", len(changed)), zap.Int("removed", len(removed)))
+
+	service.updateBuildCache(docId, changed, removed)
+	return nil
+}
+
+// removeDeletedPreviews removes the previews built or restored in docPath
+// whose preview no longer exists.
+func (service *DocService) removeDeletedPreviews(docPath string) {
+	entries, err := os.ReadDir(filepath.Join(docPath, "preview"))
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		var count int64
+		if err := service.DB.Model(&models.PreviewBuild{}).Where("token = ?", entry.Name()).Count(&count).Error; err != nil || count > 0 {
+			continue
+		}
+
+		if err := utils.RemovePath(filepath.Join(docPath, "preview", entry.Name())); err != nil {
+			logger.Error("Failed to remove deleted preview", zap.String("token", entry.Name()), zap.Error(err))
+		}
+	}
+}
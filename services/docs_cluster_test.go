@@ -0,0 +1,134 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.difuse.io/Difuse/kalmia/config"
+	"git.difuse.io/Difuse/kalmia/db"
+	"git.difuse.io/Difuse/kalmia/db/models"
+	"git.difuse.io/Difuse/kalmia/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// enableCluster runs the rest of a test as instance id of a cluster.
+func enableCluster(t *testing.T, id string) {
+	cluster := config.ParsedConfig.Cluster
+	t.Cleanup(func() { config.ParsedConfig.Cluster = cluster })
+
+	config.ParsedConfig.Cluster.Enabled = true
+	config.ParsedConfig.Cluster.InstanceID = id
+}
+
+func TestLeases(t *testing.T) {
+	held, err := TestDocService.acquireLease("test-lease", "a", time.Minute)
+	require.NoError(t, err)
+	assert.True(t, held)
+
+	held, err = TestDocService.acquireLease("test-lease", "b", time.Minute)
+	require.NoError(t, err)
+	assert.False(t, held, "lease is taken while it has not expired")
+
+	held, err = TestDocService.acquireLease("test-lease", "a", time.Minute)
+	require.NoError(t, err)
+	assert.True(t, held, "lease is renewed by its holder")
+
+	require.NoError(t, TestDocService.DB.Model(&models.Lease{}).Where("name = ?", "test-lease").
+		Update("expires_at", time.Now().Add(-time.Second)).Error)
+
+	held, err = TestDocService.acquireLease("test-lease", "b", time.Minute)
+	require.NoError(t, err)
+	assert.True(t, held, "expired lease is taken over")
+}
+
+func TestClusterBuildClaims(t *testing.T) {
+	require.NoError(t, TestDocService.DB.Model(&models.BuildTriggers{}).
+		Where("triggered = ?", false).Update("triggered", true).Error)
+
+	enableCluster(t, "instance-a")
+
+	doc := models.Documentation{Name: "Cluster Claims", Version: "1.0.0", BaseURL: "/cluster-claims", AuthorID: 1}
+	require.NoError(t, TestDocService.DB.Create(&doc).Error)
+
+	running := models.BuildTriggers{DocumentationID: doc.ID, Status: models.BuildTriggerRunning, ClaimedBy: "instance-b"}
+	require.NoError(t, TestDocService.DB.Create(&running).Error)
+	require.NoError(t, TestDocService.AddBuildTrigger(doc.ID, false))
+
+	t.Run("Documentations built by another instance are left to it", func(t *testing.T) {
+		job, err := TestDocService.claimBuild()
+		require.NoError(t, err)
+		assert.Nil(t, job)
+	})
+
+	t.Run("Builds of stopped instances are requeued by the leader", func(t *testing.T) {
+		_, err := TestDocService.acquireLease(models.InstanceLeasePrefix+"instance-b", "instance-b", -time.Second)
+		require.NoError(t, err)
+		require.NoError(t, TestDocService.requeueOrphanedBuilds())
+
+		job, err := TestDocService.claimBuild()
+		require.NoError(t, err)
+		require.NotNil(t, job)
+		assert.Equal(t, doc.ID, job.docId)
+		assert.Len(t, job.triggers, 2)
+
+		var claimedBy []string
+		TestDocService.DB.Model(&models.BuildTriggers{}).Where("documentation_id = ?", doc.ID).Pluck("claimed_by", &claimedBy)
+		assert.Equal(t, []string{"instance-a", "instance-a"}, claimedBy)
+
+		TestDocService.finishBuild(job, nil)
+	})
+}
+
+func TestPublishedSites(t *testing.T) {
+	enableCluster(t, "instance-a")
+
+	doc := models.Documentation{Name: "Cluster Sites", Version: "1.0.0", BaseURL: "/cluster-sites", AuthorID: 1}
+	require.NoError(t, TestDocService.DB.Create(&doc).Error)
+
+	docPath := utils.GetDocPathByID(doc.ID, config.ParsedConfig)
+	buildPath := filepath.Join(docPath, "build")
+	require.NoError(t, utils.MakeDir(filepath.Join(buildPath, "guides")))
+	require.NoError(t, os.WriteFile(filepath.Join(buildPath, "index.html"), []byte("home"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(buildPath, "guides", "index.html"), []byte("guides"), 0644))
+
+	require.NoError(t, TestDocService.publishSite(docSiteName(doc.ID), buildPath))
+
+	t.Run("Other instances pick up the build", func(t *testing.T) {
+		// As seen from an instance that never built it
+		require.NoError(t, utils.RemovePath(docPath))
+
+		TestDocService.SyncPublishedSites()
+
+		content, err := os.ReadFile(filepath.Join(buildPath, "guides", "index.html"))
+		require.NoError(t, err)
+		assert.Equal(t, "guides", string(content))
+
+		served, _, err := TestDocService.GetSiteFile(doc.ID, "index.html")
+		require.NoError(t, err)
+		assert.Equal(t, "home", string(served.Data))
+	})
+
+	t.Run("Unchanged builds are not published again", func(t *testing.T) {
+		var before models.PublishedSite
+		require.NoError(t, TestDocService.DB.Where("name = ?", docSiteName(doc.ID)).First(&before).Error)
+
+		require.NoError(t, TestDocService.publishSite(docSiteName(doc.ID), buildPath))
+
+		var after models.PublishedSite
+		require.NoError(t, TestDocService.DB.Where("name = ?", docSiteName(doc.ID)).First(&after).Error)
+		assert.True(t, before.UpdatedAt.Equal(after.UpdatedAt))
+	})
+
+	t.Run("Deleted documentations are removed", func(t *testing.T) {
+		require.NoError(t, TestDocService.unpublishSite(docSiteName(doc.ID)))
+
+		TestDocService.SyncPublishedSites()
+
+		assert.False(t, utils.PathExists(docPath))
+		_, cached := db.Cache.Get("rs|" + docSiteName(doc.ID) + "|index.html")
+		assert.False(t, cached)
+	})
+}
@@ -22,6 +22,13 @@ import (
 	"gorm.io/gorm/clause"
 )
 
+// Git secrets are never read back, the documentation only says whether they
+// are set.
+const (
+	gitPasswordSet = "COALESCE(git_password, '') <> '' AS git_password_set"
+	gitSSHKeySet   = "COALESCE(git_ssh_private_key, '') <> '' AS git_ssh_key_set"
+)
+
 func (service *DocService) GetDocumentations() ([]models.Documentation, error) {
 	var documentations []models.Documentation
 
@@ -32,19 +39,19 @@ func (service *DocService) GetDocumentations() ([]models.Documentation, error) {
 	}).Preload("Editors", func(db *gorm.DB) *gorm.DB {
 		return db.Select("ID", "Username", "Email", "Photo")
 	}).Preload("PageGroups", func(db *gorm.DB) *gorm.DB {
-		return db.Select("ID", "DocumentationID", "Name", "CreatedAt", "UpdatedAt", "AuthorID", "Order")
+		return db.Select("ID", "DocumentationID", "Name", "CreatedAt", "UpdatedAt", "AuthorID", "Order", "PublishAt", "UnpublishAt")
 	}).Preload("PageGroups.Author", func(db *gorm.DB) *gorm.DB {
 		return db.Select("ID", "Username", "Email", "Photo")
 	}).Preload("PageGroups.Editors", func(db *gorm.DB) *gorm.DB {
 		return db.Select("users.ID", "users.Username", "users.Email", "users.Photo")
 	}).Preload("PageGroups.Pages", func(db *gorm.DB) *gorm.DB {
-		return db.Select("ID", "PageGroupID", "Title", "Slug", "CreatedAt", "UpdatedAt", "AuthorID", "Order")
+		return db.Select("ID", "PageGroupID", "Title", "Slug", "CreatedAt", "UpdatedAt", "AuthorID", "Order", "PublishAt", "UnpublishAt", "IsDraft")
 	}).Preload("PageGroups.Pages.Author", func(db *gorm.DB) *gorm.DB {
 		return db.Select("ID", "Username", "Email", "Photo")
 	}).Preload("PageGroups.Pages.Editors", func(db *gorm.DB) *gorm.DB {
 		return db.Select("users.ID", "users.Username", "users.Email", "users.Photo")
 	}).Preload("Pages", func(db *gorm.DB) *gorm.DB {
-		return db.Select("ID", "DocumentationID", "Title", "Slug", "CreatedAt", "UpdatedAt", "AuthorID", "Order", "IsIntroPage").Where("page_group_id IS NULL")
+		return db.Select("ID", "DocumentationID", "Title", "Slug", "CreatedAt", "UpdatedAt", "AuthorID", "Order", "IsIntroPage", "PublishAt", "UnpublishAt", "IsDraft").Where("page_group_id IS NULL")
 	}).Preload("Pages.Author", func(db *gorm.DB) *gorm.DB {
 		return db.Select("ID", "Username", "Email", "Photo")
 	}).Preload("Pages.Editors", func(db *gorm.DB) *gorm.DB {
@@ -52,7 +59,8 @@ func (service *DocService) GetDocumentations() ([]models.Documentation, error) {
 	}).Select("ID", "Name", "Description", "CreatedAt", "UpdatedAt", "AuthorID", "Version", "ClonedFrom",
 		"LastEditorID", "Favicon", "MetaImage", "NavImage", "NavImageDark", "CustomCSS", "FooterLabelLinks", "MoreLabelLinks",
 		"URL", "OrganizationName", "LanderDetails", "ProjectName", "BaseURL", "RequireAuth",
-		"GitRepo", "GitEmail", "GitUser", "GitPassword", "GitBranch", "DisableAutoBuild").
+		"GitRepo", "GitEmail", "GitUser", "GitBranch", "GitSSHPublicKey", "GitSSHKnownHosts", "GitSyncEnabled", "GitSyncRepo", "GitSyncBranch", "DisableAutoBuild", "Generator",
+		gitPasswordSet, gitSSHKeySet).
 		Find(&documentations).Error; err != nil {
 		return nil, fmt.Errorf("failed_to_get_documentations")
 	}
@@ -79,19 +87,19 @@ func (service *DocService) GetDocumentation(id uint) (models.Documentation, erro
 	}).Preload("Editors", func(db *gorm.DB) *gorm.DB {
 		return db.Select("ID", "Username", "Email", "Photo")
 	}).Preload("PageGroups", func(db *gorm.DB) *gorm.DB {
-		return db.Select("ID", "DocumentationID", "Name", "CreatedAt", "UpdatedAt", "AuthorID", "Order")
+		return db.Select("ID", "DocumentationID", "Name", "CreatedAt", "UpdatedAt", "AuthorID", "Order", "PublishAt", "UnpublishAt")
 	}).Preload("PageGroups.Author", func(db *gorm.DB) *gorm.DB {
 		return db.Select("ID", "Username", "Email", "Photo")
 	}).Preload("PageGroups.Editors", func(db *gorm.DB) *gorm.DB {
 		return db.Select("users.ID", "users.Username", "users.Email", "users.Photo")
 	}).Preload("PageGroups.Pages", func(db *gorm.DB) *gorm.DB {
-		return db.Select("ID", "PageGroupID", "Title", "Slug", "CreatedAt", "UpdatedAt", "AuthorID")
+		return db.Select("ID", "PageGroupID", "Title", "Slug", "CreatedAt", "UpdatedAt", "AuthorID", "PublishAt", "UnpublishAt", "IsDraft")
 	}).Preload("PageGroups.Pages.Author", func(db *gorm.DB) *gorm.DB {
 		return db.Select("ID", "Username", "Email", "Photo")
 	}).Preload("PageGroups.Pages.Editors", func(db *gorm.DB) *gorm.DB {
 		return db.Select("users.ID", "users.Username", "users.Email", "users.Photo")
 	}).Preload("Pages", func(db *gorm.DB) *gorm.DB {
-		return db.Select("ID", "DocumentationID", "Title", "Slug", "CreatedAt", "UpdatedAt", "AuthorID", "IsIntroPage", "Order").Where("page_group_id IS NULL")
+		return db.Select("ID", "DocumentationID", "Title", "Slug", "CreatedAt", "UpdatedAt", "AuthorID", "IsIntroPage", "Order", "PublishAt", "UnpublishAt", "IsDraft").Where("page_group_id IS NULL")
 	}).Preload("Pages.Author", func(db *gorm.DB) *gorm.DB {
 		return db.Select("ID", "Username", "Email", "Photo")
 	}).Preload("Pages.Editors", func(db *gorm.DB) *gorm.DB {
@@ -99,7 +107,8 @@ func (service *DocService) GetDocumentation(id uint) (models.Documentation, erro
 	}).Where("id = ?", id).Select("ID", "Name", "Description", "CreatedAt", "UpdatedAt", "AuthorID", "Version", "LastEditorID", "Favicon",
 		"MetaImage", "NavImage", "NavImageDark", "CustomCSS", "FooterLabelLinks", "MoreLabelLinks", "CopyrightText",
 		"BaseURL", "URL", "OrganizationName", "LanderDetails", "ProjectName", "ClonedFrom", "RequireAuth",
-		"GitRepo", "GitEmail", "GitUser", "GitPassword", "GitBranch", "DisableAutoBuild").
+		"GitRepo", "GitEmail", "GitUser", "GitBranch", "GitSSHPublicKey", "GitSSHKnownHosts", "GitSyncEnabled", "GitSyncRepo", "GitSyncBranch", "DisableAutoBuild", "Generator",
+		gitPasswordSet, gitSSHKeySet).
 		Find(&documentation).Error; err != nil {
 		return models.Documentation{}, fmt.Errorf("failed_to_get_documentation")
 	}
@@ -231,6 +240,16 @@ func (service *DocService) CreateDocumentation(documentation *models.Documentati
 		return fmt.Errorf("invalid_base_url")
 	}
 
+	generator, err := generatorName(documentation.Generator)
+	if err != nil {
+		return err
+	}
+	documentation.Generator = generator
+
+	if err := encryptGitSecrets(documentation); err != nil {
+		return err
+	}
+
 	if err := db.Create(documentation).Error; err != nil {
 		return fmt.Errorf("failed_to_create_documentation")
 	}
@@ -254,7 +273,7 @@ func (service *DocService) CreateDocumentation(documentation *models.Documentati
 		return fmt.Errorf("failed_to_create_documentation_intro_page")
 	}
 
-	err := service.InitRsPress(documentation.ID)
+	err = service.generatorNamed(documentation.Generator).Init(documentation.ID)
 	if err != nil {
 		logger.Error("failed_to_init_rspress", zap.Error(err))
 		db.Delete(&documentation)
@@ -370,14 +389,46 @@ func (service *DocService) EditDocumentation(
 	gitUser string,
 	gitPassword string,
 	gitEmail string,
+	gitSSHPrivateKey string,
+	gitSSHKnownHosts string,
+	clearGitPassword bool,
+	clearGitSSHPrivateKey bool,
+	gitSyncEnabled bool,
+	gitSyncRepo string,
+	gitSyncBranch string,
+	generator string,
 
 	bucketUploadedFiles map[string]string,
 ) error {
-	tx := service.DB.Begin()
 	if !utils.IsBaseURLValid(baseURL) {
 		return fmt.Errorf("invalid_base_url")
 	}
 
+	generator, err := generatorName(generator)
+	if err != nil {
+		return err
+	}
+
+	// Sites on a domain of their own are public, see checkDomainAllowed
+	if requireAuth {
+		if rootId, err := service.GetRootParentID(id); err == nil && service.SiteDomainOf(rootId) != "" {
+			return fmt.Errorf("documentation_has_domain")
+		}
+	}
+
+	// Secrets are write-only, an empty value keeps the stored one and only
+	// an explicit clear removes it
+	gitSecrets := models.Documentation{
+		GitPassword:      gitPassword,
+		GitSSHPrivateKey: gitSSHPrivateKey,
+		GitSSHKnownHosts: gitSSHKnownHosts,
+	}
+	if err := encryptGitSecrets(&gitSecrets); err != nil {
+		return err
+	}
+
+	tx := service.DB.Begin()
+
 	updateDoc := func(doc *models.Documentation, isTarget bool) error {
 		doc.LastEditorID = &user.ID
 		doc.Name = name
@@ -399,8 +450,26 @@ func (service *DocService) EditDocumentation(
 		doc.GitRepo = gitRepo
 		doc.GitBranch = gitBranch
 		doc.GitUser = gitUser
-		doc.GitPassword = gitPassword
 		doc.GitEmail = gitEmail
+		if gitSSHKnownHosts != "" {
+			doc.GitSSHKnownHosts = gitSSHKnownHosts
+		}
+		if clearGitPassword {
+			doc.GitPassword = ""
+		} else if gitPassword != "" {
+			doc.GitPassword = gitSecrets.GitPassword
+		}
+		if clearGitSSHPrivateKey {
+			doc.GitSSHPrivateKey = ""
+			doc.GitSSHPublicKey = ""
+		} else if gitSSHPrivateKey != "" {
+			doc.GitSSHPrivateKey = gitSecrets.GitSSHPrivateKey
+			doc.GitSSHPublicKey = gitSecrets.GitSSHPublicKey
+		}
+		doc.GitSyncEnabled = gitSyncEnabled
+		doc.GitSyncRepo = gitSyncRepo
+		doc.GitSyncBranch = gitSyncBranch
+		doc.Generator = generator
 		if isTarget && version != "" {
 			doc.Version = version
 		}
@@ -632,11 +701,18 @@ func (service *DocService) DeleteDocumentation(id uint) error {
 		return fmt.Errorf("failed_to_fetch_pages: %v", err)
 	}
 
+	pageIds := make([]uint, 0, len(pages))
 	for _, page := range pages {
 		if err := tx.Model(&page).Association("Editors").Clear(); err != nil {
 			tx.Rollback()
 			return fmt.Errorf("failed_to_clear_page_editors_association: %v", err)
 		}
+		pageIds = append(pageIds, page.ID)
+	}
+
+	if err := deletePageDrafts(tx, pageIds); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed_to_delete_page_drafts: %v", err)
 	}
 
 	if err := tx.Where("documentation_id = ?", id).Delete(&models.PageGroup{}).Error; err != nil {
@@ -654,6 +730,11 @@ func (service *DocService) DeleteDocumentation(id uint) error {
 		return fmt.Errorf("failed_to_clear_documentation_editors_association: %v", err)
 	}
 
+	if err := tx.Model(&models.Documentation{ID: id}).Association("Reviewers").Clear(); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed_to_clear_documentation_reviewers_association: %v", err)
+	}
+
 	if err := tx.Delete(&models.Documentation{ID: id}).Error; err != nil {
 		tx.Rollback()
 		return fmt.Errorf("failed_to_delete_documentation: %v", err)
@@ -709,6 +790,13 @@ func (service *DocService) CreateDocumentationVersion(originalDocId uint, newVer
 		GitUser:          originalDoc.GitUser,
 		GitPassword:      originalDoc.GitPassword,
 		GitEmail:         originalDoc.GitEmail,
+		GitSSHPrivateKey: originalDoc.GitSSHPrivateKey,
+		GitSSHPublicKey:  originalDoc.GitSSHPublicKey,
+		GitSSHKnownHosts: originalDoc.GitSSHKnownHosts,
+		GitSyncEnabled:   originalDoc.GitSyncEnabled,
+		GitSyncRepo:      originalDoc.GitSyncRepo,
+		GitSyncBranch:    originalDoc.GitSyncBranch,
+		Generator:        originalDoc.Generator,
 	}
 
 	err = service.DB.Transaction(func(tx *gorm.DB) error {
@@ -741,6 +829,8 @@ func (service *DocService) CreateDocumentationVersion(originalDocId uint, newVer
 				AuthorID:        pg.AuthorID,
 				Name:            pg.Name,
 				Order:           pg.Order,
+				PublishAt:       pg.PublishAt,
+				UnpublishAt:     pg.UnpublishAt,
 			}
 			if err := tx.Create(&newPG).Error; err != nil {
 				return fmt.Errorf("failed_to_create_page_group")
@@ -762,6 +852,8 @@ func (service *DocService) CreateDocumentationVersion(originalDocId uint, newVer
 					Slug:            page.Slug,
 					Content:         page.Content,
 					Order:           page.Order,
+					PublishAt:       page.PublishAt,
+					UnpublishAt:     page.UnpublishAt,
 				}
 				if err := tx.Create(&newPage).Error; err != nil {
 					return fmt.Errorf("failed_to_create_page")
@@ -827,6 +919,8 @@ func (service *DocService) CreateDocumentationVersion(originalDocId uint, newVer
 					Content:         page.Content,
 					Order:           page.Order,
 					IsIntroPage:     page.IsIntroPage,
+					PublishAt:       page.PublishAt,
+					UnpublishAt:     page.UnpublishAt,
 				}
 				if err := tx.Create(&newPage).Error; err != nil {
 					return fmt.Errorf("failed to create new page without group: %w", err)
@@ -850,6 +944,12 @@ func (service *DocService) CreateDocumentationVersion(originalDocId uint, newVer
 		return fmt.Errorf("failed_to_add_build_trigger")
 	}
 
+	service.EmitWebhookEvent(newDoc.ID, WebhookEventVersionCreated, map[string]interface{}{
+		"version":      newDoc.Version,
+		"clonedFrom":   originalDocId,
+		"versionDocId": newDoc.ID,
+	})
+
 	return nil
 }
 
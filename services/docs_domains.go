@@ -0,0 +1,290 @@
+package services
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.difuse.io/Difuse/kalmia/config"
+	"git.difuse.io/Difuse/kalmia/db"
+	"git.difuse.io/Difuse/kalmia/db/models"
+	"git.difuse.io/Difuse/kalmia/logger"
+	"git.difuse.io/Difuse/kalmia/utils"
+	"go.uber.org/zap"
+)
+
+// The TXT record proving control of a domain is looked up under this label.
+const domainChallengeLabel = "_kalmia-challenge"
+
+var domainRegex = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z]{2,63}$`)
+
+// lookupTXT resolves TXT records, replaced in tests.
+var lookupTXT = net.LookupTXT
+
+// siteDomains maps the verified domains to the documentations they serve.
+type siteDomains struct {
+	hosts map[string]uint // domain -> root id
+	docs  map[uint]string // root id -> first verified domain
+}
+
+func normalizeDomain(domain string) (string, error) {
+	domain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+	if !domainRegex.MatchString(domain) || len(domain) > 253 {
+		return "", fmt.Errorf("invalid_domain")
+	}
+
+	return domain, nil
+}
+
+// DomainChallengeRecord returns the name of the TXT record that verifies
+// domain.
+func DomainChallengeRecord(domain string) string {
+	return domainChallengeLabel + "." + domain
+}
+
+// loadSiteDomains reads the verified domains from the database, replacing
+// the ones known so far.
+func (service *DocService) loadSiteDomains() *siteDomains {
+	var domains []models.DocumentationDomain
+	if err := service.DB.Where("verified = ?", true).Order("id ASC").Find(&domains).Error; err != nil {
+		logger.Error("Failed to fetch site domains", zap.Error(err))
+		if known := service.siteDomains.Load(); known != nil {
+			return known
+		}
+	}
+
+	loaded := &siteDomains{hosts: make(map[string]uint), docs: make(map[uint]string)}
+	for _, domain := range domains {
+		loaded.hosts[domain.Domain] = domain.DocumentationID
+		if _, ok := loaded.docs[domain.DocumentationID]; !ok {
+			loaded.docs[domain.DocumentationID] = domain.Domain
+		}
+	}
+
+	service.siteDomains.Store(loaded)
+	return loaded
+}
+
+func (service *DocService) currentSiteDomains() *siteDomains {
+	if domains := service.siteDomains.Load(); domains != nil {
+		return domains
+	}
+
+	return service.loadSiteDomains()
+}
+
+// SiteDomainOf returns the domain the site of a documentation is served on,
+// or "" when it is served under its base URL.
+func (service *DocService) SiteDomainOf(rootId uint) string {
+	return service.currentSiteDomains().docs[rootId]
+}
+
+// IsSiteDomain reports whether host is a verified domain of a site.
+func (service *DocService) IsSiteDomain(host string) bool {
+	_, ok := service.currentSiteDomains().hosts[strings.ToLower(host)]
+	return ok
+}
+
+// siteView is the view of the published site of a documentation, whose links
+// start at the root when it is served on a domain of its own.
+func (service *DocService) siteView(rootId uint) contentView {
+	view := publishedView(time.Now())
+	if service.SiteDomainOf(rootId) != "" {
+		view.baseURL = "/"
+	}
+
+	return view
+}
+
+// GetRsPressByHost finds the documentation served on host, the Host header of
+// a request. It returns the root id of the documentation, the folder of its
+// build and whether it requires a login.
+func (service *DocService) GetRsPressByHost(host string) (uint, string, bool, error) {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+
+	rootId, ok := service.currentSiteDomains().hosts[strings.TrimSuffix(strings.ToLower(host), ".")]
+	if !ok {
+		return 0, "", false, fmt.Errorf("domain_not_found")
+	}
+
+	docPath := filepath.Join(utils.GetDocPathByID(rootId, config.ParsedConfig), "build")
+
+	// Base URLs are cached along with whether their documentation requires
+	// a login, see GetRsPress
+	cachePrefix := fmt.Sprintf("burl|doc_%d|", rootId)
+	for cacheKey := range db.Cache.Values(cachePrefix) {
+		if reqAuth, err := strconv.ParseBool(strings.TrimPrefix(cacheKey, cachePrefix)); err == nil {
+			return rootId, docPath, reqAuth, nil
+		}
+	}
+
+	doc, err := service.GetDocumentation(rootId)
+	if err != nil {
+		return 0, "", false, err
+	}
+
+	_ = db.Cache.Set(fmt.Sprintf("burl|doc_%d|%t", doc.ID, doc.RequireAuth), []byte(doc.BaseURL), "text/plain")
+
+	return rootId, docPath, doc.RequireAuth, nil
+}
+
+func (service *DocService) GetDomains(docId uint) ([]models.DocumentationDomain, error) {
+	query := service.DB.Order("id ASC")
+	if docId != 0 {
+		rootId, err := service.GetRootParentID(docId)
+		if err != nil {
+			return nil, fmt.Errorf("documentation_not_found")
+		}
+		query = query.Where("documentation_id = ?", rootId)
+	}
+
+	var domains []models.DocumentationDomain
+	if err := query.Find(&domains).Error; err != nil {
+		return nil, fmt.Errorf("failed_to_get_domains")
+	}
+
+	return domains, nil
+}
+
+// checkDomainAllowed fails when the documentation rootId requires a login.
+// Its site is only served to signed in users under its base URL, and a domain
+// would redirect them away from it.
+func (service *DocService) checkDomainAllowed(rootId uint) error {
+	var doc models.Documentation
+	if err := service.DB.Select("id", "require_auth").First(&doc, rootId).Error; err != nil {
+		return fmt.Errorf("documentation_not_found")
+	}
+
+	if doc.RequireAuth {
+		return fmt.Errorf("documentation_requires_auth")
+	}
+
+	return nil
+}
+
+// AddDomain adds domain to the site of a documentation. It is served once
+// verified with VerifyDomain.
+func (service *DocService) AddDomain(docId uint, domain string) (models.DocumentationDomain, error) {
+	domain, err := normalizeDomain(domain)
+	if err != nil {
+		return models.DocumentationDomain{}, err
+	}
+
+	rootId, err := service.GetRootParentID(docId)
+	if err != nil {
+		return models.DocumentationDomain{}, fmt.Errorf("documentation_not_found")
+	}
+
+	if err := service.checkDomainAllowed(rootId); err != nil {
+		return models.DocumentationDomain{}, err
+	}
+
+	var count int64
+	service.DB.Model(&models.DocumentationDomain{}).Where("domain = ?", domain).Count(&count)
+	if count > 0 {
+		return models.DocumentationDomain{}, fmt.Errorf("domain_already_exists")
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		return models.DocumentationDomain{}, fmt.Errorf("failed_to_generate_token")
+	}
+
+	record := models.DocumentationDomain{
+		DocumentationID: rootId,
+		Domain:          domain,
+		Token:           token,
+	}
+	if err := service.DB.Create(&record).Error; err != nil {
+		return models.DocumentationDomain{}, fmt.Errorf("failed_to_add_domain")
+	}
+
+	return record, nil
+}
+
+// VerifyDomain looks up the challenge record of a domain, and starts serving
+// the site of its documentation on it if the record holds its token. The
+// site is rebuilt to be served from the root of the domain.
+func (service *DocService) VerifyDomain(domainId uint) (models.DocumentationDomain, error) {
+	var domain models.DocumentationDomain
+	if err := service.DB.First(&domain, domainId).Error; err != nil {
+		return models.DocumentationDomain{}, fmt.Errorf("domain_not_found")
+	}
+
+	if domain.Verified {
+		return domain, nil
+	}
+
+	if err := service.checkDomainAllowed(domain.DocumentationID); err != nil {
+		return models.DocumentationDomain{}, err
+	}
+
+	records, err := lookupTXT(DomainChallengeRecord(domain.Domain))
+	if err != nil || !slices.Contains(records, domain.Token) {
+		return models.DocumentationDomain{}, fmt.Errorf("domain_verification_failed")
+	}
+
+	rebuild := service.SiteDomainOf(domain.DocumentationID) == ""
+
+	now := time.Now()
+	if err := service.DB.Model(&domain).Updates(map[string]interface{}{
+		"verified":    true,
+		"verified_at": now,
+	}).Error; err != nil {
+		return models.DocumentationDomain{}, fmt.Errorf("failed_to_verify_domain")
+	}
+
+	domain.Verified = true
+	domain.VerifiedAt = &now
+
+	service.loadSiteDomains()
+	if rebuild {
+		if err := service.AddBuildTrigger(domain.DocumentationID, false, true); err != nil {
+			logger.Error("Failed to rebuild site for its domain", zap.Uint("doc_id", domain.DocumentationID), zap.Error(err))
+		}
+	}
+
+	return domain, nil
+}
+
+// DeleteDomain stops serving a site on a domain. A site left without a
+// domain is rebuilt to be served under its base URL again.
+func (service *DocService) DeleteDomain(domainId uint) error {
+	var domain models.DocumentationDomain
+	if err := service.DB.First(&domain, domainId).Error; err != nil {
+		return fmt.Errorf("domain_not_found")
+	}
+
+	if err := service.DB.Delete(&domain).Error; err != nil {
+		return fmt.Errorf("failed_to_delete_domain")
+	}
+
+	if !domain.Verified {
+		return nil
+	}
+
+	if service.loadSiteDomains().docs[domain.DocumentationID] == "" {
+		if err := service.AddBuildTrigger(domain.DocumentationID, false, true); err != nil {
+			logger.Error("Failed to rebuild site without its domain", zap.Uint("doc_id", domain.DocumentationID), zap.Error(err))
+		}
+	}
+
+	return nil
+}
+
+// deleteDomains removes the domains of a deleted documentation.
+func (service *DocService) deleteDomains(rootId uint) error {
+	if err := service.DB.Where("documentation_id = ?", rootId).Delete(&models.DocumentationDomain{}).Error; err != nil {
+		return err
+	}
+
+	service.loadSiteDomains()
+	return nil
+}
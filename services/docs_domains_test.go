@@ -0,0 +1,146 @@
+package services
+
+import (
+	"fmt"
+	"testing"
+
+	"git.difuse.io/Difuse/kalmia/db/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeDomain(t *testing.T) {
+	tests := []struct {
+		domain string
+		want   string
+		ok     bool
+	}{
+		{"docs.example.com", "docs.example.com", true},
+		{" Docs.Example.COM. ", "docs.example.com", true},
+		{"example", "", false},
+		{"docs.example.com/path", "", false},
+		{"-docs.example.com", "", false},
+		{"docs.example.com:8080", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.domain, func(t *testing.T) {
+			got, err := normalizeDomain(tt.domain)
+			if !tt.ok {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestDomains(t *testing.T) {
+	records := map[string][]string{}
+	originalLookupTXT := lookupTXT
+	lookupTXT = func(name string) ([]string, error) {
+		if values, ok := records[name]; ok {
+			return values, nil
+		}
+		return nil, fmt.Errorf("no such host")
+	}
+	t.Cleanup(func() { lookupTXT = originalLookupTXT })
+
+	doc := models.Documentation{Name: "Domains", Version: "1.0.0", BaseURL: "/domains", AuthorID: 1}
+	require.NoError(t, TestDocService.DB.Create(&doc).Error)
+
+	domain, err := TestDocService.AddDomain(doc.ID, "Docs.Domains.Example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "docs.domains.example.com", domain.Domain)
+	assert.NotEmpty(t, domain.Token)
+	assert.False(t, domain.Verified)
+
+	t.Run("Domains are unique", func(t *testing.T) {
+		_, err := TestDocService.AddDomain(doc.ID, "docs.domains.example.com")
+		assert.EqualError(t, err, "domain_already_exists")
+
+		_, err = TestDocService.AddDomain(doc.ID, "not a domain")
+		assert.EqualError(t, err, "invalid_domain")
+	})
+
+	t.Run("Unverified domains are not served", func(t *testing.T) {
+		_, err := TestDocService.VerifyDomain(domain.ID)
+		assert.EqualError(t, err, "domain_verification_failed")
+
+		records[DomainChallengeRecord(domain.Domain)] = []string{"someone else"}
+		_, err = TestDocService.VerifyDomain(domain.ID)
+		assert.EqualError(t, err, "domain_verification_failed")
+
+		_, _, _, err = TestDocService.GetRsPressByHost(domain.Domain)
+		assert.Error(t, err)
+		assert.Empty(t, TestDocService.SiteDomainOf(doc.ID))
+	})
+
+	t.Run("Verified domains serve their site from the root", func(t *testing.T) {
+		records[DomainChallengeRecord(domain.Domain)] = []string{"other", domain.Token}
+
+		verified, err := TestDocService.VerifyDomain(domain.ID)
+		require.NoError(t, err)
+		assert.True(t, verified.Verified)
+		assert.NotNil(t, verified.VerifiedAt)
+
+		docId, docPath, reqAuth, err := TestDocService.GetRsPressByHost("DOCS.domains.example.com:443")
+		require.NoError(t, err)
+		assert.Equal(t, doc.ID, docId)
+		assert.Contains(t, docPath, fmt.Sprintf("doc_%d", doc.ID))
+		assert.False(t, reqAuth)
+
+		assert.Equal(t, domain.Domain, TestDocService.SiteDomainOf(doc.ID))
+		assert.Equal(t, "/", TestDocService.siteView(doc.ID).baseURLOf(doc))
+
+		replacements, err := TestDocService.rsPressConfigReplacements(doc.ID)
+		require.NoError(t, err)
+		assert.Equal(t, "/", replacements["__BASE_URL__"])
+		assert.Equal(t, "https://"+domain.Domain, replacements["__URL__"])
+
+		domains, err := TestDocService.GetDomains(doc.ID)
+		require.NoError(t, err)
+		assert.Len(t, domains, 1)
+	})
+
+	t.Run("Documentation with a domain cannot require a login", func(t *testing.T) {
+		user, err := TestAuthService.GetUser(1)
+		require.NoError(t, err)
+
+		err = TestDocService.EditDocumentation(user, doc.ID, doc.Name, "", doc.Version, "", "", "", "", "", "", "", "",
+			"", "", "", doc.BaseURL, "", true, "", "", "", "", "", "", "", false, false, false, "", "", "", map[string]string{})
+		assert.EqualError(t, err, "documentation_has_domain")
+
+		var stored models.Documentation
+		require.NoError(t, TestDocService.DB.First(&stored, doc.ID).Error)
+		assert.False(t, stored.RequireAuth)
+	})
+
+	t.Run("Deleted domains are no longer served", func(t *testing.T) {
+		require.NoError(t, TestDocService.DeleteDomain(domain.ID))
+
+		_, _, _, err := TestDocService.GetRsPressByHost(domain.Domain)
+		assert.Error(t, err)
+		assert.Equal(t, "/domains", TestDocService.siteView(doc.ID).baseURLOf(doc))
+
+		assert.EqualError(t, TestDocService.DeleteDomain(domain.ID), "domain_not_found")
+	})
+
+	t.Run("Documentation requiring a login cannot have a domain", func(t *testing.T) {
+		require.NoError(t, TestDocService.DB.Model(&doc).Update("require_auth", true).Error)
+
+		_, err := TestDocService.AddDomain(doc.ID, "private.domains.example.com")
+		assert.EqualError(t, err, "documentation_requires_auth")
+
+		// Added before the documentation required a login
+		pending := models.DocumentationDomain{DocumentationID: doc.ID, Domain: "private.domains.example.com", Token: "token"}
+		require.NoError(t, TestDocService.DB.Create(&pending).Error)
+		records[DomainChallengeRecord(pending.Domain)] = []string{pending.Token}
+
+		_, err = TestDocService.VerifyDomain(pending.ID)
+		assert.EqualError(t, err, "documentation_requires_auth")
+		assert.Empty(t, TestDocService.SiteDomainOf(doc.ID))
+	})
+}
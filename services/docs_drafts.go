@@ -0,0 +1,333 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"git.difuse.io/Difuse/kalmia/db/models"
+	"gorm.io/gorm"
+)
+
+func (service *DocService) GetDraft(pageId uint) (models.PageDraft, error) {
+	var draft models.PageDraft
+	if err := service.DB.Where("page_id = ?", pageId).First(&draft).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return models.PageDraft{}, fmt.Errorf("draft_not_found")
+		}
+		return models.PageDraft{}, fmt.Errorf("failed_to_get_draft")
+	}
+
+	return draft, nil
+}
+
+// SaveDraft stores edits to a page without publishing them. Editing a draft
+// that is in review or approved sends it back to the author, as earlier
+// approvals no longer cover its content.
+func (service *DocService) SaveDraft(user models.User, pageId uint, title, slug, content string) (models.PageDraft, error) {
+	var page models.Page
+	if err := service.DB.First(&page, pageId).Error; err != nil {
+		return models.PageDraft{}, fmt.Errorf("page_not_found")
+	}
+
+	draft, err := service.GetDraft(pageId)
+	if err != nil && err.Error() != "draft_not_found" {
+		return models.PageDraft{}, err
+	}
+
+	if err != nil {
+		draft = models.PageDraft{
+			PageID:   pageId,
+			AuthorID: user.ID,
+			Content:  page.Content,
+		}
+	}
+
+	draft.Title = title
+	draft.Slug = slug
+	if content != "" {
+		draft.Content = content
+	}
+	draft.Status = models.PageDraftEditing
+	draft.LastEditorID = &user.ID
+	draft.ReviewRequestedAt = nil
+	draft.ApprovedAt = nil
+	draft.ApprovedByID = nil
+
+	if err := service.DB.Save(&draft).Error; err != nil {
+		return models.PageDraft{}, fmt.Errorf("failed_to_save_draft")
+	}
+
+	return draft, nil
+}
+
+// DiscardDraft drops the unpublished edits to a page. Pages that were never
+// published are kept, with their content, as drafts of their own.
+func (service *DocService) DiscardDraft(pageId uint) error {
+	result := service.DB.Where("page_id = ?", pageId).Delete(&models.PageDraft{})
+	if result.Error != nil {
+		return fmt.Errorf("failed_to_discard_draft")
+	}
+
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("draft_not_found")
+	}
+
+	return nil
+}
+
+func addPageReview(tx *gorm.DB, draft models.PageDraft, user models.User, action, comment string) error {
+	review := models.PageReview{
+		PageID:  draft.PageID,
+		DraftID: draft.ID,
+		UserID:  user.ID,
+		Action:  action,
+		Comment: comment,
+	}
+
+	if err := tx.Create(&review).Error; err != nil {
+		return fmt.Errorf("failed_to_record_review")
+	}
+
+	return nil
+}
+
+func (service *DocService) GetPageReviews(pageId uint) ([]models.PageReview, error) {
+	var reviews []models.PageReview
+	if err := service.DB.Preload("User", func(db *gorm.DB) *gorm.DB {
+		return db.Select("ID", "Username", "Email", "Photo")
+	}).Where("page_id = ?", pageId).Order("id ASC").Find(&reviews).Error; err != nil {
+		return nil, fmt.Errorf("failed_to_get_reviews")
+	}
+
+	return reviews, nil
+}
+
+func (service *DocService) RequestDraftReview(user models.User, pageId uint, comment string) error {
+	draft, err := service.GetDraft(pageId)
+	if err != nil {
+		return err
+	}
+
+	if draft.Status == models.PageDraftInReview || draft.Status == models.PageDraftApproved {
+		return fmt.Errorf("draft_already_in_review")
+	}
+
+	if err := service.DB.Model(&draft).Updates(map[string]interface{}{
+		"status":              models.PageDraftInReview,
+		"review_requested_at": time.Now(),
+	}).Error; err != nil {
+		return fmt.Errorf("failed_to_update_draft")
+	}
+
+	return addPageReview(service.DB, draft, user, models.PageReviewRequested, comment)
+}
+
+// GetReviewers returns the users allowed to approve drafts of a
+// documentation and its versions.
+func (service *DocService) GetReviewers(docId uint) ([]models.User, error) {
+	rootId, err := service.GetRootParentID(docId)
+	if err != nil {
+		return nil, fmt.Errorf("documentation_not_found")
+	}
+
+	var reviewers []models.User
+	if err := service.DB.Model(&models.Documentation{ID: rootId}).Association("Reviewers").
+		Find(&reviewers); err != nil {
+		return nil, fmt.Errorf("failed_to_get_reviewers")
+	}
+
+	for i := range reviewers {
+		reviewers[i] = models.User{
+			ID:       reviewers[i].ID,
+			Username: reviewers[i].Username,
+			Email:    reviewers[i].Email,
+			Photo:    reviewers[i].Photo,
+		}
+	}
+
+	return reviewers, nil
+}
+
+// SetReviewers replaces the reviewers of a documentation. Once a
+// documentation has reviewers, drafts must be approved by one of them
+// before they can be published.
+func (service *DocService) SetReviewers(docId uint, userIds []uint) error {
+	if !service.IsDocIdValid(docId) {
+		return fmt.Errorf("invalid_documentation_id")
+	}
+
+	var users []models.User
+	if len(userIds) > 0 {
+		if err := service.DB.Where("id IN ?", userIds).Find(&users).Error; err != nil {
+			return fmt.Errorf("failed_to_get_users")
+		}
+
+		if len(users) != len(userIds) {
+			return fmt.Errorf("user_not_found")
+		}
+	}
+
+	if err := service.DB.Model(&models.Documentation{ID: docId}).Association("Reviewers").Replace(users); err != nil {
+		return fmt.Errorf("failed_to_update_reviewers")
+	}
+
+	return nil
+}
+
+// ReviewRequired reports whether edits to a documentation have to go
+// through an approved draft, which is the case once it has reviewers.
+func (service *DocService) ReviewRequired(docId uint) bool {
+	reviewers, err := service.GetReviewers(docId)
+	return err == nil && len(reviewers) > 0
+}
+
+func (service *DocService) draftReviewers(pageId uint) ([]models.User, error) {
+	docId, err := service.GetDocumentationIDOfPage(pageId)
+	if err != nil {
+		return nil, fmt.Errorf("failed_to_get_documentation_id")
+	}
+
+	return service.GetReviewers(docId)
+}
+
+// reviewDraft checks that user may review the draft of a page: admins and
+// the reviewers of its documentation can, except for their own edits.
+func (service *DocService) reviewDraft(user models.User, pageId uint) (models.PageDraft, error) {
+	draft, err := service.GetDraft(pageId)
+	if err != nil {
+		return models.PageDraft{}, err
+	}
+
+	if draft.Status != models.PageDraftInReview {
+		return models.PageDraft{}, fmt.Errorf("draft_not_in_review")
+	}
+
+	if user.Admin {
+		return draft, nil
+	}
+
+	if draft.LastEditorID != nil && *draft.LastEditorID == user.ID {
+		return models.PageDraft{}, fmt.Errorf("cannot_review_own_draft")
+	}
+
+	reviewers, err := service.draftReviewers(pageId)
+	if err != nil {
+		return models.PageDraft{}, err
+	}
+
+	for _, reviewer := range reviewers {
+		if reviewer.ID == user.ID {
+			return draft, nil
+		}
+	}
+
+	return models.PageDraft{}, fmt.Errorf("not_a_reviewer")
+}
+
+func (service *DocService) ApproveDraft(user models.User, pageId uint, comment string) error {
+	draft, err := service.reviewDraft(user, pageId)
+	if err != nil {
+		return err
+	}
+
+	if err := service.DB.Model(&draft).Updates(map[string]interface{}{
+		"status":         models.PageDraftApproved,
+		"approved_at":    time.Now(),
+		"approved_by_id": user.ID,
+	}).Error; err != nil {
+		return fmt.Errorf("failed_to_update_draft")
+	}
+
+	return addPageReview(service.DB, draft, user, models.PageReviewApproved, comment)
+}
+
+func (service *DocService) RequestDraftChanges(user models.User, pageId uint, comment string) error {
+	draft, err := service.reviewDraft(user, pageId)
+	if err != nil {
+		return err
+	}
+
+	if err := service.DB.Model(&draft).Update("status", models.PageDraftChangesRequested).Error; err != nil {
+		return fmt.Errorf("failed_to_update_draft")
+	}
+
+	return addPageReview(service.DB, draft, user, models.PageReviewChangesRequested, comment)
+}
+
+// PublishDraft copies the draft of a page onto the page, which is then
+// built like any other edit. When the documentation has reviewers the draft
+// must have been approved first.
+func (service *DocService) PublishDraft(user models.User, pageId uint) error {
+	draft, err := service.GetDraft(pageId)
+	if err != nil {
+		return err
+	}
+
+	reviewers, err := service.draftReviewers(pageId)
+	if err != nil {
+		return err
+	}
+
+	if len(reviewers) > 0 && draft.Status != models.PageDraftApproved {
+		return fmt.Errorf("draft_not_approved")
+	}
+
+	// A build must never see the page published with its old content, nor
+	// the content published with the draft still pending
+	var page models.Page
+	err = service.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.Page{}).Where("id = ?", pageId).Update("is_draft", false).Error; err != nil {
+			return fmt.Errorf("failed_to_update_page")
+		}
+
+		page, err = editPage(tx, user, pageId, draft.Title, draft.Slug, draft.Content, nil, nil)
+		if err != nil {
+			return err
+		}
+
+		if err := addPageReview(tx, draft, user, models.PageReviewPublished, ""); err != nil {
+			return err
+		}
+
+		if err := tx.Delete(&draft).Error; err != nil {
+			return fmt.Errorf("failed_to_discard_draft")
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return service.pageEdited(page)
+}
+
+// PreviewDraft renders the draft of a page to the MDX that publishing it
+// would write.
+func (service *DocService) PreviewDraft(pageId uint) (string, error) {
+	draft, err := service.GetDraft(pageId)
+	if err != nil {
+		return "", err
+	}
+
+	preview, err := service.CraftPage(pageId, draft.Title, draft.Slug, draft.Content)
+	if err != nil {
+		return "", fmt.Errorf("failed_to_render_draft")
+	}
+
+	return preview, nil
+}
+
+// deletePageDrafts removes the drafts and review history of deleted pages.
+func deletePageDrafts(tx *gorm.DB, pageIds []uint) error {
+	if len(pageIds) == 0 {
+		return nil
+	}
+
+	if err := tx.Where("page_id IN ?", pageIds).Delete(&models.PageDraft{}).Error; err != nil {
+		return err
+	}
+
+	return tx.Where("page_id IN ?", pageIds).Delete(&models.PageReview{}).Error
+}
@@ -0,0 +1,109 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"git.difuse.io/Difuse/kalmia/db/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDraftReview(t *testing.T) {
+	require.NoError(t, TestDocService.DB.Model(&models.BuildTriggers{}).
+		Where("triggered = ?", false).Update("triggered", true).Error)
+
+	author := models.User{Username: "draft_author", Email: "draft_author@example.com", Password: "x"}
+	reviewer := models.User{Username: "draft_reviewer", Email: "draft_reviewer@example.com", Password: "x"}
+	outsider := models.User{Username: "draft_outsider", Email: "draft_outsider@example.com", Password: "x"}
+	for _, user := range []*models.User{&author, &reviewer, &outsider} {
+		require.NoError(t, TestDocService.DB.Create(user).Error)
+	}
+
+	doc := models.Documentation{Name: "Drafts", Version: "1.0.0", BaseURL: "/drafts", AuthorID: 1}
+	require.NoError(t, TestDocService.DB.Create(&doc).Error)
+
+	page := models.Page{DocumentationID: doc.ID, Title: "Guide", Slug: "/guide", Content: "[]", AuthorID: author.ID, IsDraft: true}
+	require.NoError(t, TestDocService.CreatePage(&page))
+
+	t.Run("New draft page is not written", func(t *testing.T) {
+		var pages []models.Page
+		require.NoError(t, TestDocService.DB.Where("documentation_id = ?", doc.ID).Find(&pages).Error)
+		assert.Empty(t, publishedPages(pages, time.Now()))
+
+		draft, err := TestDocService.GetDraft(page.ID)
+		require.NoError(t, err)
+		assert.Equal(t, models.PageDraftEditing, draft.Status)
+	})
+
+	require.NoError(t, TestDocService.SetReviewers(doc.ID, []uint{reviewer.ID}))
+	assert.True(t, TestDocService.ReviewRequired(doc.ID))
+	assert.EqualError(t, TestDocService.SetReviewers(doc.ID, []uint{0}), "user_not_found")
+
+	_, err := TestDocService.SaveDraft(author, page.ID, "Guide", "/guide", "[]")
+	require.NoError(t, err)
+
+	t.Run("Publishing needs approval", func(t *testing.T) {
+		assert.EqualError(t, TestDocService.PublishDraft(author, page.ID), "draft_not_approved")
+		assert.EqualError(t, TestDocService.ApproveDraft(reviewer, page.ID, ""), "draft_not_in_review")
+	})
+
+	require.NoError(t, TestDocService.RequestDraftReview(author, page.ID, "Ready"))
+
+	t.Run("Reviewer permissions", func(t *testing.T) {
+		assert.EqualError(t, TestDocService.RequestDraftReview(author, page.ID, ""), "draft_already_in_review")
+		assert.EqualError(t, TestDocService.ApproveDraft(outsider, page.ID, ""), "not_a_reviewer")
+
+		require.NoError(t, TestDocService.SetReviewers(doc.ID, []uint{reviewer.ID, author.ID}))
+		assert.EqualError(t, TestDocService.ApproveDraft(author, page.ID, ""), "cannot_review_own_draft")
+	})
+
+	t.Run("Changes requested", func(t *testing.T) {
+		require.NoError(t, TestDocService.RequestDraftChanges(reviewer, page.ID, "Needs an example"))
+
+		draft, err := TestDocService.GetDraft(page.ID)
+		require.NoError(t, err)
+		assert.Equal(t, models.PageDraftChangesRequested, draft.Status)
+	})
+
+	t.Run("Approve and publish", func(t *testing.T) {
+		_, err := TestDocService.SaveDraft(author, page.ID, "Getting started", "/getting-started", "[]")
+		require.NoError(t, err)
+		require.NoError(t, TestDocService.RequestDraftReview(author, page.ID, ""))
+		require.NoError(t, TestDocService.ApproveDraft(reviewer, page.ID, "LGTM"))
+		require.NoError(t, TestDocService.PublishDraft(author, page.ID))
+
+		var published models.Page
+		require.NoError(t, TestDocService.DB.First(&published, page.ID).Error)
+		assert.False(t, published.IsDraft)
+		assert.Equal(t, "Getting started", published.Title)
+		assert.Equal(t, "/getting-started", published.Slug)
+
+		_, err = TestDocService.GetDraft(page.ID)
+		assert.EqualError(t, err, "draft_not_found")
+
+		reviews, err := TestDocService.GetPageReviews(page.ID)
+		require.NoError(t, err)
+
+		var actions []string
+		for _, review := range reviews {
+			actions = append(actions, review.Action)
+		}
+		assert.Equal(t, []string{
+			models.PageReviewRequested,
+			models.PageReviewChangesRequested,
+			models.PageReviewRequested,
+			models.PageReviewApproved,
+			models.PageReviewPublished,
+		}, actions)
+	})
+
+	t.Run("Without reviewers drafts publish directly", func(t *testing.T) {
+		require.NoError(t, TestDocService.SetReviewers(doc.ID, nil))
+		assert.False(t, TestDocService.ReviewRequired(doc.ID))
+
+		_, err := TestDocService.SaveDraft(author, page.ID, "Getting started", "/getting-started", "[]")
+		require.NoError(t, err)
+		require.NoError(t, TestDocService.PublishDraft(author, page.ID))
+	})
+}
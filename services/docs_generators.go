@@ -0,0 +1,167 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"git.difuse.io/Difuse/kalmia/config"
+	"git.difuse.io/Difuse/kalmia/db/models"
+	"git.difuse.io/Difuse/kalmia/logger"
+	"git.difuse.io/Difuse/kalmia/utils"
+	"go.uber.org/zap"
+)
+
+// generatorStamp records, in the folder of a documentation, the name of the
+// generator its site was last built with.
+const generatorStamp = ".generator"
+
+// SiteGenerator turns the content of a documentation into the static site
+// it is served from. A documentation and all of its versions are built by
+// the generator chosen for the documentation.
+type SiteGenerator interface {
+	// Name returns the name a documentation picks the generator by.
+	Name() string
+	// Init prepares the folder of a documentation for its first build.
+	Init(rootId uint) error
+	// Initialized reports whether the folder of a documentation has been
+	// prepared by Init.
+	Initialized(rootId uint) bool
+	// WriteConfig writes the site configuration of a documentation,
+	// reporting whether it changed since the last build.
+	WriteConfig(docId uint, rootId uint) (bool, error)
+	// WriteContents writes the published content of every version of a
+	// documentation, reporting whether any of it changed since the last build.
+	WriteContents(ctx context.Context, docId uint, rootId uint) (bool, error)
+	// Build builds the site and serves it. Without rebuild, the site of the
+	// last build is served as it is.
+	Build(ctx context.Context, rootId uint, rebuild bool) error
+	// BuildGit builds the site into gitbuild, to be served from the root of
+	// a git repository.
+	BuildGit(ctx context.Context, rootId uint) error
+	// BuildPreview builds the site as it appears in view into the build
+	// folder of a preview.
+	BuildPreview(ctx context.Context, preview models.PreviewBuild, view contentView) error
+}
+
+// generatorName validates the name of the generator a documentation is to be
+// built with. Documentations that do not pick one are built with rspress.
+func generatorName(name string) (string, error) {
+	switch name {
+	case "":
+		return models.GeneratorRsPress, nil
+	case models.GeneratorRsPress, models.GeneratorHTML:
+		return name, nil
+	}
+
+	return "", fmt.Errorf("invalid_generator")
+}
+
+func (service *DocService) generatorNamed(name string) SiteGenerator {
+	if name == models.GeneratorHTML {
+		return htmlGenerator{service: service}
+	}
+
+	return rsPressGenerator{service: service}
+}
+
+// siteGenerator returns the generator a documentation is built with.
+func (service *DocService) siteGenerator(rootId uint) SiteGenerator {
+	var names []string
+	service.DB.Model(&models.Documentation{}).Where("id = ?", rootId).Pluck("generator", &names)
+
+	if len(names) == 0 {
+		return service.generatorNamed("")
+	}
+
+	return service.generatorNamed(names[0])
+}
+
+// buildGenerator returns the generator a documentation is to be built with
+// on this host. Documentations built with rspress fall back to the built-in
+// HTML generator while pnpm or the registry it installs packages from is
+// unavailable.
+func (service *DocService) buildGenerator(rootId uint) SiteGenerator {
+	generator := service.siteGenerator(rootId)
+
+	if rsPress, ok := generator.(rsPressGenerator); ok && !rsPress.available(rootId) {
+		logger.Warn("NPM is unavailable, building with the built-in HTML generator", zap.Uint("doc_id", rootId))
+		return service.generatorNamed(models.GeneratorHTML)
+	}
+
+	return generator
+}
+
+// generatorChanged reports whether the site of a documentation was last
+// built with a generator other than generator.
+func generatorChanged(rootId uint, generator SiteGenerator) bool {
+	built, err := os.ReadFile(filepath.Join(utils.GetDocPathByID(rootId, config.ParsedConfig), generatorStamp))
+	return err != nil || string(built) != generator.Name()
+}
+
+func markGenerator(rootId uint, generator SiteGenerator) error {
+	return utils.WriteToFile(filepath.Join(utils.GetDocPathByID(rootId, config.ParsedConfig), generatorStamp), generator.Name())
+}
+
+// rsPressGenerator builds documentations with rspress, from the project in
+// embedded/rspress and the packages pnpm installs for it.
+type rsPressGenerator struct {
+	service *DocService
+}
+
+func (generator rsPressGenerator) Name() string {
+	return models.GeneratorRsPress
+}
+
+// available reports whether a documentation can be built with rspress, which
+// needs pnpm and, unless its packages are already installed, the registry or
+// an offline store.
+func (generator rsPressGenerator) available(rootId uint) bool {
+	docPath := utils.GetDocPathByID(rootId, config.ParsedConfig)
+	if buildStepDone(docPath, installStamp, installInputs...) && generator.Initialized(rootId) {
+		_, err := exec.LookPath("pnpm")
+		return err == nil
+	}
+
+	return npmAvailable()
+}
+
+func (generator rsPressGenerator) Init(rootId uint) error {
+	return generator.service.InitRsPress(rootId)
+}
+
+func (generator rsPressGenerator) Initialized(rootId uint) bool {
+	return utils.PathExists(filepath.Join(utils.GetDocPathByID(rootId, config.ParsedConfig), "node_modules"))
+}
+
+func (generator rsPressGenerator) WriteConfig(docId uint, rootId uint) (bool, error) {
+	// The config is written in full every time, its hash tells whether the
+	// site has to be rebuilt for it
+	preConfigHash, _ := utils.FileHash(filepath.Join(utils.GetDocPathByID(rootId, config.ParsedConfig), "rspress.config.ts"))
+
+	configHash, err := generator.service.StartUpdate(docId, rootId)
+	if err != nil {
+		return false, err
+	}
+
+	return configHash != preConfigHash, nil
+}
+
+func (generator rsPressGenerator) WriteContents(ctx context.Context, docId uint, rootId uint) (bool, error) {
+	return generator.service.WriteContents(ctx, docId, rootId)
+}
+
+func (generator rsPressGenerator) Build(ctx context.Context, rootId uint, rebuild bool) error {
+	return generator.service.RsPressBuild(ctx, rootId, rebuild)
+}
+
+func (generator rsPressGenerator) BuildGit(ctx context.Context, rootId uint) error {
+	docPath := utils.GetDocPathByID(rootId, config.ParsedConfig)
+	return utils.RunNpxCommandContext(ctx, buildRecorderFrom(ctx).output(), docPath, "rspress", "build", "--config", "rspress.config.git.ts")
+}
+
+func (generator rsPressGenerator) BuildPreview(ctx context.Context, preview models.PreviewBuild, view contentView) error {
+	return generator.service.rsPressPreview(ctx, preview, view)
+}
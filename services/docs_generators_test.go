@@ -0,0 +1,158 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.difuse.io/Difuse/kalmia/config"
+	"git.difuse.io/Difuse/kalmia/db/models"
+	"git.difuse.io/Difuse/kalmia/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGeneratorName(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+		valid    bool
+	}{
+		{"", models.GeneratorRsPress, true},
+		{models.GeneratorRsPress, models.GeneratorRsPress, true},
+		{models.GeneratorHTML, models.GeneratorHTML, true},
+		{"hugo", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, err := generatorName(tt.name)
+			if !tt.valid {
+				assert.EqualError(t, err, "invalid_generator")
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, name)
+		})
+	}
+}
+
+func TestSiteGenerator(t *testing.T) {
+	rsPressDoc := models.Documentation{Name: "Generator rspress", Version: "1.0.0", BaseURL: "/generator-rspress", AuthorID: 1}
+	require.NoError(t, TestDocService.DB.Create(&rsPressDoc).Error)
+
+	htmlDoc := models.Documentation{Name: "Generator html", Version: "1.0.0", BaseURL: "/generator-html", AuthorID: 1, Generator: models.GeneratorHTML}
+	require.NoError(t, TestDocService.DB.Create(&htmlDoc).Error)
+
+	assert.IsType(t, rsPressGenerator{}, TestDocService.siteGenerator(rsPressDoc.ID))
+	assert.IsType(t, htmlGenerator{}, TestDocService.siteGenerator(htmlDoc.ID))
+
+	t.Run("Falls back to HTML without pnpm", func(t *testing.T) {
+		t.Setenv("PATH", t.TempDir())
+
+		assert.IsType(t, htmlGenerator{}, TestDocService.buildGenerator(rsPressDoc.ID))
+		assert.IsType(t, htmlGenerator{}, TestDocService.buildGenerator(htmlDoc.ID))
+	})
+
+	t.Run("Generator changes are detected", func(t *testing.T) {
+		require.NoError(t, utils.MakeDir(utils.GetDocPathByID(htmlDoc.ID, config.ParsedConfig)))
+
+		generator := TestDocService.siteGenerator(htmlDoc.ID)
+		assert.True(t, generatorChanged(htmlDoc.ID, generator))
+
+		require.NoError(t, markGenerator(htmlDoc.ID, generator))
+		assert.False(t, generatorChanged(htmlDoc.ID, generator))
+		assert.True(t, generatorChanged(htmlDoc.ID, TestDocService.generatorNamed(models.GeneratorRsPress)))
+	})
+}
+
+func TestHTMLRender(t *testing.T) {
+	doc := models.Documentation{Name: "HTML Docs", Version: "1.0.0", BaseURL: "/html-docs", AuthorID: 1,
+		Generator: models.GeneratorHTML, CustomCSS: ".content { color: teal; }", CopyrightText: "Example Inc.",
+		NavImage: "/logo.png", MoreLabelLinks: `[{"label":"Blog","link":"https://example.com/blog"}]`,
+		FooterLabelLinks: `[{"icon":"github","link":"https://github.com/example"}]`}
+	require.NoError(t, TestDocService.DB.Create(&doc).Error)
+
+	intro := models.Page{DocumentationID: doc.ID, Title: "Introduction", Slug: "/", AuthorID: 1, IsIntroPage: true,
+		Content: `[{"type":"paragraph","content":[{"type":"text","text":"Welcome","styles":{}}],"children":[]}]`}
+	require.NoError(t, TestDocService.DB.Create(&intro).Error)
+
+	group := models.PageGroup{DocumentationID: doc.ID, Name: "Advanced", AuthorID: 1}
+	require.NoError(t, TestDocService.DB.Create(&group).Error)
+
+	setup := models.Page{DocumentationID: doc.ID, PageGroupID: &group.ID, Title: "Setup", Slug: "/setup", AuthorID: 1,
+		Content: `[{"type":"heading","props":{"level":2},"content":[{"type":"text","text":"Install","styles":{}}],"children":[]}]`}
+	require.NoError(t, TestDocService.DB.Create(&setup).Error)
+
+	hidden := models.Page{DocumentationID: doc.ID, Title: "Hidden", Slug: "/hidden", Content: "[]", AuthorID: 1, IsDraft: true}
+	require.NoError(t, TestDocService.DB.Create(&hidden).Error)
+
+	generator := htmlGenerator{service: TestDocService}
+	outDir := t.TempDir()
+
+	require.NoError(t, generator.render(context.Background(), publishedView(time.Now()), doc.ID, outDir))
+
+	readFile := func(path ...string) string {
+		content, err := os.ReadFile(filepath.Join(append([]string{outDir}, path...)...))
+		require.NoError(t, err)
+		return string(content)
+	}
+
+	t.Run("Pages", func(t *testing.T) {
+		introPage := readFile("guides", "index.html")
+		assert.Contains(t, introPage, "<p>Welcome</p>")
+		assert.Contains(t, introPage, "<title>Introduction | HTML Docs</title>")
+		assert.Contains(t, introPage, ".content { color: teal; }")
+		assert.Contains(t, introPage, "Example Inc.")
+		assert.Contains(t, introPage, `<img class="logo logo-light" src="/html-docs/logo.png"`)
+		assert.Contains(t, introPage, `<img class="logo logo-dark" src="/html-docs/logo.png"`)
+		assert.Contains(t, introPage, `<a href="https://example.com/blog">Blog</a>`)
+		assert.Contains(t, introPage, `<a href="https://github.com/example" rel="noopener">Github</a>`)
+		assert.NotContains(t, introPage, "version-switcher")
+
+		setupPage := readFile("guides", "advanced", "setup", "index.html")
+		assert.Contains(t, setupPage, `<h2 id="install">Install</h2>`)
+		assert.Contains(t, setupPage, `<a href="/html-docs/guides/advanced/setup/" class="active" aria-current="page">Setup</a>`)
+		assert.Contains(t, setupPage, `href="/html-docs/_kalmia/style.css"`)
+		assert.Contains(t, setupPage, `<details open>`)
+		assert.Contains(t, setupPage, `src="/html-docs/_kalmia/site.js"`)
+		assert.Contains(t, readFile("_kalmia", "site.js"), "search-index.json")
+
+		assert.False(t, utils.PathExists(filepath.Join(outDir, "guides", "hidden")))
+	})
+
+	t.Run("Search index", func(t *testing.T) {
+		var index []htmlSearchEntry
+		require.NoError(t, json.Unmarshal([]byte(readFile("search-index.json")), &index))
+
+		assert.Contains(t, index, htmlSearchEntry{Title: "Introduction", Link: "/html-docs/guides/", Text: "Welcome"})
+		assert.Contains(t, index, htmlSearchEntry{Title: "Setup", Link: "/html-docs/guides/advanced/setup/", Text: "Install"})
+	})
+
+	t.Run("Home page redirects to the guides", func(t *testing.T) {
+		assert.Contains(t, readFile("index.html"), `content="0; url=/html-docs/guides/"`)
+	})
+
+	t.Run("Older versions are served from their folder", func(t *testing.T) {
+		require.NoError(t, TestDocService.CreateDocumentationVersion(doc.ID, "2.0.0"))
+		require.NoError(t, generator.render(context.Background(), publishedView(time.Now()), doc.ID, outDir))
+
+		assert.Contains(t, readFile("1.0.0", "guides", "index.html"), `href="/html-docs/1.0.0/guides/"`)
+		assert.Contains(t, readFile("guides", "index.html"), `href="/html-docs/guides/"`)
+		assert.Contains(t, readFile("1.0.0", "guides", "index.html"), `<option value="/html-docs/1.0.0/" selected>1.0.0</option>`)
+		assert.Contains(t, readFile("guides", "index.html"), `<option value="/html-docs/" selected>2.0.0</option>`)
+		assert.True(t, utils.PathExists(filepath.Join(outDir, "1.0.0", "search-index.json")))
+	})
+
+	t.Run("Unpublished pages are pruned", func(t *testing.T) {
+		require.NoError(t, TestDocService.DB.Model(&models.Page{}).Where("documentation_id = ? AND title = ?", doc.ID, "Setup").
+			Update("is_draft", true).Error)
+		require.NoError(t, generator.render(context.Background(), publishedView(time.Now()), doc.ID, outDir))
+
+		assert.False(t, utils.PathExists(filepath.Join(outDir, "1.0.0", "guides", "advanced", "setup")))
+	})
+}
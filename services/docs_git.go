@@ -1,22 +1,267 @@
 package services
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"git.difuse.io/Difuse/kalmia/config"
+	"git.difuse.io/Difuse/kalmia/db/models"
 	"git.difuse.io/Difuse/kalmia/logger"
+	"git.difuse.io/Difuse/kalmia/metrics"
+	"git.difuse.io/Difuse/kalmia/secrets"
+	"git.difuse.io/Difuse/kalmia/tracing"
 	"git.difuse.io/Difuse/kalmia/utils"
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
 	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
+	"gorm.io/gorm"
 )
 
-func (service *DocService) GitDeploy(docId uint) error {
+// encryptGitSecrets encrypts the git password and SSH private key of doc in
+// place, deriving the public key from an uploaded private key.
+func encryptGitSecrets(doc *models.Documentation) error {
+	if doc.GitSSHPrivateKey != "" && !secrets.IsEncrypted(doc.GitSSHPrivateKey) {
+		publicKey, err := utils.SSHPublicKey(doc.GitSSHPrivateKey)
+		if err != nil {
+			return fmt.Errorf("invalid_git_ssh_key")
+		}
+		doc.GitSSHPublicKey = publicKey
+	}
+
+	if doc.GitSSHKnownHosts != "" {
+		if err := utils.ValidateKnownHosts(doc.GitSSHKnownHosts); err != nil {
+			return fmt.Errorf("invalid_git_ssh_known_hosts")
+		}
+	}
+
+	var err error
+	if doc.GitPassword, err = encryptGitSecret(doc.GitPassword); err != nil {
+		return fmt.Errorf("failed_to_encrypt_git_password")
+	}
+
+	if doc.GitSSHPrivateKey, err = encryptGitSecret(doc.GitSSHPrivateKey); err != nil {
+		return fmt.Errorf("failed_to_encrypt_git_ssh_key")
+	}
+
+	return nil
+}
+
+func encryptGitSecret(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+
+	if secrets.IsEncrypted(value) {
+		return value, nil
+	}
+
+	return secrets.Encrypt(value)
+}
+
+// MigrateSecrets encrypts git credentials stored before encryption at rest,
+// and re-encrypts ones sealed with a previous key after a key rotation.
+func (service *DocService) MigrateSecrets() error {
+	var docs []models.Documentation
+	if err := service.DB.Select("ID", "GitPassword", "GitSSHPrivateKey").
+		Where("git_password != '' OR git_ssh_private_key != ''").Find(&docs).Error; err != nil {
+		return fmt.Errorf("failed to fetch documentations: %v", err)
+	}
+
+	migrated := 0
+	for _, doc := range docs {
+		updates := map[string]interface{}{}
+
+		password, changed, err := secrets.Rotate(doc.GitPassword)
+		if err != nil {
+			logger.Error("Failed to encrypt git password", zap.Uint("doc_id", doc.ID), zap.Error(err))
+		} else if changed {
+			updates["git_password"] = password
+		}
+
+		privateKey, changed, err := secrets.Rotate(doc.GitSSHPrivateKey)
+		if err != nil {
+			logger.Error("Failed to encrypt git SSH key", zap.Uint("doc_id", doc.ID), zap.Error(err))
+		} else if changed {
+			updates["git_ssh_private_key"] = privateKey
+		}
+
+		if len(updates) == 0 {
+			continue
+		}
+
+		if err := service.DB.Model(&models.Documentation{}).Where("id = ?", doc.ID).Updates(updates).Error; err != nil {
+			logger.Error("Failed to update documentation secrets", zap.Uint("doc_id", doc.ID), zap.Error(err))
+			continue
+		}
+
+		migrated++
+	}
+
+	if migrated > 0 {
+		logger.Info("Encrypted stored secrets", zap.Int("documentations", migrated))
+	}
+
+	return nil
+}
+
+// gitAuth returns the credentials used to reach repoURL on behalf of a
+// documentation: its SSH key for SSH remotes, basic auth otherwise, or nil
+// for anonymous access.
+func (service *DocService) gitAuth(docId uint, repoURL string) (transport.AuthMethod, error) {
+	var doc models.Documentation
+	if err := service.DB.Select("ID", "GitUser", "GitPassword", "GitSSHPrivateKey", "GitSSHKnownHosts").
+		First(&doc, docId).Error; err != nil {
+		return nil, fmt.Errorf("documentation_not_found")
+	}
+
+	if utils.IsSSHGitURL(repoURL) {
+		if doc.GitSSHPrivateKey == "" {
+			return nil, fmt.Errorf("git_ssh_key_not_set")
+		}
+
+		privateKey, err := secrets.Decrypt(doc.GitSSHPrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed_to_decrypt_git_ssh_key")
+		}
+
+		return utils.GitSSHAuth(repoURL, privateKey, doc.GitSSHKnownHosts, func(line string) {
+			service.pinGitHostKey(docId, line)
+		})
+	}
+
+	password, err := secrets.Decrypt(doc.GitPassword)
+	if err != nil {
+		return nil, fmt.Errorf("failed_to_decrypt_git_password")
+	}
+
+	if doc.GitUser == "" && password == "" {
+		return nil, nil
+	}
+
+	return &http.BasicAuth{
+		Username: doc.GitUser,
+		Password: password,
+	}, nil
+}
+
+// pinGitHostKey remembers the first host key seen for a host of a
+// documentation's remotes, so that later connections to that host are refused
+// if it changes.
+func (service *DocService) pinGitHostKey(docId uint, line string) {
+	ids, err := service.gitVersionIDs(docId)
+	if err != nil {
+		logger.Error("Failed to pin git host key", zap.Uint("doc_id", docId), zap.Error(err))
+		return
+	}
+
+	err = service.DB.Transaction(func(tx *gorm.DB) error {
+		var docs []models.Documentation
+		if err := tx.Select("ID", "GitSSHKnownHosts").Where("id IN ?", ids).Find(&docs).Error; err != nil {
+			return err
+		}
+
+		for _, doc := range docs {
+			if strings.Contains(doc.GitSSHKnownHosts, line) {
+				continue
+			}
+
+			knownHosts := line
+			if pins := strings.TrimRight(doc.GitSSHKnownHosts, "\n"); pins != "" {
+				knownHosts = pins + "\n" + line
+			}
+
+			if err := tx.Model(&models.Documentation{}).Where("id = ?", doc.ID).
+				Update("git_ssh_known_hosts", knownHosts).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		logger.Error("Failed to pin git host key", zap.Uint("doc_id", docId), zap.Error(err))
+		return
+	}
+
+	logger.Warn("Pinned new git host key", zap.Uint("doc_id", docId), zap.String("host_key", line))
+}
+
+func (service *DocService) gitVersionIDs(docId uint) ([]uint, error) {
+	rootId, err := service.GetRootParentID(docId)
+	if err != nil {
+		return nil, err
+	}
+
+	versionInfos, err := service.buildVersionTree(rootId)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]uint, 0, len(versionInfos))
+	for _, versionInfo := range versionInfos {
+		ids = append(ids, versionInfo.DocId)
+	}
+
+	return ids, nil
+}
+
+// GenerateGitSSHKey creates a new deploy key for a documentation and all of
+// its versions, returning the public key to be added to the git server.
+func (service *DocService) GenerateGitSSHKey(docId uint) (string, error) {
+	ids, err := service.gitVersionIDs(docId)
+	if err != nil {
+		return "", fmt.Errorf("documentation_not_found")
+	}
+
+	privateKey, publicKey, err := utils.GenerateSSHKey(fmt.Sprintf("kalmia-doc-%d", ids[0]))
+	if err != nil {
+		return "", fmt.Errorf("failed_to_generate_ssh_key")
+	}
+
+	encryptedKey, err := secrets.Encrypt(privateKey)
+	if err != nil {
+		return "", fmt.Errorf("failed_to_encrypt_ssh_key")
+	}
+
+	if err := service.DB.Model(&models.Documentation{}).Where("id IN ?", ids).Updates(map[string]interface{}{
+		"git_ssh_private_key": encryptedKey,
+		"git_ssh_public_key":  publicKey,
+	}).Error; err != nil {
+		return "", fmt.Errorf("failed_to_update_documentation")
+	}
+
+	return publicKey, nil
+}
+
+// startGitSpan starts the span of a git operation on the repository at url.
+func startGitSpan(ctx context.Context, operation string, url string) (context.Context, trace.Span) {
+	return tracing.Start(ctx, "git "+operation,
+		attribute.String("vcs.operation", operation),
+		attribute.String("vcs.repository.url.full", url),
+	)
+}
+
+// endGitSpan ends the span of a git operation, which did not fail when
+// there was nothing to do.
+func endGitSpan(span trace.Span, err error) {
+	if errors.Is(err, git.NoErrAlreadyUpToDate) {
+		err = nil
+	}
+
+	tracing.End(span, err)
+}
+
+func (service *DocService) GitDeploy(ctx context.Context, docId uint) (err error) {
 	doc, err := service.GetDocumentation(docId)
 	if err != nil {
 		return fmt.Errorf("failed to get documentation: %v", err)
@@ -26,6 +271,22 @@ func (service *DocService) GitDeploy(docId uint) error {
 		return nil
 	}
 
+	recorder := buildRecorderFrom(ctx)
+	ctx = recorder.startPhase(ctx, BuildPhaseGitDeploy)
+
+	start := time.Now()
+	defer func() {
+		result := "success"
+		if err != nil {
+			result = "failure"
+			recorder.logf("Git deploy failed: %v", err)
+			recorder.endPhase(models.BuildRunFailed)
+		}
+
+		metrics.GitDeploys.WithLabelValues(result).Inc()
+		metrics.GitDeployDuration.Observe(time.Since(start).Seconds())
+	}()
+
 	docPath := filepath.Join(config.ParsedConfig.DataPath, "rspress_data", "doc_"+fmt.Sprint(docId))
 	gitBuildPath := filepath.Join(docPath, "gitbuild")
 	gitRemotePath := filepath.Join(docPath, "gitremote")
@@ -35,9 +296,9 @@ func (service *DocService) GitDeploy(docId uint) error {
 	}
 
 	// Build the documentation
-	err = utils.RunNpxCommand(docPath, "rspress", "build", "--config", "rspress.config.git.ts")
+	err = service.buildGenerator(docId).BuildGit(ctx, docId)
 	if err != nil {
-		return fmt.Errorf("failed to run npx command: %v", err)
+		return fmt.Errorf("failed to build for git: %w", err)
 	}
 
 	if !utils.PathExists(filepath.Join(gitBuildPath, ".nojekyll")) {
@@ -47,6 +308,11 @@ func (service *DocService) GitDeploy(docId uint) error {
 		}
 	}
 
+	auth, err := service.gitAuth(docId, doc.GitRepo)
+	if err != nil {
+		return fmt.Errorf("failed to get git credentials: %v", err)
+	}
+
 	// Check if the remote repository exists and if its URL matches the current one
 	repo, err := git.PlainOpen(gitRemotePath)
 	if err == nil {
@@ -62,13 +328,12 @@ func (service *DocService) GitDeploy(docId uint) error {
 
 	// If the repository doesn't exist or was removed, clone it
 	if repo == nil {
-		repo, err = git.PlainClone(gitRemotePath, false, &git.CloneOptions{
-			URL: doc.GitRepo,
-			Auth: &http.BasicAuth{
-				Username: doc.GitUser,
-				Password: doc.GitPassword,
-			},
+		cloneCtx, span := startGitSpan(ctx, "clone", doc.GitRepo)
+		repo, err = git.PlainCloneContext(cloneCtx, gitRemotePath, false, &git.CloneOptions{
+			URL:  doc.GitRepo,
+			Auth: auth,
 		})
+		endGitSpan(span, err)
 		if err != nil {
 			return fmt.Errorf("failed to clone repository: %v", err)
 		}
@@ -80,12 +345,11 @@ func (service *DocService) GitDeploy(docId uint) error {
 	}
 
 	// Fetch the latest changes
-	err = repo.Fetch(&git.FetchOptions{
-		Auth: &http.BasicAuth{
-			Username: doc.GitUser,
-			Password: doc.GitPassword,
-		},
+	fetchCtx, span := startGitSpan(ctx, "fetch", doc.GitRepo)
+	err = repo.FetchContext(fetchCtx, &git.FetchOptions{
+		Auth: auth,
 	})
+	endGitSpan(span, err)
 
 	if err != nil && err != git.NoErrAlreadyUpToDate {
 		return fmt.Errorf("failed to fetch from remote: %v", err)
@@ -177,7 +441,9 @@ func (service *DocService) GitDeploy(docId uint) error {
 	}
 
 	// Add changes
+	_, span = startGitSpan(ctx, "add", doc.GitRepo)
 	_, err = w.Add(".")
+	endGitSpan(span, err)
 	if err != nil {
 		return fmt.Errorf("failed to add changes: %v", err)
 	}
@@ -195,7 +461,8 @@ func (service *DocService) GitDeploy(docId uint) error {
 
 	// Commit changes
 	updateMessage := fmt.Sprintf("Update @ %s", time.Now().Format("2006-01-02 15:04:05"))
-	_, err = w.Commit(updateMessage, &git.CommitOptions{
+	_, span = startGitSpan(ctx, "commit", doc.GitRepo)
+	commitHash, err := w.Commit(updateMessage, &git.CommitOptions{
 		All: true,
 		Author: &object.Signature{
 			Name:  doc.GitUser,
@@ -203,21 +470,27 @@ func (service *DocService) GitDeploy(docId uint) error {
 			When:  time.Now(),
 		},
 	})
+	endGitSpan(span, err)
 	if err != nil {
 		return fmt.Errorf("failed to commit changes: %v", err)
 	}
 
 	// Push changes
-	err = repo.Push(&git.PushOptions{
+	pushCtx, span := startGitSpan(ctx, "push", doc.GitRepo)
+	err = repo.PushContext(pushCtx, &git.PushOptions{
 		RemoteName: "origin",
-		Auth: &http.BasicAuth{
-			Username: doc.GitUser,
-			Password: doc.GitPassword,
-		},
+		Auth:       auth,
 	})
+	endGitSpan(span, err)
 	if err != nil && err != git.NoErrAlreadyUpToDate {
 		return fmt.Errorf("failed to push changes: %v", err)
 	}
 
+	service.EmitWebhookEvent(docId, WebhookEventGitDeployed, map[string]interface{}{
+		"repository": doc.GitRepo,
+		"branch":     doc.GitBranch,
+		"commit":     commitHash.String(),
+	})
+
 	return nil
 }
@@ -0,0 +1,197 @@
+package services
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"git.difuse.io/Difuse/kalmia/db/models"
+	"git.difuse.io/Difuse/kalmia/secrets"
+	"git.difuse.io/Difuse/kalmia/utils"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGitCredentials(t *testing.T) {
+	user, err := TestAuthService.GetUser(1)
+	require.NoError(t, err)
+
+	doc := models.Documentation{
+		Name:     "Git Credentials",
+		Version:  "1.0.0",
+		BaseURL:  "/git-credentials",
+		AuthorID: user.ID,
+		GitRepo:  "https://git.example.com/docs.git",
+	}
+	require.NoError(t, TestDocService.DB.Create(&doc).Error)
+
+	editClearing := func(password, sshKey string, clearPassword, clearSSHKey bool) error {
+		return TestDocService.EditDocumentation(user, doc.ID, doc.Name, "", doc.Version, "", "", "", "", "", "", "", "",
+			"", "", "", doc.BaseURL, "", false, doc.GitRepo, "main", "deploy", password, "deploy@example.com", sshKey, "",
+			clearPassword, clearSSHKey, false, "", "", "", map[string]string{})
+	}
+	edit := func(password, sshKey string) error {
+		return editClearing(password, sshKey, false, false)
+	}
+
+	t.Run("Password is encrypted at rest", func(t *testing.T) {
+		require.NoError(t, edit("s3cret", ""))
+
+		var stored models.Documentation
+		require.NoError(t, TestDocService.DB.First(&stored, doc.ID).Error)
+		assert.True(t, secrets.IsEncrypted(stored.GitPassword))
+
+		auth, err := TestDocService.gitAuth(doc.ID, doc.GitRepo)
+		require.NoError(t, err)
+		assert.Equal(t, &http.BasicAuth{Username: "deploy", Password: "s3cret"}, auth)
+	})
+
+	t.Run("Password is never returned", func(t *testing.T) {
+		fetched, err := TestDocService.GetDocumentation(doc.ID)
+		require.NoError(t, err)
+		assert.Empty(t, fetched.GitPassword)
+		assert.True(t, fetched.GitPasswordSet)
+		assert.False(t, fetched.GitSSHKeySet)
+
+		data, err := json.Marshal(fetched)
+		require.NoError(t, err)
+		assert.Contains(t, string(data), `"gitPasswordSet":true`)
+		assert.NotContains(t, string(data), "gitPassword\"")
+
+		docs, err := TestDocService.GetDocumentations()
+		require.NoError(t, err)
+		for _, listed := range docs {
+			assert.Empty(t, listed.GitPassword)
+			assert.Empty(t, listed.GitSSHPrivateKey)
+		}
+	})
+
+	t.Run("Empty password keeps the stored one", func(t *testing.T) {
+		require.NoError(t, edit("", ""))
+
+		auth, err := TestDocService.gitAuth(doc.ID, doc.GitRepo)
+		require.NoError(t, err)
+		assert.Equal(t, "s3cret", auth.(*http.BasicAuth).Password)
+	})
+
+	t.Run("Uploaded SSH key", func(t *testing.T) {
+		privateKey, publicKey, err := utils.GenerateSSHKey("")
+		require.NoError(t, err)
+
+		require.NoError(t, edit("", privateKey))
+
+		fetched, err := TestDocService.GetDocumentation(doc.ID)
+		require.NoError(t, err)
+		assert.Equal(t, publicKey, fetched.GitSSHPublicKey)
+
+		assert.Empty(t, fetched.GitSSHPrivateKey)
+		assert.True(t, fetched.GitSSHKeySet)
+
+		auth, err := TestDocService.gitAuth(doc.ID, "git@git.example.com:docs.git")
+		require.NoError(t, err)
+		assert.IsType(t, &gitssh.PublicKeys{}, auth)
+
+		assert.Error(t, edit("", "not a key"))
+	})
+
+	t.Run("Generated SSH key", func(t *testing.T) {
+		publicKey, err := TestDocService.GenerateGitSSHKey(doc.ID)
+		require.NoError(t, err)
+
+		var stored models.Documentation
+		require.NoError(t, TestDocService.DB.First(&stored, doc.ID).Error)
+		assert.Equal(t, publicKey, stored.GitSSHPublicKey)
+		assert.True(t, secrets.IsEncrypted(stored.GitSSHPrivateKey))
+	})
+
+	t.Run("Host keys are pinned per host", func(t *testing.T) {
+		_, gitKey, err := utils.GenerateSSHKey("")
+		require.NoError(t, err)
+		_, mirrorKey, err := utils.GenerateSSHKey("")
+		require.NoError(t, err)
+
+		gitPin := "git.example.com " + strings.TrimSpace(gitKey)
+		mirrorPin := "mirror.example.com " + strings.TrimSpace(mirrorKey)
+
+		TestDocService.pinGitHostKey(doc.ID, gitPin)
+		TestDocService.pinGitHostKey(doc.ID, mirrorPin)
+		TestDocService.pinGitHostKey(doc.ID, gitPin)
+
+		// An edit without known hosts keeps the pins
+		require.NoError(t, edit("", ""))
+
+		var stored models.Documentation
+		require.NoError(t, TestDocService.DB.First(&stored, doc.ID).Error)
+		assert.Equal(t, gitPin+"\n"+mirrorPin, stored.GitSSHKnownHosts)
+		assert.NoError(t, utils.ValidateKnownHosts(stored.GitSSHKnownHosts))
+	})
+
+	t.Run("Password can be cleared", func(t *testing.T) {
+		require.NoError(t, editClearing("", "", true, false))
+
+		var stored models.Documentation
+		require.NoError(t, TestDocService.DB.First(&stored, doc.ID).Error)
+		assert.Empty(t, stored.GitPassword)
+		assert.NotEmpty(t, stored.GitSSHPrivateKey)
+
+		auth, err := TestDocService.gitAuth(doc.ID, doc.GitRepo)
+		require.NoError(t, err)
+		assert.Equal(t, &http.BasicAuth{Username: "deploy"}, auth)
+	})
+
+	t.Run("SSH key can be cleared", func(t *testing.T) {
+		require.NoError(t, editClearing("", "", false, true))
+
+		var stored models.Documentation
+		require.NoError(t, TestDocService.DB.First(&stored, doc.ID).Error)
+		assert.Empty(t, stored.GitSSHPrivateKey)
+		assert.Empty(t, stored.GitSSHPublicKey)
+
+		_, err := TestDocService.gitAuth(doc.ID, "git@git.example.com:docs.git")
+		assert.EqualError(t, err, "git_ssh_key_not_set")
+	})
+}
+
+func TestMigrateSecrets(t *testing.T) {
+	legacy, err := secrets.NewKeyring("old-key")
+	require.NoError(t, err)
+
+	sealedWithOldKey, err := legacy.Encrypt("rotated")
+	require.NoError(t, err)
+
+	doc := models.Documentation{
+		Name:        "Legacy Secrets",
+		Version:     "1.0.0",
+		BaseURL:     "/legacy-secrets",
+		AuthorID:    1,
+		GitUser:     "deploy",
+		GitPassword: "plaintext",
+	}
+	require.NoError(t, TestDocService.DB.Create(&doc).Error)
+
+	other := models.Documentation{
+		Name:        "Rotated Secrets",
+		Version:     "1.0.0",
+		BaseURL:     "/rotated-secrets",
+		AuthorID:    1,
+		GitUser:     "deploy",
+		GitPassword: sealedWithOldKey,
+	}
+	require.NoError(t, TestDocService.DB.Create(&other).Error)
+
+	require.NoError(t, secrets.SetKeys("test", "old-key"))
+
+	require.NoError(t, TestDocService.MigrateSecrets())
+
+	for id, expected := range map[uint]string{doc.ID: "plaintext", other.ID: "rotated"} {
+		var stored models.Documentation
+		require.NoError(t, TestDocService.DB.First(&stored, id).Error)
+		assert.True(t, strings.HasPrefix(stored.GitPassword, "enc:v1:"))
+
+		auth, err := TestDocService.gitAuth(id, "https://git.example.com/docs.git")
+		require.NoError(t, err)
+		assert.Equal(t, expected, auth.(*http.BasicAuth).Password)
+	}
+}
@@ -0,0 +1,1309 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.difuse.io/Difuse/kalmia/config"
+	"git.difuse.io/Difuse/kalmia/db/models"
+	"git.difuse.io/Difuse/kalmia/logger"
+	"git.difuse.io/Difuse/kalmia/tracing"
+	"git.difuse.io/Difuse/kalmia/utils"
+	"github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/index"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+const gitSyncGroupFile = "_group.md"
+
+type GitSyncResult struct {
+	Pulled    int    `json:"pulled"`
+	Pushed    int    `json:"pushed"`
+	Conflicts int    `json:"conflicts"`
+	Commit    string `json:"commit"`
+}
+
+type gitSyncPageMeta struct {
+	ID        uint   `yaml:"id,omitempty"`
+	Title     string `yaml:"title"`
+	Slug      string `yaml:"slug"`
+	Order     *uint  `yaml:"order,omitempty"`
+	IntroPage bool   `yaml:"introPage,omitempty"`
+}
+
+type gitSyncGroupMeta struct {
+	ID    uint   `yaml:"id,omitempty"`
+	Name  string `yaml:"name"`
+	Order *uint  `yaml:"order,omitempty"`
+}
+
+// gitSyncEntry is a single page or page group as it appears in the
+// repository, keyed by "page:<id>" or "group:<id>". Files that are not yet
+// known to the database are keyed by "new:<path>".
+type gitSyncEntry struct {
+	Key     string
+	Path    string
+	Data    []byte
+	IsGroup bool
+}
+
+func gitSyncHash(entry *gitSyncEntry) string {
+	if entry == nil {
+		return ""
+	}
+
+	return utils.HashStrings([]string{entry.Path, "\x00", string(entry.Data)})
+}
+
+func gitSyncKey(isGroup bool, id uint) string {
+	return gitSyncKind(isGroup) + strconv.FormatUint(uint64(id), 10)
+}
+
+func gitSyncKind(isGroup bool) string {
+	if isGroup {
+		return "group:"
+	}
+
+	return "page:"
+}
+
+func gitSyncKeyID(key string) uint {
+	idx := strings.Index(key, ":")
+	if idx == -1 {
+		return 0
+	}
+
+	id, err := strconv.ParseUint(key[idx+1:], 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	return uint(id)
+}
+
+func (service *DocService) gitSyncRender(rootId uint) (map[string]*gitSyncEntry, map[string]uint, error) {
+	versionInfos, err := service.buildVersionTree(rootId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	entries := make(map[string]*gitSyncEntry)
+	versions := make(map[string]uint)
+
+	for _, versionInfo := range versionInfos {
+		version := versionInfo.Version
+		versions[version] = versionInfo.DocId
+
+		var groups []models.PageGroup
+		if err := service.DB.Where("documentation_id = ?", versionInfo.DocId).Order("id").Find(&groups).Error; err != nil {
+			return nil, nil, fmt.Errorf("failed_to_get_page_groups")
+		}
+
+		var pages []models.Page
+		// Pages that were never published stay out of the repository
+		if err := service.DB.Where("documentation_id = ? AND is_draft = ?", versionInfo.DocId, false).Order("id").Find(&pages).Error; err != nil {
+			return nil, nil, fmt.Errorf("failed_to_get_pages")
+		}
+
+		groupsByID := make(map[uint]models.PageGroup)
+		for _, group := range groups {
+			groupsByID[group.ID] = group
+		}
+
+		usedPaths := make(map[string]bool)
+		groupDirs := make(map[uint]string)
+
+		var groupDir func(id uint) string
+		groupDir = func(id uint) string {
+			if dir, ok := groupDirs[id]; ok {
+				return dir
+			}
+
+			// Guards against parent cycles while the real path is resolved
+			groupDirs[id] = version
+
+			group := groupsByID[id]
+			parentDir := version
+			if group.ParentID != nil {
+				if _, ok := groupsByID[*group.ParentID]; ok {
+					parentDir = groupDir(*group.ParentID)
+				}
+			}
+
+			dir := path.Join(parentDir, utils.StringToFileString(group.Name))
+			if usedPaths[dir] {
+				dir = fmt.Sprintf("%s-%d", dir, id)
+			}
+
+			usedPaths[dir] = true
+			groupDirs[id] = dir
+
+			return dir
+		}
+
+		for _, group := range groups {
+			data, err := utils.WriteFrontmatter(gitSyncGroupMeta{
+				ID:    group.ID,
+				Name:  group.Name,
+				Order: group.Order,
+			}, "")
+			if err != nil {
+				return nil, nil, err
+			}
+
+			key := gitSyncKey(true, group.ID)
+			entries[key] = &gitSyncEntry{
+				Key:     key,
+				Path:    path.Join(groupDir(group.ID), gitSyncGroupFile),
+				Data:    []byte(data),
+				IsGroup: true,
+			}
+		}
+
+		for _, page := range pages {
+			dir := version
+			if page.PageGroupID != nil {
+				if _, ok := groupsByID[*page.PageGroupID]; ok {
+					dir = groupDir(*page.PageGroupID)
+				}
+			}
+
+			name := utils.StringToFileString(page.Title)
+			if page.IsIntroPage {
+				name = "index"
+			}
+
+			filePath := path.Join(dir, name+".md")
+			if usedPaths[filePath] || name+".md" == gitSyncGroupFile {
+				filePath = path.Join(dir, fmt.Sprintf("%s-%d.md", name, page.ID))
+			}
+			usedPaths[filePath] = true
+
+			var blocks []utils.Block
+			body := ""
+			if strings.TrimSpace(page.Content) != "" {
+				if err := json.Unmarshal([]byte(page.Content), &blocks); err != nil {
+					logger.Warn("Page content is not valid JSON, exporting an empty body", zap.Uint("page_id", page.ID), zap.Error(err))
+				} else {
+					body = utils.BlocksToMarkdown(blocks)
+				}
+			}
+
+			data, err := utils.WriteFrontmatter(gitSyncPageMeta{
+				ID:        page.ID,
+				Title:     page.Title,
+				Slug:      page.Slug,
+				Order:     page.Order,
+				IntroPage: page.IsIntroPage,
+			}, body)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			key := gitSyncKey(false, page.ID)
+			entries[key] = &gitSyncEntry{
+				Key:  key,
+				Path: filePath,
+				Data: []byte(data),
+			}
+		}
+	}
+
+	return entries, versions, nil
+}
+
+func gitSyncReadWorktree(repoPath string) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+
+	err := filepath.Walk(repoPath, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			if info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !strings.HasSuffix(info.Name(), ".md") {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(repoPath, filePath)
+		if err != nil {
+			return err
+		}
+
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			return err
+		}
+
+		files[filepath.ToSlash(relPath)] = data
+		return nil
+	})
+
+	return files, err
+}
+
+// gitSyncParse maps repository files to entries. Files whose frontmatter id
+// is unknown, duplicated or missing fall back to the last synced file at the
+// same path, or are treated as new.
+func gitSyncParse(files map[string][]byte, versions map[string]uint, known func(string) bool, statesByPath map[string]string) map[string]*gitSyncEntry {
+	entries := make(map[string]*gitSyncEntry)
+
+	paths := make([]string, 0, len(files))
+	for filePath := range files {
+		paths = append(paths, filePath)
+	}
+	sort.Strings(paths)
+
+	for _, filePath := range paths {
+		parts := strings.SplitN(filePath, "/", 2)
+		if len(parts) < 2 {
+			continue
+		}
+
+		if _, ok := versions[parts[0]]; !ok {
+			continue
+		}
+
+		isGroup := path.Base(filePath) == gitSyncGroupFile
+		if isGroup && path.Dir(filePath) == parts[0] {
+			continue
+		}
+
+		var id uint
+		if isGroup {
+			var meta gitSyncGroupMeta
+			if _, err := utils.ReadFrontmatter(string(files[filePath]), &meta); err == nil {
+				id = meta.ID
+			}
+		} else {
+			var meta gitSyncPageMeta
+			if _, err := utils.ReadFrontmatter(string(files[filePath]), &meta); err == nil {
+				id = meta.ID
+			}
+		}
+
+		key := ""
+		if id != 0 {
+			key = gitSyncKey(isGroup, id)
+			if _, taken := entries[key]; taken || !known(key) {
+				key = ""
+			}
+		}
+
+		if key == "" {
+			if stateKey, ok := statesByPath[filePath]; ok && strings.HasPrefix(stateKey, gitSyncKind(isGroup)) {
+				if _, taken := entries[stateKey]; !taken {
+					key = stateKey
+				}
+			}
+		}
+
+		if key == "" {
+			key = "new:" + filePath
+		}
+
+		entries[key] = &gitSyncEntry{
+			Key:     key,
+			Path:    filePath,
+			Data:    files[filePath],
+			IsGroup: isGroup,
+		}
+	}
+
+	return entries
+}
+
+func (service *DocService) gitSyncCheckout(ctx context.Context, doc models.Documentation, repoPath string) (*git.Repository, plumbing.Hash, error) {
+	branch := doc.GitSyncBranch
+	if branch == "" {
+		branch = "main"
+	}
+
+	repo, err := git.PlainOpen(repoPath)
+	if err == nil {
+		remote, err := repo.Remote("origin")
+		if err != nil || len(remote.Config().URLs) == 0 || remote.Config().URLs[0] != doc.GitSyncRepo {
+			repo = nil
+		}
+	} else {
+		repo = nil
+	}
+
+	if repo == nil {
+		if err := os.RemoveAll(repoPath); err != nil {
+			return nil, plumbing.ZeroHash, fmt.Errorf("failed to remove old repository: %v", err)
+		}
+
+		repo, err = git.PlainInit(repoPath, false)
+		if err != nil {
+			return nil, plumbing.ZeroHash, fmt.Errorf("failed to init repository: %v", err)
+		}
+
+		_, err = repo.CreateRemote(&gitconfig.RemoteConfig{
+			Name: "origin",
+			URLs: []string{doc.GitSyncRepo},
+		})
+		if err != nil {
+			return nil, plumbing.ZeroHash, fmt.Errorf("failed to add remote: %v", err)
+		}
+	}
+
+	auth, err := service.gitAuth(doc.ID, doc.GitSyncRepo)
+	if err != nil {
+		return nil, plumbing.ZeroHash, fmt.Errorf("failed to get git credentials: %v", err)
+	}
+
+	branchRef := plumbing.NewBranchReferenceName(branch)
+	remoteRef := plumbing.NewRemoteReferenceName("origin", branch)
+
+	fetchCtx, span := startGitSpan(ctx, "fetch", doc.GitSyncRepo)
+	err = repo.FetchContext(fetchCtx, &git.FetchOptions{
+		RemoteName: "origin",
+		Auth:       auth,
+		Force:      true,
+		RefSpecs:   []gitconfig.RefSpec{gitconfig.RefSpec(fmt.Sprintf("+%s:%s", branchRef, remoteRef))},
+	})
+
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) &&
+		!errors.Is(err, transport.ErrEmptyRemoteRepository) &&
+		!errors.Is(err, git.NoMatchingRefSpecError{}) {
+		endGitSpan(span, err)
+		return nil, plumbing.ZeroHash, fmt.Errorf("failed to fetch from remote: %v", err)
+	}
+	span.End()
+
+	upstream := plumbing.ZeroHash
+	if err == nil || errors.Is(err, git.NoErrAlreadyUpToDate) {
+		if ref, err := repo.Reference(remoteRef, true); err == nil {
+			upstream = ref.Hash()
+		}
+	}
+
+	if err := repo.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, branchRef)); err != nil {
+		return nil, plumbing.ZeroHash, fmt.Errorf("failed to set HEAD: %v", err)
+	}
+
+	w, err := repo.Worktree()
+	if err != nil {
+		return nil, plumbing.ZeroHash, fmt.Errorf("failed to get worktree: %v", err)
+	}
+
+	if upstream.IsZero() {
+		// Nothing upstream yet, start an orphan branch from an empty tree
+		if err := repo.Storer.RemoveReference(branchRef); err != nil {
+			return nil, plumbing.ZeroHash, fmt.Errorf("failed to reset branch: %v", err)
+		}
+
+		if err := repo.Storer.SetIndex(&index.Index{Version: 2}); err != nil {
+			return nil, plumbing.ZeroHash, fmt.Errorf("failed to reset index: %v", err)
+		}
+
+		entries, err := os.ReadDir(repoPath)
+		if err != nil {
+			return nil, plumbing.ZeroHash, err
+		}
+
+		for _, entry := range entries {
+			if entry.Name() == ".git" {
+				continue
+			}
+			if err := os.RemoveAll(filepath.Join(repoPath, entry.Name())); err != nil {
+				return nil, plumbing.ZeroHash, err
+			}
+		}
+
+		return repo, upstream, nil
+	}
+
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(branchRef, upstream)); err != nil {
+		return nil, plumbing.ZeroHash, fmt.Errorf("failed to update branch: %v", err)
+	}
+
+	if err := w.Reset(&git.ResetOptions{Commit: upstream, Mode: git.HardReset}); err != nil {
+		return nil, plumbing.ZeroHash, fmt.Errorf("failed to reset branch to match remote: %v", err)
+	}
+
+	if err := w.Clean(&git.CleanOptions{Dir: true}); err != nil {
+		return nil, plumbing.ZeroHash, fmt.Errorf("failed to clean worktree: %v", err)
+	}
+
+	return repo, upstream, nil
+}
+
+func (service *DocService) gitSyncImport(doc models.Documentation, entry *gitSyncEntry, key string, versions map[string]uint, ensureGroup func(string) (*uint, error)) (uint, error) {
+	version := strings.SplitN(entry.Path, "/", 2)[0]
+	docId := versions[version]
+	dir := path.Dir(entry.Path)
+
+	if entry.IsGroup {
+		var meta gitSyncGroupMeta
+		if _, err := utils.ReadFrontmatter(string(entry.Data), &meta); err != nil {
+			return 0, err
+		}
+
+		parentID, err := ensureGroup(path.Dir(dir))
+		if err != nil {
+			return 0, err
+		}
+
+		name := meta.Name
+		if name == "" {
+			name = path.Base(dir)
+		}
+
+		var group models.PageGroup
+		if id := gitSyncKeyID(key); id != 0 && !strings.HasPrefix(key, "new:") {
+			if err := service.DB.First(&group, id).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+				return 0, fmt.Errorf("failed_to_get_page_group")
+			}
+		}
+
+		if group.ID == 0 {
+			group.AuthorID = doc.AuthorID
+		}
+
+		if parentID != nil && *parentID == group.ID {
+			parentID = nil
+		}
+
+		group.Name = name
+		group.DocumentationID = docId
+		group.ParentID = parentID
+		group.Order = meta.Order
+
+		if err := service.DB.Save(&group).Error; err != nil {
+			return 0, fmt.Errorf("failed_to_update_page_group")
+		}
+
+		return group.ID, nil
+	}
+
+	var meta gitSyncPageMeta
+	body, err := utils.ReadFrontmatter(string(entry.Data), &meta)
+	if err != nil {
+		return 0, err
+	}
+
+	blocks, err := utils.MarkdownToBlocks(body)
+	if err != nil {
+		return 0, err
+	}
+
+	content, err := json.Marshal(blocks)
+	if err != nil {
+		return 0, err
+	}
+
+	groupID, err := ensureGroup(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	var page models.Page
+	if id := gitSyncKeyID(key); id != 0 && !strings.HasPrefix(key, "new:") {
+		if err := service.DB.First(&page, id).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return 0, fmt.Errorf("failed_to_get_page")
+		}
+	}
+
+	if page.ID == 0 {
+		page.AuthorID = doc.AuthorID
+	}
+
+	title := meta.Title
+	if title == "" {
+		title = strings.TrimSuffix(path.Base(entry.Path), ".md")
+	}
+
+	slug := meta.Slug
+	if slug == "" {
+		slug = "/" + utils.StringToFileString(title)
+	}
+
+	page.Title = title
+	page.Slug = slug
+	page.Content = string(content)
+	page.Order = meta.Order
+	page.IsIntroPage = meta.IntroPage
+	page.DocumentationID = docId
+	page.PageGroupID = groupID
+
+	if err := service.DB.Save(&page).Error; err != nil {
+		return 0, fmt.Errorf("failed_to_update_page")
+	}
+
+	return page.ID, nil
+}
+
+func (service *DocService) gitSyncDelete(key string) error {
+	id := gitSyncKeyID(key)
+
+	if strings.HasPrefix(key, "group:") {
+		var count int64
+		service.DB.Model(&models.PageGroup{}).Where("id = ?", id).Count(&count)
+		if count == 0 {
+			return nil
+		}
+
+		return service.DB.Transaction(func(tx *gorm.DB) error {
+			return service.deletePageGroupRecursive(tx, id)
+		})
+	}
+
+	var page models.Page
+	if err := service.DB.First(&page, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return fmt.Errorf("failed_to_fetch_page")
+	}
+
+	return service.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&page).Association("Editors").Clear(); err != nil {
+			return fmt.Errorf("failed_to_clear_page_associations")
+		}
+
+		if err := tx.Delete(&page).Error; err != nil {
+			return fmt.Errorf("failed_to_delete_page")
+		}
+
+		if err := deletePageDrafts(tx, []uint{page.ID}); err != nil {
+			return fmt.Errorf("failed_to_delete_page")
+		}
+
+		return nil
+	})
+}
+
+func (service *DocService) gitSyncConflict(docId uint, key string, entryPath string, upstream string, reason string) error {
+	var conflict models.GitSyncConflict
+	err := service.DB.Where("documentation_id = ? AND key = ? AND resolved_at IS NULL", docId, key).First(&conflict).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+
+	conflict.DocumentationID = docId
+	conflict.Key = key
+	conflict.Path = entryPath
+	conflict.UpstreamCommit = upstream
+	conflict.Reason = reason
+
+	return service.DB.Save(&conflict).Error
+}
+
+func (service *DocService) gitSync(ctx context.Context, doc models.Documentation, result *GitSyncResult) (string, error) {
+	repoPath := filepath.Join(utils.GetDocPathByID(doc.ID, config.ParsedConfig), "gitsource")
+
+	repo, upstreamHash, err := service.gitSyncCheckout(ctx, doc, repoPath)
+	if err != nil {
+		return "", err
+	}
+
+	upstreamCommit := ""
+	if !upstreamHash.IsZero() {
+		upstreamCommit = upstreamHash.String()
+	}
+
+	upstreamFiles, err := gitSyncReadWorktree(repoPath)
+	if err != nil {
+		return upstreamCommit, fmt.Errorf("failed to read worktree: %v", err)
+	}
+
+	local, versions, err := service.gitSyncRender(doc.ID)
+	if err != nil {
+		return upstreamCommit, err
+	}
+
+	var stateRows []models.GitSyncFile
+	if err := service.DB.Where("documentation_id = ?", doc.ID).Find(&stateRows).Error; err != nil {
+		return upstreamCommit, fmt.Errorf("failed_to_get_sync_state")
+	}
+
+	states := make(map[string]models.GitSyncFile)
+	statesByPath := make(map[string]string)
+	for _, state := range stateRows {
+		states[state.Key] = state
+		statesByPath[state.Path] = state.Key
+	}
+
+	known := func(key string) bool {
+		_, inLocal := local[key]
+		_, inState := states[key]
+		return inLocal || inState
+	}
+
+	upstream := gitSyncParse(upstreamFiles, versions, known, statesByPath)
+
+	keySet := make(map[string]bool)
+	for key := range local {
+		keySet[key] = true
+	}
+	for key := range upstream {
+		keySet[key] = true
+	}
+	for key := range states {
+		keySet[key] = true
+	}
+
+	keys := make([]string, 0, len(keySet))
+	for key := range keySet {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var imports []string
+	exports := make(map[string]bool)
+	conflicts := make(map[string]bool)
+
+	for _, key := range keys {
+		state := states[key]
+		localHash := gitSyncHash(local[key])
+		upstreamHash := gitSyncHash(upstream[key])
+
+		upstreamChanged := upstreamHash != state.FileHash
+		localChanged := localHash != state.ContentHash
+
+		switch {
+		case upstreamChanged && localChanged:
+			if local[key] != nil && upstream[key] != nil && string(local[key].Data) == string(upstream[key].Data) && local[key].Path == upstream[key].Path {
+				continue
+			}
+
+			conflictPath := state.Path
+			if upstream[key] != nil {
+				conflictPath = upstream[key].Path
+			} else if local[key] != nil {
+				conflictPath = local[key].Path
+			}
+
+			if err := service.gitSyncConflict(doc.ID, key, conflictPath, upstreamCommit, "changed_in_both"); err != nil {
+				return upstreamCommit, fmt.Errorf("failed_to_record_conflict")
+			}
+			conflicts[key] = true
+		case upstreamChanged:
+			imports = append(imports, key)
+		case localChanged:
+			exports[key] = true
+		}
+	}
+
+	// Groups are imported parents first so that pages can be placed in them
+	sort.SliceStable(imports, func(i, j int) bool {
+		a, b := upstream[imports[i]], upstream[imports[j]]
+		if a == nil || b == nil {
+			return a != nil && b == nil
+		}
+		if a.IsGroup != b.IsGroup {
+			return a.IsGroup
+		}
+		return strings.Count(a.Path, "/") < strings.Count(b.Path, "/")
+	})
+
+	dirGroups := make(map[string]uint)
+	for _, entry := range upstream {
+		if entry.IsGroup && !strings.HasPrefix(entry.Key, "new:") {
+			dirGroups[path.Dir(entry.Path)] = gitSyncKeyID(entry.Key)
+		}
+	}
+	for _, entry := range local {
+		if _, ok := dirGroups[path.Dir(entry.Path)]; entry.IsGroup && !ok {
+			dirGroups[path.Dir(entry.Path)] = gitSyncKeyID(entry.Key)
+		}
+	}
+
+	var ensureGroup func(dir string) (*uint, error)
+	ensureGroup = func(dir string) (*uint, error) {
+		version := strings.SplitN(dir, "/", 2)[0]
+		if dir == version || dir == "." {
+			return nil, nil
+		}
+
+		if id, ok := dirGroups[dir]; ok {
+			var count int64
+			service.DB.Model(&models.PageGroup{}).Where("id = ?", id).Count(&count)
+			if count > 0 {
+				return utils.UintPtr(id), nil
+			}
+		}
+
+		parentID, err := ensureGroup(path.Dir(dir))
+		if err != nil {
+			return nil, err
+		}
+
+		group := models.PageGroup{
+			Name:            path.Base(dir),
+			DocumentationID: versions[version],
+			ParentID:        parentID,
+			AuthorID:        doc.AuthorID,
+		}
+		if err := service.DB.Create(&group).Error; err != nil {
+			return nil, fmt.Errorf("failed_to_create_page_group")
+		}
+
+		dirGroups[dir] = group.ID
+		return utils.UintPtr(group.ID), nil
+	}
+
+	renamed := make(map[string]string)
+	created := make(map[string]bool)
+	applied := 0
+
+	for _, key := range imports {
+		entry := upstream[key]
+
+		if entry == nil {
+			if strings.HasPrefix(key, "group:") && gitSyncDirInUse(upstream, path.Dir(states[key].Path)) {
+				conflicts[key] = true
+				if err := service.gitSyncConflict(doc.ID, key, states[key].Path, upstreamCommit, "group_not_empty"); err != nil {
+					return upstreamCommit, fmt.Errorf("failed_to_record_conflict")
+				}
+				continue
+			}
+
+			if err := service.gitSyncDelete(key); err != nil {
+				logger.Error("Failed to apply upstream deletion", zap.String("key", key), zap.Error(err))
+				conflicts[key] = true
+				if err := service.gitSyncConflict(doc.ID, key, states[key].Path, upstreamCommit, "delete_failed: "+err.Error()); err != nil {
+					return upstreamCommit, fmt.Errorf("failed_to_record_conflict")
+				}
+				continue
+			}
+			applied++
+			continue
+		}
+
+		id, err := service.gitSyncImport(doc, entry, key, versions, ensureGroup)
+		if err != nil {
+			logger.Error("Failed to apply upstream change", zap.String("path", entry.Path), zap.Error(err))
+			conflicts[key] = true
+			if err := service.gitSyncConflict(doc.ID, key, entry.Path, upstreamCommit, "import_failed: "+err.Error()); err != nil {
+				return upstreamCommit, fmt.Errorf("failed_to_record_conflict")
+			}
+			continue
+		}
+
+		if entry.IsGroup {
+			dirGroups[path.Dir(entry.Path)] = id
+		}
+
+		if newKey := gitSyncKey(entry.IsGroup, id); newKey != key {
+			// Write the id back into the new file so later syncs can track it
+			renamed[key] = newKey
+			created[newKey] = true
+			upstream[newKey] = &gitSyncEntry{Key: newKey, Path: entry.Path, Data: entry.Data, IsGroup: entry.IsGroup}
+			delete(upstream, key)
+			exports[newKey] = true
+		}
+
+		applied++
+	}
+
+	result.Pulled = applied
+
+	if applied > 0 {
+		local, _, err = service.gitSyncRender(doc.ID)
+		if err != nil {
+			return upstreamCommit, err
+		}
+	}
+
+	pathOwners := make(map[string]string)
+	for key, entry := range upstream {
+		pathOwners[entry.Path] = key
+	}
+
+	exportKeys := make([]string, 0, len(exports))
+	for key := range exports {
+		exportKeys = append(exportKeys, key)
+	}
+	sort.Strings(exportKeys)
+
+	// Clear old locations first so that entries swapping paths do not clobber each other
+	for _, key := range exportKeys {
+		entry := local[key]
+		for _, oldPath := range []string{upstream[key].pathOrEmpty(), states[key].Path} {
+			if oldPath == "" || (entry != nil && oldPath == entry.Path) {
+				continue
+			}
+			if owner, ok := pathOwners[oldPath]; ok && owner != key && !exports[owner] {
+				continue
+			}
+			if err := os.Remove(filepath.Join(repoPath, filepath.FromSlash(oldPath))); err != nil && !os.IsNotExist(err) {
+				return upstreamCommit, err
+			}
+			removeEmptyParents(repoPath, path.Dir(oldPath))
+		}
+	}
+
+	for _, key := range exportKeys {
+		entry := local[key]
+		if entry == nil {
+			continue
+		}
+
+		if owner, ok := pathOwners[entry.Path]; ok && owner != key && !exports[owner] {
+			conflicts[key] = true
+			if err := service.gitSyncConflict(doc.ID, key, entry.Path, upstreamCommit, "path_in_use"); err != nil {
+				return upstreamCommit, fmt.Errorf("failed_to_record_conflict")
+			}
+			continue
+		}
+
+		fullPath := filepath.Join(repoPath, filepath.FromSlash(entry.Path))
+		if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+			return upstreamCommit, err
+		}
+
+		if err := os.WriteFile(fullPath, entry.Data, 0644); err != nil {
+			return upstreamCommit, err
+		}
+	}
+
+	commit, pushErr := service.gitSyncCommitAndPush(ctx, doc, repo)
+	if pushErr == nil && commit != "" {
+		result.Pushed = len(exports)
+		upstreamCommit = commit
+	}
+
+	var final map[string]*gitSyncEntry
+	if pushErr == nil {
+		finalFiles, err := gitSyncReadWorktree(repoPath)
+		if err != nil {
+			return upstreamCommit, fmt.Errorf("failed to read worktree: %v", err)
+		}
+		final = gitSyncParse(finalFiles, versions, known, statesByPath)
+	} else {
+		final = upstream
+	}
+
+	stateKeys := make(map[string]bool)
+	for _, key := range keys {
+		if newKey, ok := renamed[key]; ok {
+			key = newKey
+		}
+		stateKeys[key] = true
+	}
+	for key := range local {
+		stateKeys[key] = true
+	}
+
+	for key := range stateKeys {
+		if conflicts[key] || strings.HasPrefix(key, "new:") {
+			continue
+		}
+
+		// Local changes that never made it upstream are retried next time
+		if pushErr != nil && exports[key] && !created[key] {
+			continue
+		}
+
+		finalEntry := final[key]
+		localEntry := local[key]
+		state := states[key]
+
+		if finalEntry == nil && localEntry == nil {
+			if state.ID != 0 {
+				service.DB.Delete(&state)
+			}
+			continue
+		}
+
+		state.DocumentationID = doc.ID
+		state.Key = key
+		state.FileHash = gitSyncHash(finalEntry)
+		state.ContentHash = gitSyncHash(localEntry)
+		if finalEntry != nil {
+			state.Path = finalEntry.Path
+		} else {
+			state.Path = localEntry.Path
+		}
+
+		if err := service.DB.Save(&state).Error; err != nil {
+			return upstreamCommit, fmt.Errorf("failed_to_save_sync_state")
+		}
+	}
+
+	// Conflicts that no longer apply were settled on one side or the other
+	var open []models.GitSyncConflict
+	service.DB.Where("documentation_id = ? AND resolved_at IS NULL", doc.ID).Find(&open)
+	for _, conflict := range open {
+		if conflicts[conflict.Key] {
+			continue
+		}
+		conflict.ResolvedAt = utils.TimePtr(time.Now())
+		conflict.Resolution = "converged"
+		service.DB.Save(&conflict)
+	}
+
+	result.Conflicts = len(conflicts)
+	result.Commit = upstreamCommit
+
+	return upstreamCommit, pushErr
+}
+
+func (e *gitSyncEntry) pathOrEmpty() string {
+	if e == nil {
+		return ""
+	}
+
+	return e.Path
+}
+
+func gitSyncDirInUse(entries map[string]*gitSyncEntry, dir string) bool {
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Path, dir+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func removeEmptyParents(root string, dir string) {
+	for dir != "." && dir != "/" && dir != "" {
+		fullPath := filepath.Join(root, filepath.FromSlash(dir))
+		entries, err := os.ReadDir(fullPath)
+		if err != nil || len(entries) > 0 {
+			return
+		}
+		os.Remove(fullPath)
+		dir = path.Dir(dir)
+	}
+}
+
+func (service *DocService) gitSyncCommitAndPush(ctx context.Context, doc models.Documentation, repo *git.Repository) (string, error) {
+	w, err := repo.Worktree()
+	if err != nil {
+		return "", fmt.Errorf("failed to get worktree: %v", err)
+	}
+
+	if err := w.AddWithOptions(&git.AddOptions{All: true}); err != nil {
+		return "", fmt.Errorf("failed to add changes: %v", err)
+	}
+
+	status, err := w.Status()
+	if err != nil {
+		return "", fmt.Errorf("failed to get worktree status: %v", err)
+	}
+
+	if status.IsClean() {
+		return "", nil
+	}
+
+	name := doc.GitUser
+	if name == "" {
+		name = "Kalmia"
+	}
+
+	updateMessage := fmt.Sprintf("Sync from Kalmia @ %s", time.Now().Format("2006-01-02 15:04:05"))
+	_, span := startGitSpan(ctx, "commit", doc.GitSyncRepo)
+	commit, err := w.Commit(updateMessage, &git.CommitOptions{
+		Author: &object.Signature{
+			Name:  name,
+			Email: doc.GitEmail,
+			When:  time.Now(),
+		},
+	})
+	endGitSpan(span, err)
+	if err != nil {
+		return "", fmt.Errorf("failed to commit changes: %v", err)
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		return "", fmt.Errorf("failed to get HEAD: %v", err)
+	}
+
+	auth, err := service.gitAuth(doc.ID, doc.GitSyncRepo)
+	if err != nil {
+		return "", fmt.Errorf("failed to get git credentials: %v", err)
+	}
+
+	pushCtx, span := startGitSpan(ctx, "push", doc.GitSyncRepo)
+	err = repo.PushContext(pushCtx, &git.PushOptions{
+		RemoteName: "origin",
+		Auth:       auth,
+		RefSpecs:   []gitconfig.RefSpec{gitconfig.RefSpec(fmt.Sprintf("%s:%s", head.Name(), head.Name()))},
+	})
+	endGitSpan(span, err)
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return "", fmt.Errorf("failed to push changes: %v", err)
+	}
+
+	return commit.String(), nil
+}
+
+// GitSourceSync pushes the page tree of a documentation (and all of its
+// versions) to its source repository as Markdown and applies commits made
+// upstream since the last sync. Entries changed on both sides are recorded
+// as conflicts and left untouched until resolved.
+func (service *DocService) GitSourceSync(docId uint) (GitSyncResult, error) {
+	return service.gitSourceSync(context.Background(), docId)
+}
+
+func (service *DocService) gitSourceSync(ctx context.Context, docId uint) (result GitSyncResult, err error) {
+	ctx, span := tracing.Start(ctx, "git source sync", attribute.Int64("kalmia.documentation.id", int64(docId)))
+	defer func() {
+		span.SetAttributes(
+			attribute.Int("kalmia.git_sync.pulled", result.Pulled),
+			attribute.Int("kalmia.git_sync.pushed", result.Pushed),
+			attribute.Int("kalmia.git_sync.conflicts", result.Conflicts),
+		)
+		tracing.End(span, err)
+	}()
+
+	rootId, err := service.GetRootParentID(docId)
+	if err != nil {
+		return result, err
+	}
+
+	doc, err := service.GetDocumentation(rootId)
+	if err != nil {
+		return result, err
+	}
+
+	if !doc.GitSyncEnabled || doc.GitSyncRepo == "" {
+		return result, fmt.Errorf("git_sync_not_enabled")
+	}
+
+	mutexI, _ := service.UWBMutexMap.LoadOrStore(fmt.Sprintf("git_sync_%d", rootId), &sync.Mutex{})
+	mutex := mutexI.(*sync.Mutex)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	commit, syncErr := service.gitSync(ctx, doc, &result)
+
+	var state models.GitSyncState
+	service.DB.Where("documentation_id = ?", rootId).First(&state)
+	state.DocumentationID = rootId
+	state.LastSyncedAt = utils.TimePtr(time.Now())
+	if commit != "" {
+		state.LastCommit = commit
+	}
+	if syncErr != nil {
+		state.LastError = syncErr.Error()
+	} else {
+		state.LastError = ""
+	}
+
+	if err := service.DB.Save(&state).Error; err != nil {
+		logger.Error("Failed to save git sync state", zap.Uint("doc_id", rootId), zap.Error(err))
+	}
+
+	return result, syncErr
+}
+
+func (service *DocService) GetGitSyncStatus(docId uint) (models.GitSyncState, []models.GitSyncConflict, error) {
+	rootId, err := service.GetRootParentID(docId)
+	if err != nil {
+		return models.GitSyncState{}, nil, err
+	}
+
+	var state models.GitSyncState
+	if err := service.DB.Where("documentation_id = ?", rootId).First(&state).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return models.GitSyncState{}, nil, fmt.Errorf("failed_to_get_sync_state")
+	}
+
+	var conflicts []models.GitSyncConflict
+	if err := service.DB.Where("documentation_id = ? AND resolved_at IS NULL", rootId).Order("id").Find(&conflicts).Error; err != nil {
+		return models.GitSyncState{}, nil, fmt.Errorf("failed_to_get_sync_conflicts")
+	}
+
+	return state, conflicts, nil
+}
+
+// ResolveGitSyncConflict settles a conflict by keeping either the local
+// ("local") or the upstream ("upstream") side, then syncs again so the
+// chosen side is applied.
+func (service *DocService) ResolveGitSyncConflict(conflictId uint, strategy string) (GitSyncResult, error) {
+	var conflict models.GitSyncConflict
+	if err := service.DB.First(&conflict, conflictId).Error; err != nil {
+		return GitSyncResult{}, fmt.Errorf("conflict_not_found")
+	}
+
+	if conflict.ResolvedAt != nil {
+		return GitSyncResult{}, fmt.Errorf("conflict_already_resolved")
+	}
+
+	if strategy != "local" && strategy != "upstream" {
+		return GitSyncResult{}, fmt.Errorf("invalid_strategy")
+	}
+
+	doc, err := service.GetDocumentation(conflict.DocumentationID)
+	if err != nil {
+		return GitSyncResult{}, err
+	}
+
+	mutexI, _ := service.UWBMutexMap.LoadOrStore(fmt.Sprintf("git_sync_%d", doc.ID), &sync.Mutex{})
+	mutex := mutexI.(*sync.Mutex)
+	mutex.Lock()
+
+	err = func() error {
+		repoPath := filepath.Join(utils.GetDocPathByID(doc.ID, config.ParsedConfig), "gitsource")
+		if _, _, err := service.gitSyncCheckout(context.Background(), doc, repoPath); err != nil {
+			return err
+		}
+
+		files, err := gitSyncReadWorktree(repoPath)
+		if err != nil {
+			return err
+		}
+
+		local, versions, err := service.gitSyncRender(doc.ID)
+		if err != nil {
+			return err
+		}
+
+		var state models.GitSyncFile
+		service.DB.Where("documentation_id = ? AND key = ?", doc.ID, conflict.Key).First(&state)
+
+		statesByPath := map[string]string{}
+		if state.ID != 0 {
+			statesByPath[state.Path] = state.Key
+		}
+
+		upstream := gitSyncParse(files, versions, func(key string) bool {
+			_, ok := local[key]
+			return ok || key == conflict.Key
+		}, statesByPath)
+
+		// Pretend the losing side is what was last synced, so only the
+		// winning side shows up as a change
+		state.DocumentationID = doc.ID
+		state.Key = conflict.Key
+		if strategy == "local" {
+			state.FileHash = gitSyncHash(upstream[conflict.Key])
+		} else {
+			state.ContentHash = gitSyncHash(local[conflict.Key])
+		}
+		if state.Path == "" {
+			state.Path = conflict.Path
+		}
+
+		if err := service.DB.Save(&state).Error; err != nil {
+			return fmt.Errorf("failed_to_save_sync_state")
+		}
+
+		conflict.ResolvedAt = utils.TimePtr(time.Now())
+		conflict.Resolution = strategy
+
+		if err := service.DB.Save(&conflict).Error; err != nil {
+			return fmt.Errorf("failed_to_resolve_conflict")
+		}
+
+		return nil
+	}()
+
+	mutex.Unlock()
+
+	if err != nil {
+		return GitSyncResult{}, err
+	}
+
+	return service.GitSourceSync(doc.ID)
+}
+
+// gitSyncForBuild brings the source repository in line with the database
+// ahead of a build, so the build sees upstream edits and the repository sees
+// the edits that triggered it.
+func (service *DocService) gitSyncForBuild(ctx context.Context, docId uint) {
+	rootId, err := service.GetRootParentID(docId)
+	if err != nil {
+		return
+	}
+
+	var enabled bool
+	service.DB.Model(&models.Documentation{}).
+		Select("git_sync_enabled").
+		Where("id = ?", rootId).
+		Pluck("git_sync_enabled", &enabled)
+	if !enabled {
+		return
+	}
+
+	start := time.Now()
+	result, err := service.gitSourceSync(ctx, rootId)
+	if err != nil {
+		logger.ErrorContext(ctx, "Failed to sync git source", zap.Uint("doc_id", rootId), zap.Error(err))
+		return
+	}
+
+	logger.InfoContext(ctx, "Git source sync completed",
+		zap.Uint("doc_id", rootId),
+		zap.Int("pulled", result.Pulled),
+		zap.Int("pushed", result.Pushed),
+		zap.Int("conflicts", result.Conflicts),
+		zap.Duration("elapsed", time.Since(start)))
+}
+
+var gitSyncLastRun sync.Map
+
+// GitSyncJob periodically pulls upstream changes for documentations with
+// source sync enabled and triggers a build when anything was applied. The
+// syncs are cut short once ctx is done.
+func (service *DocService) GitSyncJob(ctx context.Context) {
+	var docs []models.Documentation
+
+	if err := service.DB.Select("ID").
+		Where("git_sync_enabled = ? AND cloned_from IS NULL", true).
+		Find(&docs).Error; err != nil {
+		logger.Error("Failed to fetch git sync documentations", zap.Error(err))
+		return
+	}
+
+	interval := time.Duration(config.ParsedConfig.GitSyncInterval) * time.Second
+	if interval <= 0 {
+		interval = 60 * time.Second
+	}
+
+	for _, doc := range docs {
+		if ctx.Err() != nil {
+			return
+		}
+
+		if last, ok := gitSyncLastRun.Load(doc.ID); ok && time.Since(last.(time.Time)) < interval {
+			continue
+		}
+		gitSyncLastRun.Store(doc.ID, time.Now())
+
+		result, err := service.gitSourceSync(ctx, doc.ID)
+		if err != nil {
+			logger.Error("Failed to sync git source", zap.Uint("doc_id", doc.ID), zap.Error(err))
+			continue
+		}
+
+		if result.Pulled > 0 {
+			logger.Info("Applied upstream git changes",
+				zap.Uint("doc_id", doc.ID),
+				zap.Int("pulled", result.Pulled),
+				zap.Int("conflicts", result.Conflicts))
+
+			if err := service.AddBuildTrigger(doc.ID, false); err != nil {
+				logger.Error("Failed to add build trigger", zap.Uint("doc_id", doc.ID), zap.Error(err))
+			}
+		}
+	}
+}
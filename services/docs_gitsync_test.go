@@ -0,0 +1,192 @@
+package services
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"git.difuse.io/Difuse/kalmia/db/models"
+	"git.difuse.io/Difuse/kalmia/utils"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func gitSyncTestContent(t *testing.T, markdown string) string {
+	blocks, err := utils.MarkdownToBlocks(markdown)
+	require.NoError(t, err)
+
+	content, err := json.Marshal(blocks)
+	require.NoError(t, err)
+
+	return string(content)
+}
+
+func gitSyncTestPush(t *testing.T, repo *git.Repository, files map[string]string) {
+	w, err := repo.Worktree()
+	require.NoError(t, err)
+
+	for name, content := range files {
+		fullPath := filepath.Join(w.Filesystem.Root(), name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(fullPath), 0755))
+		require.NoError(t, os.WriteFile(fullPath, []byte(content), 0644))
+	}
+
+	require.NoError(t, w.AddWithOptions(&git.AddOptions{All: true}))
+	_, err = w.Commit("Upstream edit", &git.CommitOptions{
+		Author: &object.Signature{Name: "Engineer", Email: "engineer@example.com", When: time.Now()},
+	})
+	require.NoError(t, err)
+	require.NoError(t, repo.Push(&git.PushOptions{}))
+}
+
+func gitSyncTestPull(t *testing.T, repo *git.Repository) {
+	w, err := repo.Worktree()
+	require.NoError(t, err)
+
+	err = w.Pull(&git.PullOptions{RemoteName: "origin"})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		require.NoError(t, err)
+	}
+}
+
+func TestGitSourceSync(t *testing.T) {
+	remotePath := filepath.Join(t.TempDir(), "docs.git")
+	remote, err := git.PlainInit(remotePath, true)
+	require.NoError(t, err)
+	require.NoError(t, remote.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, plumbing.NewBranchReferenceName("main"))))
+
+	doc := models.Documentation{
+		Name:           "Git Sync",
+		Version:        "1.0.0",
+		BaseURL:        "/git-sync",
+		AuthorID:       1,
+		GitSyncEnabled: true,
+		GitSyncRepo:    remotePath,
+		GitSyncBranch:  "main",
+	}
+	require.NoError(t, TestDocService.DB.Create(&doc).Error)
+
+	group := models.PageGroup{Name: "Guides", DocumentationID: doc.ID, AuthorID: 1}
+	require.NoError(t, TestDocService.DB.Create(&group).Error)
+
+	intro := models.Page{
+		Title:           "Installation",
+		Slug:            "/installation",
+		DocumentationID: doc.ID,
+		PageGroupID:     &group.ID,
+		AuthorID:        1,
+		Content:         gitSyncTestContent(t, "# Installation\n\nRun the installer.\n"),
+	}
+	require.NoError(t, TestDocService.DB.Create(&intro).Error)
+
+	t.Run("Push local pages", func(t *testing.T) {
+		result, err := TestDocService.GitSourceSync(doc.ID)
+		require.NoError(t, err)
+		assert.Equal(t, 2, result.Pushed)
+		assert.NotEmpty(t, result.Commit)
+	})
+
+	clonePath := filepath.Join(t.TempDir(), "clone")
+	clone, err := git.PlainClone(clonePath, false, &git.CloneOptions{URL: remotePath})
+	require.NoError(t, err)
+
+	pagePath := filepath.Join(clonePath, "1.0.0", "guides", "installation.md")
+
+	t.Run("Repository layout", func(t *testing.T) {
+		assert.FileExists(t, filepath.Join(clonePath, "1.0.0", "guides", "_group.md"))
+
+		data, err := os.ReadFile(pagePath)
+		require.NoError(t, err)
+		assert.Contains(t, string(data), "title: Installation")
+		assert.Contains(t, string(data), "Run the installer.")
+	})
+
+	t.Run("Apply upstream changes", func(t *testing.T) {
+		data, err := os.ReadFile(pagePath)
+		require.NoError(t, err)
+
+		gitSyncTestPush(t, clone, map[string]string{
+			"1.0.0/guides/installation.md": strings.Replace(string(data), "Run the installer.", "Run the new installer.", 1),
+			"1.0.0/guides/upgrading.md":    "---\ntitle: Upgrading\n---\n\nRead the changelog first.\n",
+		})
+
+		result, err := TestDocService.GitSourceSync(doc.ID)
+		require.NoError(t, err)
+		assert.Equal(t, 2, result.Pulled)
+		assert.Equal(t, 0, result.Conflicts)
+
+		page, err := TestDocService.GetPage(intro.ID)
+		require.NoError(t, err)
+		assert.Contains(t, page.Content, "Run the new installer.")
+
+		var created models.Page
+		require.NoError(t, TestDocService.DB.Where("documentation_id = ? AND title = ?", doc.ID, "Upgrading").First(&created).Error)
+		assert.Equal(t, group.ID, *created.PageGroupID)
+		assert.Equal(t, "/upgrading", created.Slug)
+
+		// The new file gets its id written back
+		gitSyncTestPull(t, clone)
+		data, err = os.ReadFile(filepath.Join(clonePath, "1.0.0", "guides", "upgrading.md"))
+		require.NoError(t, err)
+		assert.Contains(t, string(data), "id: ")
+	})
+
+	t.Run("Report conflicts", func(t *testing.T) {
+		data, err := os.ReadFile(pagePath)
+		require.NoError(t, err)
+
+		gitSyncTestPush(t, clone, map[string]string{
+			"1.0.0/guides/installation.md": strings.Replace(string(data), "Run the new installer.", "Upstream wording.", 1),
+		})
+
+		require.NoError(t, TestDocService.DB.Model(&models.Page{}).Where("id = ?", intro.ID).
+			Update("content", gitSyncTestContent(t, "# Installation\n\nLocal wording.\n")).Error)
+
+		result, err := TestDocService.GitSourceSync(doc.ID)
+		require.NoError(t, err)
+		assert.Equal(t, 1, result.Conflicts)
+
+		page, err := TestDocService.GetPage(intro.ID)
+		require.NoError(t, err)
+		assert.Contains(t, page.Content, "Local wording.")
+
+		_, conflicts, err := TestDocService.GetGitSyncStatus(doc.ID)
+		require.NoError(t, err)
+		require.Len(t, conflicts, 1)
+		assert.Equal(t, "1.0.0/guides/installation.md", conflicts[0].Path)
+
+		_, err = TestDocService.ResolveGitSyncConflict(conflicts[0].ID, "upstream")
+		require.NoError(t, err)
+
+		page, err = TestDocService.GetPage(intro.ID)
+		require.NoError(t, err)
+		assert.Contains(t, page.Content, "Upstream wording.")
+
+		_, conflicts, err = TestDocService.GetGitSyncStatus(doc.ID)
+		require.NoError(t, err)
+		assert.Len(t, conflicts, 0)
+	})
+
+	t.Run("Delete upstream", func(t *testing.T) {
+		gitSyncTestPull(t, clone)
+		w, err := clone.Worktree()
+		require.NoError(t, err)
+		_, err = w.Remove("1.0.0/guides/upgrading.md")
+		require.NoError(t, err)
+		gitSyncTestPush(t, clone, map[string]string{})
+
+		result, err := TestDocService.GitSourceSync(doc.ID)
+		require.NoError(t, err)
+		assert.Equal(t, 1, result.Pulled)
+
+		var count int64
+		TestDocService.DB.Model(&models.Page{}).Where("documentation_id = ? AND title = ?", doc.ID, "Upgrading").Count(&count)
+		assert.Equal(t, int64(0), count)
+	})
+}
@@ -0,0 +1,576 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"git.difuse.io/Difuse/kalmia/config"
+	"git.difuse.io/Difuse/kalmia/db/models"
+	"git.difuse.io/Difuse/kalmia/embedded"
+	"git.difuse.io/Difuse/kalmia/utils"
+	"golang.org/x/net/html"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/language"
+)
+
+// htmlAssetsDir is where the built-in HTML generator puts its stylesheet
+// and script, under the base URL of a documentation.
+const htmlAssetsDir = "_kalmia"
+
+// htmlSearchIndex is the file, at the root of every version, that the
+// search of its pages is run against.
+const htmlSearchIndex = "search-index.json"
+
+// htmlSearchTextLimit is how much of the text of a page is searched.
+const htmlSearchTextLimit = 5000
+
+var htmlTemplates = template.Must(template.ParseFS(embedded.HTMLFS, "html/*.html"))
+
+// htmlGenerator renders documentations to HTML in Go, without Node.js or
+// any packages to install, for sites that don't need what rspress offers.
+type htmlGenerator struct {
+	service *DocService
+}
+
+type htmlNavItem struct {
+	Label    string
+	Link     string
+	Active   bool
+	Open     bool
+	Children []htmlNavItem
+}
+
+type htmlLink struct {
+	Label string
+	Link  string
+}
+
+type htmlVersion struct {
+	Version string
+	Link    string
+	Current bool
+}
+
+type htmlSearchEntry struct {
+	Title string `json:"title"`
+	Link  string `json:"link"`
+	Text  string `json:"text"`
+}
+
+// htmlSite is what every page of a documentation version shares. Root is
+// the URL of the version, Base the one of the documentation.
+type htmlSite struct {
+	Title        string
+	Description  string
+	Base         string
+	Root         string
+	Assets       string
+	Favicon      string
+	NavImage     string
+	NavImageDark string
+	CustomCSS    template.CSS
+	Versions     []htmlVersion
+	FooterLinks  []htmlLink
+	SocialLinks  []htmlLink
+	Copyright    string
+	Year         int
+}
+
+type htmlHero struct {
+	Name     string
+	Text     string
+	Image    string
+	Actions  []htmlHeroAction
+	Features []htmlHeroFeature
+}
+
+type htmlHeroAction struct {
+	Theme string
+	Text  string
+	Link  string
+}
+
+type htmlHeroFeature struct {
+	Icon    string
+	Title   string
+	Details string
+}
+
+type htmlPageData struct {
+	Site     *htmlSite
+	Title    string
+	Nav      []htmlNavItem
+	Content  template.HTML
+	Hero     *htmlHero
+	Redirect string
+}
+
+// htmlPage is a page of a documentation version and the folder, relative to
+// the version, it is written to.
+type htmlPage struct {
+	page models.Page
+	dir  string
+	link string
+}
+
+func (generator htmlGenerator) Name() string {
+	return models.GeneratorHTML
+}
+
+func (generator htmlGenerator) Init(rootId uint) error {
+	return utils.MakeDir(filepath.Join(utils.GetDocPathByID(rootId, config.ParsedConfig), "public"))
+}
+
+func (generator htmlGenerator) Initialized(rootId uint) bool {
+	return utils.PathExists(utils.GetDocPathByID(rootId, config.ParsedConfig))
+}
+
+func (generator htmlGenerator) WriteConfig(docId uint, rootId uint) (bool, error) {
+	// There is no config besides the documentation itself, which is rendered
+	// into every page
+	return false, nil
+}
+
+func (generator htmlGenerator) WriteContents(ctx context.Context, docId uint, rootId uint) (bool, error) {
+	tmpBuildPath := filepath.Join(utils.GetDocPathByID(rootId, config.ParsedConfig), "build_tmp")
+
+	if err := generator.render(ctx, generator.service.siteView(rootId), rootId, tmpBuildPath); err != nil {
+		return false, err
+	}
+
+	// Rendering is cheap, so the site is rendered in full and what changed is
+	// only found out when it replaces the one being served
+	return true, nil
+}
+
+func (generator htmlGenerator) Build(ctx context.Context, rootId uint, rebuild bool) error {
+	if !rebuild {
+		buildRecorderFrom(ctx).logf("No changes since the last build, reusing it")
+		return nil
+	}
+
+	ctx = buildRecorderFrom(ctx).startPhase(ctx, BuildPhaseBuild)
+
+	return generator.service.publishBuild(ctx, rootId)
+}
+
+func (generator htmlGenerator) BuildGit(ctx context.Context, rootId uint) error {
+	view := publishedView(time.Now())
+	view.baseURL = "/"
+
+	gitBuildPath := filepath.Join(utils.GetDocPathByID(rootId, config.ParsedConfig), "gitbuild")
+
+	return generator.render(ctx, view, rootId, gitBuildPath)
+}
+
+func (generator htmlGenerator) BuildPreview(ctx context.Context, preview models.PreviewBuild, view contentView) error {
+	return generator.render(ctx, view, preview.RootID, filepath.Join(previewPath(preview.RootID, preview.Token), "build"))
+}
+
+// render writes the site of every version of a documentation, as it appears
+// in view, to outDir. The latest version is served from the base URL, the
+// others from a folder named after their version.
+func (generator htmlGenerator) render(ctx context.Context, view contentView, rootId uint, outDir string) error {
+	service := generator.service
+	files := newContentWriter()
+
+	latest, versions, err := service.GetAllVersions(rootId)
+	if err != nil {
+		return err
+	}
+
+	versionInfos, err := service.buildVersionTree(rootId)
+	if err != nil {
+		return err
+	}
+
+	for _, versionInfo := range versionInfos {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		versionDoc, err := service.GetDocumentation(versionInfo.DocId)
+		if err != nil {
+			return err
+		}
+
+		baseURL := strings.TrimSuffix(view.baseURLOf(versionDoc), "/")
+
+		versionDir := outDir
+		site := &htmlSite{
+			Title:        versionDoc.Name,
+			Description:  versionDoc.Description,
+			Base:         baseURL,
+			Root:         baseURL,
+			Assets:       baseURL + "/" + htmlAssetsDir,
+			Favicon:      htmlAssetURL(baseURL, versionDoc.Favicon),
+			NavImage:     htmlAssetURL(baseURL, versionDoc.NavImage),
+			NavImageDark: htmlAssetURL(baseURL, versionDoc.NavImageDark),
+			CustomCSS:    template.CSS(versionDoc.CustomCSS),
+			FooterLinks:  htmlFooterLinks(versionDoc.MoreLabelLinks),
+			SocialLinks:  htmlSocialLinks(versionDoc.FooterLabelLinks),
+			Copyright:    versionDoc.CopyrightText,
+			Year:         time.Now().UTC().Year(),
+		}
+
+		if versionInfo.Version != latest {
+			versionDir = filepath.Join(outDir, versionInfo.Version)
+			site.Root += "/" + versionInfo.Version
+		}
+
+		if site.NavImageDark == "" {
+			site.NavImageDark = site.NavImage
+		}
+
+		if len(versions) > 1 {
+			for _, version := range versions {
+				link := baseURL + "/"
+				if version != latest {
+					link += version + "/"
+				}
+
+				site.Versions = append(site.Versions, htmlVersion{Version: version, Link: link, Current: version == versionInfo.Version})
+			}
+		}
+
+		nav, pages, err := generator.versionPages(view, versionDoc, site.Root)
+		if err != nil {
+			return err
+		}
+
+		searchIndex := make([]htmlSearchEntry, 0, len(pages))
+
+		for _, page := range pages {
+			content, err := htmlPageContent(page.page)
+			if err != nil {
+				return err
+			}
+
+			searchIndex = append(searchIndex, htmlSearchEntry{
+				Title: page.page.Title,
+				Link:  page.link,
+				Text:  htmlSearchText(string(content)),
+			})
+
+			data := htmlPageData{
+				Site:    site,
+				Title:   page.page.Title,
+				Nav:     htmlActiveNav(nav, page.link),
+				Content: content,
+			}
+
+			if err := generator.writePage(files, filepath.Join(versionDir, page.dir, "index.html"), data); err != nil {
+				return err
+			}
+		}
+
+		home, err := generator.homePage(versionDoc, site)
+		if err != nil {
+			return err
+		}
+
+		if err := generator.writePage(files, filepath.Join(versionDir, "index.html"), home); err != nil {
+			return err
+		}
+
+		searchJSON, err := json.Marshal(searchIndex)
+		if err != nil {
+			return err
+		}
+
+		if err := files.write(filepath.Join(versionDir, htmlSearchIndex), string(searchJSON)); err != nil {
+			return err
+		}
+	}
+
+	for _, asset := range []string{"style.css", "site.js"} {
+		content, err := embedded.HTMLFS.ReadFile("html/" + asset)
+		if err != nil {
+			return err
+		}
+
+		if err := files.write(filepath.Join(outDir, htmlAssetsDir, asset), string(content)); err != nil {
+			return err
+		}
+	}
+
+	if err := generator.writePublicAssets(files, rootId, outDir); err != nil {
+		return err
+	}
+
+	return files.prune(outDir)
+}
+
+func (generator htmlGenerator) writePage(files *contentWriter, path string, data htmlPageData) error {
+	var buffer bytes.Buffer
+	if err := htmlTemplates.ExecuteTemplate(&buffer, "page", data); err != nil {
+		return err
+	}
+
+	return files.write(path, buffer.String())
+}
+
+// writePublicAssets copies the uploaded favicon and images of a
+// documentation to the root of its site, where rspress puts them too.
+func (generator htmlGenerator) writePublicAssets(files *contentWriter, rootId uint, outDir string) error {
+	publicPath := filepath.Join(utils.GetDocPathByID(rootId, config.ParsedConfig), "public")
+	if !utils.PathExists(publicPath) {
+		return nil
+	}
+
+	return filepath.WalkDir(publicPath, func(path string, entry os.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(publicPath, path)
+		if err != nil {
+			return err
+		}
+
+		return files.write(filepath.Join(outDir, relPath), string(content))
+	})
+}
+
+// versionPages returns the sidebar of a documentation version and its pages,
+// which are written under guides like rspress does.
+func (generator htmlGenerator) versionPages(view contentView, versionDoc models.Documentation, root string) ([]htmlNavItem, []htmlPage, error) {
+	var rootPageGroups []models.PageGroup
+	if err := generator.service.DB.Where("parent_id IS NULL AND documentation_id = ?", versionDoc.ID).Find(&rootPageGroups).Error; err != nil {
+		return nil, nil, err
+	}
+
+	return generator.navLevel(view, view.pages(versionDoc.Pages), view.pageGroups(rootPageGroups), "guides", root)
+}
+
+// navLevel collects the pages and page groups of one level of the sidebar,
+// in the order they appear in it.
+func (generator htmlGenerator) navLevel(view contentView, pages []models.Page, pageGroups []models.PageGroup, dir string, root string) ([]htmlNavItem, []htmlPage, error) {
+	type navEntry struct {
+		order uint
+		name  string
+		item  htmlNavItem
+	}
+
+	var entries []navEntry
+	var collected []htmlPage
+
+	for _, page := range pages {
+		fullPage, err := generator.service.GetPage(page.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+		fullPage = view.applyDraft(fullPage)
+
+		name := utils.StringToFileString(fullPage.Title)
+		pageDir := dir + "/" + name
+		if fullPage.IsIntroPage {
+			name = "index"
+			pageDir = dir
+		}
+
+		link := root + "/" + pageDir + "/"
+		collected = append(collected, htmlPage{page: fullPage, dir: filepath.FromSlash(pageDir), link: link})
+
+		order := uint(0)
+		if fullPage.Order != nil && !fullPage.IsIntroPage {
+			order = *fullPage.Order
+		}
+
+		entries = append(entries, navEntry{order: order, name: name, item: htmlNavItem{Label: fullPage.Title, Link: link}})
+	}
+
+	for _, pageGroup := range pageGroups {
+		groupPages, err := generator.service.GetPagesOfPageGroup(pageGroup.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var nestedPageGroups []models.PageGroup
+		if err := generator.service.DB.Where("parent_id = ?", pageGroup.ID).Find(&nestedPageGroups).Error; err != nil {
+			return nil, nil, err
+		}
+
+		name := utils.StringToFileString(pageGroup.Name)
+		children, groupCollected, err := generator.navLevel(view, view.pages(groupPages), view.pageGroups(nestedPageGroups), dir+"/"+name, root)
+		if err != nil {
+			return nil, nil, err
+		}
+		collected = append(collected, groupCollected...)
+
+		order := uint(0)
+		if pageGroup.Order != nil {
+			order = *pageGroup.Order
+		}
+
+		entries = append(entries, navEntry{order: order, name: name, item: htmlNavItem{Label: pageGroup.Name, Children: children}})
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].order != entries[j].order {
+			return entries[i].order < entries[j].order
+		}
+		return entries[i].name < entries[j].name
+	})
+
+	items := make([]htmlNavItem, 0, len(entries))
+	for _, entry := range entries {
+		items = append(items, entry.item)
+	}
+
+	return items, collected, nil
+}
+
+// homePage is the landing page of a documentation version, or a redirect to
+// its guides when it has none.
+func (generator htmlGenerator) homePage(versionDoc models.Documentation, site *htmlSite) (htmlPageData, error) {
+	if versionDoc.LanderDetails == "" || versionDoc.LanderDetails == "{}" {
+		return htmlPageData{Site: site, Redirect: site.Root + "/guides/"}, nil
+	}
+
+	var landerDetails struct {
+		CtaButtonText struct {
+			CtaButtonLinkLabel string `json:"ctaButtonLinkLabel"`
+			CtaButtonLink      string `json:"ctaButtonLink"`
+		} `json:"ctaButtonText"`
+		SecondCtaButtonText struct {
+			CtaButtonLinkLabel string `json:"ctaButtonLinkLabel"`
+			CtaButtonLink      string `json:"ctaButtonLink"`
+		} `json:"secondCtaButtonText"`
+		CtaImageLink string `json:"ctaImageLink"`
+		Features     []struct {
+			Emoji string `json:"emoji"`
+			Title string `json:"title"`
+			Text  string `json:"text"`
+		} `json:"features"`
+	}
+
+	if err := json.Unmarshal([]byte(versionDoc.LanderDetails), &landerDetails); err != nil {
+		return htmlPageData{}, fmt.Errorf("error unmarshaling LanderDetails: %w", err)
+	}
+
+	hero := &htmlHero{
+		Name:  versionDoc.Name,
+		Text:  versionDoc.Description,
+		Image: htmlAssetURL(site.Base, landerDetails.CtaImageLink),
+		Actions: []htmlHeroAction{
+			{Theme: "brand", Text: landerDetails.CtaButtonText.CtaButtonLinkLabel, Link: htmlAssetURL(site.Root, landerDetails.CtaButtonText.CtaButtonLink)},
+			{Theme: "alt", Text: landerDetails.SecondCtaButtonText.CtaButtonLinkLabel, Link: htmlAssetURL(site.Root, landerDetails.SecondCtaButtonText.CtaButtonLink)},
+		},
+	}
+
+	for _, feature := range landerDetails.Features {
+		hero.Features = append(hero.Features, htmlHeroFeature{
+			Icon:    utils.ConvertToEmoji(feature.Emoji),
+			Title:   feature.Title,
+			Details: feature.Text,
+		})
+	}
+
+	return htmlPageData{Site: site, Hero: hero}, nil
+}
+
+func htmlPageContent(page models.Page) (template.HTML, error) {
+	var blocks []Block
+	if page.Content != "" && page.Content != `"[]"` {
+		if err := json.Unmarshal([]byte(page.Content), &blocks); err != nil {
+			return "", err
+		}
+	}
+
+	content, err := utils.BlocksToHTML(blocks)
+	if err != nil {
+		return "", err
+	}
+
+	return template.HTML(content), nil
+}
+
+// htmlActiveNav returns a copy of nav with the item linking to link marked
+// as the current page and the page groups leading to it opened.
+func htmlActiveNav(nav []htmlNavItem, link string) []htmlNavItem {
+	marked := make([]htmlNavItem, len(nav))
+	for i, item := range nav {
+		item.Active = item.Link == link
+		item.Children = htmlActiveNav(item.Children, link)
+		for _, child := range item.Children {
+			item.Open = item.Open || child.Active || child.Open
+		}
+		marked[i] = item
+	}
+
+	return marked
+}
+
+// htmlSearchText returns the text of the HTML content of a page, as it is
+// searched.
+func htmlSearchText(content string) string {
+	var words []string
+
+	tokenizer := html.NewTokenizer(strings.NewReader(content))
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			text := strings.Join(words, " ")
+			if len(text) > htmlSearchTextLimit {
+				text = strings.ToValidUTF8(text[:htmlSearchTextLimit], "")
+			}
+			return text
+		case html.TextToken:
+			words = append(words, strings.Fields(string(tokenizer.Text()))...)
+		}
+	}
+}
+
+func htmlFooterLinks(moreLabelLinks string) []htmlLink {
+	var moreLinks []MoreLink
+	if err := json.Unmarshal([]byte(moreLabelLinks), &moreLinks); err != nil {
+		return nil
+	}
+
+	links := make([]htmlLink, 0, len(moreLinks))
+	for _, link := range moreLinks {
+		links = append(links, htmlLink{Label: link.Label, Link: link.Link})
+	}
+
+	return links
+}
+
+func htmlSocialLinks(footerLabelLinks string) []htmlLink {
+	var socialLinks []SocialLink
+	if err := json.Unmarshal([]byte(footerLabelLinks), &socialLinks); err != nil {
+		return nil
+	}
+
+	caser := cases.Title(language.English)
+
+	links := make([]htmlLink, 0, len(socialLinks))
+	for _, link := range socialLinks {
+		links = append(links, htmlLink{Label: caser.String(link.Label), Link: link.Link})
+	}
+
+	return links
+}
+
+// htmlAssetURL resolves a path on the site, like the uploaded favicon, under
+// root. Full URLs are left as they are.
+func htmlAssetURL(root string, url string) string {
+	if strings.HasPrefix(url, "/") && !strings.HasPrefix(url, "//") {
+		return root + url
+	}
+
+	return url
+}
@@ -9,13 +9,16 @@ import (
 	"strings"
 
 	"git.difuse.io/Difuse/kalmia/config"
+	"git.difuse.io/Difuse/kalmia/logger"
 	"git.difuse.io/Difuse/kalmia/utils"
 	"github.com/PuerkitoBio/goquery"
 	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/transport"
 	"github.com/go-git/go-git/v5/plumbing/transport/http"
 	figure "github.com/mangoumbrella/goldmark-figure"
 	"github.com/yuin/goldmark"
 	"github.com/yuin/goldmark/parser"
+	"go.uber.org/zap"
 )
 
 func processMarkdown(content, dir string, cfg *config.Config) (string, error) {
@@ -129,12 +132,29 @@ func parseMarkdownFiles(dir string, doc map[string]interface{}, cfg *config.Conf
 	return nil
 }
 
-func (service *DocService) ImportGitbook(url, username, password string, cfg *config.Config) (string, error) {
+func (service *DocService) ImportGitbook(url, username, password, sshPrivateKey, sshKnownHosts string, cfg *config.Config) (string, error) {
 	if !utils.IsValidGitURL(url) {
 		return "", fmt.Errorf("invalid_git_url")
 	}
 
-	err := utils.IsRepoAccessible(url, username, password)
+	var auth transport.AuthMethod
+	var err error
+
+	if utils.IsSSHGitURL(url) {
+		auth, err = utils.GitSSHAuth(url, sshPrivateKey, sshKnownHosts, func(line string) {
+			logger.Warn("Trusting unpinned git host key for import", zap.String("url", url), zap.String("host_key", line))
+		})
+		if err != nil {
+			return "", fmt.Errorf("invalid_ssh_credentials")
+		}
+	} else if username != "" && password != "" {
+		auth = &http.BasicAuth{
+			Username: username,
+			Password: password,
+		}
+	}
+
+	err = utils.IsRepoAccessibleWithAuth(url, auth)
 
 	if err != nil {
 		return "", fmt.Errorf("failed_to_check_repo_access")
@@ -148,18 +168,10 @@ func (service *DocService) ImportGitbook(url, username, password string, cfg *co
 
 	defer os.RemoveAll(tempDir)
 
-	cloneOptions := &git.CloneOptions{
-		URL: url,
-	}
-
-	if username != "" && password != "" {
-		cloneOptions.Auth = &http.BasicAuth{
-			Username: username,
-			Password: password,
-		}
-	}
-
-	_, err = git.PlainClone(tempDir, false, cloneOptions)
+	_, err = git.PlainClone(tempDir, false, &git.CloneOptions{
+		URL:  url,
+		Auth: auth,
+	})
 
 	if err != nil {
 		return "", fmt.Errorf("failed_to_clone_repo")
@@ -0,0 +1,238 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"git.difuse.io/Difuse/kalmia/db/models"
+	"git.difuse.io/Difuse/kalmia/logger"
+	"git.difuse.io/Difuse/kalmia/secrets"
+	"git.difuse.io/Difuse/kalmia/utils"
+	"go.uber.org/zap"
+)
+
+var inboundHookActions = []string{
+	models.InboundHookActionNone,
+	models.InboundHookActionGitSync,
+	models.InboundHookActionCreateVersion,
+}
+
+var hookVersionRegex = regexp.MustCompile(`^v?(\d[\w.\-+]*)$`)
+
+func hashInboundHookToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func generateToken() (string, error) {
+	tokenBytes := make([]byte, 24)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(tokenBytes), nil
+}
+
+// hookVersion finds the version to create in a hook payload: a "version"
+// field, the tag of a GitHub/Gitea release or a pushed tag ref. A leading
+// "v" is dropped, so tag v1.2.0 creates version 1.2.0.
+func hookVersion(body []byte) (string, error) {
+	var payload struct {
+		Version string `json:"version"`
+		Ref     string `json:"ref"`
+		Release struct {
+			TagName string `json:"tag_name"`
+		} `json:"release"`
+	}
+
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return "", fmt.Errorf("invalid_hook_payload")
+		}
+	}
+
+	version := payload.Version
+	if version == "" {
+		version = payload.Release.TagName
+	}
+	if version == "" && strings.HasPrefix(payload.Ref, "refs/tags/") {
+		version = strings.TrimPrefix(payload.Ref, "refs/tags/")
+	}
+
+	if version == "" {
+		return "", fmt.Errorf("version_required")
+	}
+
+	matches := hookVersionRegex.FindStringSubmatch(version)
+	if matches == nil {
+		return "", fmt.Errorf("invalid_version")
+	}
+
+	return matches[1], nil
+}
+
+func (service *DocService) GetInboundHooks(docId uint) ([]models.InboundHook, error) {
+	var hooks []models.InboundHook
+
+	// The secret is never read back, only whether it is set
+	if err := service.DB.Select("ID", "DocumentationID", "TokenHint", "Action", "AuthorID", "LastTriggeredAt", "CreatedAt", "UpdatedAt",
+		"COALESCE(secret, '') <> '' AS secret_set").Where("documentation_id = ?", docId).Order("id ASC").Find(&hooks).Error; err != nil {
+		return nil, fmt.Errorf("failed_to_get_inbound_hooks")
+	}
+
+	return hooks, nil
+}
+
+// CreateInboundHook creates a build hook for a root documentation and
+// returns it with its token. The token is not stored and cannot be shown
+// again.
+func (service *DocService) CreateInboundHook(user models.User, docId uint, secret, action string) (models.InboundHook, string, error) {
+	if !service.IsDocIdValid(docId) {
+		return models.InboundHook{}, "", fmt.Errorf("invalid_documentation_id")
+	}
+
+	if !utils.ArrayContains(inboundHookActions, action) {
+		return models.InboundHook{}, "", fmt.Errorf("invalid_hook_action")
+	}
+
+	if action == models.InboundHookActionGitSync {
+		var enabled bool
+		service.DB.Model(&models.Documentation{}).Where("id = ?", docId).Pluck("git_sync_enabled", &enabled)
+		if !enabled {
+			return models.InboundHook{}, "", fmt.Errorf("git_sync_not_enabled")
+		}
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		return models.InboundHook{}, "", fmt.Errorf("failed_to_generate_hook_token")
+	}
+
+	encryptedSecret, err := secrets.Encrypt(secret)
+	if err != nil {
+		return models.InboundHook{}, "", fmt.Errorf("failed_to_encrypt_hook_secret")
+	}
+
+	hook := models.InboundHook{
+		DocumentationID: docId,
+		TokenHash:       hashInboundHookToken(token),
+		TokenHint:       token[:6],
+		Secret:          encryptedSecret,
+		SecretSet:       secret != "",
+		Action:          action,
+		AuthorID:        user.ID,
+	}
+
+	if err := service.DB.Create(&hook).Error; err != nil {
+		return models.InboundHook{}, "", fmt.Errorf("failed_to_create_inbound_hook")
+	}
+
+	return hook, token, nil
+}
+
+func (service *DocService) DeleteInboundHook(id uint) error {
+	result := service.DB.Delete(&models.InboundHook{}, id)
+	if result.Error != nil {
+		return fmt.Errorf("failed_to_delete_inbound_hook")
+	}
+
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("inbound_hook_not_found")
+	}
+
+	return nil
+}
+
+// TriggerInboundHook checks a call to the hook with the given token and
+// queues its action and a forced build in the background. Calls for event
+// "ping" are only checked. When the hook has a secret, signature must be the
+// HMAC-SHA256 of body as sent by GitHub or Gitea.
+func (service *DocService) TriggerInboundHook(token, event, signature string, body []byte) (models.InboundHook, error) {
+	var hook models.InboundHook
+	if token == "" || service.DB.Where("token_hash = ?", hashInboundHookToken(token)).First(&hook).Error != nil {
+		return models.InboundHook{}, fmt.Errorf("inbound_hook_not_found")
+	}
+
+	if hook.Secret != "" {
+		secret, err := secrets.Decrypt(hook.Secret)
+		if err != nil {
+			logger.Error("Failed to decrypt inbound hook secret", zap.Uint("hook_id", hook.ID), zap.Error(err))
+			return models.InboundHook{}, fmt.Errorf("failed_to_verify_signature")
+		}
+
+		if !utils.VerifyHMAC(secret, body, signature) {
+			return models.InboundHook{}, fmt.Errorf("invalid_signature")
+		}
+	}
+
+	if event == "ping" {
+		return hook, nil
+	}
+
+	var version string
+	if hook.Action == models.InboundHookActionCreateVersion {
+		var err error
+		if version, err = hookVersion(body); err != nil {
+			return models.InboundHook{}, err
+		}
+	}
+
+	if err := service.DB.Model(&hook).Update("last_triggered_at", time.Now()).Error; err != nil {
+		logger.Error("Failed to save inbound hook", zap.Uint("hook_id", hook.ID), zap.Error(err))
+	}
+
+	service.background.Go(func() {
+		if err := service.runInboundHook(service.buildCtx, hook, version); err != nil {
+			logger.Error("Inbound hook failed",
+				zap.Uint("hook_id", hook.ID),
+				zap.Uint("doc_id", hook.DocumentationID),
+				zap.String("action", hook.Action),
+				zap.Error(err))
+		}
+	})
+
+	return hook, nil
+}
+
+// runInboundHook runs the action of a hook and then queues a forced build.
+// The build is not queued when the action fails. Like builds, the action is
+// cancelled with ctx.
+func (service *DocService) runInboundHook(ctx context.Context, hook models.InboundHook, version string) error {
+	switch hook.Action {
+	case models.InboundHookActionGitSync:
+		if _, err := service.gitSourceSync(ctx, hook.DocumentationID); err != nil {
+			return err
+		}
+	case models.InboundHookActionCreateVersion:
+		ids, err := service.gitVersionIDs(hook.DocumentationID)
+		if err != nil {
+			return err
+		}
+
+		var versions []models.Documentation
+		if err := service.DB.Where("id IN ?", ids).Order("created_at DESC").Find(&versions).Error; err != nil {
+			return err
+		}
+
+		exists := false
+		for _, doc := range versions {
+			exists = exists || doc.Version == version
+		}
+
+		// Retried deliveries of the same release only rebuild
+		if !exists && len(versions) > 0 {
+			if err := service.CreateDocumentationVersion(versions[0].ID, version); err != nil {
+				return err
+			}
+		}
+	}
+
+	return service.AddBuildTrigger(hook.DocumentationID, false, true)
+}
@@ -0,0 +1,128 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"git.difuse.io/Difuse/kalmia/db/models"
+	"git.difuse.io/Difuse/kalmia/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHookVersion(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		expected string
+		err      string
+	}{
+		{"Version field", `{"version": "1.4.0"}`, "1.4.0", ""},
+		{"Release tag", `{"action": "published", "release": {"tag_name": "v2.0.0"}}`, "2.0.0", ""},
+		{"Tag push", `{"ref": "refs/tags/v3.1.0-rc.1"}`, "3.1.0-rc.1", ""},
+		{"Branch push", `{"ref": "refs/heads/main"}`, "", "version_required"},
+		{"Empty body", ``, "", "version_required"},
+		{"Not a version", `{"version": "latest"}`, "", "invalid_version"},
+		{"Invalid JSON", `{`, "", "invalid_hook_payload"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			version, err := hookVersion([]byte(tt.body))
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, version)
+		})
+	}
+}
+
+func TestInboundHooks(t *testing.T) {
+	require.NoError(t, TestDocService.DB.Model(&models.BuildTriggers{}).
+		Where("triggered = ?", false).Update("triggered", true).Error)
+
+	doc := models.Documentation{Name: "Hooks", Version: "1.0.0", BaseURL: "/hooks", AuthorID: 1}
+	require.NoError(t, TestDocService.DB.Create(&doc).Error)
+
+	user := models.User{ID: 1}
+
+	manualTriggers := func() int64 {
+		var count int64
+		TestDocService.DB.Model(&models.BuildTriggers{}).
+			Where("documentation_id = ? AND manual = ? AND triggered = ?", doc.ID, true, false).Count(&count)
+		return count
+	}
+
+	t.Run("Invalid input", func(t *testing.T) {
+		_, _, err := TestDocService.CreateInboundHook(user, doc.ID, "", "deploy")
+		assert.EqualError(t, err, "invalid_hook_action")
+
+		_, _, err = TestDocService.CreateInboundHook(user, doc.ID, "", models.InboundHookActionGitSync)
+		assert.EqualError(t, err, "git_sync_not_enabled")
+
+		_, _, err = TestDocService.CreateInboundHook(user, 0, "", "")
+		assert.EqualError(t, err, "invalid_documentation_id")
+	})
+
+	t.Run("Token only", func(t *testing.T) {
+		hook, token, err := TestDocService.CreateInboundHook(user, doc.ID, "", "")
+		require.NoError(t, err)
+		assert.NotContains(t, hook.TokenHash, token)
+		assert.Equal(t, token[:6], hook.TokenHint)
+
+		_, err = TestDocService.TriggerInboundHook("wrong", "", "", nil)
+		assert.EqualError(t, err, "inbound_hook_not_found")
+
+		_, err = TestDocService.TriggerInboundHook(token, "", "", nil)
+		require.NoError(t, err)
+
+		require.Eventually(t, func() bool { return manualTriggers() == 1 }, 5*time.Second, 50*time.Millisecond)
+
+		require.NoError(t, TestDocService.DeleteInboundHook(hook.ID))
+		_, err = TestDocService.TriggerInboundHook(token, "", "", nil)
+		assert.EqualError(t, err, "inbound_hook_not_found")
+	})
+
+	t.Run("Signed create version", func(t *testing.T) {
+		hook, token, err := TestDocService.CreateInboundHook(user, doc.ID, "hook-secret", models.InboundHookActionCreateVersion)
+		require.NoError(t, err)
+		defer TestDocService.DeleteInboundHook(hook.ID)
+
+		hooks, err := TestDocService.GetInboundHooks(doc.ID)
+		require.NoError(t, err)
+		require.Len(t, hooks, 1)
+		assert.Empty(t, hooks[0].Secret)
+		assert.True(t, hooks[0].SecretSet)
+
+		body := []byte(`{"action": "published", "release": {"tag_name": "v2.0.0"}}`)
+
+		_, err = TestDocService.TriggerInboundHook(token, "release", "", body)
+		assert.EqualError(t, err, "invalid_signature")
+
+		_, err = TestDocService.TriggerInboundHook(token, "release", "sha256="+utils.SignHMAC("other", body), body)
+		assert.EqualError(t, err, "invalid_signature")
+
+		_, err = TestDocService.TriggerInboundHook(token, "ping", "sha256="+utils.SignHMAC("hook-secret", []byte(`{}`)), []byte(`{}`))
+		require.NoError(t, err)
+
+		_, err = TestDocService.TriggerInboundHook(token, "release", "sha256="+utils.SignHMAC("hook-secret", body), body)
+		require.NoError(t, err)
+
+		versionCount := func() int64 {
+			var count int64
+			TestDocService.DB.Model(&models.Documentation{}).
+				Where("cloned_from = ? AND version = ?", doc.ID, "2.0.0").Count(&count)
+			return count
+		}
+
+		require.Eventually(t, func() bool { return versionCount() == 1 }, 5*time.Second, 50*time.Millisecond)
+
+		// A redelivery of the same release does not create the version again
+		require.NoError(t, TestDocService.runInboundHook(context.Background(), hook, "2.0.0"))
+		assert.Equal(t, int64(1), versionCount())
+	})
+}
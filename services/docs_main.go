@@ -1,16 +1,74 @@
 package services
 
 import (
+	"context"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"git.difuse.io/Difuse/kalmia/logger"
+	"go.uber.org/zap"
 	"gorm.io/gorm"
 )
 
+// shutdownGracePeriod is how long Shutdown waits for the background jobs to
+// stop after cancelling the running builds.
+var shutdownGracePeriod = 10 * time.Second
+
 type DocService struct {
-	DB          *gorm.DB
-	UWBMutexMap sync.Map
+	DB           *gorm.DB
+	UWBMutexMap  sync.Map
+	builds       *buildQueue
+	buildEvents  *buildEventBus
+	webhookWake  chan struct{}
+	scheduleWake chan struct{}
+	leader       atomic.Bool
+	siteReleases sync.Map // root id -> active models.SiteRelease
+	siteBuilds   sync.Map // root id -> SiteBuild served from disk
+	siteDomains  atomic.Pointer[siteDomains]
+	background   sync.WaitGroup // jobs and builds, waited for by Shutdown
+	buildCtx     context.Context
+	cancelBuilds context.CancelFunc
 }
 
 func NewDocService(db *gorm.DB) *DocService {
-	return &DocService{DB: db}
+	buildCtx, cancelBuilds := context.WithCancel(context.Background())
+
+	return &DocService{
+		DB:           db,
+		builds:       newBuildQueue(),
+		buildEvents:  newBuildEventBus(),
+		webhookWake:  make(chan struct{}, 1),
+		scheduleWake: make(chan struct{}, 1),
+		buildCtx:     buildCtx,
+		cancelBuilds: cancelBuilds,
+	}
+}
+
+// Shutdown waits for the background jobs to stop once the context they were
+// started with is done. The running builds and previews are given until ctx
+// is done to finish, after which they are cancelled, and the triggers of the
+// builds are queued again for the next start. Jobs still running
+// shutdownGracePeriod after that are abandoned.
+func (service *DocService) Shutdown(ctx context.Context) error {
+	err := waitContext(ctx, &service.background)
+	if err != nil {
+		logger.Warn("Cancelling the running builds", zap.Error(err))
+		service.cancelBuilds()
+
+		graceCtx, cancel := context.WithTimeout(context.Background(), shutdownGracePeriod)
+		defer cancel()
+
+		if err := waitContext(graceCtx, &service.background); err != nil {
+			logger.Error("Background jobs did not stop, shutting down without them", zap.Error(err))
+		}
+	}
+
+	service.releaseLeases()
+	return err
+}
+
+// buildsInterrupted reports whether the builds were cancelled by Shutdown.
+func (service *DocService) buildsInterrupted() bool {
+	return service.buildCtx.Err() != nil
 }
@@ -0,0 +1,133 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"git.difuse.io/Difuse/kalmia/config"
+	"git.difuse.io/Difuse/kalmia/embedded"
+	"git.difuse.io/Difuse/kalmia/utils"
+)
+
+// pnpmArchiveStamp records, in the data path, the hash of the store archive
+// last loaded into the pnpm store.
+const pnpmArchiveStamp = ".pnpm_store_archive_hash"
+
+// pnpmStoreDir is where pnpm keeps the packages it installs, shared by the
+// package cache and every documentation.
+func pnpmStoreDir() string {
+	return filepath.Join(config.ParsedConfig.DataPath, "pnpm-store")
+}
+
+func packageCachePath() string {
+	return filepath.Join(config.ParsedConfig.DataPath, "rspress_pc")
+}
+
+func pnpmConfig() utils.PnpmConfig {
+	npm := config.ParsedConfig.Npm
+
+	return utils.PnpmConfig{
+		StoreDir:  pnpmStoreDir(),
+		Registry:  npm.Registry,
+		AuthToken: npm.AuthToken,
+		Offline:   npm.Offline,
+	}
+}
+
+// npmAvailable reports whether pnpm can install packages, from the registry
+// in the config or, offline, from the pnpm store alone.
+func npmAvailable() bool {
+	if _, err := exec.LookPath("pnpm"); err != nil {
+		return false
+	}
+
+	if config.ParsedConfig.Npm.Offline {
+		return true
+	}
+
+	// The registry and its token are read from the .npmrc of the folder pnpm
+	// runs in
+	pingPath := packageCachePath()
+	if err := utils.MakeDir(pingPath); err != nil {
+		return false
+	}
+
+	if err := utils.WritePnpmConfig(pingPath, pnpmConfig()); err != nil {
+		return false
+	}
+
+	return utils.NpmPing(pingPath)
+}
+
+// LoadPnpmStore extracts the store archive in the config into the pnpm
+// store, keeping the packages already in it. An archive is only loaded once,
+// it is loaded again when it changes. It reports whether it was loaded.
+func LoadPnpmStore() (bool, error) {
+	archivePath := config.ParsedConfig.Npm.StoreArchive
+	if archivePath == "" {
+		return false, nil
+	}
+
+	archiveHash, err := utils.FileHash(archivePath)
+	if err != nil {
+		return false, fmt.Errorf("failed to read pnpm store archive: %w", err)
+	}
+
+	stampPath := filepath.Join(config.ParsedConfig.DataPath, pnpmArchiveStamp)
+	if loaded, err := os.ReadFile(stampPath); err == nil && string(loaded) == archiveHash && utils.PathExists(pnpmStoreDir()) {
+		return false, nil
+	}
+
+	if err := utils.MakeDir(pnpmStoreDir()); err != nil {
+		return false, fmt.Errorf("failed to create pnpm store directory: %w", err)
+	}
+
+	if err := utils.ExtractTarGz(archivePath, pnpmStoreDir()); err != nil {
+		return false, fmt.Errorf("failed to extract pnpm store archive: %w", err)
+	}
+
+	return true, utils.WriteToFile(stampPath, archiveHash)
+}
+
+// ExportPnpmStore writes the pnpm store to a gzipped tar archive at path, to
+// be loaded by hosts without access to the registry through the storeArchive
+// of their config.
+func ExportPnpmStore(path string) error {
+	empty, err := utils.IsEmptyDir(pnpmStoreDir())
+	if err != nil || empty {
+		return fmt.Errorf("pnpm store at %s is empty, start Kalmia with access to the registry to fill it", pnpmStoreDir())
+	}
+
+	return utils.CreateTarGz(pnpmStoreDir(), path)
+}
+
+// VerifyPnpmStore checks the pnpm store holds every package rspress needs,
+// by installing them offline into a scratch copy of the rspress project.
+func VerifyPnpmStore(output io.Writer) error {
+	if _, err := exec.LookPath("pnpm"); err != nil {
+		return fmt.Errorf("pnpm is not installed")
+	}
+
+	projectPath, err := os.MkdirTemp("", "kalmia-pnpm-verify-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(projectPath)
+
+	if err := embedded.CopyInitFiles(projectPath); err != nil {
+		return err
+	}
+
+	offlineConfig := pnpmConfig()
+	offlineConfig.Offline = true
+
+	if err := utils.WritePnpmConfig(projectPath, offlineConfig); err != nil {
+		return err
+	}
+
+	return utils.RunNpmCommandContext(context.Background(), output, projectPath, "install")
+}
@@ -0,0 +1,86 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"git.difuse.io/Difuse/kalmia/config"
+	"git.difuse.io/Difuse/kalmia/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPnpmStoreArchive(t *testing.T) {
+	npm := config.ParsedConfig.Npm
+	t.Cleanup(func() {
+		config.ParsedConfig.Npm = npm
+		utils.RemovePath(pnpmStoreDir())
+		utils.RemovePath(filepath.Join(config.ParsedConfig.DataPath, pnpmArchiveStamp))
+	})
+
+	require.NoError(t, utils.MakeDir(filepath.Join(pnpmStoreDir(), "v3", "files")))
+	require.NoError(t, os.WriteFile(filepath.Join(pnpmStoreDir(), "v3", "files", "package"), []byte("package"), 0644))
+
+	archive := filepath.Join(t.TempDir(), "store.tar.gz")
+	require.NoError(t, ExportPnpmStore(archive))
+	require.NoError(t, utils.RemovePath(pnpmStoreDir()))
+
+	t.Run("Nothing is loaded without an archive", func(t *testing.T) {
+		loaded, err := LoadPnpmStore()
+		require.NoError(t, err)
+		assert.False(t, loaded)
+	})
+
+	config.ParsedConfig.Npm.StoreArchive = archive
+
+	t.Run("Archive is loaded once", func(t *testing.T) {
+		loaded, err := LoadPnpmStore()
+		require.NoError(t, err)
+		assert.True(t, loaded)
+
+		content, err := os.ReadFile(filepath.Join(pnpmStoreDir(), "v3", "files", "package"))
+		require.NoError(t, err)
+		assert.Equal(t, "package", string(content))
+
+		loaded, err = LoadPnpmStore()
+		require.NoError(t, err)
+		assert.False(t, loaded)
+	})
+
+	t.Run("Archive is loaded again when removed from the store", func(t *testing.T) {
+		require.NoError(t, utils.RemovePath(pnpmStoreDir()))
+
+		loaded, err := LoadPnpmStore()
+		require.NoError(t, err)
+		assert.True(t, loaded)
+	})
+
+	t.Run("Missing archive", func(t *testing.T) {
+		config.ParsedConfig.Npm.StoreArchive = filepath.Join(t.TempDir(), "missing.tar.gz")
+
+		_, err := LoadPnpmStore()
+		assert.Error(t, err)
+	})
+
+	t.Run("Empty store is not exported", func(t *testing.T) {
+		require.NoError(t, utils.RemovePath(pnpmStoreDir()))
+		require.NoError(t, utils.MakeDir(pnpmStoreDir()))
+
+		assert.Error(t, ExportPnpmStore(filepath.Join(t.TempDir(), "empty.tar.gz")))
+	})
+}
+
+func TestNpmAvailableOffline(t *testing.T) {
+	offline := config.ParsedConfig.Npm.Offline
+	t.Cleanup(func() { config.ParsedConfig.Npm.Offline = offline })
+
+	config.ParsedConfig.Npm.Offline = true
+
+	binDir := t.TempDir()
+	t.Setenv("PATH", binDir)
+	assert.False(t, npmAvailable())
+
+	require.NoError(t, os.WriteFile(filepath.Join(binDir, "pnpm"), []byte("#!/bin/sh\nexit 1\n"), 0755))
+	assert.True(t, npmAvailable())
+}
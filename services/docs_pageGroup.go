@@ -155,10 +155,18 @@ func (service *DocService) GetPageGroup(id uint) (map[string]interface{}, error)
 }
 
 func (service *DocService) CreatePageGroup(group *models.PageGroup) (uint, error) {
+	if err := validateSchedule(group.PublishAt, group.UnpublishAt); err != nil {
+		return 0, err
+	}
+
 	if err := service.DB.Create(&group).Error; err != nil {
 		return 0, fmt.Errorf("failed_to_create_page_group")
 	}
 
+	if group.PublishAt != nil || group.UnpublishAt != nil {
+		service.notifyScheduler()
+	}
+
 	docId, err := service.GetDocumentationIDOfPageGroup(group.ID)
 	if err != nil {
 		return 0, fmt.Errorf("failed_to_get_documentation_id")
@@ -267,6 +275,15 @@ func (service *DocService) deletePageGroupRecursive(tx *gorm.DB, id uint) error
 		}
 	}
 
+	pageIds := make([]uint, 0, len(pageGroup.Pages))
+	for _, page := range pageGroup.Pages {
+		pageIds = append(pageIds, page.ID)
+	}
+
+	if err := deletePageDrafts(tx, pageIds); err != nil {
+		return fmt.Errorf("failed_to_delete_associated_pages: %v", err)
+	}
+
 	if err := tx.Where("page_group_id = ?", id).Delete(&models.Page{}).Error; err != nil {
 		return fmt.Errorf("failed_to_delete_associated_pages: %v", err)
 	}
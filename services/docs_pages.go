@@ -42,16 +42,43 @@ func (service *DocService) GetPage(id uint) (models.Page, error) {
 }
 
 func (service *DocService) CreatePage(page *models.Page) error {
+	if err := validateSchedule(page.PublishAt, page.UnpublishAt); err != nil {
+		return err
+	}
+
 	if err := service.DB.Create(&page).Error; err != nil {
 		return fmt.Errorf("failed_to_create_page")
 	}
 
+	if page.PublishAt != nil || page.UnpublishAt != nil {
+		service.notifyScheduler()
+	}
+
+	// A page created as a draft is only written once it is published
+	if page.IsDraft {
+		draft := models.PageDraft{
+			PageID:       page.ID,
+			Title:        page.Title,
+			Slug:         page.Slug,
+			Content:      page.Content,
+			Status:       models.PageDraftEditing,
+			AuthorID:     page.AuthorID,
+			LastEditorID: page.LastEditorID,
+		}
+
+		if err := service.DB.Create(&draft).Error; err != nil {
+			return fmt.Errorf("failed_to_save_draft")
+		}
+	}
+
 	docId, err := service.GetDocumentationIDOfPage(page.ID)
 
 	if err != nil {
 		return fmt.Errorf("failed_to_get_documentation_id")
 	}
 
+	service.EmitWebhookEvent(docId, WebhookEventPageCreated, pageWebhookData(*page))
+
 	parentDocId, _ := service.GetRootParentID(docId)
 
 	if parentDocId == 0 {
@@ -70,10 +97,24 @@ func (service *DocService) CreatePage(page *models.Page) error {
 func (service *DocService) EditPage(user models.User, id uint, title, slug, content string, order *uint, pageGroupId *uint) error {
 	tx := service.DB.Begin()
 
+	page, err := editPage(tx, user, id, title, slug, content, order, pageGroupId)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return fmt.Errorf("failed_to_commit_changes")
+	}
+
+	return service.pageEdited(page)
+}
+
+// editPage updates a page within tx, recording user as one of its editors.
+func editPage(tx *gorm.DB, user models.User, id uint, title, slug, content string, order *uint, pageGroupId *uint) (models.Page, error) {
 	var page models.Page
 	if err := tx.Preload("Editors").First(&page, id).Error; err != nil {
-		tx.Rollback()
-		return fmt.Errorf("page_not_found")
+		return models.Page{}, fmt.Errorf("page_not_found")
 	}
 
 	page.Title = title
@@ -105,20 +146,23 @@ func (service *DocService) EditPage(user models.User, id uint, title, slug, cont
 	}
 
 	if err := tx.Save(&page).Error; err != nil {
-		tx.Rollback()
-		return fmt.Errorf("failed_to_update_page")
+		return models.Page{}, fmt.Errorf("failed_to_update_page")
 	}
 
-	if err := tx.Commit().Error; err != nil {
-		return fmt.Errorf("failed_to_commit_changes")
-	}
+	return page, nil
+}
 
-	docId, err := service.GetDocumentationIDOfPage(id)
+// pageEdited announces a committed page edit and queues a build of its
+// documentation.
+func (service *DocService) pageEdited(page models.Page) error {
+	docId, err := service.GetDocumentationIDOfPage(page.ID)
 
 	if err != nil {
 		return fmt.Errorf("failed_to_get_documentation_id")
 	}
 
+	service.EmitWebhookEvent(docId, WebhookEventPageUpdated, pageWebhookData(page))
+
 	parentDocId, _ := service.GetRootParentID(docId)
 
 	if parentDocId == 0 {
@@ -161,6 +205,11 @@ func (service *DocService) DeletePage(id uint) error {
 		return fmt.Errorf("failed_to_delete_page")
 	}
 
+	if err := deletePageDrafts(tx, []uint{page.ID}); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed_to_delete_page")
+	}
+
 	if err := tx.Commit().Error; err != nil {
 		return fmt.Errorf("transaction_commit_failed")
 	}
@@ -169,6 +218,8 @@ func (service *DocService) DeletePage(id uint) error {
 		return fmt.Errorf("failed_to_get_documentation_id")
 	}
 
+	service.EmitWebhookEvent(docId, WebhookEventPageDeleted, pageWebhookData(page))
+
 	parentDocId, _ := service.GetRootParentID(docId)
 
 	if parentDocId == 0 {
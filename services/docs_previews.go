@@ -0,0 +1,313 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.difuse.io/Difuse/kalmia/config"
+	"git.difuse.io/Difuse/kalmia/db/models"
+	"git.difuse.io/Difuse/kalmia/embedded"
+	"git.difuse.io/Difuse/kalmia/logger"
+	"git.difuse.io/Difuse/kalmia/utils"
+	"go.uber.org/zap"
+)
+
+// PreviewURLPrefix is the path preview builds are served under, followed by
+// their token.
+const PreviewURLPrefix = "/_preview"
+
+const previewCleanupInterval = 10 * time.Minute
+
+// previewPath is the directory of a preview build, next to the build of its
+// documentation. It holds the written content in docs and the site in build.
+func previewPath(rootId uint, token string) string {
+	return filepath.Join(config.ParsedConfig.DataPath, "rspress_data", "doc_"+strconv.Itoa(int(rootId)), "preview", token)
+}
+
+func previewBaseURL(token string) string {
+	return PreviewURLPrefix + "/" + token
+}
+
+// PreviewURL returns where a preview build of a documentation version is
+// served.
+func (service *DocService) PreviewURL(preview models.PreviewBuild) string {
+	url := previewBaseURL(preview.Token) + "/"
+
+	doc, err := service.GetDocumentation(preview.DocumentationID)
+	if err != nil {
+		return url
+	}
+
+	latest, _, err := service.GetAllVersions(preview.DocumentationID)
+	if err == nil && doc.Version != latest {
+		url += doc.Version + "/"
+	}
+
+	return url
+}
+
+// CreatePreview starts a build of a documentation version with its pending
+// drafts applied. Scheduled content is shown as it will be at previewAt, or
+// as it is now when previewAt is nil.
+func (service *DocService) CreatePreview(user models.User, docId uint, previewAt *time.Time) (models.PreviewBuild, error) {
+	if _, err := service.GetDocumentation(docId); err != nil {
+		return models.PreviewBuild{}, fmt.Errorf("documentation_not_found")
+	}
+
+	rootId, err := service.GetRootParentID(docId)
+	if err != nil {
+		return models.PreviewBuild{}, fmt.Errorf("documentation_not_found")
+	}
+
+	if !service.buildGenerator(rootId).Initialized(rootId) {
+		return models.PreviewBuild{}, fmt.Errorf("documentation_not_initialized")
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		return models.PreviewBuild{}, fmt.Errorf("failed_to_generate_token")
+	}
+
+	preview := models.PreviewBuild{
+		DocumentationID: docId,
+		RootID:          rootId,
+		Token:           token,
+		Status:          models.PreviewBuildRunning,
+		PreviewAt:       previewAt,
+		Instance:        instanceID(),
+		CreatedByID:     user.ID,
+		ExpiresAt:       time.Now().Add(time.Duration(config.ParsedConfig.PreviewTTL) * time.Second),
+	}
+
+	if err := service.DB.Create(&preview).Error; err != nil {
+		return models.PreviewBuild{}, fmt.Errorf("failed_to_create_preview")
+	}
+
+	service.background.Go(func() { service.runPreviewBuild(preview) })
+
+	return preview, nil
+}
+
+func (service *DocService) runPreviewBuild(preview models.PreviewBuild) {
+	updates := map[string]interface{}{"status": models.PreviewBuildReady}
+
+	err := service.buildPreview(preview)
+	if err == nil {
+		err = service.publishSite(previewSiteName(preview.Token), filepath.Join(previewPath(preview.RootID, preview.Token), "build"))
+	}
+
+	if err != nil {
+		logger.Error("Preview build failed", zap.Uint("preview_id", preview.ID), zap.Error(err))
+		updates = map[string]interface{}{"status": models.PreviewBuildFailed, "error": err.Error()}
+	}
+
+	if err := service.DB.Model(&models.PreviewBuild{}).Where("id = ?", preview.ID).Updates(updates).Error; err != nil {
+		logger.Error("Failed to update preview build", zap.Uint("preview_id", preview.ID), zap.Error(err))
+	}
+}
+
+// previewDrafts returns the pending drafts of every page in a documentation
+// and its versions, by page.
+func (service *DocService) previewDrafts(rootId uint) (map[uint]models.PageDraft, error) {
+	ids, err := service.gitVersionIDs(rootId)
+	if err != nil {
+		return nil, err
+	}
+
+	var drafts []models.PageDraft
+	if err := service.DB.Joins("JOIN pages ON pages.id = page_drafts.page_id").
+		Where("pages.documentation_id IN ?", ids).Find(&drafts).Error; err != nil {
+		return nil, err
+	}
+
+	byPage := make(map[uint]models.PageDraft, len(drafts))
+	for _, draft := range drafts {
+		byPage[draft.PageID] = draft
+	}
+
+	return byPage, nil
+}
+
+func (service *DocService) buildPreview(preview models.PreviewBuild) error {
+	// Previews share the folder of the documentation, with rspress also its
+	// installed packages and styles, so they wait for its builds like they
+	// wait for each other
+	mutexI, _ := service.UWBMutexMap.LoadOrStore(fmt.Sprintf("update_write_build_%d", preview.RootID), &sync.Mutex{})
+	mutex := mutexI.(*sync.Mutex)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	drafts, err := service.previewDrafts(preview.RootID)
+	if err != nil {
+		return err
+	}
+
+	view := contentView{at: time.Now(), drafts: drafts, baseURL: previewBaseURL(preview.Token)}
+	if preview.PreviewAt != nil {
+		view.at = *preview.PreviewAt
+	}
+
+	return service.buildGenerator(preview.RootID).BuildPreview(service.buildCtx, preview, view)
+}
+
+// rsPressPreview builds a preview with the packages and config of its
+// documentation, writing its content and site next to them.
+func (service *DocService) rsPressPreview(ctx context.Context, preview models.PreviewBuild, view contentView) error {
+	previewDir := filepath.Join("preview", preview.Token)
+	docPath := filepath.Join(config.ParsedConfig.DataPath, "rspress_data", "doc_"+strconv.Itoa(int(preview.RootID)))
+	docsPath := filepath.Join(docPath, previewDir, "docs")
+
+	if err := utils.MakeDir(docsPath); err != nil {
+		return err
+	}
+
+	if _, err := service.writeVersions(ctx, view, preview.RootID, docsPath); err != nil {
+		return err
+	}
+
+	docConfigTemplate, err := embedded.ReadEmbeddedFile("rspress.config.ts")
+	if err != nil {
+		return err
+	}
+
+	replacements, err := service.rsPressConfigReplacements(preview.RootID)
+	if err != nil {
+		return err
+	}
+
+	replacements["__BASE_URL__"] = view.baseURL
+	replacements["__ROOT_DIR__"] = filepath.ToSlash(filepath.Join(previewDir, "docs"))
+	replacements["__OUT_DIR__"] = filepath.ToSlash(filepath.Join(previewDir, "build"))
+
+	previewConfig := "rspress.config.preview.ts"
+	if err := utils.WriteToFile(filepath.Join(docPath, previewConfig), utils.ReplaceMany(string(docConfigTemplate), replacements)); err != nil {
+		return err
+	}
+
+	return utils.RunNpxCommandContext(ctx, nil, docPath, "rspress", "build", "--config", previewConfig)
+}
+
+// GetPreviewBuild returns the directory a preview is served from, as long as
+// it has been built and has not expired.
+func (service *DocService) GetPreviewBuild(token string) (string, error) {
+	var preview models.PreviewBuild
+	if token == "" || service.DB.Where("token = ?", token).First(&preview).Error != nil {
+		return "", fmt.Errorf("preview_not_found")
+	}
+
+	if !time.Now().Before(preview.ExpiresAt) {
+		return "", fmt.Errorf("preview_expired")
+	}
+
+	if preview.Status != models.PreviewBuildReady {
+		return "", fmt.Errorf("preview_not_ready")
+	}
+
+	buildPath := filepath.Join(previewPath(preview.RootID, preview.Token), "build")
+
+	// Previews built by another instance are fetched when first requested
+	if err := service.restorePreviewSite(preview.Token, buildPath); err != nil {
+		return "", fmt.Errorf("preview_not_found")
+	}
+
+	return buildPath, nil
+}
+
+// SplitPreviewPath splits a request path under PreviewURLPrefix into the
+// preview token and the path within the preview.
+func SplitPreviewPath(urlPath string) (string, string, bool) {
+	rest, ok := strings.CutPrefix(urlPath, PreviewURLPrefix+"/")
+	if !ok {
+		return "", "", false
+	}
+
+	token, filePath, _ := strings.Cut(rest, "/")
+	return token, "/" + filePath, token != ""
+}
+
+func (service *DocService) GetPreviews(docId uint) ([]models.PreviewBuild, error) {
+	rootId, err := service.GetRootParentID(docId)
+	if err != nil {
+		return nil, fmt.Errorf("documentation_not_found")
+	}
+
+	var previews []models.PreviewBuild
+	if err := service.DB.Where("root_id = ? AND expires_at > ?", rootId, time.Now()).
+		Order("id DESC").Find(&previews).Error; err != nil {
+		return nil, fmt.Errorf("failed_to_get_previews")
+	}
+
+	return previews, nil
+}
+
+func (service *DocService) DeletePreview(id uint) error {
+	var preview models.PreviewBuild
+	if err := service.DB.First(&preview, id).Error; err != nil {
+		return fmt.Errorf("preview_not_found")
+	}
+
+	return service.removePreview(preview)
+}
+
+func (service *DocService) removePreview(preview models.PreviewBuild) error {
+	if err := utils.RemovePath(previewPath(preview.RootID, preview.Token)); err != nil {
+		return fmt.Errorf("failed_to_remove_preview")
+	}
+
+	if err := service.unpublishSite(previewSiteName(preview.Token)); err != nil {
+		return fmt.Errorf("failed_to_delete_preview")
+	}
+
+	if err := service.DB.Delete(&preview).Error; err != nil {
+		return fmt.Errorf("failed_to_delete_preview")
+	}
+
+	return nil
+}
+
+// CleanupPreviews removes the preview builds that have expired, leaving the
+// ones still building to finish first.
+func (service *DocService) CleanupPreviews() {
+	var previews []models.PreviewBuild
+	if err := service.DB.Where("expires_at <= ? AND status <> ?", time.Now(), models.PreviewBuildRunning).
+		Find(&previews).Error; err != nil {
+		logger.Error("Failed to fetch expired previews", zap.Error(err))
+		return
+	}
+
+	for _, preview := range previews {
+		if err := service.removePreview(preview); err != nil {
+			logger.Error("Failed to remove expired preview", zap.Uint("preview_id", preview.ID), zap.Error(err))
+		}
+	}
+}
+
+func (service *DocService) StartPreviewCleanup(ctx context.Context) {
+	// Builds are not resumed, so previews still building when the server
+	// stopped never will be
+	query := service.DB.Model(&models.PreviewBuild{}).Where("status = ?", models.PreviewBuildRunning)
+	if clusterEnabled() {
+		query = query.Where("instance = ?", instanceID())
+	}
+
+	if err := query.Updates(map[string]interface{}{"status": models.PreviewBuildFailed, "error": "interrupted"}).Error; err != nil {
+		logger.Error("Failed to fail interrupted previews", zap.Error(err))
+	}
+
+	service.background.Go(func() {
+		for {
+			if service.isLeader() {
+				service.CleanupPreviews()
+			}
+
+			if !sleepContext(ctx, previewCleanupInterval) {
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,148 @@
+package services
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.difuse.io/Difuse/kalmia/db/models"
+	"git.difuse.io/Difuse/kalmia/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitPreviewPath(t *testing.T) {
+	tests := []struct {
+		path     string
+		token    string
+		filePath string
+		ok       bool
+	}{
+		{"/_preview/abc/guides/index.html", "abc", "/guides/index.html", true},
+		{"/_preview/abc", "abc", "/", true},
+		{"/_preview/", "", "/", false},
+		{"/docs/_preview/abc", "", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			token, filePath, ok := SplitPreviewPath(tt.path)
+			assert.Equal(t, tt.ok, ok)
+			if tt.ok {
+				assert.Equal(t, tt.token, token)
+				assert.Equal(t, tt.filePath, filePath)
+			}
+		})
+	}
+}
+
+func TestPreviewContent(t *testing.T) {
+	require.NoError(t, TestDocService.DB.Model(&models.BuildTriggers{}).
+		Where("triggered = ?", false).Update("triggered", true).Error)
+
+	doc := models.Documentation{Name: "Preview", Version: "1.0.0", BaseURL: "/preview-docs", AuthorID: 1}
+	require.NoError(t, TestDocService.DB.Create(&doc).Error)
+
+	published := models.Page{DocumentationID: doc.ID, Title: "Install", Slug: "/install", Content: "[]", AuthorID: 1}
+	require.NoError(t, TestDocService.CreatePage(&published))
+
+	unpublished := models.Page{DocumentationID: doc.ID, Title: "Upgrade", Slug: "/upgrade", Content: "[]", AuthorID: 1, IsDraft: true}
+	require.NoError(t, TestDocService.CreatePage(&unpublished))
+
+	_, err := TestDocService.SaveDraft(models.User{ID: 1}, published.ID, "Installation", "/installation", "[]")
+	require.NoError(t, err)
+
+	drafts, err := TestDocService.previewDrafts(doc.ID)
+	require.NoError(t, err)
+	require.Len(t, drafts, 2)
+
+	t.Run("Live view ignores drafts", func(t *testing.T) {
+		pages := publishedView(time.Now()).pages([]models.Page{published, unpublished})
+		require.Len(t, pages, 1)
+		assert.Equal(t, "Install", pages[0].Title)
+	})
+
+	t.Run("Preview view applies drafts", func(t *testing.T) {
+		view := contentView{at: time.Now(), drafts: drafts, baseURL: previewBaseURL("token")}
+		pages := view.pages([]models.Page{published, unpublished})
+		require.Len(t, pages, 2)
+		assert.Equal(t, "Installation", pages[0].Title)
+		assert.Equal(t, "/installation", pages[0].Slug)
+		assert.Equal(t, "Upgrade", pages[1].Title)
+		assert.Equal(t, "/_preview/token", view.baseURLOf(doc))
+	})
+
+	t.Run("Preview writes drafts", func(t *testing.T) {
+		docsPath := t.TempDir()
+		view := contentView{at: time.Now(), drafts: drafts, baseURL: previewBaseURL("token")}
+		_, err := TestDocService.writeVersions(context.Background(), view, doc.ID, docsPath)
+		require.NoError(t, err)
+
+		guidesPath := filepath.Join(docsPath, doc.Version, "guides")
+		assert.True(t, utils.PathExists(filepath.Join(guidesPath, utils.StringToFileString("Installation")+".mdx")))
+		assert.True(t, utils.PathExists(filepath.Join(guidesPath, utils.StringToFileString("Upgrade")+".mdx")))
+		assert.False(t, utils.PathExists(filepath.Join(guidesPath, utils.StringToFileString("Install")+".mdx")))
+	})
+}
+
+func TestPreviewBuilds(t *testing.T) {
+	doc := models.Documentation{Name: "Preview builds", Version: "1.0.0", BaseURL: "/preview-builds", AuthorID: 1}
+	require.NoError(t, TestDocService.DB.Create(&doc).Error)
+
+	newPreview := func(token, status string, expiresAt time.Time) models.PreviewBuild {
+		preview := models.PreviewBuild{
+			DocumentationID: doc.ID,
+			RootID:          doc.ID,
+			Token:           token,
+			Status:          status,
+			CreatedByID:     1,
+			ExpiresAt:       expiresAt,
+		}
+		require.NoError(t, TestDocService.DB.Create(&preview).Error)
+		require.NoError(t, utils.MakeDir(filepath.Join(previewPath(doc.ID, token), "build")))
+		return preview
+	}
+
+	ready := newPreview("preview-ready", models.PreviewBuildReady, time.Now().Add(time.Hour))
+	running := newPreview("preview-running", models.PreviewBuildRunning, time.Now().Add(time.Hour))
+	expired := newPreview("preview-expired", models.PreviewBuildReady, time.Now().Add(-time.Minute))
+
+	t.Run("Serving", func(t *testing.T) {
+		buildPath, err := TestDocService.GetPreviewBuild(ready.Token)
+		require.NoError(t, err)
+		assert.Equal(t, filepath.Join(previewPath(doc.ID, ready.Token), "build"), buildPath)
+
+		_, err = TestDocService.GetPreviewBuild(running.Token)
+		assert.EqualError(t, err, "preview_not_ready")
+
+		_, err = TestDocService.GetPreviewBuild(expired.Token)
+		assert.EqualError(t, err, "preview_expired")
+
+		_, err = TestDocService.GetPreviewBuild("unknown")
+		assert.EqualError(t, err, "preview_not_found")
+	})
+
+	t.Run("Listing skips expired previews", func(t *testing.T) {
+		previews, err := TestDocService.GetPreviews(doc.ID)
+		require.NoError(t, err)
+		assert.Len(t, previews, 2)
+	})
+
+	t.Run("Cleanup", func(t *testing.T) {
+		TestDocService.CleanupPreviews()
+
+		_, err := os.Stat(previewPath(doc.ID, expired.Token))
+		assert.True(t, os.IsNotExist(err))
+		assert.Error(t, TestDocService.DB.First(&models.PreviewBuild{}, expired.ID).Error)
+
+		assert.True(t, utils.PathExists(previewPath(doc.ID, ready.Token)))
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		require.NoError(t, TestDocService.DeletePreview(ready.ID))
+		assert.False(t, utils.PathExists(previewPath(doc.ID, ready.Token)))
+		assert.EqualError(t, TestDocService.DeletePreview(ready.ID), "preview_not_found")
+	})
+}
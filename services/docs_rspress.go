@@ -2,6 +2,7 @@ package services
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"math"
@@ -27,6 +28,8 @@ import (
 
 type Block = utils.Block
 
+const buildPendingMarker = ".build_pending"
+
 type Versions struct {
 	Default  string   `json:"default"`
 	Versions []string `json:"versions"`
@@ -71,6 +74,21 @@ type MetaData struct {
 }
 
 func (service *DocService) GenerateHead(docID uint, pageId uint, pageType string) (string, error) {
+	if pageId == math.MaxUint32 {
+		return service.generateHead(publishedView(time.Now()), docID, nil, pageType)
+	}
+
+	page, err := service.GetPage(pageId)
+	if err != nil {
+		return "", err
+	}
+
+	return service.generateHead(publishedView(time.Now()), docID, &page, pageType)
+}
+
+// generateHead writes the frontmatter and imports of a page as it appears in
+// view, or of the home page when page is nil.
+func (service *DocService) generateHead(view contentView, docID uint, page *models.Page, pageType string) (string, error) {
 	var buffer bytes.Buffer
 	doc, err := service.GetDocumentation(docID)
 	if err != nil {
@@ -85,7 +103,7 @@ func (service *DocService) GenerateHead(docID uint, pageId uint, pageType string
 	latestVersion := latest
 	isLatestVersion := (doc.Version == latest)
 
-	if pageId == math.MaxUint32 {
+	if page == nil {
 		buffer.WriteString("---\n")
 		buffer.WriteString(fmt.Sprintf("pageType: %s\n", pageType))
 		buffer.WriteString("footer: true\n")
@@ -118,15 +136,10 @@ func (service *DocService) GenerateHead(docID uint, pageId uint, pageType string
 		}
 
 		buffer.WriteString(fmt.Sprintf(`<Meta rawJson='%s' />%s`, string(metaJSON), "\n"))
-		buffer.WriteString(fmt.Sprintf(`<Redirect to={'%s'} />%s`, doc.BaseURL+"/guides/index.html", "\n\n"))
+		buffer.WriteString(fmt.Sprintf(`<Redirect to={'%s'} />%s`, strings.TrimSuffix(view.baseURLOf(doc), "/")+"/guides/index.html", "\n\n"))
 
 		return buffer.String(), nil
 	} else {
-		page, err := service.GetPage(pageId)
-		if err != nil {
-			return "", err
-		}
-
 		buffer.WriteString("---\n")
 		buffer.WriteString(fmt.Sprintf("pageType: %s\n", pageType))
 		buffer.WriteString("footer: true\n")
@@ -204,10 +217,11 @@ func (service *DocService) RemoveDocFolder(docId uint) error {
 		return err
 	}
 
+	service.siteBuilds.Delete(docId)
 	return nil
 }
 
-func (service *DocService) UpdateWriteBuild(docId uint) error {
+func (service *DocService) UpdateWriteBuild(ctx context.Context, docId uint) error {
 	key := fmt.Sprintf("update_write_build_%d", docId)
 	mutexI, _ := service.UWBMutexMap.LoadOrStore(key, &sync.Mutex{})
 	mutex := mutexI.(*sync.Mutex)
@@ -225,6 +239,8 @@ func (service *DocService) UpdateWriteBuild(docId uint) error {
 		return fmt.Errorf("timeout waiting for operation to complete for docId: %d", docId)
 	}
 
+	ctx = buildRecorderFrom(ctx).startPhase(ctx, BuildPhaseWrite)
+
 	rootParentId, err := service.GetRootParentID(docId)
 	if err != nil {
 		return err
@@ -233,30 +249,69 @@ func (service *DocService) UpdateWriteBuild(docId uint) error {
 	allDocsPath := filepath.Join(config.ParsedConfig.DataPath, "rspress_data")
 	docsPath := filepath.Join(allDocsPath, "doc_"+strconv.Itoa(int(rootParentId)))
 
-	doc, err := service.GetDocumentation(docId)
+	if _, err := service.GetDocumentation(docId); err != nil {
+		if err.Error() == "documentation_not_found" {
+			if err := utils.RemovePath(docsPath); err != nil {
+				return err
+			}
+		}
+		return err
+	}
+
+	generator := service.buildGenerator(rootParentId)
+
+	// A documentation whose generator was changed has not been prepared for
+	// the new one yet
+	if !generator.Initialized(rootParentId) {
+		if err := generator.Init(rootParentId); err != nil {
+			return err
+		}
+	}
+
+	configChanged, err := generator.WriteConfig(docId, rootParentId)
 	if err != nil {
 		return err
 	}
 
-	preHashDocs, err := utils.DirHash(docsPath + "/docs")
-	if err != nil && !os.IsNotExist(err) {
+	// The last build may have come from the other generator, so the site is
+	// rebuilt even if the content is unchanged
+	force := configChanged || generatorChanged(rootParentId, generator)
+
+	// A build that was cancelled or failed after writing its contents leaves
+	// the marker behind, so the next one rebuilds even if nothing changed since
+	pendingMarker := filepath.Join(docsPath, buildPendingMarker)
+	if utils.PathExists(pendingMarker) {
+		force = true
+	} else if err := utils.TouchFile(pendingMarker); err != nil {
 		return err
 	}
 
-	if utils.PathExists(filepath.Join(docsPath, "docs", doc.Version)) {
-		if err := utils.RemovePath(filepath.Join(docsPath, "docs", doc.Version)); err != nil {
-			return err
-		}
+	changed, err := generator.WriteContents(ctx, docId, rootParentId)
+	if err != nil {
+		return err
 	}
 
-	configHash, err := service.StartUpdate(docId, rootParentId)
+	if err := generator.Build(ctx, rootParentId, force || changed); err != nil {
+		return err
+	}
+
+	// Other instances serve sites from the bucket when they are kept in one,
+	// so they are only shared through the database otherwise
+	buildPath := filepath.Join(docsPath, "build")
+	if service.SitesInObjectStorage() {
+		err = service.publishSiteRelease(ctx, rootParentId, buildPath)
+	} else if err = service.recordSiteRelease(ctx, rootParentId, buildPath); err == nil {
+		err = service.publishSite(docSiteName(rootParentId), buildPath)
+	}
 	if err != nil {
 		return err
 	}
 
-	preHash := utils.HashStrings([]string{preHashDocs, configHash})
+	if err := markGenerator(rootParentId, generator); err != nil {
+		return err
+	}
 
-	if err := service.WriteContents(docId, rootParentId, preHash); err != nil {
+	if err := os.Remove(pendingMarker); err != nil && !os.IsNotExist(err) {
 		return err
 	}
 
@@ -297,14 +352,21 @@ func (service *DocService) StartupCheck() error {
 	}
 
 	logger.Debug("Starting DocService.StartupCheck")
-	npmPinged := utils.NpmPing()
-	if !npmPinged {
-		logger.Panic("Startup check failed for NPM, exiting...")
+
+	if loaded, err := LoadPnpmStore(); err != nil {
+		logger.Error("Failed to load the pnpm store archive", zap.Error(err))
+	} else if loaded {
+		logger.Info("Loaded the pnpm store archive", zap.String("archive", cfg.Npm.StoreArchive))
 	}
 
-	err = service.InitRsPressPackageCache()
-	if err != nil {
-		logger.Fatal("Initializing Package Cache Failed...", zap.Error(err))
+	npmPinged := npmAvailable()
+	if npmPinged {
+		err = service.InitRsPressPackageCache()
+		if err != nil {
+			logger.Fatal("Initializing Package Cache Failed...", zap.Error(err))
+		}
+	} else {
+		logger.Warn("Startup check failed for NPM, documentations will be built with the built-in HTML generator until it is available")
 	}
 
 	db := service.DB
@@ -317,9 +379,14 @@ func (service *DocService) StartupCheck() error {
 	}
 
 	for _, doc := range docs {
-		if err := service.InitRsPress(doc.ID); err != nil {
-			logger.Error("Failed to initialize/update RsPress", zap.Uint("doc_id", doc.ID), zap.Error(err))
-			return err
+		generator := service.siteGenerator(doc.ID)
+
+		// rspress is installed by the first build once NPM is available again
+		if npmPinged || generator.Name() != models.GeneratorRsPress {
+			if err := generator.Init(doc.ID); err != nil {
+				logger.Error("Failed to initialize/update site generator", zap.Uint("doc_id", doc.ID), zap.Error(err))
+				return err
+			}
 		}
 
 		err = service.AddBuildTrigger(doc.ID, false)
@@ -334,9 +401,8 @@ func (service *DocService) StartupCheck() error {
 }
 
 func (service *DocService) InitRsPressPackageCache() error {
-	cfg := config.ParsedConfig
-	packageCachePath := filepath.Join(cfg.DataPath, "rspress_pc")
-	storeDir := filepath.Join(cfg.DataPath, "pnpm-store")
+	packageCachePath := packageCachePath()
+	storeDir := pnpmStoreDir()
 
 	if !utils.PathExists(storeDir) {
 		if err := utils.MakeDir(storeDir); err != nil {
@@ -355,7 +421,7 @@ func (service *DocService) InitRsPressPackageCache() error {
 		return err
 	}
 
-	err = utils.WritePnpmStoreConfig(packageCachePath, storeDir)
+	err = utils.WritePnpmConfig(packageCachePath, pnpmConfig())
 	if err != nil {
 		return err
 	}
@@ -390,15 +456,12 @@ func (service *DocService) InitRsPress(docId uint) error {
 		return err
 	}
 
-	storeDir := filepath.Join(cfg.DataPath, "pnpm-store")
-	err = utils.WritePnpmStoreConfig(docPath, storeDir)
+	err = utils.WritePnpmConfig(docPath, pnpmConfig())
 	if err != nil {
 		return err
 	}
 
-	npmPing := utils.NpmPing()
-
-	if !npmPing {
+	if !npmAvailable() {
 		return fmt.Errorf("NPM/PNPM ping failed for %d initialization", docId)
 	}
 
@@ -410,25 +473,12 @@ func (service *DocService) InitRsPress(docId uint) error {
 	return nil
 }
 
-func (service *DocService) StartUpdate(docId uint, rootParentId uint) (string, error) {
+// rsPressConfigReplacements returns the values filled into the rspress
+// config template for a documentation.
+func (service *DocService) rsPressConfigReplacements(docId uint) (map[string]string, error) {
 	doc, err := service.GetDocumentation(docId)
 	if err != nil {
-		return "", err
-	}
-
-	docConfigTemplate, err := embedded.ReadEmbeddedFile("rspress.config.ts")
-	if err != nil {
-		return "", err
-	}
-
-	docPath := filepath.Join(config.ParsedConfig.DataPath, "rspress_data", "doc_"+strconv.Itoa(int(rootParentId)))
-	docConfig := filepath.Join(docPath, "rspress.config.ts")
-	gitDocConfig := filepath.Join(docPath, "rspress.config.git.ts")
-
-	if !utils.PathExists(gitDocConfig) {
-		if err := utils.CopyFile(docConfig, gitDocConfig); err != nil {
-			return "", err
-		}
+		return nil, err
 	}
 
 	replacements := map[string]string{
@@ -447,6 +497,7 @@ func (service *DocService) StartUpdate(docId uint, rootParentId uint) (string, e
 		"__SOCIAL_LINKS__":      "[]",
 		"__FOOTER_CONTENT__":    "Made with ❤️ by Difuse",
 		"__OUT_DIR__":           "build_tmp",
+		"__ROOT_DIR__":          "docs",
 	}
 
 	if doc.NavImage != "" {
@@ -473,6 +524,16 @@ func (service *DocService) StartUpdate(docId uint, rootParentId uint) (string, e
 		replacements["__URL__"] = doc.URL
 	}
 
+	// Sites served on a domain of their own are served from its root
+	if rootId, err := service.GetRootParentID(docId); err == nil {
+		if domain := service.SiteDomainOf(rootId); domain != "" {
+			replacements["__BASE_URL__"] = "/"
+			if doc.URL == "" {
+				replacements["__URL__"] = "https://" + domain
+			}
+		}
+	}
+
 	if doc.FooterLabelLinks != "" {
 		var socialLinks []SocialLink
 		var socialLinksRsPress []SocialLinkRsPress
@@ -520,25 +581,49 @@ func (service *DocService) StartUpdate(docId uint, rootParentId uint) (string, e
 		replacements["__FOOTER_CONTENT__"] = "Made with ❤️ by Iridia Solutions Pvt. Ltd."
 	}
 
-	if utils.PathExists(docConfig) {
-		if err := os.Remove(docConfig); err != nil {
-			return "", err
-		}
-	}
-
 	latest, versions, err := service.GetAllVersions(docId)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	multiVersions := Versions{Default: latest, Versions: versions}
 	multiVersionsJSON, err := json.Marshal(multiVersions)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	replacements["__MULTI_VERSIONS__"] = "multiVersion: " + string(multiVersionsJSON)
 
+	return replacements, nil
+}
+
+func (service *DocService) StartUpdate(docId uint, rootParentId uint) (string, error) {
+	docConfigTemplate, err := embedded.ReadEmbeddedFile("rspress.config.ts")
+	if err != nil {
+		return "", err
+	}
+
+	docPath := filepath.Join(config.ParsedConfig.DataPath, "rspress_data", "doc_"+strconv.Itoa(int(rootParentId)))
+	docConfig := filepath.Join(docPath, "rspress.config.ts")
+	gitDocConfig := filepath.Join(docPath, "rspress.config.git.ts")
+
+	if !utils.PathExists(gitDocConfig) {
+		if err := utils.CopyFile(docConfig, gitDocConfig); err != nil {
+			return "", err
+		}
+	}
+
+	replacements, err := service.rsPressConfigReplacements(docId)
+	if err != nil {
+		return "", err
+	}
+
+	if utils.PathExists(docConfig) {
+		if err := os.Remove(docConfig); err != nil {
+			return "", err
+		}
+	}
+
 	err = utils.WriteToFile(docConfig, utils.ReplaceMany(string(docConfigTemplate), replacements))
 	if err != nil {
 		return "", err
@@ -565,8 +650,25 @@ func (service *DocService) CraftPage(pageID uint, title string, slug string, con
 		return "", nil
 	}
 
+	page, err := service.GetPage(pageID)
+	if err != nil {
+		return "", err
+	}
+
+	page.Title = title
+	page.Slug = slug
+	page.Content = content
+
+	return service.craftPage(publishedView(time.Now()), page)
+}
+
+func (service *DocService) craftPage(view contentView, page models.Page) (string, error) {
+	if page.Content == `"[]"` {
+		return "", nil
+	}
+
 	var blocks []Block
-	err := json.Unmarshal([]byte(content), &blocks)
+	err := json.Unmarshal([]byte(page.Content), &blocks)
 	if err != nil {
 		return "", err
 	}
@@ -590,12 +692,12 @@ func (service *DocService) CraftPage(pageID uint, title string, slug string, con
 		markdown += utils.ListToMDX(listItems)
 	}
 
-	docId, err := service.GetDocIdByPageId(pageID)
+	docId, err := service.GetDocIdByPageId(page.ID)
 	if err != nil {
 		return "", err
 	}
 
-	top, err := service.GenerateHead(docId, pageID, "doc")
+	top, err := service.generateHead(view, docId, &page, "doc")
 	if err != nil {
 		return "", err
 	}
@@ -603,7 +705,7 @@ func (service *DocService) CraftPage(pageID uint, title string, slug string, con
 	return fmt.Sprintf("%s%s", top, markdown), nil
 }
 
-func (service *DocService) writePagesToDirectory(pages []models.Page, dirPath string) error {
+func (service *DocService) writePagesToDirectory(view contentView, pages []models.Page, dirPath string) error {
 	var metaElements []MetaElement
 
 	sort.Slice(pages, func(i, j int) bool {
@@ -618,9 +720,10 @@ func (service *DocService) writePagesToDirectory(pages []models.Page, dirPath st
 		if err != nil {
 			return err
 		}
+		fullPage = view.applyDraft(fullPage)
 
 		var fileName, content string
-		content, err = service.CraftPage(fullPage.ID, fullPage.Title, fullPage.Slug, fullPage.Content)
+		content, err = service.craftPage(view, fullPage)
 		if err != nil {
 			return err
 		}
@@ -633,7 +736,7 @@ func (service *DocService) writePagesToDirectory(pages []models.Page, dirPath st
 			fileName = utils.StringToFileString(fullPage.Title) + markdownExt
 		}
 
-		err = utils.WriteToFile(filepath.Join(dirPath, fileName), content)
+		err = view.files.write(filepath.Join(dirPath, fileName), content)
 		if err != nil {
 			return err
 		}
@@ -662,10 +765,10 @@ func (service *DocService) writePagesToDirectory(pages []models.Page, dirPath st
 		}
 	}
 
-	return writeMetaJSON(metaElements, dirPath)
+	return view.files.writeMetaJSON(metaElements, dirPath)
 }
 
-func (service *DocService) writePageGroupsToDirectory(pageGroups []models.PageGroup, dirPath string, docId uint) error {
+func (service *DocService) writePageGroupsToDirectory(view contentView, pageGroups []models.PageGroup, dirPath string, docId uint) error {
 	for _, pageGroup := range pageGroups {
 		if pageGroup.DocumentationID != docId {
 			continue
@@ -686,8 +789,9 @@ func (service *DocService) writePageGroupsToDirectory(pageGroups []models.PageGr
 		if err != nil {
 			return err
 		}
+		pages = view.pages(pages)
 
-		if err := service.writePagesToDirectory(pages, fullPath); err != nil {
+		if err := service.writePagesToDirectory(view, pages, fullPath); err != nil {
 			return err
 		}
 
@@ -711,6 +815,7 @@ func (service *DocService) writePageGroupsToDirectory(pageGroups []models.PageGr
 		if err := service.DB.Where("parent_id = ?", pageGroup.ID).Find(&nestedPageGroups).Error; err != nil {
 			return err
 		}
+		nestedPageGroups = view.pageGroups(nestedPageGroups)
 
 		for _, nestedGroup := range nestedPageGroups {
 			nestedGroupDir := utils.StringToFileString(nestedGroup.Name)
@@ -721,7 +826,7 @@ func (service *DocService) writePageGroupsToDirectory(pageGroups []models.PageGr
 				}
 			}
 
-			if err := service.writePageGroupsToDirectory([]models.PageGroup{nestedGroup}, fullPath, docId); err != nil {
+			if err := service.writePageGroupsToDirectory(view, []models.PageGroup{nestedGroup}, fullPath, docId); err != nil {
 				return err
 			}
 
@@ -741,7 +846,7 @@ func (service *DocService) writePageGroupsToDirectory(pageGroups []models.PageGr
 		}
 
 		// Write _meta.json for the current page group
-		if err := writeMetaJSON(metaElements, fullPath); err != nil {
+		if err := view.files.writeMetaJSON(metaElements, fullPath); err != nil {
 			return err
 		}
 	}
@@ -749,7 +854,69 @@ func (service *DocService) writePageGroupsToDirectory(pageGroups []models.PageGr
 	return nil
 }
 
-func writeMetaJSON(metaElements []MetaElement, dirPath string) error {
+// contentWriter writes the files of a build, keeping track of the ones it
+// wrote and of the ones whose content changed.
+type contentWriter struct {
+	written map[string]bool
+	changed []string
+	removed []string
+}
+
+func newContentWriter() *contentWriter {
+	return &contentWriter{written: make(map[string]bool)}
+}
+
+// write writes content to path unless the file already holds it, so that
+// unchanged files keep their modification time.
+func (files *contentWriter) write(path string, content string) error {
+	path = filepath.Clean(path)
+	files.written[path] = true
+
+	existing, err := os.ReadFile(path)
+	if err == nil && string(existing) == content {
+		return nil
+	}
+
+	if err := utils.MakeDir(filepath.Dir(path)); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		return err
+	}
+
+	files.changed = append(files.changed, path)
+
+	return nil
+}
+
+// prune removes the files under dir that were not written.
+func (files *contentWriter) prune(dir string) error {
+	err := filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || files.written[filepath.Clean(path)] {
+			return err
+		}
+
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+
+		files.removed = append(files.removed, path)
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return utils.RemoveEmptyDirs(dir)
+}
+
+func (files *contentWriter) hasChanges() bool {
+	return len(files.changed) > 0 || len(files.removed) > 0
+}
+
+func (files *contentWriter) writeMetaJSON(metaElements []MetaElement, dirPath string) error {
 	// Sort metaElements
 	sort.Slice(metaElements, func(i, j int) bool {
 		if metaElements[i].Order != metaElements[j].Order {
@@ -772,7 +939,7 @@ func writeMetaJSON(metaElements []MetaElement, dirPath string) error {
 	}
 
 	metaFilePath := filepath.Join(dirPath, "_meta.json")
-	err = os.WriteFile(metaFilePath, metaJSON, 0644)
+	err = files.write(metaFilePath, string(metaJSON))
 	if err != nil {
 		return fmt.Errorf("error writing _meta.json file: %w", err)
 	}
@@ -804,51 +971,43 @@ func (service *DocService) buildVersionTree(docId uint) ([]VersionInfo, error) {
 	return versionTree, nil
 }
 
-func (service *DocService) WriteContents(docId uint, rootParentId uint, preHash string) error {
-	docIdPath := filepath.Join(config.ParsedConfig.DataPath, "rspress_data", "doc_"+strconv.Itoa(int(rootParentId)))
-	_, err := service.GetDocumentation(docId)
-	if err != nil {
-		if err.Error() == "documentation_not_found" {
-			if err := utils.RemovePath(docIdPath); err != nil {
-				return err
-			}
-		}
-		return err
-	}
-
-	docsPath := filepath.Join(docIdPath, "docs")
-
-	for _, path := range []string{docIdPath, docsPath} {
-		if err := utils.MakeDir(path); err != nil {
-			return err
-		}
-	}
+// writeVersions writes the content of every version of a documentation, as
+// it appears in view, to docsPath. Files whose content did not change are
+// left untouched and files that are no longer part of a version are removed;
+// the returned writer tells which files changed.
+func (service *DocService) writeVersions(ctx context.Context, view contentView, rootParentId uint, docsPath string) (*contentWriter, error) {
+	view.files = newContentWriter()
 
 	versionInfos, err := service.buildVersionTree(rootParentId)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	for _, versionInfo := range versionInfos {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
 		versionDoc, err := service.GetDocumentation(versionInfo.DocId)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		versionedDocPath := filepath.Join(docsPath, versionInfo.Version)
 
-		if !utils.PathExists(versionedDocPath) {
-			if err := utils.MakeDir(versionedDocPath); err != nil {
-				return err
-			}
+		if err := utils.MakeDir(versionedDocPath); err != nil {
+			return nil, err
 		}
 
 		var rootPageGroups []models.PageGroup
 
 		if err := service.DB.Where("parent_id IS NULL AND documentation_id = ?", versionDoc.ID).Preload("Pages").Find(&rootPageGroups).Error; err != nil {
-			return err
+			return nil, err
 		}
 
+		rootPageGroups = view.pageGroups(rootPageGroups)
+		versionDoc.Pages = view.pages(versionDoc.Pages)
+
 		cleanedBase := "guides"
 
 		var rootMeta string
@@ -859,41 +1018,45 @@ func (service *DocService) WriteContents(docId uint, rootParentId uint, preHash
 			rootMeta = fmt.Sprintf(`[{"text": "Documentation","link": "/%s/index","activeMatch": "/%s/"}]`, cleanedBase, cleanedBase)
 		}
 
-		var customCSS strings.Builder
+		// Previews use the stylesheet of the last build, which is compiled from
+		// this file
+		if !view.isPreview() {
+			var customCSS strings.Builder
 
-		customCSS.WriteString("@tailwind base;\n")
-		customCSS.WriteString("@tailwind components;\n")
-		customCSS.WriteString("@tailwind utilities;\n\n")
+			customCSS.WriteString("@tailwind base;\n")
+			customCSS.WriteString("@tailwind components;\n")
+			customCSS.WriteString("@tailwind utilities;\n\n")
 
-		if versionDoc.CustomCSS != "" {
-			customCSS.WriteString(versionDoc.CustomCSS)
-		}
+			if versionDoc.CustomCSS != "" {
+				customCSS.WriteString(versionDoc.CustomCSS)
+			}
 
-		if err := utils.WriteToFile(filepath.Join(versionedDocPath, "../../", "styles", "input.css"), customCSS.String()); err != nil {
-			return err
+			if err := view.files.write(filepath.Join(versionedDocPath, "../../", "styles", "input.css"), customCSS.String()); err != nil {
+				return nil, err
+			}
 		}
 
-		if err := utils.WriteToFile(filepath.Join(versionedDocPath, "_meta.json"), rootMeta); err != nil {
-			return err
+		if err := view.files.write(filepath.Join(versionedDocPath, "_meta.json"), rootMeta); err != nil {
+			return nil, err
 		}
 
 		userContentPath := filepath.Join(versionedDocPath, cleanedBase)
 
 		if !utils.PathExists(userContentPath) {
 			if err := utils.MakeDir(userContentPath); err != nil {
-				return err
+				return nil, err
 			}
 		}
 
-		if err := service.WriteHomePage(versionDoc, userContentPath); err != nil {
-			return err
+		if err := service.writeHomePage(view, versionDoc, userContentPath); err != nil {
+			return nil, err
 		}
 
 		var rootMetaElements []MetaElement
 
 		// Write pages directly in the userContentPath
-		if err := service.writePagesToDirectory(versionDoc.Pages, userContentPath); err != nil {
-			return err
+		if err := service.writePagesToDirectory(view, versionDoc.Pages, userContentPath); err != nil {
+			return nil, err
 		}
 
 		// Add pages to root meta elements
@@ -923,8 +1086,8 @@ func (service *DocService) WriteContents(docId uint, rootParentId uint, preHash
 		}
 
 		// Write page groups
-		if err := service.writePageGroupsToDirectory(rootPageGroups, userContentPath, versionDoc.ID); err != nil {
-			return err
+		if err := service.writePageGroupsToDirectory(view, rootPageGroups, userContentPath, versionDoc.ID); err != nil {
+			return nil, err
 		}
 
 		// Add page groups to root meta elements
@@ -945,36 +1108,46 @@ func (service *DocService) WriteContents(docId uint, rootParentId uint, preHash
 		}
 
 		// Write root _meta.json
-		if err := writeMetaJSON(rootMetaElements, userContentPath); err != nil {
-			return err
+		if err := view.files.writeMetaJSON(rootMetaElements, userContentPath); err != nil {
+			return nil, err
+		}
+
+		// Pages which were deleted or unpublished since the last build must
+		// not be left behind
+		if err := view.files.prune(versionedDocPath); err != nil {
+			return nil, err
 		}
 	}
 
-	newDocsHash, err := utils.DirHash(docsPath)
-	if err != nil {
-		return err
+	return view.files, nil
+}
+
+// WriteContents writes the content of a documentation for rspress,
+// reporting whether any of it changed since the last build.
+func (service *DocService) WriteContents(ctx context.Context, docId uint, rootParentId uint) (bool, error) {
+	docIdPath := filepath.Join(config.ParsedConfig.DataPath, "rspress_data", "doc_"+strconv.Itoa(int(rootParentId)))
+	docsPath := filepath.Join(docIdPath, "docs")
+
+	if err := utils.MakeDir(docsPath); err != nil {
+		return false, err
 	}
 
-	newConfigHash, err := utils.FileHash(filepath.Join(docIdPath, "rspress.config.ts"))
+	files, err := service.writeVersions(ctx, service.siteView(rootParentId), rootParentId, docsPath)
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	newHash := utils.HashStrings([]string{newDocsHash, newConfigHash})
+	buildRecorderFrom(ctx).logf("%d content files changed, %d removed", len(files.changed), len(files.removed))
+
 	deletionsOccurred, err := service.PreBuildCleanup(rootParentId)
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	needRebuild := false
-	if newHash != preHash || deletionsOccurred {
-		needRebuild = true
-	}
-
-	return service.RsPressBuild(rootParentId, needRebuild)
+	return files.hasChanges() || deletionsOccurred, nil
 }
 
-func (service *DocService) WriteHomePage(documentation models.Documentation, contentPath string) error {
+func (service *DocService) writeHomePage(view contentView, documentation models.Documentation, contentPath string) error {
 	var homePage string
 	var homePagePath string
 
@@ -1060,7 +1233,7 @@ func (service *DocService) WriteHomePage(documentation models.Documentation, con
 		homePage = yamlBuilder.String()
 		homePagePath = filepath.Join(contentPath, "../", "index.mdx")
 	} else {
-		head, err := service.GenerateHead(documentation.ID, math.MaxUint32, "doc")
+		head, err := service.generateHead(view, documentation.ID, nil, "doc")
 		if err != nil {
 			logger.Error("Failed to generate head for home page", zap.Error(err))
 		}
@@ -1073,7 +1246,7 @@ func (service *DocService) WriteHomePage(documentation models.Documentation, con
 		homePagePath = filepath.Join(contentPath, "../", "index.mdx")
 	}
 
-	if err := utils.WriteToFile(homePagePath, homePage); err != nil {
+	if err := view.files.write(homePagePath, homePage); err != nil {
 		return err
 	}
 	return nil
@@ -1115,94 +1288,199 @@ func (service *DocService) PreBuildCleanup(docId uint) (bool, error) {
 		}
 	}
 
-	err = db.ClearCacheByPrefix(fmt.Sprintf("rs|doc_%d", docId))
-	if err != nil {
-		logger.Error("Failed to clear cache", zap.Error(err))
-		return deletionsOccurred, err
+	return deletionsOccurred, nil
+}
+
+// Steps of a build that are skipped while their inputs, relative to the
+// documentation folder, are unchanged since they last ran.
+const (
+	installStamp  = ".install_hash"
+	tailwindStamp = ".tailwind_hash"
+)
+
+var (
+	installInputs  = []string{"package.json", "pnpm-lock.yaml", ".npmrc"}
+	tailwindInputs = []string{"styles/input.css", "tailwind.config.js", "src"}
+)
+
+func buildStepHash(docPath string, inputs ...string) string {
+	hashes := make([]string, 0, len(inputs))
+	for _, input := range inputs {
+		path := filepath.Join(docPath, input)
+
+		var hash string
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			hash, _ = utils.DirHash(path)
+		} else if err == nil {
+			hash, _ = utils.FileHash(path)
+		}
+
+		hashes = append(hashes, input+":"+hash+"\n")
 	}
 
-	return deletionsOccurred, nil
+	return utils.HashStrings(hashes)
+}
+
+func buildStepDone(docPath string, stamp string, inputs ...string) bool {
+	done, err := os.ReadFile(filepath.Join(docPath, stamp))
+	return err == nil && string(done) == buildStepHash(docPath, inputs...)
+}
+
+func markBuildStepDone(docPath string, stamp string, inputs ...string) error {
+	return utils.WriteToFile(filepath.Join(docPath, stamp), buildStepHash(docPath, inputs...))
+}
+
+// updateBuildCache drops the cached files of a documentation that changed
+// in its last build, they are loaded again when next requested.
+func (service *DocService) updateBuildCache(docId uint, changed []string, removed []string) {
+	for _, fileName := range changed {
+		db.Cache.Delete(fmt.Sprintf("rs|doc_%d|%s", docId, fileName))
+	}
+
+	for _, fileName := range removed {
+		db.Cache.Delete(fmt.Sprintf("rs|doc_%d|%s", docId, fileName))
+	}
+
+	db.Cache.DeletePrefix(fmt.Sprintf("burl|doc_%d|", docId))
+
+	if _, err := service.markSiteBuild(docId); err != nil {
+		logger.Error("Failed to record site build", zap.Uint("doc_id", docId), zap.Error(err))
+	}
 }
 
-func (service *DocService) RsPressBuild(docId uint, rebuild bool) error {
+// clearBuildCache drops every cached file of a documentation.
+func (service *DocService) clearBuildCache(docId uint) {
+	db.Cache.DeletePrefix(fmt.Sprintf("rs|doc_%d|", docId))
+	db.Cache.DeletePrefix(fmt.Sprintf("burl|doc_%d|", docId))
+	service.forgetSiteBuild(docId)
+}
+
+func (service *DocService) RsPressBuild(ctx context.Context, docId uint, rebuild bool) error {
 	docPath := filepath.Join(config.ParsedConfig.DataPath, "rspress_data", "doc_"+strconv.Itoa(int(docId)))
-	buildPath := filepath.Join(docPath, "build")
+	recorder := buildRecorderFrom(ctx)
+
+	if !rebuild {
+		recorder.logf("No changes since the last build, reusing it")
+	}
 
 	if rebuild {
-		tmpBuildPath := filepath.Join(docPath, "build_tmp")
+		if buildStepDone(docPath, installStamp, installInputs...) && utils.PathExists(filepath.Join(docPath, "node_modules")) {
+			recorder.logf("Dependencies unchanged, skipping install")
+		} else {
+			if !npmAvailable() {
+				return fmt.Errorf("npm_or_ping_failed")
+			}
 
-		npmPinged := utils.NpmPing()
-		if !npmPinged {
-			return fmt.Errorf("npm_or_ping_failed")
-		}
+			ctx = recorder.startPhase(ctx, BuildPhaseInstall)
+			err := utils.RunNpmCommandContext(ctx, recorder.output(), docPath, "install")
+			if err != nil {
+				return err
+			}
 
-		err := utils.RunNpmCommand(docPath, "install")
-		if err != nil {
-			return err
+			if err := markBuildStepDone(docPath, installStamp, installInputs...); err != nil {
+				return err
+			}
 		}
 
-		err = utils.RunNpxCommand(docPath, "tailwindcss", "build", "-i", "styles/input.css", "-o", "styles/output.css")
-		if err != nil {
-			return err
+		if buildStepDone(docPath, tailwindStamp, tailwindInputs...) && utils.PathExists(filepath.Join(docPath, "styles", "output.css")) {
+			recorder.logf("Styles unchanged, skipping tailwind")
+		} else {
+			ctx = recorder.startPhase(ctx, BuildPhaseTailwind)
+			err := utils.RunNpxCommandContext(ctx, recorder.output(), docPath, "tailwindcss", "build", "-i", "styles/input.css", "-o", "styles/output.css")
+			if err != nil {
+				return err
+			}
+
+			if err := markBuildStepDone(docPath, tailwindStamp, tailwindInputs...); err != nil {
+				return err
+			}
 		}
 
-		err = utils.CopyPublicAssetsToDocsIfEmpty(docPath)
+		err := utils.CopyPublicAssetsToDocsIfEmpty(docPath)
 		if err != nil {
 			return err
 		}
 
-		err = utils.RunNpmCommand(docPath, "run", "build")
+		ctx = recorder.startPhase(ctx, BuildPhaseBuild)
+		err = utils.RunNpmCommandContext(ctx, recorder.output(), docPath, "run", "build")
 		if err != nil {
 			return err
 		}
 
-		if utils.PathExists(tmpBuildPath) {
-			backupBuildPath := filepath.Join(docPath, "build_backup")
-			if utils.PathExists(buildPath) {
-				if err := os.Rename(buildPath, backupBuildPath); err != nil {
-					return fmt.Errorf("failed to rename buildPath to backupBuildPath: %w", err)
-				}
-			}
-			if err := os.Rename(tmpBuildPath, buildPath); err != nil {
-				if utils.PathExists(backupBuildPath) {
-					os.Rename(backupBuildPath, buildPath)
-				}
-				return fmt.Errorf("failed to rename tmpBuildPath to buildPath: %w", err)
+		return service.publishBuild(ctx, docId)
+	}
+
+	return nil
+}
+
+// publishBuild replaces the build of a documentation being served with the
+// one just written to build_tmp and drops the cached files it replaced.
+func (service *DocService) publishBuild(ctx context.Context, docId uint) error {
+	docPath := filepath.Join(config.ParsedConfig.DataPath, "rspress_data", "doc_"+strconv.Itoa(int(docId)))
+	buildPath := filepath.Join(docPath, "build")
+	tmpBuildPath := filepath.Join(docPath, "build_tmp")
+
+	// Sites are always built whole, but only the pages that came out
+	// different replace the ones being served
+	if utils.PathExists(tmpBuildPath) {
+		// Builds are uploaded from the build folder when sites are served
+		// from the bucket, which decides on the release there
+		if !service.SitesInObjectStorage() {
+			hash, err := utils.DirHash(tmpBuildPath)
+			if err != nil {
+				return err
 			}
-			if utils.PathExists(backupBuildPath) {
-				os.RemoveAll(backupBuildPath)
+
+			keep, activate := service.releaseBuild(ctx, docId, hash)
+			if !activate {
+				return service.holdBuild(ctx, docId, tmpBuildPath, hash, keep)
 			}
 		}
-	}
 
-	filesContent, err := utils.Tree(buildPath)
-	if err != nil {
-		return err
+		changed, removed, err := utils.SyncDir(tmpBuildPath, buildPath)
+		if err != nil {
+			return fmt.Errorf("failed to swap build_tmp into build: %w", err)
+		}
+
+		buildRecorderFrom(ctx).logf("%d output files changed, %d removed", len(changed), len(removed))
+
+		service.updateBuildCache(docId, changed, removed)
+		return nil
 	}
 
-	err = db.ClearCacheByPrefix(fmt.Sprintf("rs|doc_%d", docId))
-	if err != nil {
-		return err
+	service.clearBuildCache(docId)
+	return nil
+}
+
+// holdBuild keeps a build that does not replace the pinned release of a
+// documentation as a release of its own, if it is a new one, without serving
+// it.
+func (service *DocService) holdBuild(ctx context.Context, docId uint, tmpBuildPath string, hash string, keep bool) error {
+	recorder := buildRecorderFrom(ctx)
+
+	if !keep {
+		recorder.logf("The active site release is pinned, the build was not published")
+		return utils.RemovePath(tmpBuildPath)
 	}
 
-	err = db.ClearCacheByPrefix(fmt.Sprintf("burl|doc_%d", docId))
+	release, err := service.keepLocalSiteRelease(ctx, docId, tmpBuildPath, hash)
 	if err != nil {
 		return err
 	}
 
-	for fileName, content := range filesContent {
-		if err := db.SetKey([]byte(fmt.Sprintf("rs|doc_%d|%s", docId, fileName)), content, utils.GetContentType(fileName)); err != nil {
-			return err
-		}
+	recorder.logf("The active site release is pinned, the build was kept as release %d", release.ID)
+
+	if err := service.pruneSiteReleases(nil, docId); err != nil {
+		logger.Error("Failed to remove old site releases", zap.Uint("doc_id", docId), zap.Error(err))
 	}
 
 	return nil
 }
 
 func (service *DocService) GetRsPress(urlPath string) (uint, string, string, bool, error) {
-	cachedBaseURLs, err := db.GetCacheByPrefix("burl|doc_")
+	cachedBaseURLs := db.Cache.Values("burl|doc_")
 
-	if err == nil && len(cachedBaseURLs) > 0 {
+	if len(cachedBaseURLs) > 0 {
 		for cacheKey, baseURL := range cachedBaseURLs {
 			if strings.HasPrefix(urlPath, baseURL) {
 				split := strings.Split(cacheKey, "|")
@@ -1218,6 +1496,14 @@ func (service *DocService) GetRsPress(urlPath string) (uint, string, string, boo
 				}
 
 				docPath := filepath.Join(config.ParsedConfig.DataPath, "rspress_data", fmt.Sprintf("doc_%d", id), "build")
+				if service.SitesInObjectStorage() {
+					if _, err := service.activeSiteRelease(uint(id)); err != nil {
+						continue
+					}
+
+					return uint(id), docPath, baseURL, reqAuth, nil
+				}
+
 				if _, err := os.Stat(docPath); os.IsNotExist(err) {
 					continue
 				}
@@ -1244,7 +1530,7 @@ func (service *DocService) GetRsPress(urlPath string) (uint, string, string, boo
 		return 0, "", "", false, fmt.Errorf("unsupported_database_type: %s", dialectName)
 	}
 
-	err = service.DB.Where(query, args...).
+	err := service.DB.Where(query, args...).
 		Order("LENGTH(base_url) DESC").
 		First(&doc).Error
 	if err != nil {
@@ -1255,21 +1541,27 @@ func (service *DocService) GetRsPress(urlPath string) (uint, string, string, boo
 	}
 
 	docPath := filepath.Join(config.ParsedConfig.DataPath, "rspress_data", fmt.Sprintf("doc_%d", doc.ID), "build")
-	if _, err := os.Stat(docPath); os.IsNotExist(err) {
-		return 0, "", "", false, fmt.Errorf("rspress_build_not_found")
-	}
+	if service.SitesInObjectStorage() {
+		if _, err := service.activeSiteRelease(doc.ID); err != nil {
+			return 0, "", "", false, fmt.Errorf("rspress_build_not_found")
+		}
+	} else {
+		if _, err := os.Stat(docPath); os.IsNotExist(err) {
+			return 0, "", "", false, fmt.Errorf("rspress_build_not_found")
+		}
 
-	files, err := os.ReadDir(docPath)
-	if err != nil {
-		return 0, "", "", false, fmt.Errorf("error_reading_rspress_directory")
-	}
+		files, err := os.ReadDir(docPath)
+		if err != nil {
+			return 0, "", "", false, fmt.Errorf("error_reading_rspress_directory")
+		}
 
-	if len(files) == 0 {
-		return 0, "", "", false, fmt.Errorf("rspress_build_empty")
+		if len(files) == 0 {
+			return 0, "", "", false, fmt.Errorf("rspress_build_empty")
+		}
 	}
 
 	cacheKey := fmt.Sprintf("burl|doc_%d|%t", doc.ID, doc.RequireAuth)
-	_ = db.SetKey([]byte(cacheKey), []byte(doc.BaseURL), "text/plain")
+	_ = db.Cache.Set(cacheKey, []byte(doc.BaseURL), "text/plain")
 
 	return doc.ID, docPath, doc.BaseURL, doc.RequireAuth, nil
 }
@@ -1286,15 +1578,34 @@ func (service *DocService) AddBuildTrigger(docId uint, isDelete bool, force ...b
 		}
 	}
 
+	manual := len(force) > 0 && force[0]
+
 	trigger := models.BuildTriggers{
 		DocumentationID: docId,
 		Triggered:       false,
 		CompletedAt:     nil,
 		IsDelete:        isDelete,
+		Manual:          manual && !isDelete,
+		Status:          models.BuildTriggerPending,
 	}
 	if err := service.DB.Create(&trigger).Error; err != nil {
 		return err
 	}
+
+	if !isDelete && service.IsDocIdValid(docId) {
+		if err := service.queueBuildRun(docId, trigger.Manual); err != nil {
+			logger.Error("Failed to queue build run", zap.Uint("doc_id", docId), zap.Error(err))
+		}
+	}
+
+	// A build asked for by hand replaces the one running for this
+	// documentation, while other triggers wait for it to finish so that
+	// edits made in a row do not keep cancelling it
+	if trigger.Manual {
+		service.builds.supersede(docId)
+		service.builds.notify()
+	}
+
 	return nil
 }
 
@@ -1315,6 +1626,26 @@ func (service *DocService) DeleteJob() {
 	skipSave := false
 
 	for _, trigger := range triggers {
+		if service.builds.isRunning(trigger.DocumentationID) {
+			skipSave = true
+			continue
+		}
+
+		if err := service.unpublishSite(docSiteName(trigger.DocumentationID)); err != nil {
+			logger.Error("(DeleteJob) Failed to unpublish site", zap.Error(err))
+			skipSave = true
+		}
+
+		if err := service.deleteSiteReleases(trigger.DocumentationID); err != nil {
+			logger.Error("(DeleteJob) Failed to remove site releases", zap.Error(err))
+			skipSave = true
+		}
+
+		if err := service.deleteDomains(trigger.DocumentationID); err != nil {
+			logger.Error("(DeleteJob) Failed to remove domains", zap.Error(err))
+			skipSave = true
+		}
+
 		docPath := filepath.Join(config.ParsedConfig.DataPath, "rspress_data", "doc_"+strconv.Itoa(int(trigger.DocumentationID)))
 		if utils.PathExists(docPath) {
 			logger.Info("Deleting doc folder", zap.Uint("doc_id", trigger.DocumentationID))
@@ -1329,6 +1660,7 @@ func (service *DocService) DeleteJob() {
 	if !skipSave {
 		for i := range triggers {
 			triggers[i].Triggered = true
+			triggers[i].Status = models.BuildTriggerCompleted
 			triggers[i].CompletedAt = utils.TimePtr(time.Now())
 		}
 
@@ -1338,90 +1670,6 @@ func (service *DocService) DeleteJob() {
 	}
 }
 
-func (service *DocService) BuildJob() {
-	var triggers []models.BuildTriggers
-
-	if err := service.DB.
-		Where("triggered = ? AND is_delete = ?", false, false).
-		Find(&triggers).Error; err != nil {
-		logger.Error("Failed to fetch build triggers", zap.Error(err))
-		return
-	}
-
-	if len(triggers) == 0 {
-		return
-	}
-
-	validTriggers := triggers[:0]
-	for _, trigger := range triggers {
-		if service.IsDocIdValid(trigger.DocumentationID) {
-			validTriggers = append(validTriggers, trigger)
-		}
-	}
-
-	if len(validTriggers) == 0 {
-		return
-	}
-
-	triggerGroups := make(map[uint][]models.BuildTriggers)
-	for _, trigger := range validTriggers {
-		triggerGroups[trigger.DocumentationID] = append(triggerGroups[trigger.DocumentationID], trigger)
-	}
-
-	for docID, groupTriggers := range triggerGroups {
-		start := time.Now()
-		err := service.UpdateWriteBuild(docID)
-		elapsed := time.Since(start)
-
-		if err != nil {
-			logger.Error("Failed to update write build",
-				zap.Uint("doc_id", docID),
-				zap.Error(err),
-				zap.Duration("elapsed", elapsed),
-				zap.Int("trigger_count", len(groupTriggers)))
-		} else {
-			logger.Info("RsPress Build completed",
-				zap.Uint("doc_id", docID),
-				zap.Duration("elapsed", elapsed),
-				zap.Int("trigger_count", len(groupTriggers)))
-
-			gitTime := time.Now()
-			err := service.GitDeploy(docID)
-			gitElapsed := time.Since(gitTime)
-
-			if err != nil {
-				logger.Error("Failed to deploy to git", zap.Error(err))
-			} else {
-				logger.Info("Git Deploy completed", zap.Uint("doc_id", docID), zap.Duration("elapsed", gitElapsed), zap.Int("trigger_count", len(groupTriggers)))
-			}
-			logger.Info(fmt.Sprintf("moving static assets to docs in doc_%d", docID))
-
-			docPath := utils.GetDocPathByID(docID, config.ParsedConfig)
-			docPublicAssetPath := filepath.Join(docPath, "public")
-			docsInternalPublicAssetPath := filepath.Join(docPath, "docs", "public")
-			err = utils.CopyOrOveriteDir(docPublicAssetPath, docsInternalPublicAssetPath)
-
-			if err != nil {
-				logger.Error(fmt.Sprintf("error copying files from %s to %s", docPublicAssetPath, docsInternalPublicAssetPath), zap.Error(err))
-			} else {
-				logger.Info("successfully copied files to target", zap.Uint("doc_id", docID))
-			}
-		}
-
-		for i := range groupTriggers {
-			groupTriggers[i].Triggered = true
-			groupTriggers[i].CompletedAt = utils.TimePtr(time.Now())
-		}
-
-		if err := service.DB.Save(&groupTriggers).Error; err != nil {
-			logger.Error("Failed to save build triggers",
-				zap.Uint("doc_id", docID),
-				zap.Error(err),
-				zap.Int("trigger_count", len(groupTriggers)))
-		}
-	}
-}
-
 func (service *DocService) GetLastTrigger() ([]models.BuildTriggers, error) {
 	var allTriggers []models.BuildTriggers
 
@@ -0,0 +1,291 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"git.difuse.io/Difuse/kalmia/config"
+	"git.difuse.io/Difuse/kalmia/db/models"
+	"git.difuse.io/Difuse/kalmia/logger"
+	"go.uber.org/zap"
+)
+
+// scheduleIdleInterval is how long the publish scheduler sleeps when no
+// page or page group is waiting to be published or unpublished.
+const scheduleIdleInterval = time.Hour
+
+// isPublished reports whether content with the given publishing window is
+// visible at t. Either end of the window may be open.
+func isPublished(publishAt, unpublishAt *time.Time, t time.Time) bool {
+	if publishAt != nil && t.Before(*publishAt) {
+		return false
+	}
+
+	if unpublishAt != nil && !t.Before(*unpublishAt) {
+		return false
+	}
+
+	return true
+}
+
+// publishedPages drops the pages that are outside their publishing window
+// at t or have never been published from a draft.
+func publishedPages(pages []models.Page, t time.Time) []models.Page {
+	published := make([]models.Page, 0, len(pages))
+	for _, page := range pages {
+		if !page.IsDraft && isPublished(page.PublishAt, page.UnpublishAt, t) {
+			published = append(published, page)
+		}
+	}
+
+	return published
+}
+
+func publishedPageGroups(pageGroups []models.PageGroup, t time.Time) []models.PageGroup {
+	published := make([]models.PageGroup, 0, len(pageGroups))
+	for _, pageGroup := range pageGroups {
+		if isPublished(pageGroup.PublishAt, pageGroup.UnpublishAt, t) {
+			published = append(published, pageGroup)
+		}
+	}
+
+	return published
+}
+
+// contentView selects the content written for a build: what is published at
+// a point in time and, for previews, the pending drafts applied on top. Its
+// files are written through a contentWriter.
+type contentView struct {
+	at      time.Time
+	drafts  map[uint]models.PageDraft
+	baseURL string
+	files   *contentWriter
+}
+
+func publishedView(t time.Time) contentView {
+	return contentView{at: t}
+}
+
+// applyDraft returns page with its pending draft, if the view has one,
+// applied to it.
+func (view contentView) applyDraft(page models.Page) models.Page {
+	draft, ok := view.drafts[page.ID]
+	if !ok {
+		return page
+	}
+
+	page.Title = draft.Title
+	page.Slug = draft.Slug
+	page.Content = draft.Content
+	page.IsDraft = false
+
+	return page
+}
+
+func (view contentView) pages(pages []models.Page) []models.Page {
+	viewed := make([]models.Page, 0, len(pages))
+	for _, page := range pages {
+		viewed = append(viewed, view.applyDraft(page))
+	}
+
+	return publishedPages(viewed, view.at)
+}
+
+func (view contentView) pageGroups(pageGroups []models.PageGroup) []models.PageGroup {
+	return publishedPageGroups(pageGroups, view.at)
+}
+
+// isPreview reports whether the view is of a preview build, rather than of
+// the published site.
+func (view contentView) isPreview() bool {
+	return view.drafts != nil
+}
+
+func (view contentView) baseURLOf(doc models.Documentation) string {
+	if view.baseURL != "" {
+		return view.baseURL
+	}
+
+	return doc.BaseURL
+}
+
+func validateSchedule(publishAt, unpublishAt *time.Time) error {
+	if publishAt != nil && unpublishAt != nil && !unpublishAt.After(*publishAt) {
+		return fmt.Errorf("invalid_schedule")
+	}
+
+	return nil
+}
+
+// SetPageSchedule sets the publishing window of a page. A nil time leaves
+// that end of the window open.
+func (service *DocService) SetPageSchedule(id uint, publishAt, unpublishAt *time.Time) error {
+	if err := validateSchedule(publishAt, unpublishAt); err != nil {
+		return err
+	}
+
+	var page models.Page
+	if err := service.DB.Select("id", "documentation_id").First(&page, id).Error; err != nil {
+		return fmt.Errorf("page_not_found")
+	}
+
+	if err := service.DB.Model(&page).Updates(map[string]interface{}{
+		"publish_at":   publishAt,
+		"unpublish_at": unpublishAt,
+	}).Error; err != nil {
+		return fmt.Errorf("failed_to_update_page")
+	}
+
+	return service.scheduleChanged(page.DocumentationID)
+}
+
+// SetPageGroupSchedule sets the publishing window of a page group, which
+// also hides every page and page group nested in it outside the window.
+func (service *DocService) SetPageGroupSchedule(id uint, publishAt, unpublishAt *time.Time) error {
+	if err := validateSchedule(publishAt, unpublishAt); err != nil {
+		return err
+	}
+
+	var pageGroup models.PageGroup
+	if err := service.DB.Select("id", "documentation_id").First(&pageGroup, id).Error; err != nil {
+		return fmt.Errorf("page_group_not_found")
+	}
+
+	if err := service.DB.Model(&pageGroup).Updates(map[string]interface{}{
+		"publish_at":   publishAt,
+		"unpublish_at": unpublishAt,
+	}).Error; err != nil {
+		return fmt.Errorf("failed_to_update_page_group")
+	}
+
+	return service.scheduleChanged(pageGroup.DocumentationID)
+}
+
+// scheduleChanged rebuilds a documentation whose publishing windows changed
+// and lets the scheduler pick up its new boundaries.
+func (service *DocService) scheduleChanged(docId uint) error {
+	service.notifyScheduler()
+
+	rootId, err := service.GetRootParentID(docId)
+	if err != nil {
+		return fmt.Errorf("failed_to_get_documentation_id")
+	}
+
+	if err := service.AddBuildTrigger(rootId, false); err != nil {
+		return fmt.Errorf("failed_to_update_write_build")
+	}
+
+	return nil
+}
+
+func (service *DocService) notifyScheduler() {
+	select {
+	case service.scheduleWake <- struct{}{}:
+	default:
+	}
+}
+
+// nextScheduleBoundary returns the earliest publish or unpublish time after
+// t, or nil when nothing is scheduled.
+func (service *DocService) nextScheduleBoundary(t time.Time) (*time.Time, error) {
+	var next *time.Time
+
+	for _, model := range []interface{}{&models.Page{}, &models.PageGroup{}} {
+		for _, column := range []string{"publish_at", "unpublish_at"} {
+			var times []time.Time
+			if err := service.DB.Model(model).Where(column+" > ?", t).
+				Order(column+" ASC").Limit(1).Pluck(column, &times).Error; err != nil {
+				return nil, err
+			}
+
+			if len(times) > 0 && (next == nil || times[0].Before(*next)) {
+				next = &times[0]
+			}
+		}
+	}
+
+	return next, nil
+}
+
+// triggerScheduledBuilds queues a build of every documentation with content
+// published or unpublished in (from, to].
+func (service *DocService) triggerScheduledBuilds(from, to time.Time) {
+	docIds := make(map[uint]struct{})
+
+	for _, model := range []interface{}{&models.Page{}, &models.PageGroup{}} {
+		var ids []uint
+		if err := service.DB.Model(model).Distinct("documentation_id").
+			Where("(publish_at > ? AND publish_at <= ?) OR (unpublish_at > ? AND unpublish_at <= ?)", from, to, from, to).
+			Pluck("documentation_id", &ids).Error; err != nil {
+			logger.Error("Failed to fetch scheduled content", zap.Error(err))
+			continue
+		}
+
+		for _, id := range ids {
+			rootId, err := service.GetRootParentID(id)
+			if err != nil {
+				continue
+			}
+			docIds[rootId] = struct{}{}
+		}
+	}
+
+	for docId := range docIds {
+		if err := service.AddBuildTrigger(docId, false); err != nil {
+			logger.Error("Failed to add scheduled build trigger", zap.Uint("doc_id", docId), zap.Error(err))
+			continue
+		}
+
+		logger.Info("Scheduled build queued", zap.Uint("doc_id", docId))
+	}
+}
+
+// StartPublishScheduler queues a build of a documentation as soon as one of
+// its pages or page groups is published or unpublished by its schedule.
+func (service *DocService) StartPublishScheduler(ctx context.Context) {
+	service.background.Go(func() {
+		last := time.Now()
+
+		for {
+			wait := scheduleIdleInterval
+
+			next, err := service.nextScheduleBoundary(last)
+			if err != nil {
+				logger.Error("Failed to fetch the next scheduled publication", zap.Error(err))
+			} else if next != nil && time.Until(*next) < wait {
+				wait = time.Until(*next)
+			}
+
+			// Schedules set on another instance only wake that instance, so
+			// look for new boundaries as often as the cluster syncs
+			if sync := time.Duration(config.ParsedConfig.Cluster.SyncInterval) * time.Second; clusterEnabled() && sync < wait {
+				wait = sync
+			}
+
+			timer := time.NewTimer(wait)
+
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-service.scheduleWake:
+				timer.Stop()
+			case <-timer.C:
+				last = service.runPublishSchedule(last, time.Now())
+			}
+		}
+	})
+}
+
+// runPublishSchedule queues the builds for the schedules that changed between
+// last and now when this instance is the leader. Every instance moves on to
+// now, so that followers wait for the next boundary instead of the one the
+// leader just handled.
+func (service *DocService) runPublishSchedule(last time.Time, now time.Time) time.Time {
+	if service.isLeader() {
+		service.triggerScheduledBuilds(last, now)
+	}
+
+	return now
+}
@@ -0,0 +1,168 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"git.difuse.io/Difuse/kalmia/config"
+	"git.difuse.io/Difuse/kalmia/db/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsPublished(t *testing.T) {
+	now := time.Now()
+	past := now.Add(-time.Hour)
+	future := now.Add(time.Hour)
+
+	tests := []struct {
+		name        string
+		publishAt   *time.Time
+		unpublishAt *time.Time
+		expected    bool
+	}{
+		{"No schedule", nil, nil, true},
+		{"Published", &past, nil, true},
+		{"Embargoed", &future, nil, false},
+		{"Published at now", &now, nil, true},
+		{"Expired", nil, &past, false},
+		{"Expires at now", nil, &now, false},
+		{"Inside window", &past, &future, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, isPublished(tt.publishAt, tt.unpublishAt, now))
+		})
+	}
+}
+
+func TestPublishSchedule(t *testing.T) {
+	require.NoError(t, TestDocService.DB.Model(&models.BuildTriggers{}).
+		Where("triggered = ?", false).Update("triggered", true).Error)
+
+	doc := models.Documentation{Name: "Schedule", Version: "1.0.0", BaseURL: "/schedule", AuthorID: 1}
+	require.NoError(t, TestDocService.DB.Create(&doc).Error)
+
+	launch := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+
+	page := models.Page{DocumentationID: doc.ID, Title: "Release notes", Slug: "/release-notes", AuthorID: 1, PublishAt: &launch}
+	require.NoError(t, TestDocService.CreatePage(&page))
+
+	group := models.PageGroup{DocumentationID: doc.ID, Name: "Launch", AuthorID: 1}
+	require.NoError(t, TestDocService.DB.Create(&group).Error)
+
+	pendingTriggers := func() int64 {
+		var count int64
+		TestDocService.DB.Model(&models.BuildTriggers{}).
+			Where("documentation_id = ? AND triggered = ?", doc.ID, false).Count(&count)
+		return count
+	}
+
+	t.Run("Invalid window", func(t *testing.T) {
+		before := launch.Add(-time.Hour)
+		assert.EqualError(t, TestDocService.SetPageSchedule(page.ID, &launch, &before), "invalid_schedule")
+		assert.EqualError(t, TestDocService.SetPageGroupSchedule(group.ID, &launch, &launch), "invalid_schedule")
+		assert.EqualError(t, TestDocService.SetPageSchedule(0, nil, nil), "page_not_found")
+	})
+
+	t.Run("Embargoed content is not written", func(t *testing.T) {
+		var pages []models.Page
+		require.NoError(t, TestDocService.DB.Where("documentation_id = ?", doc.ID).Find(&pages).Error)
+
+		assert.Empty(t, publishedPages(pages, time.Now()))
+		assert.Len(t, publishedPages(pages, launch), 1)
+	})
+
+	t.Run("Next boundary", func(t *testing.T) {
+		expiry := launch.Add(time.Hour)
+		require.NoError(t, TestDocService.SetPageGroupSchedule(group.ID, nil, &expiry))
+
+		next, err := TestDocService.nextScheduleBoundary(time.Now())
+		require.NoError(t, err)
+		require.NotNil(t, next)
+		assert.True(t, launch.Equal(*next), "expected %v, got %v", launch, *next)
+
+		next, err = TestDocService.nextScheduleBoundary(launch)
+		require.NoError(t, err)
+		require.NotNil(t, next)
+		assert.True(t, expiry.Equal(*next), "expected %v, got %v", expiry, *next)
+	})
+
+	t.Run("Build queued when the embargo lifts", func(t *testing.T) {
+		require.NoError(t, TestDocService.DB.Model(&models.BuildTriggers{}).
+			Where("documentation_id = ?", doc.ID).Update("triggered", true).Error)
+
+		TestDocService.triggerScheduledBuilds(time.Now(), launch.Add(-time.Second))
+		assert.Equal(t, int64(0), pendingTriggers())
+
+		TestDocService.triggerScheduledBuilds(time.Now(), launch)
+		assert.Equal(t, int64(1), pendingTriggers())
+	})
+
+	t.Run("Followers move past the boundary without queueing builds", func(t *testing.T) {
+		require.NoError(t, TestDocService.DB.Model(&models.BuildTriggers{}).
+			Where("documentation_id = ?", doc.ID).Update("triggered", true).Error)
+
+		enableCluster(t, "schedule-follower")
+		TestDocService.leader.Store(false)
+		defer TestDocService.leader.Store(false)
+
+		last := TestDocService.runPublishSchedule(launch.Add(-time.Second), launch)
+		assert.True(t, launch.Equal(last), "expected %v, got %v", launch, last)
+		assert.Equal(t, int64(0), pendingTriggers())
+
+		// The boundary just passed is not waited for again
+		next, err := TestDocService.nextScheduleBoundary(last)
+		require.NoError(t, err)
+		require.NotNil(t, next)
+		assert.True(t, next.After(launch), "expected a boundary after %v, got %v", launch, *next)
+
+		TestDocService.leader.Store(true)
+		TestDocService.runPublishSchedule(launch.Add(-time.Second), launch)
+		assert.Equal(t, int64(1), pendingTriggers())
+	})
+
+	t.Run("Leader picks up schedules set on other instances", func(t *testing.T) {
+		require.NoError(t, TestDocService.DB.Model(&models.BuildTriggers{}).
+			Where("documentation_id = ?", doc.ID).Update("triggered", true).Error)
+
+		enableCluster(t, "schedule-leader")
+		config.ParsedConfig.Cluster.SyncInterval = 1
+		TestDocService.leader.Store(true)
+		defer TestDocService.leader.Store(false)
+
+		// Drop the wake left behind by the schedules set above
+		select {
+		case <-TestDocService.scheduleWake:
+		default:
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		TestDocService.StartPublishScheduler(ctx)
+		// Let the scheduler go to sleep on the boundaries it already knows
+		time.Sleep(200 * time.Millisecond)
+
+		// Written straight to the database, as another instance would, so
+		// the scheduler of this instance is not woken up
+		publishAt := time.Now().Add(1500 * time.Millisecond)
+		remote := models.Page{DocumentationID: doc.ID, Title: "Remote", Slug: "/remote", AuthorID: 1, PublishAt: &publishAt}
+		require.NoError(t, TestDocService.DB.Create(&remote).Error)
+
+		assert.Eventually(t, func() bool { return pendingTriggers() == 1 }, 5*time.Second, 100*time.Millisecond)
+	})
+
+	t.Run("Version keeps the schedule", func(t *testing.T) {
+		require.NoError(t, TestDocService.CreateDocumentationVersion(doc.ID, "2.0.0"))
+
+		var versionPage models.Page
+		require.NoError(t, TestDocService.DB.
+			Joins("JOIN documentations ON documentations.id = pages.documentation_id").
+			Where("documentations.cloned_from = ? AND pages.slug = ?", doc.ID, page.Slug).
+			First(&versionPage).Error)
+		require.NotNil(t, versionPage.PublishAt)
+		assert.True(t, launch.Equal(*versionPage.PublishAt))
+	})
+}
@@ -0,0 +1,675 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"git.difuse.io/Difuse/kalmia/config"
+	"git.difuse.io/Difuse/kalmia/db"
+	"git.difuse.io/Difuse/kalmia/db/models"
+	"git.difuse.io/Difuse/kalmia/logger"
+	"git.difuse.io/Difuse/kalmia/utils"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// Objects of a release never change, they are uploaded under a new prefix
+// instead.
+const siteObjectCacheControl = "public, max-age=31536000, immutable"
+
+// siteBuildStamp records, in the folder of a documentation, the hash of the
+// build served from disk.
+const siteBuildStamp = ".build_hash"
+
+// SiteBuild is the build of a site being served. Its hash changes with any of
+// its files, so responses can be validated against it.
+type SiteBuild struct {
+	Hash    string
+	BuiltAt time.Time
+}
+
+// SitesInObjectStorage reports whether built sites are served from the S3
+// bucket rather than from the build folders on disk.
+func (service *DocService) SitesInObjectStorage() bool {
+	return config.ParsedConfig.SiteStorage.Type == "s3"
+}
+
+func siteStorageClient() (s3iface.S3API, error) {
+	cfg := config.ParsedConfig.S3
+
+	sess, err := session.NewSession(&aws.Config{
+		Endpoint:         aws.String(cfg.Endpoint),
+		Region:           aws.String(cfg.Region),
+		Credentials:      credentials.NewStaticCredentials(cfg.AccessKeyId, cfg.SecretAccessKey, ""),
+		S3ForcePathStyle: aws.Bool(cfg.UsePathStyle),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating AWS session: %v", err)
+	}
+
+	return newS3Client(sess), nil
+}
+
+func siteReleasePrefix(docId uint, createdAt time.Time) string {
+	return fmt.Sprintf("%s/doc_%d/%d", strings.Trim(config.ParsedConfig.SiteStorage.Prefix, "/"), docId, createdAt.UnixNano())
+}
+
+// publishSiteRelease uploads the build in buildPath as a new release of a
+// documentation and makes it the active one, unless it is the same as the
+// active release. It does nothing when sites are served from disk.
+func (service *DocService) publishSiteRelease(ctx context.Context, docId uint, buildPath string) error {
+	if !service.SitesInObjectStorage() {
+		return nil
+	}
+
+	hash, err := utils.DirHash(buildPath)
+	if err != nil {
+		return err
+	}
+
+	keep, activate := service.releaseBuild(ctx, docId, hash)
+	if !keep {
+		return nil
+	}
+
+	client, err := siteStorageClient()
+	if err != nil {
+		return err
+	}
+
+	recorder := buildRecorderFrom(ctx)
+	ctx = recorder.startPhase(ctx, BuildPhaseUpload)
+
+	release := models.SiteRelease{
+		DocumentationID: docId,
+		BuildRunID:      recorder.runID(),
+		Prefix:          siteReleasePrefix(docId, time.Now()),
+		Hash:            hash,
+	}
+
+	err = filepath.WalkDir(buildPath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(buildPath, path)
+		if err != nil {
+			return err
+		}
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		_, err = client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+			Bucket:        aws.String(config.ParsedConfig.S3.Bucket),
+			Key:           aws.String(release.Prefix + "/" + filepath.ToSlash(relPath)),
+			Body:          bytes.NewReader(content),
+			ContentLength: aws.Int64(int64(len(content))),
+			ContentType:   aws.String(utils.GetContentType(relPath)),
+			CacheControl:  aws.String(siteObjectCacheControl),
+		})
+		if err != nil {
+			return err
+		}
+
+		release.Files++
+		release.Size += int64(len(content))
+		return nil
+	})
+	if err != nil {
+		if err := deleteSiteObjects(client, release.Prefix); err != nil {
+			logger.Error("Failed to remove partially uploaded release", zap.String("prefix", release.Prefix), zap.Error(err))
+		}
+		return fmt.Errorf("failed to upload site: %w", err)
+	}
+
+	if err := service.DB.Create(&release).Error; err != nil {
+		return fmt.Errorf("failed to save site release: %w", err)
+	}
+
+	recorder.logf("Uploaded %d files to %s", release.Files, release.Prefix)
+
+	// The files being served here already are the ones of the new release
+	if !activate {
+		recorder.logf("The active site release is pinned, release %d was not activated", release.ID)
+	} else if err := service.setActiveSiteRelease(release, false); err != nil {
+		return err
+	}
+
+	if err := service.pruneSiteReleases(client, docId); err != nil {
+		logger.Error("Failed to remove old site releases", zap.Uint("doc_id", docId), zap.Error(err))
+	}
+
+	return nil
+}
+
+// releaseBuild decides what becomes of a build of a documentation whose
+// files hash to hash. It returns whether the build is kept as a new release,
+// and whether that release replaces the active one, which it does not while
+// the active release is pinned, unless the build was started by hand.
+func (service *DocService) releaseBuild(ctx context.Context, docId uint, hash string) (bool, bool) {
+	var active models.SiteRelease
+	if err := service.DB.Where("documentation_id = ? AND active = ?", docId, true).First(&active).Error; err != nil {
+		return true, true
+	}
+
+	if active.Hash == hash {
+		return false, false
+	}
+
+	if !active.Pinned || buildRecorderFrom(ctx).manual() {
+		return true, true
+	}
+
+	var latest models.SiteRelease
+	if err := service.DB.Where("documentation_id = ?", docId).Order("id DESC").First(&latest).Error; err == nil && latest.Hash == hash {
+		return false, false
+	}
+
+	return true, false
+}
+
+// localSiteReleasePrefix is where a release is kept, relative to the folder
+// of its documentation, when sites are served from disk.
+func localSiteReleasePrefix(createdAt time.Time) string {
+	return fmt.Sprintf("releases/%d", createdAt.UnixNano())
+}
+
+func localSiteReleasePath(release models.SiteRelease) string {
+	return filepath.Join(utils.GetDocPathByID(release.DocumentationID, config.ParsedConfig), filepath.FromSlash(release.Prefix))
+}
+
+// keepLocalSiteRelease moves the build in buildPath into a new release of a
+// documentation, kept on disk, and returns it.
+func (service *DocService) keepLocalSiteRelease(ctx context.Context, docId uint, buildPath string, hash string) (models.SiteRelease, error) {
+	release := models.SiteRelease{
+		DocumentationID: docId,
+		BuildRunID:      buildRecorderFrom(ctx).runID(),
+		Prefix:          localSiteReleasePrefix(time.Now()),
+		Hash:            hash,
+	}
+
+	releasePath := localSiteReleasePath(release)
+	if err := utils.MakeDir(filepath.Dir(releasePath)); err != nil {
+		return models.SiteRelease{}, err
+	}
+
+	if err := os.Rename(buildPath, releasePath); err != nil {
+		return models.SiteRelease{}, err
+	}
+
+	err := filepath.WalkDir(releasePath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return err
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		release.Files++
+		release.Size += info.Size()
+		return nil
+	})
+	if err == nil {
+		err = service.DB.Create(&release).Error
+	}
+	if err != nil {
+		utils.RemovePath(releasePath)
+		return models.SiteRelease{}, fmt.Errorf("failed to save site release: %w", err)
+	}
+
+	return release, nil
+}
+
+// recordSiteRelease keeps a copy of the build of a documentation served from
+// disk as its active release, unless it is the active release already.
+func (service *DocService) recordSiteRelease(ctx context.Context, docId uint, buildPath string) error {
+	hash, err := utils.DirHash(buildPath)
+	if err != nil {
+		return err
+	}
+
+	// Builds that do not replace a pinned release were kept by publishBuild
+	if keep, activate := service.releaseBuild(ctx, docId, hash); !keep || !activate {
+		return nil
+	}
+
+	docPath := utils.GetDocPathByID(docId, config.ParsedConfig)
+	copyPath := filepath.Join(docPath, "build_release")
+	if err := utils.RemovePath(copyPath); err != nil {
+		return err
+	}
+
+	if err := os.CopyFS(copyPath, os.DirFS(buildPath)); err != nil {
+		utils.RemovePath(copyPath)
+		return err
+	}
+
+	release, err := service.keepLocalSiteRelease(ctx, docId, copyPath, hash)
+	if err != nil {
+		utils.RemovePath(copyPath)
+		return err
+	}
+
+	if err := service.setActiveSiteRelease(release, false); err != nil {
+		return err
+	}
+
+	if err := service.pruneSiteReleases(nil, docId); err != nil {
+		logger.Error("Failed to remove old site releases", zap.Uint("doc_id", docId), zap.Error(err))
+	}
+
+	return nil
+}
+
+// restoreLocalSiteRelease serves a release kept on disk again, replacing the
+// files of the build being served that differ from its own.
+func (service *DocService) restoreLocalSiteRelease(release models.SiteRelease) error {
+	docId := release.DocumentationID
+
+	// A build of the documentation would replace the release right away
+	mutexI, _ := service.UWBMutexMap.LoadOrStore(fmt.Sprintf("update_write_build_%d", docId), &sync.Mutex{})
+	mutex := mutexI.(*sync.Mutex)
+	if !mutex.TryLock() {
+		return fmt.Errorf("build_in_progress")
+	}
+	defer mutex.Unlock()
+
+	// Releases are kept by the instance that built them
+	releasePath := localSiteReleasePath(release)
+	if !utils.PathExists(releasePath) {
+		return fmt.Errorf("site_release_not_found")
+	}
+
+	docPath := utils.GetDocPathByID(docId, config.ParsedConfig)
+	buildPath := filepath.Join(docPath, "build")
+	restorePath := filepath.Join(docPath, "build_restore")
+	if err := utils.RemovePath(restorePath); err != nil {
+		return err
+	}
+	defer utils.RemovePath(restorePath)
+
+	if err := os.CopyFS(restorePath, os.DirFS(releasePath)); err != nil {
+		return fmt.Errorf("failed to restore site release: %w", err)
+	}
+
+	changed, removed, err := utils.SyncDir(restorePath, buildPath)
+	if err != nil {
+		return fmt.Errorf("failed to restore site release: %w", err)
+	}
+
+	service.updateBuildCache(docId, changed, removed)
+
+	if err := service.setActiveSiteRelease(release, false); err != nil {
+		return err
+	}
+
+	return service.publishSite(docSiteName(docId), buildPath)
+}
+
+// setActiveSiteRelease points a documentation at release. The pointer is
+// swapped in a single statement, so every instance sees either the old
+// release or the new one.
+func (service *DocService) setActiveSiteRelease(release models.SiteRelease, clearCache bool) error {
+	if err := service.DB.Model(&models.SiteRelease{}).
+		Where("documentation_id = ?", release.DocumentationID).
+		Update("active", gorm.Expr("id = ?", release.ID)).Error; err != nil {
+		return fmt.Errorf("failed to activate site release: %w", err)
+	}
+
+	release.Active = true
+	service.siteReleases.Store(release.DocumentationID, release)
+
+	if clearCache {
+		db.Cache.DeletePrefix(fmt.Sprintf("rs|doc_%d|", release.DocumentationID))
+	}
+
+	return nil
+}
+
+func (service *DocService) activeSiteRelease(docId uint) (models.SiteRelease, error) {
+	if release, ok := service.siteReleases.Load(docId); ok {
+		return release.(models.SiteRelease), nil
+	}
+
+	var release models.SiteRelease
+	if err := service.DB.Where("documentation_id = ? AND active = ?", docId, true).First(&release).Error; err != nil {
+		return models.SiteRelease{}, fmt.Errorf("site_release_not_found")
+	}
+
+	service.siteReleases.Store(docId, release)
+	return release, nil
+}
+
+// pruneSiteReleases removes all but the latest releases of a documentation,
+// keeping the active one and the pinned ones. client is nil when sites are
+// served from disk.
+func (service *DocService) pruneSiteReleases(client s3iface.S3API, docId uint) error {
+	var releases []models.SiteRelease
+	if err := service.DB.Where("documentation_id = ? AND active = ? AND pinned = ?", docId, false, false).
+		Order("id DESC").Offset(config.ParsedConfig.SiteStorage.KeepReleases - 1).
+		Find(&releases).Error; err != nil {
+		return err
+	}
+
+	return service.removeSiteReleases(client, releases)
+}
+
+func (service *DocService) removeSiteReleases(client s3iface.S3API, releases []models.SiteRelease) error {
+	for _, release := range releases {
+		if client == nil {
+			if err := utils.RemovePath(localSiteReleasePath(release)); err != nil {
+				return err
+			}
+		} else if err := deleteSiteObjects(client, release.Prefix); err != nil {
+			return err
+		}
+
+		if err := service.DB.Delete(&release).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deleteSiteReleases removes every release of a deleted documentation.
+// Releases on disk go with the folder of the documentation.
+func (service *DocService) deleteSiteReleases(docId uint) error {
+	if !service.SitesInObjectStorage() {
+		service.siteReleases.Delete(docId)
+		return service.DB.Where("documentation_id = ?", docId).Delete(&models.SiteRelease{}).Error
+	}
+
+	var releases []models.SiteRelease
+	if err := service.DB.Where("documentation_id = ?", docId).Find(&releases).Error; err != nil {
+		return err
+	}
+
+	if len(releases) > 0 {
+		client, err := siteStorageClient()
+		if err != nil {
+			return err
+		}
+
+		if err := service.removeSiteReleases(client, releases); err != nil {
+			return err
+		}
+	}
+
+	service.siteReleases.Delete(docId)
+	return nil
+}
+
+func deleteSiteObjects(client s3iface.S3API, prefix string) error {
+	var deleteErr error
+
+	err := client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(config.ParsedConfig.S3.Bucket),
+		Prefix: aws.String(prefix + "/"),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		if len(page.Contents) == 0 {
+			return true
+		}
+
+		objects := make([]*s3.ObjectIdentifier, 0, len(page.Contents))
+		for _, object := range page.Contents {
+			objects = append(objects, &s3.ObjectIdentifier{Key: object.Key})
+		}
+
+		_, deleteErr = client.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: aws.String(config.ParsedConfig.S3.Bucket),
+			Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		return deleteErr == nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return deleteErr
+}
+
+// GetSiteFile returns a file of the site of a documentation from the cache,
+// loading it from its build folder on a miss, or from the S3 bucket when
+// sites are kept in one. Files that do not exist fall back to the index.html
+// of the site, and files too large for the cache are left to be served from
+// disk with db.ErrEntryTooLarge. When a CDN is in front of the bucket, it
+// returns the URL of the file on it instead, for every file but the pages
+// themselves, which have to stay under the base URL of the documentation.
+func (service *DocService) GetSiteFile(docId uint, filePath string) (db.CacheEntry, string, error) {
+	var release models.SiteRelease
+	if service.SitesInObjectStorage() {
+		var err error
+		if release, err = service.activeSiteRelease(docId); err != nil {
+			return db.CacheEntry{}, "", err
+		}
+
+		if cdnURL := config.ParsedConfig.SiteStorage.CdnURL; cdnURL != "" && filepath.Ext(filePath) != ".html" {
+			return db.CacheEntry{}, strings.TrimSuffix(cdnURL, "/") + "/" + release.Prefix + "/" + filePath, nil
+		}
+	}
+
+	buildPath := filepath.Join(utils.GetDocPathByID(docId, config.ParsedConfig), "build")
+
+	for _, candidate := range []string{filePath, "index.html"} {
+		cacheKey := fmt.Sprintf("rs|doc_%d|%s", docId, candidate)
+		contentType := utils.GetContentType(candidate)
+
+		var entry db.CacheEntry
+		var err error
+		if service.SitesInObjectStorage() {
+			entry, err = db.Cache.Load(cacheKey, func() ([]byte, string, error) {
+				content, err := getSiteObject(release.Prefix + "/" + candidate)
+				return content, contentType, err
+			})
+		} else {
+			entry, err = db.Cache.LoadFile(cacheKey, filepath.Join(buildPath, candidate), contentType)
+		}
+
+		if err == nil {
+			return entry, "", nil
+		}
+
+		if !siteFileMissing(err) {
+			return db.CacheEntry{}, "", err
+		}
+	}
+
+	return db.CacheEntry{}, "", fmt.Errorf("site_file_not_found")
+}
+
+// GetSiteBuild returns the build of the site of a documentation being
+// served, the active release when sites are kept in the S3 bucket.
+func (service *DocService) GetSiteBuild(docId uint) (SiteBuild, error) {
+	if service.SitesInObjectStorage() {
+		release, err := service.activeSiteRelease(docId)
+		if err != nil {
+			return SiteBuild{}, err
+		}
+
+		build := SiteBuild{Hash: release.Hash}
+		if release.CreatedAt != nil {
+			build.BuiltAt = *release.CreatedAt
+		}
+		return build, nil
+	}
+
+	if build, ok := service.siteBuilds.Load(docId); ok {
+		return build.(SiteBuild), nil
+	}
+
+	stampPath := filepath.Join(utils.GetDocPathByID(docId, config.ParsedConfig), siteBuildStamp)
+	if hash, err := os.ReadFile(stampPath); err == nil {
+		if info, err := os.Stat(stampPath); err == nil {
+			build := SiteBuild{Hash: string(hash), BuiltAt: info.ModTime()}
+			service.siteBuilds.Store(docId, build)
+			return build, nil
+		}
+	}
+
+	// Built before builds were recorded
+	return service.markSiteBuild(docId)
+}
+
+// markSiteBuild records the hash of the build of a documentation served from
+// disk, once its files were replaced.
+func (service *DocService) markSiteBuild(docId uint) (SiteBuild, error) {
+	docPath := utils.GetDocPathByID(docId, config.ParsedConfig)
+
+	hash, err := utils.DirHash(filepath.Join(docPath, "build"))
+	if err != nil {
+		service.forgetSiteBuild(docId)
+		return SiteBuild{}, err
+	}
+
+	if err := utils.WriteToFile(filepath.Join(docPath, siteBuildStamp), hash); err != nil {
+		service.forgetSiteBuild(docId)
+		return SiteBuild{}, err
+	}
+
+	build := SiteBuild{Hash: hash, BuiltAt: time.Now()}
+	service.siteBuilds.Store(docId, build)
+	return build, nil
+}
+
+func (service *DocService) forgetSiteBuild(docId uint) {
+	service.siteBuilds.Delete(docId)
+	os.Remove(filepath.Join(utils.GetDocPathByID(docId, config.ParsedConfig), siteBuildStamp))
+}
+
+func siteFileMissing(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == s3.ErrCodeNoSuchKey
+	}
+
+	return errors.Is(err, fs.ErrNotExist)
+}
+
+func getSiteObject(key string) ([]byte, error) {
+	client, err := siteStorageClient()
+	if err != nil {
+		return nil, err
+	}
+
+	object, err := client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(config.ParsedConfig.S3.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer object.Body.Close()
+
+	return io.ReadAll(object.Body)
+}
+
+func (service *DocService) GetSiteReleases(docId uint) ([]models.SiteRelease, error) {
+	rootId, err := service.GetRootParentID(docId)
+	if err != nil {
+		return nil, fmt.Errorf("documentation_not_found")
+	}
+
+	var releases []models.SiteRelease
+	if err := service.DB.Where("documentation_id = ?", rootId).Order("id DESC").Find(&releases).Error; err != nil {
+		return nil, fmt.Errorf("failed_to_get_site_releases")
+	}
+
+	return releases, nil
+}
+
+// ActivateSiteRelease rolls the site of a documentation back, or forward, to
+// one of its releases. The next build that changes the site replaces it,
+// unless the release is pinned.
+func (service *DocService) ActivateSiteRelease(docId uint, releaseId uint) error {
+	rootId, err := service.GetRootParentID(docId)
+	if err != nil {
+		return fmt.Errorf("documentation_not_found")
+	}
+
+	var release models.SiteRelease
+	if err := service.DB.Where("id = ? AND documentation_id = ?", releaseId, rootId).First(&release).Error; err != nil {
+		return fmt.Errorf("site_release_not_found")
+	}
+
+	if !service.SitesInObjectStorage() {
+		return service.restoreLocalSiteRelease(release)
+	}
+
+	return service.setActiveSiteRelease(release, true)
+}
+
+// PinSiteRelease pins or unpins a release of a documentation.
+func (service *DocService) PinSiteRelease(docId uint, releaseId uint, pinned bool) error {
+	rootId, err := service.GetRootParentID(docId)
+	if err != nil {
+		return fmt.Errorf("documentation_not_found")
+	}
+
+	result := service.DB.Model(&models.SiteRelease{}).
+		Where("id = ? AND documentation_id = ?", releaseId, rootId).
+		Update("pinned", pinned)
+	if result.Error != nil {
+		return fmt.Errorf("failed_to_pin_site_release")
+	}
+
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("site_release_not_found")
+	}
+
+	return nil
+}
+
+// syncSiteReleases drops the cached files of the documentations whose active
+// release was changed by another instance.
+func (service *DocService) syncSiteReleases() {
+	var releases []models.SiteRelease
+	if err := service.DB.Where("active = ?", true).Find(&releases).Error; err != nil {
+		logger.Error("Failed to fetch active site releases", zap.Error(err))
+		return
+	}
+
+	active := make(map[uint]bool, len(releases))
+	for _, release := range releases {
+		active[release.DocumentationID] = true
+
+		if known, ok := service.siteReleases.Load(release.DocumentationID); ok && known.(models.SiteRelease).ID == release.ID {
+			continue
+		}
+
+		service.siteReleases.Store(release.DocumentationID, release)
+		db.Cache.DeletePrefix(fmt.Sprintf("rs|doc_%d|", release.DocumentationID))
+	}
+
+	service.siteReleases.Range(func(key, value interface{}) bool {
+		if docId := key.(uint); !active[docId] {
+			service.siteReleases.Delete(docId)
+			db.Cache.DeletePrefix(fmt.Sprintf("rs|doc_%d|", docId))
+			db.Cache.DeletePrefix(fmt.Sprintf("burl|doc_%d|", docId))
+		}
+		return true
+	})
+}
@@ -0,0 +1,398 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"git.difuse.io/Difuse/kalmia/config"
+	"git.difuse.io/Difuse/kalmia/db"
+	"git.difuse.io/Difuse/kalmia/db/models"
+	"git.difuse.io/Difuse/kalmia/utils"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryS3 is a bucket kept in memory, with the calls site storage makes.
+type memoryS3 struct {
+	s3iface.S3API
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (m *memoryS3) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	content, err := io.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[*input.Key] = content
+
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (m *memoryS3) PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	return m.PutObject(input)
+}
+
+func (m *memoryS3) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	content, ok := m.objects[*input.Key]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "not found", nil)
+	}
+
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(content))}, nil
+}
+
+func (m *memoryS3) ListObjectsV2Pages(input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool) error {
+	m.mu.Lock()
+	page := &s3.ListObjectsV2Output{}
+	for key := range m.objects {
+		if strings.HasPrefix(key, *input.Prefix) {
+			page.Contents = append(page.Contents, &s3.Object{Key: aws.String(key)})
+		}
+	}
+	m.mu.Unlock()
+
+	fn(page, true)
+	return nil
+}
+
+func (m *memoryS3) DeleteObjects(input *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, object := range input.Delete.Objects {
+		delete(m.objects, *object.Key)
+	}
+
+	return &s3.DeleteObjectsOutput{}, nil
+}
+
+func (m *memoryS3) keys(prefix string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var keys []string
+	for key := range m.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// useSiteStorage serves sites from an in-memory bucket for the rest of a
+// test.
+func useSiteStorage(t *testing.T) *memoryS3 {
+	siteStorage := config.ParsedConfig.SiteStorage
+	originalNewS3Client := newS3Client
+
+	bucket := &memoryS3{objects: map[string][]byte{}}
+	newS3Client = func(sess *session.Session) s3iface.S3API {
+		return bucket
+	}
+
+	config.ParsedConfig.SiteStorage = config.SiteStorage{Type: "s3", Prefix: "sites", KeepReleases: 2}
+
+	t.Cleanup(func() {
+		config.ParsedConfig.SiteStorage = siteStorage
+		newS3Client = originalNewS3Client
+	})
+
+	return bucket
+}
+
+func TestSiteReleases(t *testing.T) {
+	bucket := useSiteStorage(t)
+
+	doc := models.Documentation{Name: "Site Releases", Version: "1.0.0", BaseURL: "/site-releases", AuthorID: 1}
+	require.NoError(t, TestDocService.DB.Create(&doc).Error)
+
+	buildPath := filepath.Join(utils.GetDocPathByID(doc.ID, config.ParsedConfig), "build")
+	require.NoError(t, utils.MakeDir(filepath.Join(buildPath, "static")))
+	require.NoError(t, os.WriteFile(filepath.Join(buildPath, "static", "main.js"), []byte("js"), 0644))
+
+	writeHome := func(content string) {
+		require.NoError(t, os.WriteFile(filepath.Join(buildPath, "index.html"), []byte(content), 0644))
+	}
+
+	clearSiteCache := func() {
+		db.Cache.DeletePrefix("rs|" + docSiteName(doc.ID) + "|")
+	}
+
+	writeHome("first")
+	require.NoError(t, TestDocService.publishSiteRelease(t.Context(), doc.ID, buildPath))
+
+	first, err := TestDocService.activeSiteRelease(doc.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 2, first.Files)
+	assert.Len(t, bucket.keys(first.Prefix+"/"), 2)
+
+	t.Run("Unchanged builds are not uploaded again", func(t *testing.T) {
+		require.NoError(t, TestDocService.publishSiteRelease(t.Context(), doc.ID, buildPath))
+
+		releases, err := TestDocService.GetSiteReleases(doc.ID)
+		require.NoError(t, err)
+		assert.Len(t, releases, 1)
+	})
+
+	t.Run("Files are served from the active release", func(t *testing.T) {
+		writeHome("second")
+		require.NoError(t, TestDocService.publishSiteRelease(t.Context(), doc.ID, buildPath))
+		clearSiteCache()
+
+		entry, redirectURL, err := TestDocService.GetSiteFile(doc.ID, "index.html")
+		require.NoError(t, err)
+		assert.Empty(t, redirectURL)
+		assert.Equal(t, "second", string(entry.Data))
+
+		entry, _, err = TestDocService.GetSiteFile(doc.ID, "guide/index.html")
+		require.NoError(t, err)
+		assert.Equal(t, "second", string(entry.Data), "unknown pages fall back to index.html")
+
+		_, cached := db.Cache.Get("rs|" + docSiteName(doc.ID) + "|guide/index.html")
+		assert.False(t, cached, "fallbacks are not cached under the requested path")
+	})
+
+	t.Run("Older releases can be activated again", func(t *testing.T) {
+		require.NoError(t, TestDocService.ActivateSiteRelease(doc.ID, first.ID))
+
+		entry, _, err := TestDocService.GetSiteFile(doc.ID, "index.html")
+		require.NoError(t, err)
+		assert.Equal(t, "first", string(entry.Data))
+
+		var active int64
+		TestDocService.DB.Model(&models.SiteRelease{}).Where("documentation_id = ? AND active = ?", doc.ID, true).Count(&active)
+		assert.Equal(t, int64(1), active)
+
+		assert.Error(t, TestDocService.ActivateSiteRelease(doc.ID, first.ID+1000))
+	})
+
+	t.Run("Assets are redirected to the CDN", func(t *testing.T) {
+		config.ParsedConfig.SiteStorage.CdnURL = "https://cdn.example.com/"
+		defer func() { config.ParsedConfig.SiteStorage.CdnURL = "" }()
+
+		_, redirectURL, err := TestDocService.GetSiteFile(doc.ID, "static/main.js")
+		require.NoError(t, err)
+		assert.Equal(t, "https://cdn.example.com/"+first.Prefix+"/static/main.js", redirectURL)
+
+		_, redirectURL, err = TestDocService.GetSiteFile(doc.ID, "index.html")
+		require.NoError(t, err)
+		assert.Empty(t, redirectURL, "pages stay under the base URL")
+	})
+
+	t.Run("Old releases are removed", func(t *testing.T) {
+		writeHome("third")
+		require.NoError(t, TestDocService.publishSiteRelease(t.Context(), doc.ID, buildPath))
+
+		releases, err := TestDocService.GetSiteReleases(doc.ID)
+		require.NoError(t, err)
+		require.Len(t, releases, 2)
+		assert.True(t, releases[0].Active)
+		assert.NotEqual(t, first.ID, releases[1].ID)
+		assert.Empty(t, bucket.keys(first.Prefix+"/"))
+		assert.Len(t, bucket.keys("sites/"+docSiteName(doc.ID)+"/"), 4)
+	})
+
+	t.Run("Releases of deleted documentations are removed", func(t *testing.T) {
+		require.NoError(t, TestDocService.deleteSiteReleases(doc.ID))
+
+		assert.Empty(t, bucket.keys("sites/"+docSiteName(doc.ID)+"/"))
+		_, err := TestDocService.activeSiteRelease(doc.ID)
+		assert.Error(t, err)
+	})
+}
+
+func TestLocalSiteReleases(t *testing.T) {
+	keepReleases := config.ParsedConfig.SiteStorage.KeepReleases
+	config.ParsedConfig.SiteStorage.KeepReleases = 3
+	t.Cleanup(func() { config.ParsedConfig.SiteStorage.KeepReleases = keepReleases })
+
+	doc := models.Documentation{Name: "Local Site Releases", Version: "1.0.0", BaseURL: "/local-site-releases", AuthorID: 1}
+	require.NoError(t, TestDocService.DB.Create(&doc).Error)
+
+	docPath := utils.GetDocPathByID(doc.ID, config.ParsedConfig)
+	buildPath := filepath.Join(docPath, "build")
+
+	// build writes a site the way the generators do and publishes it the
+	// way UpdateWriteBuild does
+	build := func(ctx context.Context, content string) {
+		tmpBuildPath := filepath.Join(docPath, "build_tmp")
+		require.NoError(t, utils.MakeDir(tmpBuildPath))
+		require.NoError(t, os.WriteFile(filepath.Join(tmpBuildPath, "index.html"), []byte(content), 0644))
+
+		require.NoError(t, TestDocService.publishBuild(ctx, doc.ID))
+		require.NoError(t, TestDocService.recordSiteRelease(ctx, doc.ID, buildPath))
+	}
+
+	served := func() string {
+		entry, _, err := TestDocService.GetSiteFile(doc.ID, "index.html")
+		require.NoError(t, err)
+		return string(entry.Data)
+	}
+
+	releases := func() []models.SiteRelease {
+		releases, err := TestDocService.GetSiteReleases(doc.ID)
+		require.NoError(t, err)
+		return releases
+	}
+
+	build(t.Context(), "first")
+	build(t.Context(), "first")
+	require.Len(t, releases(), 1, "unchanged builds are not kept again")
+	first := releases()[0]
+	assert.True(t, first.Active)
+	assert.FileExists(t, filepath.Join(docPath, first.Prefix, "index.html"))
+
+	build(t.Context(), "second")
+	assert.Equal(t, "second", served())
+
+	t.Run("Older builds can be activated again", func(t *testing.T) {
+		siteBuild, err := TestDocService.GetSiteBuild(doc.ID)
+		require.NoError(t, err)
+
+		require.NoError(t, TestDocService.ActivateSiteRelease(doc.ID, first.ID))
+		assert.Equal(t, "first", served())
+		assert.FileExists(t, filepath.Join(docPath, first.Prefix, "index.html"), "releases are kept when activated")
+
+		restored, err := TestDocService.GetSiteBuild(doc.ID)
+		require.NoError(t, err)
+		assert.NotEqual(t, siteBuild.Hash, restored.Hash)
+		assert.Equal(t, first.Hash, restored.Hash)
+
+		current := releases()
+		assert.Len(t, current, 2)
+		assert.True(t, current[1].Active)
+		assert.False(t, current[0].Active)
+	})
+
+	t.Run("Builds do not replace a pinned release", func(t *testing.T) {
+		require.NoError(t, TestDocService.PinSiteRelease(doc.ID, first.ID, true))
+
+		build(t.Context(), "third")
+		assert.Equal(t, "first", served())
+
+		current := releases()
+		require.Len(t, current, 3)
+		assert.False(t, current[0].Active)
+		assert.FileExists(t, filepath.Join(docPath, current[0].Prefix, "index.html"), "held builds are kept as releases")
+
+		build(t.Context(), "third")
+		assert.Len(t, releases(), 3, "held builds are not kept twice")
+
+		assert.Error(t, TestDocService.PinSiteRelease(doc.ID, first.ID+1000, true))
+	})
+
+	t.Run("Builds started by hand replace a pinned release", func(t *testing.T) {
+		recorder := &buildRecorder{service: TestDocService, run: &models.BuildRun{Manual: true}}
+		build(withBuildRecorder(t.Context(), recorder), "fourth")
+		assert.Equal(t, "fourth", served())
+	})
+
+	t.Run("Old releases are removed, pinned ones are kept", func(t *testing.T) {
+		build(t.Context(), "fifth")
+
+		// The latest 3 and the pinned one
+		current := releases()
+		require.Len(t, current, 4)
+		assert.True(t, current[0].Active)
+		assert.Equal(t, first.ID, current[3].ID)
+		assert.True(t, current[3].Pinned)
+
+		entries, err := os.ReadDir(filepath.Join(docPath, "releases"))
+		require.NoError(t, err)
+		assert.Len(t, entries, 4)
+	})
+
+	t.Run("Releases of deleted documentations are removed", func(t *testing.T) {
+		require.NoError(t, TestDocService.deleteSiteReleases(doc.ID))
+		assert.Empty(t, releases())
+	})
+}
+
+func TestSiteFilesFromDisk(t *testing.T) {
+	doc := models.Documentation{Name: "Site Files", Version: "1.0.0", BaseURL: "/site-files", AuthorID: 1}
+	require.NoError(t, TestDocService.DB.Create(&doc).Error)
+
+	buildPath := filepath.Join(utils.GetDocPathByID(doc.ID, config.ParsedConfig), "build")
+	require.NoError(t, utils.MakeDir(buildPath))
+	require.NoError(t, os.WriteFile(filepath.Join(buildPath, "index.html"), []byte("home"), 0644))
+
+	cacheKey := "rs|" + docSiteName(doc.ID) + "|index.html"
+
+	t.Run("Files are loaded into the cache when first requested", func(t *testing.T) {
+		_, cached := db.Cache.Get(cacheKey)
+		assert.False(t, cached)
+
+		entry, _, err := TestDocService.GetSiteFile(doc.ID, "index.html")
+		require.NoError(t, err)
+		assert.Equal(t, "home", string(entry.Data))
+		assert.Equal(t, "text/html", entry.ContentType)
+
+		_, cached = db.Cache.Get(cacheKey)
+		assert.True(t, cached)
+	})
+
+	t.Run("Files changed by a build are loaded again", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(filepath.Join(buildPath, "index.html"), []byte("rebuilt"), 0644))
+		TestDocService.updateBuildCache(doc.ID, []string{"index.html"}, nil)
+
+		entry, _, err := TestDocService.GetSiteFile(doc.ID, "index.html")
+		require.NoError(t, err)
+		assert.Equal(t, "rebuilt", string(entry.Data))
+	})
+
+	t.Run("Missing files fall back to index.html", func(t *testing.T) {
+		entry, _, err := TestDocService.GetSiteFile(doc.ID, "guides/missing.html")
+		require.NoError(t, err)
+		assert.Equal(t, "rebuilt", string(entry.Data))
+	})
+
+	t.Run("Builds get a new hash when their files change", func(t *testing.T) {
+		before, err := TestDocService.GetSiteBuild(doc.ID)
+		require.NoError(t, err)
+		assert.NotEmpty(t, before.Hash)
+
+		same, err := TestDocService.GetSiteBuild(doc.ID)
+		require.NoError(t, err)
+		assert.Equal(t, before.Hash, same.Hash)
+
+		require.NoError(t, os.WriteFile(filepath.Join(buildPath, "index.html"), []byte("rebuilt again"), 0644))
+		TestDocService.updateBuildCache(doc.ID, []string{"index.html"}, nil)
+
+		after, err := TestDocService.GetSiteBuild(doc.ID)
+		require.NoError(t, err)
+		assert.NotEqual(t, before.Hash, after.Hash)
+
+		// The hash outlives a restart
+		TestDocService.siteBuilds.Delete(doc.ID)
+		restarted, err := TestDocService.GetSiteBuild(doc.ID)
+		require.NoError(t, err)
+		assert.Equal(t, after.Hash, restarted.Hash)
+	})
+
+	t.Run("Files too large for the cache are left to be served from disk", func(t *testing.T) {
+		large := make([]byte, TestConfig.Cache.MaxEntrySize<<20+1)
+		require.NoError(t, os.WriteFile(filepath.Join(buildPath, "video.mp4"), large, 0644))
+
+		_, _, err := TestDocService.GetSiteFile(doc.ID, "video.mp4")
+		assert.ErrorIs(t, err, db.ErrEntryTooLarge)
+	})
+}
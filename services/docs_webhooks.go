@@ -0,0 +1,504 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.difuse.io/Difuse/kalmia/db/models"
+	"git.difuse.io/Difuse/kalmia/logger"
+	"git.difuse.io/Difuse/kalmia/secrets"
+	"git.difuse.io/Difuse/kalmia/utils"
+	"go.uber.org/zap"
+)
+
+const (
+	WebhookEventPing           = "ping"
+	WebhookEventPageCreated    = "page.created"
+	WebhookEventPageUpdated    = "page.updated"
+	WebhookEventPageDeleted    = "page.deleted"
+	WebhookEventVersionCreated = "version.created"
+	WebhookEventBuildSucceeded = "build.succeeded"
+	WebhookEventBuildFailed    = "build.failed"
+	WebhookEventGitDeployed    = "git.deployed"
+)
+
+var webhookEvents = []string{
+	WebhookEventPageCreated,
+	WebhookEventPageUpdated,
+	WebhookEventPageDeleted,
+	WebhookEventVersionCreated,
+	WebhookEventBuildSucceeded,
+	WebhookEventBuildFailed,
+	WebhookEventGitDeployed,
+}
+
+const (
+	webhookMaxAttempts    = 6
+	webhookResponseLimit  = 2048
+	webhookDeliveriesKept = 100
+	webhookPollInterval   = 5 * time.Second
+)
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+type WebhookPayload struct {
+	Event           string      `json:"event"`
+	DocumentationID uint        `json:"documentationId"`
+	Timestamp       time.Time   `json:"timestamp"`
+	Data            interface{} `json:"data"`
+}
+
+// webhookBackoff is the wait before retrying a delivery that failed
+// attempts times: 30s, 1m, 2m, 4m and so on, up to an hour.
+func webhookBackoff(attempts int) time.Duration {
+	backoff := 30 * time.Second
+	for i := 1; i < attempts && backoff < time.Hour; i++ {
+		backoff *= 2
+	}
+
+	if backoff > time.Hour {
+		backoff = time.Hour
+	}
+
+	return backoff
+}
+
+func normalizeWebhookEvents(events []string) (string, error) {
+	if len(events) == 0 {
+		return "*", nil
+	}
+
+	for _, event := range events {
+		if event == "*" {
+			return "*", nil
+		}
+
+		if !utils.ArrayContains(webhookEvents, event) {
+			return "", fmt.Errorf("invalid_webhook_event")
+		}
+	}
+
+	return strings.Join(events, ","), nil
+}
+
+func webhookWantsEvent(webhook models.Webhook, event string) bool {
+	if event == WebhookEventPing || webhook.Events == "*" || webhook.Events == "" {
+		return true
+	}
+
+	return utils.ArrayContains(strings.Split(webhook.Events, ","), event)
+}
+
+func pageWebhookData(page models.Page) map[string]interface{} {
+	return map[string]interface{}{
+		"pageId":      page.ID,
+		"title":       page.Title,
+		"slug":        page.Slug,
+		"pageGroupId": page.PageGroupID,
+	}
+}
+
+func validateWebhookURL(webhookURL string) error {
+	parsed, err := url.Parse(webhookURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("invalid_webhook_url")
+	}
+
+	return nil
+}
+
+func (service *DocService) GetWebhooks(docId *uint) ([]models.Webhook, error) {
+	var webhooks []models.Webhook
+
+	// The secret is never read back, only whether it is set
+	query := service.DB.Select("ID", "DocumentationID", "URL", "Events", "Enabled", "AuthorID", "CreatedAt", "UpdatedAt",
+		"COALESCE(secret, '') <> '' AS secret_set").Order("id ASC")
+	if docId != nil {
+		query = query.Where("documentation_id = ?", *docId)
+	} else {
+		query = query.Where("documentation_id IS NULL")
+	}
+
+	if err := query.Find(&webhooks).Error; err != nil {
+		return nil, fmt.Errorf("failed_to_get_webhooks")
+	}
+
+	return webhooks, nil
+}
+
+func (service *DocService) CreateWebhook(user models.User, docId *uint, webhookURL, secret string, events []string) (models.Webhook, error) {
+	if err := validateWebhookURL(webhookURL); err != nil {
+		return models.Webhook{}, err
+	}
+
+	if docId != nil {
+		rootId, err := service.GetRootParentID(*docId)
+		if err != nil {
+			return models.Webhook{}, fmt.Errorf("documentation_not_found")
+		}
+		docId = &rootId
+	}
+
+	eventList, err := normalizeWebhookEvents(events)
+	if err != nil {
+		return models.Webhook{}, err
+	}
+
+	encryptedSecret, err := secrets.Encrypt(secret)
+	if err != nil {
+		return models.Webhook{}, fmt.Errorf("failed_to_encrypt_webhook_secret")
+	}
+
+	webhook := models.Webhook{
+		DocumentationID: docId,
+		URL:             webhookURL,
+		Secret:          encryptedSecret,
+		SecretSet:       secret != "",
+		Events:          eventList,
+		Enabled:         true,
+		AuthorID:        user.ID,
+	}
+
+	if err := service.DB.Create(&webhook).Error; err != nil {
+		return models.Webhook{}, fmt.Errorf("failed_to_create_webhook")
+	}
+
+	return webhook, nil
+}
+
+// EditWebhook updates a webhook. An empty secret keeps the stored one.
+func (service *DocService) EditWebhook(id uint, webhookURL, secret string, events []string, enabled bool) error {
+	var webhook models.Webhook
+	if err := service.DB.First(&webhook, id).Error; err != nil {
+		return fmt.Errorf("webhook_not_found")
+	}
+
+	if err := validateWebhookURL(webhookURL); err != nil {
+		return err
+	}
+
+	eventList, err := normalizeWebhookEvents(events)
+	if err != nil {
+		return err
+	}
+
+	updates := map[string]interface{}{
+		"url":     webhookURL,
+		"events":  eventList,
+		"enabled": enabled,
+	}
+
+	if secret != "" {
+		encryptedSecret, err := secrets.Encrypt(secret)
+		if err != nil {
+			return fmt.Errorf("failed_to_encrypt_webhook_secret")
+		}
+		updates["secret"] = encryptedSecret
+	}
+
+	if err := service.DB.Model(&webhook).Updates(updates).Error; err != nil {
+		return fmt.Errorf("failed_to_update_webhook")
+	}
+
+	return nil
+}
+
+func (service *DocService) DeleteWebhook(id uint) error {
+	if err := service.DB.Where("webhook_id = ?", id).Delete(&models.WebhookDelivery{}).Error; err != nil {
+		return fmt.Errorf("failed_to_delete_webhook")
+	}
+
+	result := service.DB.Delete(&models.Webhook{}, id)
+	if result.Error != nil {
+		return fmt.Errorf("failed_to_delete_webhook")
+	}
+
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("webhook_not_found")
+	}
+
+	return nil
+}
+
+func (service *DocService) GetWebhookDeliveries(webhookId uint) ([]models.WebhookDelivery, error) {
+	var deliveries []models.WebhookDelivery
+	if err := service.DB.Where("webhook_id = ?", webhookId).
+		Order("id DESC").Limit(webhookDeliveriesKept).Find(&deliveries).Error; err != nil {
+		return nil, fmt.Errorf("failed_to_get_webhook_deliveries")
+	}
+
+	return deliveries, nil
+}
+
+func (service *DocService) queueWebhookDelivery(webhook models.Webhook, event string, payload []byte) error {
+	delivery := models.WebhookDelivery{
+		WebhookID:     webhook.ID,
+		Event:         event,
+		Payload:       string(payload),
+		Status:        models.WebhookDeliveryPending,
+		NextAttemptAt: utils.TimePtr(time.Now()),
+	}
+
+	return service.DB.Create(&delivery).Error
+}
+
+// EmitWebhookEvent queues a delivery of event to every enabled webhook of
+// the documentation (or of its root documentation) and every global webhook
+// subscribed to it.
+func (service *DocService) EmitWebhookEvent(docId uint, event string, data interface{}) {
+	rootId, err := service.GetRootParentID(docId)
+	if err != nil {
+		rootId = docId
+	}
+
+	var webhooks []models.Webhook
+	if err := service.DB.Where("enabled = ? AND (documentation_id = ? OR documentation_id IS NULL)", true, rootId).
+		Find(&webhooks).Error; err != nil {
+		logger.Error("Failed to fetch webhooks", zap.Uint("doc_id", docId), zap.Error(err))
+		return
+	}
+
+	payload, err := json.Marshal(WebhookPayload{
+		Event:           event,
+		DocumentationID: docId,
+		Timestamp:       time.Now().UTC(),
+		Data:            data,
+	})
+	if err != nil {
+		logger.Error("Failed to encode webhook payload", zap.String("event", event), zap.Error(err))
+		return
+	}
+
+	queued := false
+	for _, webhook := range webhooks {
+		if !webhookWantsEvent(webhook, event) {
+			continue
+		}
+
+		if err := service.queueWebhookDelivery(webhook, event, payload); err != nil {
+			logger.Error("Failed to queue webhook delivery", zap.Uint("webhook_id", webhook.ID), zap.Error(err))
+			continue
+		}
+		queued = true
+	}
+
+	if queued {
+		service.notifyWebhooks()
+	}
+}
+
+// PingWebhook queues a ping delivery to a webhook, to check that it is set up
+// correctly.
+func (service *DocService) PingWebhook(id uint) error {
+	var webhook models.Webhook
+	if err := service.DB.First(&webhook, id).Error; err != nil {
+		return fmt.Errorf("webhook_not_found")
+	}
+
+	var docId uint
+	if webhook.DocumentationID != nil {
+		docId = *webhook.DocumentationID
+	}
+
+	payload, err := json.Marshal(WebhookPayload{
+		Event:           WebhookEventPing,
+		DocumentationID: docId,
+		Timestamp:       time.Now().UTC(),
+		Data:            map[string]interface{}{"webhookId": webhook.ID},
+	})
+	if err != nil {
+		return fmt.Errorf("failed_to_encode_webhook_payload")
+	}
+
+	if err := service.queueWebhookDelivery(webhook, WebhookEventPing, payload); err != nil {
+		return fmt.Errorf("failed_to_queue_webhook_delivery")
+	}
+
+	service.notifyWebhooks()
+
+	return nil
+}
+
+// RedeliverWebhook queues a new delivery with the payload of an earlier one.
+func (service *DocService) RedeliverWebhook(deliveryId uint) error {
+	var delivery models.WebhookDelivery
+	if err := service.DB.First(&delivery, deliveryId).Error; err != nil {
+		return fmt.Errorf("webhook_delivery_not_found")
+	}
+
+	var webhook models.Webhook
+	if err := service.DB.First(&webhook, delivery.WebhookID).Error; err != nil {
+		return fmt.Errorf("webhook_not_found")
+	}
+
+	if err := service.queueWebhookDelivery(webhook, delivery.Event, []byte(delivery.Payload)); err != nil {
+		return fmt.Errorf("failed_to_queue_webhook_delivery")
+	}
+
+	service.notifyWebhooks()
+
+	return nil
+}
+
+func (service *DocService) notifyWebhooks() {
+	select {
+	case service.webhookWake <- struct{}{}:
+	default:
+	}
+}
+
+// StartWebhookDispatcher sends queued webhook deliveries in the background,
+// until ctx is done.
+func (service *DocService) StartWebhookDispatcher(ctx context.Context) {
+	service.background.Go(func() {
+		for {
+			service.DeliverWebhooks()
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-service.webhookWake:
+			case <-time.After(webhookPollInterval):
+			}
+		}
+	})
+}
+
+// DeliverWebhooks attempts every delivery that is due. In cluster mode
+// deliveries are only attempted by the leader, so that they are sent once.
+func (service *DocService) DeliverWebhooks() {
+	if !service.isLeader() {
+		return
+	}
+
+	var deliveries []models.WebhookDelivery
+	if err := service.DB.Where("status = ? AND next_attempt_at <= ?", models.WebhookDeliveryPending, time.Now()).
+		Order("id ASC").Find(&deliveries).Error; err != nil {
+		logger.Error("Failed to fetch webhook deliveries", zap.Error(err))
+		return
+	}
+
+	delivered := map[uint]bool{}
+	for _, delivery := range deliveries {
+		service.deliverWebhook(delivery)
+		delivered[delivery.WebhookID] = true
+	}
+
+	for webhookId := range delivered {
+		service.pruneWebhookDeliveries(webhookId)
+	}
+}
+
+// pruneWebhookDeliveries removes the finished deliveries of a webhook beyond
+// the last webhookDeliveriesKept.
+func (service *DocService) pruneWebhookDeliveries(webhookId uint) {
+	var ids []uint
+	if err := service.DB.Model(&models.WebhookDelivery{}).
+		Where("webhook_id = ? AND status <> ?", webhookId, models.WebhookDeliveryPending).
+		Order("id DESC").Offset(webhookDeliveriesKept).Pluck("id", &ids).Error; err != nil || len(ids) == 0 {
+		return
+	}
+
+	if err := service.DB.Where("id IN ?", ids).Delete(&models.WebhookDelivery{}).Error; err != nil {
+		logger.Error("Failed to prune webhook deliveries", zap.Uint("webhook_id", webhookId), zap.Error(err))
+	}
+}
+
+func (service *DocService) deliverWebhook(delivery models.WebhookDelivery) {
+	var webhook models.Webhook
+	if err := service.DB.First(&webhook, delivery.WebhookID).Error; err != nil {
+		service.DB.Model(&delivery).Updates(map[string]interface{}{
+			"status": models.WebhookDeliveryFailed,
+			"error":  "webhook_not_found",
+		})
+		return
+	}
+
+	attempts := delivery.Attempts + 1
+
+	// Payloads are never sent unsigned in place of a signed one
+	secret, err := secrets.Decrypt(webhook.Secret)
+	if err != nil {
+		logger.Error("Failed to decrypt webhook secret", zap.Uint("webhook_id", webhook.ID), zap.Error(err))
+		service.DB.Model(&delivery).Updates(map[string]interface{}{
+			"attempts":        attempts,
+			"status":          models.WebhookDeliveryFailed,
+			"error":           fmt.Sprintf("failed to decrypt webhook secret: %v", err),
+			"next_attempt_at": nil,
+		})
+		return
+	}
+
+	updates := map[string]interface{}{"attempts": attempts}
+
+	code, body, err := sendWebhook(webhook.URL, secret, delivery)
+	updates["response_code"] = code
+	updates["response_body"] = body
+
+	if err == nil {
+		updates["status"] = models.WebhookDeliverySucceeded
+		updates["error"] = ""
+		updates["delivered_at"] = time.Now()
+		updates["next_attempt_at"] = nil
+	} else {
+		updates["error"] = err.Error()
+
+		if attempts >= webhookMaxAttempts {
+			updates["status"] = models.WebhookDeliveryFailed
+			updates["next_attempt_at"] = nil
+		} else {
+			updates["next_attempt_at"] = time.Now().Add(webhookBackoff(attempts))
+		}
+
+		logger.Warn("Webhook delivery failed",
+			zap.Uint("webhook_id", webhook.ID),
+			zap.Uint("delivery_id", delivery.ID),
+			zap.Int("attempts", attempts),
+			zap.Error(err))
+	}
+
+	if err := service.DB.Model(&delivery).Updates(updates).Error; err != nil {
+		logger.Error("Failed to save webhook delivery", zap.Uint("delivery_id", delivery.ID), zap.Error(err))
+	}
+}
+
+// sendWebhook posts a delivery, signing its payload with the webhook secret
+// in the X-Kalmia-Signature header when one is set.
+func sendWebhook(webhookURL, secret string, delivery models.WebhookDelivery) (int, string, error) {
+	body := []byte(delivery.Payload)
+
+	req, err := http.NewRequest(http.MethodPost, webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, "", err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Kalmia-Webhook")
+	req.Header.Set("X-Kalmia-Event", delivery.Event)
+	req.Header.Set("X-Kalmia-Delivery", strconv.FormatUint(uint64(delivery.ID), 10))
+	if secret != "" {
+		req.Header.Set("X-Kalmia-Signature", "sha256="+utils.SignHMAC(secret, body))
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+
+	responseBody, _ := io.ReadAll(io.LimitReader(resp.Body, webhookResponseLimit))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, string(responseBody), fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	return resp.StatusCode, string(responseBody), nil
+}
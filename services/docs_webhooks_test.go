@@ -0,0 +1,223 @@
+package services
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"git.difuse.io/Difuse/kalmia/db/models"
+	"git.difuse.io/Difuse/kalmia/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type receivedWebhook struct {
+	event     string
+	signature string
+	body      []byte
+}
+
+func TestWebhooks(t *testing.T) {
+	var mu sync.Mutex
+	var received []receivedWebhook
+	failNext := true
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		received = append(received, receivedWebhook{
+			event:     r.Header.Get("X-Kalmia-Event"),
+			signature: r.Header.Get("X-Kalmia-Signature"),
+			body:      body,
+		})
+
+		if failNext {
+			failNext = false
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	doc := models.Documentation{Name: "Webhooks", Version: "1.0.0", BaseURL: "/webhooks", AuthorID: 1}
+	require.NoError(t, TestDocService.DB.Create(&doc).Error)
+
+	user := models.User{ID: 1}
+
+	webhook, err := TestDocService.CreateWebhook(user, &doc.ID, receiver.URL, "hook-secret", []string{WebhookEventPageCreated})
+	require.NoError(t, err)
+	assert.NotEqual(t, "hook-secret", webhook.Secret)
+
+	global, err := TestDocService.CreateWebhook(user, nil, receiver.URL, "", []string{WebhookEventBuildFailed})
+	require.NoError(t, err)
+
+	defer func() {
+		TestDocService.DeleteWebhook(webhook.ID)
+		TestDocService.DeleteWebhook(global.ID)
+	}()
+
+	deliveries := func(webhookId uint) []models.WebhookDelivery {
+		deliveries, err := TestDocService.GetWebhookDeliveries(webhookId)
+		require.NoError(t, err)
+		return deliveries
+	}
+
+	t.Run("Secret is never returned", func(t *testing.T) {
+		webhooks, err := TestDocService.GetWebhooks(&doc.ID)
+		require.NoError(t, err)
+		require.Len(t, webhooks, 1)
+		assert.Empty(t, webhooks[0].Secret)
+		assert.True(t, webhooks[0].SecretSet)
+
+		data, err := json.Marshal(webhooks[0])
+		require.NoError(t, err)
+		assert.Contains(t, string(data), `"secretSet":true`)
+		assert.NotContains(t, string(data), `"secret"`)
+
+		globals, err := TestDocService.GetWebhooks(nil)
+		require.NoError(t, err)
+		require.Len(t, globals, 1)
+		assert.False(t, globals[0].SecretSet)
+	})
+
+	t.Run("Invalid input", func(t *testing.T) {
+		_, err := TestDocService.CreateWebhook(user, nil, "ftp://example.com", "", nil)
+		assert.EqualError(t, err, "invalid_webhook_url")
+
+		_, err = TestDocService.CreateWebhook(user, nil, receiver.URL, "", []string{"page.renamed"})
+		assert.EqualError(t, err, "invalid_webhook_event")
+	})
+
+	t.Run("Events go to subscribed webhooks", func(t *testing.T) {
+		TestDocService.EmitWebhookEvent(doc.ID, WebhookEventPageCreated, map[string]interface{}{"pageId": 1})
+
+		assert.Len(t, deliveries(webhook.ID), 1)
+		assert.Len(t, deliveries(global.ID), 0)
+	})
+
+	t.Run("Failed delivery is retried with backoff", func(t *testing.T) {
+		TestDocService.DeliverWebhooks()
+
+		delivery := deliveries(webhook.ID)[0]
+		assert.Equal(t, models.WebhookDeliveryPending, delivery.Status)
+		assert.Equal(t, 1, delivery.Attempts)
+		assert.Equal(t, http.StatusInternalServerError, delivery.ResponseCode)
+		require.NotNil(t, delivery.NextAttemptAt)
+		assert.True(t, delivery.NextAttemptAt.After(time.Now()))
+
+		// Not due yet
+		TestDocService.DeliverWebhooks()
+		assert.Equal(t, 1, deliveries(webhook.ID)[0].Attempts)
+
+		require.NoError(t, TestDocService.DB.Model(&delivery).Update("next_attempt_at", time.Now()).Error)
+		TestDocService.DeliverWebhooks()
+
+		delivery = deliveries(webhook.ID)[0]
+		assert.Equal(t, models.WebhookDeliverySucceeded, delivery.Status)
+		assert.Equal(t, 2, delivery.Attempts)
+		assert.NotNil(t, delivery.DeliveredAt)
+	})
+
+	t.Run("Payload is signed", func(t *testing.T) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		require.Len(t, received, 2)
+		last := received[1]
+		assert.Equal(t, WebhookEventPageCreated, last.event)
+		assert.True(t, utils.VerifyHMAC("hook-secret", last.body, last.signature))
+		assert.False(t, utils.VerifyHMAC("other-secret", last.body, last.signature))
+
+		var payload WebhookPayload
+		require.NoError(t, json.Unmarshal(last.body, &payload))
+		assert.Equal(t, WebhookEventPageCreated, payload.Event)
+		assert.Equal(t, doc.ID, payload.DocumentationID)
+	})
+
+	t.Run("Redeliver", func(t *testing.T) {
+		original := deliveries(webhook.ID)[0]
+		require.NoError(t, TestDocService.RedeliverWebhook(original.ID))
+		TestDocService.DeliverWebhooks()
+
+		all := deliveries(webhook.ID)
+		require.Len(t, all, 2)
+		assert.Equal(t, models.WebhookDeliverySucceeded, all[0].Status)
+		assert.Equal(t, original.Payload, all[0].Payload)
+
+		assert.EqualError(t, TestDocService.RedeliverWebhook(0), "webhook_delivery_not_found")
+	})
+
+	t.Run("Disabled webhooks receive nothing", func(t *testing.T) {
+		require.NoError(t, TestDocService.EditWebhook(webhook.ID, receiver.URL, "", []string{WebhookEventPageCreated}, false))
+
+		var stored models.Webhook
+		require.NoError(t, TestDocService.DB.First(&stored, webhook.ID).Error)
+		assert.Equal(t, webhook.Secret, stored.Secret)
+
+		TestDocService.EmitWebhookEvent(doc.ID, WebhookEventPageCreated, nil)
+		assert.Len(t, deliveries(webhook.ID), 2)
+	})
+
+	t.Run("Secret that cannot be decrypted fails the delivery", func(t *testing.T) {
+		broken, err := TestDocService.CreateWebhook(user, &doc.ID, receiver.URL, "broken-secret", []string{WebhookEventPageUpdated})
+		require.NoError(t, err)
+		defer TestDocService.DeleteWebhook(broken.ID)
+
+		require.NoError(t, TestDocService.DB.Model(&broken).Update("secret", "enc:v1:unknown:AAAA").Error)
+
+		mu.Lock()
+		before := len(received)
+		mu.Unlock()
+
+		TestDocService.EmitWebhookEvent(doc.ID, WebhookEventPageUpdated, nil)
+		TestDocService.DeliverWebhooks()
+
+		delivery := deliveries(broken.ID)[0]
+		assert.Equal(t, models.WebhookDeliveryFailed, delivery.Status)
+		assert.Contains(t, delivery.Error, "failed to decrypt webhook secret")
+		assert.Nil(t, delivery.NextAttemptAt)
+
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Len(t, received, before)
+	})
+
+	t.Run("Old deliveries are pruned", func(t *testing.T) {
+		var old []models.WebhookDelivery
+		for i := 0; i < webhookDeliveriesKept+5; i++ {
+			old = append(old, models.WebhookDelivery{
+				WebhookID: global.ID,
+				Event:     WebhookEventBuildFailed,
+				Payload:   "{}",
+				Status:    models.WebhookDeliverySucceeded,
+			})
+		}
+		require.NoError(t, TestDocService.DB.Create(&old).Error)
+
+		TestDocService.EmitWebhookEvent(doc.ID, WebhookEventBuildFailed, nil)
+		TestDocService.DeliverWebhooks()
+
+		var count int64
+		require.NoError(t, TestDocService.DB.Model(&models.WebhookDelivery{}).Where("webhook_id = ?", global.ID).Count(&count).Error)
+		assert.Equal(t, int64(webhookDeliveriesKept), count)
+
+		var oldest models.WebhookDelivery
+		require.NoError(t, TestDocService.DB.Where("id = ?", old[0].ID).Limit(1).Find(&oldest).Error)
+		assert.Zero(t, oldest.ID)
+	})
+
+	t.Run("Backoff", func(t *testing.T) {
+		assert.Equal(t, 30*time.Second, webhookBackoff(1))
+		assert.Equal(t, time.Minute, webhookBackoff(2))
+		assert.Equal(t, time.Hour, webhookBackoff(20))
+	})
+}
@@ -0,0 +1,130 @@
+package services
+
+import (
+	"strconv"
+	"time"
+
+	"git.difuse.io/Difuse/kalmia/db"
+	"git.difuse.io/Difuse/kalmia/db/models"
+	"git.difuse.io/Difuse/kalmia/logger"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"go.uber.org/zap"
+)
+
+var (
+	buildQueueDepthDesc = prometheus.NewDesc("kalmia_build_queue_depth",
+		"Build triggers waiting to be built.", nil, nil)
+	buildsRunningDesc = prometheus.NewDesc("kalmia_builds_running",
+		"Builds running on this instance.", nil, nil)
+	activeSessionsDesc = prometheus.NewDesc("kalmia_active_sessions",
+		"Sessions whose token has not expired.", nil, nil)
+	documentationPagesDesc = prometheus.NewDesc("kalmia_documentation_pages",
+		"Pages of each documentation.", []string{"documentation_id"}, nil)
+	cacheEntriesDesc = prometheus.NewDesc("kalmia_cache_entries",
+		"Entries in the site cache.", nil, nil)
+	cacheSizeDesc = prometheus.NewDesc("kalmia_cache_size_bytes",
+		"Size of the entries in the site cache.", nil, nil)
+	cacheMaxSizeDesc = prometheus.NewDesc("kalmia_cache_max_size_bytes",
+		"Size the site cache is bounded to.", nil, nil)
+	cacheHitsDesc = prometheus.NewDesc("kalmia_cache_hits_total",
+		"Lookups answered by the site cache.", nil, nil)
+	cacheMissesDesc = prometheus.NewDesc("kalmia_cache_misses_total",
+		"Lookups missed by the site cache.", nil, nil)
+	cacheEvictionsDesc = prometheus.NewDesc("kalmia_cache_evictions_total",
+		"Entries evicted from the site cache to stay within its size.", nil, nil)
+	cacheHitRatioDesc = prometheus.NewDesc("kalmia_cache_hit_ratio",
+		"Share of the lookups answered by the site cache since it started.", nil, nil)
+)
+
+// metricsCollector reads the state of the services when metrics are
+// scraped.
+type metricsCollector struct {
+	registry *ServiceRegistry
+}
+
+// RegisterMetrics adds the build queue, sessions, page counts, site cache and
+// database pool of the services to reg.
+func (registry *ServiceRegistry) RegisterMetrics(reg prometheus.Registerer) error {
+	sqlDB, err := registry.DocService.DB.DB()
+	if err != nil {
+		return err
+	}
+
+	if err := reg.Register(collectors.NewDBStatsCollector(sqlDB, "kalmia")); err != nil {
+		return err
+	}
+
+	return reg.Register(&metricsCollector{registry: registry})
+}
+
+func (collector *metricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- buildQueueDepthDesc
+	ch <- buildsRunningDesc
+	ch <- activeSessionsDesc
+	ch <- documentationPagesDesc
+	ch <- cacheEntriesDesc
+	ch <- cacheSizeDesc
+	ch <- cacheMaxSizeDesc
+	ch <- cacheHitsDesc
+	ch <- cacheMissesDesc
+	ch <- cacheEvictionsDesc
+	ch <- cacheHitRatioDesc
+}
+
+func (collector *metricsCollector) Collect(ch chan<- prometheus.Metric) {
+	docService := collector.registry.DocService
+
+	var pending int64
+	if err := docService.DB.Model(&models.BuildTriggers{}).
+		Where("triggered = ? AND is_delete = ? AND status IN ?", false, false, []string{"", models.BuildTriggerPending}).
+		Count(&pending).Error; err != nil {
+		logger.Error("Failed to count pending builds", zap.Error(err))
+	} else {
+		ch <- prometheus.MustNewConstMetric(buildQueueDepthDesc, prometheus.GaugeValue, float64(pending))
+	}
+
+	docService.builds.mu.Lock()
+	running := len(docService.builds.running)
+	docService.builds.mu.Unlock()
+	ch <- prometheus.MustNewConstMetric(buildsRunningDesc, prometheus.GaugeValue, float64(running))
+
+	var sessions int64
+	if err := collector.registry.AuthService.DB.Model(&models.Token{}).
+		Where("expiry > ?", time.Now().Unix()).Count(&sessions).Error; err != nil {
+		logger.Error("Failed to count active sessions", zap.Error(err))
+	} else {
+		ch <- prometheus.MustNewConstMetric(activeSessionsDesc, prometheus.GaugeValue, float64(sessions))
+	}
+
+	var pageCounts []struct {
+		DocumentationID uint
+		Count           int64
+	}
+	if err := docService.DB.Model(&models.Page{}).Select("documentation_id, COUNT(*) AS count").
+		Group("documentation_id").Scan(&pageCounts).Error; err != nil {
+		logger.Error("Failed to count pages", zap.Error(err))
+	}
+	for _, pageCount := range pageCounts {
+		ch <- prometheus.MustNewConstMetric(documentationPagesDesc, prometheus.GaugeValue,
+			float64(pageCount.Count), strconv.FormatUint(uint64(pageCount.DocumentationID), 10))
+	}
+
+	if db.Cache == nil {
+		return
+	}
+
+	stats := db.Cache.Stats()
+	hitRatio := 0.0
+	if lookups := stats.Hits + stats.Misses; lookups > 0 {
+		hitRatio = float64(stats.Hits) / float64(lookups)
+	}
+
+	ch <- prometheus.MustNewConstMetric(cacheEntriesDesc, prometheus.GaugeValue, float64(stats.Entries))
+	ch <- prometheus.MustNewConstMetric(cacheSizeDesc, prometheus.GaugeValue, float64(stats.Size))
+	ch <- prometheus.MustNewConstMetric(cacheMaxSizeDesc, prometheus.GaugeValue, float64(stats.MaxSize))
+	ch <- prometheus.MustNewConstMetric(cacheHitsDesc, prometheus.CounterValue, float64(stats.Hits))
+	ch <- prometheus.MustNewConstMetric(cacheMissesDesc, prometheus.CounterValue, float64(stats.Misses))
+	ch <- prometheus.MustNewConstMetric(cacheEvictionsDesc, prometheus.CounterValue, float64(stats.Evictions))
+	ch <- prometheus.MustNewConstMetric(cacheHitRatioDesc, prometheus.GaugeValue, hitRatio)
+}
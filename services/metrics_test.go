@@ -0,0 +1,43 @@
+package services
+
+import (
+	"fmt"
+	"testing"
+
+	"git.difuse.io/Difuse/kalmia/db/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	doc := models.Documentation{Name: "Metrics", Version: "1.0.0", BaseURL: "/metrics-doc", AuthorID: 1}
+	require.NoError(t, TestDocService.DB.Create(&doc).Error)
+	for _, slug := range []string{"/one", "/two"} {
+		require.NoError(t, TestDocService.DB.Create(&models.Page{Title: slug, Slug: slug, DocumentationID: doc.ID, AuthorID: 1}).Error)
+	}
+
+	reg := prometheus.NewRegistry()
+	registry := &ServiceRegistry{AuthService: TestAuthService, DocService: TestDocService}
+	require.NoError(t, registry.RegisterMetrics(reg))
+
+	families, err := reg.Gather()
+	require.NoError(t, err)
+
+	values := make(map[string]float64)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			name := family.GetName()
+			for _, label := range metric.GetLabel() {
+				name += fmt.Sprintf("{%s=%s}", label.GetName(), label.GetValue())
+			}
+			values[name] = metric.GetGauge().GetValue()
+		}
+	}
+
+	for _, name := range []string{"kalmia_build_queue_depth", "kalmia_builds_running", "kalmia_active_sessions", "go_sql_open_connections{db_name=kalmia}", "kalmia_cache_hit_ratio"} {
+		assert.Contains(t, values, name)
+	}
+
+	assert.Equal(t, float64(2), values[fmt.Sprintf("kalmia_documentation_pages{documentation_id=%d}", doc.ID)])
+}
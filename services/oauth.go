@@ -1,70 +1,81 @@
 package services
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
-	"sync"
 	"time"
-)
-
-type oauthEntry struct {
-	Token     string
-	ExpiresAt time.Time
-}
 
-var (
-	oauthCodeStore = make(map[string]oauthEntry)
-	oauthStoreMu   sync.RWMutex
+	"git.difuse.io/Difuse/kalmia/db/models"
+	"git.difuse.io/Difuse/kalmia/logger"
+	"go.uber.org/zap"
 )
 
-func init() {
-	go func() {
-		for {
-			time.Sleep(30 * time.Second)
-			oauthStoreMu.Lock()
-			now := time.Now()
-			for code, entry := range oauthCodeStore {
-				if now.After(entry.ExpiresAt) {
-					delete(oauthCodeStore, code)
-				}
-			}
-			oauthStoreMu.Unlock()
-		}
-	}()
-}
+const (
+	oauthCodeTTL         = 5 * time.Minute
+	oauthCleanupInterval = 30 * time.Second
+)
 
-func StoreOAuthToken(token string) (string, error) {
+// StoreOAuthToken keeps the token of a user signing in through an OAuth
+// provider under a one-time code, which the admin UI exchanges for it. Codes
+// are kept in the database so that any instance can exchange them.
+func (service *AuthService) StoreOAuthToken(token string) (string, error) {
 	codeBytes := make([]byte, 16)
 	if _, err := rand.Read(codeBytes); err != nil {
 		return "", fmt.Errorf("failed_to_generate_oauth_code")
 	}
 	code := hex.EncodeToString(codeBytes)
 
-	oauthStoreMu.Lock()
-	oauthCodeStore[code] = oauthEntry{
+	if err := service.DB.Create(&models.OAuthCode{
+		Code:      code,
 		Token:     token,
-		ExpiresAt: time.Now().Add(5 * time.Minute),
+		ExpiresAt: time.Now().Add(oauthCodeTTL),
+	}).Error; err != nil {
+		return "", fmt.Errorf("failed_to_store_oauth_code")
 	}
-	oauthStoreMu.Unlock()
 
 	return code, nil
 }
 
-func ExchangeOAuthCode(code string) (string, error) {
-	oauthStoreMu.Lock()
-	entry, ok := oauthCodeStore[code]
-	if ok {
-		delete(oauthCodeStore, code)
+func (service *AuthService) ExchangeOAuthCode(code string) (string, error) {
+	var entry models.OAuthCode
+	if err := service.DB.Where("code = ?", code).First(&entry).Error; err != nil {
+		return "", fmt.Errorf("invalid_or_expired_code")
 	}
-	oauthStoreMu.Unlock()
 
-	if !ok {
+	// Only the request that deletes the code gets the token
+	result := service.DB.Where("code = ?", code).Delete(&models.OAuthCode{})
+	if result.Error != nil || result.RowsAffected == 0 {
 		return "", fmt.Errorf("invalid_or_expired_code")
 	}
+
 	if time.Now().After(entry.ExpiresAt) {
 		return "", fmt.Errorf("code_expired")
 	}
 
 	return entry.Token, nil
 }
+
+// CleanupOAuthCodes removes the codes that expired without being exchanged.
+func (service *AuthService) CleanupOAuthCodes() error {
+	return service.DB.Where("expires_at <= ?", time.Now()).Delete(&models.OAuthCode{}).Error
+}
+
+// StartOAuthCleanup removes the expired codes periodically, until ctx is
+// done.
+func (service *AuthService) StartOAuthCleanup(ctx context.Context) {
+	service.background.Go(func() {
+		for sleepContext(ctx, oauthCleanupInterval) {
+			if err := service.CleanupOAuthCodes(); err != nil {
+				logger.Error("Failed to remove expired OAuth codes", zap.Error(err))
+			}
+		}
+	})
+}
+
+// Shutdown waits for the cleanup started with StartOAuthCleanup to stop,
+// once its context is done, or until ctx is done.
+func (service *AuthService) Shutdown(ctx context.Context) error {
+	return waitContext(ctx, &service.background)
+}
@@ -1,6 +1,10 @@
 package services
 
-import "gorm.io/gorm"
+import (
+	"context"
+
+	"gorm.io/gorm"
+)
 
 type ServiceRegistry struct {
 	AuthService *AuthService
@@ -13,3 +17,17 @@ func NewServiceRegistry(db *gorm.DB) *ServiceRegistry {
 		DocService:  NewDocService(db),
 	}
 }
+
+// Shutdown waits for the background jobs of the services to stop, once the
+// context they were started with is done. Builds still running when ctx is
+// done are cancelled and queued again for the next start.
+func (registry *ServiceRegistry) Shutdown(ctx context.Context) error {
+	docErr := registry.DocService.Shutdown(ctx)
+	authErr := registry.AuthService.Shutdown(ctx)
+
+	if docErr != nil {
+		return docErr
+	}
+
+	return authErr
+}
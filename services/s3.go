@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"git.difuse.io/Difuse/kalmia/config"
+	"git.difuse.io/Difuse/kalmia/tracing"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -73,5 +74,8 @@ func UploadToS3Storage(file io.Reader, originalFilename, contentType string, par
 }
 
 var newS3Client = func(sess *session.Session) s3iface.S3API {
-	return s3.New(sess)
+	client := s3.New(sess)
+	tracing.InstrumentAWS(&client.Handlers)
+
+	return client
 }
@@ -51,7 +51,7 @@ func TestMain(m *testing.M) {
 
 	d := db.SetupDatabase(TestConfig.Environment, TestConfig.Database, TestConfig.DataPath)
 	db.SetupBasicData(d, TestConfig.Admins)
-	db.InitCache()
+	db.InitCache(TestConfig.Cache.MaxSize<<20, TestConfig.Cache.MaxEntrySize<<20)
 
 	serviceRegistry := NewServiceRegistry(d)
 	TestAuthService = serviceRegistry.AuthService
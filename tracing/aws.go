@@ -0,0 +1,38 @@
+package tracing
+
+import (
+	"github.com/aws/aws-sdk-go/aws/request"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// InstrumentAWS traces the requests sent by an AWS client with handlers,
+// as part of the span in the context they are sent with.
+func InstrumentAWS(handlers *request.Handlers) {
+	handlers.Validate.PushFrontNamed(request.NamedHandler{
+		Name: "kalmia.tracing.Start",
+		Fn: func(r *request.Request) {
+			ctx, _ := Start(r.Context(), r.ClientInfo.ServiceName+" "+r.Operation.Name,
+				attribute.String("rpc.system", "aws-api"),
+				attribute.String("rpc.service", r.ClientInfo.ServiceName),
+				attribute.String("rpc.method", r.Operation.Name),
+			)
+			r.SetContext(ctx)
+		},
+	})
+
+	handlers.Complete.PushBackNamed(request.NamedHandler{
+		Name: "kalmia.tracing.End",
+		Fn: func(r *request.Request) {
+			span := trace.SpanFromContext(r.Context())
+			if r.HTTPResponse != nil {
+				span.SetAttributes(attribute.Int("http.response.status_code", r.HTTPResponse.StatusCode))
+			}
+			if r.RequestID != "" {
+				span.SetAttributes(attribute.String("aws.request_id", r.RequestID))
+			}
+
+			End(span, r.Error)
+		},
+	})
+}
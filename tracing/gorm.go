@@ -0,0 +1,100 @@
+package tracing
+
+import (
+	"errors"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+// SlowQuery is how long a query run without a span in its context takes
+// before it is traced on its own.
+const SlowQuery = 100 * time.Millisecond
+
+const (
+	gormStartKey = "kalmia:tracing_start"
+	gormSpanKey  = "kalmia:tracing_span"
+)
+
+// GORMPlugin traces the queries of a database. Queries run with a context
+// holding a span, see gorm.DB.WithContext, are traced as part of it, and
+// other ones only when they are slower than SlowQuery.
+type GORMPlugin struct{}
+
+func (GORMPlugin) Name() string {
+	return "kalmia:tracing"
+}
+
+func (GORMPlugin) Initialize(db *gorm.DB) error {
+	callback := db.Callback()
+
+	for _, err := range []error{
+		callback.Create().Before("gorm:create").Register("kalmia:before_create", beforeQuery("create")),
+		callback.Create().After("gorm:create").Register("kalmia:after_create", afterQuery("create")),
+		callback.Query().Before("gorm:query").Register("kalmia:before_query", beforeQuery("select")),
+		callback.Query().After("gorm:query").Register("kalmia:after_query", afterQuery("select")),
+		callback.Update().Before("gorm:update").Register("kalmia:before_update", beforeQuery("update")),
+		callback.Update().After("gorm:update").Register("kalmia:after_update", afterQuery("update")),
+		callback.Delete().Before("gorm:delete").Register("kalmia:before_delete", beforeQuery("delete")),
+		callback.Delete().After("gorm:delete").Register("kalmia:after_delete", afterQuery("delete")),
+		callback.Row().Before("gorm:row").Register("kalmia:before_row", beforeQuery("row")),
+		callback.Row().After("gorm:row").Register("kalmia:after_row", afterQuery("row")),
+		callback.Raw().Before("gorm:raw").Register("kalmia:before_raw", beforeQuery("raw")),
+		callback.Raw().After("gorm:raw").Register("kalmia:after_raw", afterQuery("raw")),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func beforeQuery(operation string) func(*gorm.DB) {
+	return func(db *gorm.DB) {
+		// Statements of a chained query are reused, so both are always set
+		var span trace.Span
+		if trace.SpanContextFromContext(db.Statement.Context).IsValid() {
+			_, span = Start(db.Statement.Context, "db "+operation)
+		}
+
+		db.InstanceSet(gormSpanKey, span)
+		db.InstanceSet(gormStartKey, time.Now())
+	}
+}
+
+func afterQuery(operation string) func(*gorm.DB) {
+	return func(db *gorm.DB) {
+		value, _ := db.InstanceGet(gormSpanKey)
+		span, _ := value.(trace.Span)
+
+		if span == nil {
+			value, _ := db.InstanceGet(gormStartKey)
+			start, ok := value.(time.Time)
+			if !ok || time.Since(start) < SlowQuery {
+				return
+			}
+
+			_, span = otel.Tracer(tracerName).Start(db.Statement.Context, "db "+operation, trace.WithTimestamp(start))
+			span.SetAttributes(attribute.Bool("db.slow_query", true))
+		}
+
+		span.SetAttributes(
+			attribute.String("db.system.name", db.Dialector.Name()),
+			attribute.String("db.operation.name", operation),
+			attribute.String("db.collection.name", db.Statement.Table),
+			attribute.String("db.query.text", db.Statement.SQL.String()),
+			attribute.Int64("db.response.returned_rows", db.Statement.RowsAffected),
+		)
+
+		err := db.Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			err = nil
+		}
+
+		End(span, err)
+	}
+}
@@ -0,0 +1,194 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/glebarez/sqlite"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previous)
+		provider.Shutdown(context.Background())
+	})
+
+	return recorder
+}
+
+func spanNamed(spans []sdktrace.ReadOnlySpan, name string) sdktrace.ReadOnlySpan {
+	for _, span := range spans {
+		if span.Name() == name {
+			return span
+		}
+	}
+
+	return nil
+}
+
+func TestEnd(t *testing.T) {
+	recorder := recordSpans(t)
+
+	_, span := Start(context.Background(), "failing")
+	End(span, errors.New("broken"))
+
+	_, span = Start(context.Background(), "working")
+	End(span, nil)
+
+	if span := spanNamed(recorder.Ended(), "failing"); span == nil || span.Status().Code != codes.Error || span.Status().Description != "broken" {
+		t.Errorf("Expected the failing span to have an error status")
+	}
+
+	if span := spanNamed(recorder.Ended(), "working"); span == nil || span.Status().Code == codes.Error {
+		t.Errorf("Expected the working span not to have an error status")
+	}
+}
+
+func TestGORMPlugin(t *testing.T) {
+	recorder := recordSpans(t)
+
+	type Page struct {
+		ID    uint
+		Title string
+	}
+
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	if err := db.Use(GORMPlugin{}); err != nil {
+		t.Fatalf("Failed to use plugin: %v", err)
+	}
+	if err := db.AutoMigrate(&Page{}); err != nil {
+		t.Fatalf("Failed to migrate: %v", err)
+	}
+
+	// Quick queries outside of a span are not traced
+	db.Create(&Page{Title: "untraced"})
+	if spans := recorder.Ended(); len(spans) != 0 {
+		t.Fatalf("Expected no spans outside of a trace, got %d", len(spans))
+	}
+
+	ctx, parent := Start(context.Background(), "save")
+	db.WithContext(ctx).Create(&Page{Title: "traced"})
+
+	var page Page
+	err = db.WithContext(ctx).Where("title = ?", "missing").First(&page).Error
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("Expected the page not to be found, got %v", err)
+	}
+	parent.End()
+
+	spans := recorder.Ended()
+
+	create := spanNamed(spans, "db create")
+	if create == nil {
+		t.Fatalf("Expected a span for the insert")
+	}
+	if create.Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Errorf("Expected the insert to be traced as part of its parent span")
+	}
+
+	attributes := map[string]string{}
+	for _, attribute := range create.Attributes() {
+		attributes[string(attribute.Key)] = attribute.Value.Emit()
+	}
+	if attributes["db.collection.name"] != "pages" || attributes["db.system.name"] != "sqlite" {
+		t.Errorf("Unexpected attributes %v", attributes)
+	}
+	if !strings.Contains(attributes["db.query.text"], "INSERT INTO") {
+		t.Errorf("Expected the statement in the attributes, got %q", attributes["db.query.text"])
+	}
+
+	query := spanNamed(spans, "db select")
+	if query == nil {
+		t.Fatalf("Expected a span for the select")
+	}
+	if query.Status().Code == codes.Error {
+		t.Errorf("Expected records not found not to fail the span")
+	}
+}
+
+func TestInstrumentAWS(t *testing.T) {
+	recorder := recordSpans(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/bucket/missing" {
+			http.Error(w, "", http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	sess, err := session.NewSession(&aws.Config{
+		Endpoint:         aws.String(server.URL),
+		Region:           aws.String("us-east-1"),
+		Credentials:      credentials.NewStaticCredentials("key", "secret", ""),
+		S3ForcePathStyle: aws.Bool(true),
+		MaxRetries:       aws.Int(0),
+	})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+
+	client := s3.New(sess)
+	InstrumentAWS(&client.Handlers)
+
+	ctx, parent := Start(context.Background(), "upload")
+	_, err = client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket: aws.String("bucket"),
+		Key:    aws.String("index.html"),
+		Body:   bytes.NewReader([]byte("<html></html>")),
+	})
+	if err != nil {
+		t.Fatalf("Failed to put object: %v", err)
+	}
+
+	_, err = client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket: aws.String("bucket"),
+		Key:    aws.String("missing"),
+		Body:   bytes.NewReader(nil),
+	})
+	if err == nil {
+		t.Fatalf("Expected the second upload to fail")
+	}
+	parent.End()
+
+	var puts []sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		if span.Name() == "s3 PutObject" {
+			puts = append(puts, span)
+		}
+	}
+
+	if len(puts) != 2 {
+		t.Fatalf("Expected 2 spans for the uploads, got %d", len(puts))
+	}
+	if puts[0].Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Errorf("Expected the upload to be traced as part of its parent span")
+	}
+	if puts[0].Status().Code == codes.Error || puts[1].Status().Code != codes.Error {
+		t.Errorf("Expected only the failed upload to have an error status")
+	}
+}
@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestTarGz(t *testing.T) {
+	tempDir := t.TempDir()
+	src := filepath.Join(tempDir, "store")
+	dst := filepath.Join(tempDir, "loaded")
+	archive := filepath.Join(tempDir, "store.tar.gz")
+
+	files := map[string]string{
+		"v3/files/00/abc":       "package file",
+		"v3/files/01/def-index": "index",
+		"v3/tmp/placeholder":    "",
+	}
+
+	for name, content := range files {
+		path := filepath.Join(src, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+
+	if err := CreateTarGz(src, archive); err != nil {
+		t.Fatalf("CreateTarGz failed: %v", err)
+	}
+
+	if err := MakeDir(filepath.Join(dst, "v3", "files", "02")); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dst, "v3", "files", "02", "kept"), []byte("kept"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	if err := ExtractTarGz(archive, dst); err != nil {
+		t.Fatalf("ExtractTarGz failed: %v", err)
+	}
+
+	expected, err := Tree(src)
+	if err != nil {
+		t.Fatalf("Tree failed: %v", err)
+	}
+	expected[filepath.Join("v3", "files", "02", "kept")] = []byte("kept")
+
+	result, err := Tree(dst)
+	if err != nil {
+		t.Fatalf("Tree failed: %v", err)
+	}
+
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Extracted files do not match.\nGot: %v\nExpected: %v", result, expected)
+	}
+}
+
+func TestExtractTarGzOutsideDestination(t *testing.T) {
+	tempDir := t.TempDir()
+	archive := filepath.Join(tempDir, "evil.tar.gz")
+
+	file, err := os.Create(archive)
+	if err != nil {
+		t.Fatalf("Failed to create archive: %v", err)
+	}
+
+	gzipWriter := gzip.NewWriter(file)
+	tarWriter := tar.NewWriter(gzipWriter)
+	content := []byte("evil")
+	if err := tarWriter.WriteHeader(&tar.Header{Name: "../evil", Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+		t.Fatalf("Failed to write header: %v", err)
+	}
+	tarWriter.Write(content)
+	tarWriter.Close()
+	gzipWriter.Close()
+	file.Close()
+
+	if err := ExtractTarGz(archive, filepath.Join(tempDir, "dst")); err == nil {
+		t.Error("Expected an error for an entry outside of the destination, but got none")
+	}
+
+	if PathExists(filepath.Join(tempDir, "evil")) {
+		t.Error("Expected the entry not to be written")
+	}
+}
@@ -0,0 +1,118 @@
+package utils
+
+import (
+	"bytes"
+	"html"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// rawBlockRemover drops the blocks BlocksToMarkdown kept as fenced JSON,
+// which have nothing to show in HTML.
+type rawBlockRemover struct{}
+
+func (rawBlockRemover) Transform(node *ast.Document, reader text.Reader, pc parser.Context) {
+	var raw []ast.Node
+
+	ast.Walk(node, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if fenced, ok := n.(*ast.FencedCodeBlock); ok && entering &&
+			string(fenced.Language(reader.Source())) == rawBlockFence {
+			raw = append(raw, n)
+		}
+		return ast.WalkContinue, nil
+	})
+
+	for _, n := range raw {
+		n.Parent().RemoveChild(n.Parent(), n)
+	}
+}
+
+// codeBlockRenderer renders code blocks highlighted by HighlightCode.
+type codeBlockRenderer struct{}
+
+func (codeBlockRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(ast.KindFencedCodeBlock, renderCodeBlock)
+	reg.Register(ast.KindCodeBlock, renderCodeBlock)
+}
+
+func renderCodeBlock(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkSkipChildren, nil
+	}
+
+	var language string
+	if fenced, ok := node.(*ast.FencedCodeBlock); ok {
+		language = string(fenced.Language(source))
+	}
+
+	if language != "" {
+		escaped := html.EscapeString(language)
+		w.WriteString(`<pre class="code" data-language="` + escaped + `"><code class="language-` + escaped + `">`)
+	} else {
+		w.WriteString(`<pre class="code"><code>`)
+	}
+
+	w.WriteString(HighlightCode(linesText(node, source), language))
+	w.WriteString("</code></pre>\n")
+
+	return ast.WalkSkipChildren, nil
+}
+
+var htmlMarkdown = goldmark.New(
+	goldmark.WithExtensions(extension.GFM),
+	goldmark.WithParserOptions(
+		parser.WithAutoHeadingID(),
+		parser.WithASTTransformers(util.Prioritized(rawBlockRemover{}, 100)),
+	),
+	goldmark.WithRendererOptions(renderer.WithNodeRenderers(util.Prioritized(codeBlockRenderer{}, 100))),
+)
+
+// BlocksToHTML renders BlockNote blocks as HTML by way of their Markdown,
+// with code highlighted and headings given ids to link to. HTML written in
+// the content is escaped rather than passed through.
+func BlocksToHTML(blocks []Block) (string, error) {
+	var buffer bytes.Buffer
+	var run []Block
+
+	flush := func() error {
+		if len(run) == 0 {
+			return nil
+		}
+
+		err := htmlMarkdown.Convert([]byte(BlocksToMarkdown(run)), &buffer)
+		run = nil
+		return err
+	}
+
+	for _, block := range blocks {
+		// Alerts only have a Markdown form on GitHub, so they are rendered
+		// here instead
+		alertType, _ := block.Props["type"].(string)
+		if _, ok := alertMarkers[alertType]; !ok || block.Type != "alert" {
+			run = append(run, block)
+			continue
+		}
+
+		if err := flush(); err != nil {
+			return "", err
+		}
+
+		buffer.WriteString(`<div class="alert alert-` + alertType + `">` + "\n")
+		if err := htmlMarkdown.Convert([]byte(inlineToMarkdown(block.Content)), &buffer); err != nil {
+			return "", err
+		}
+		buffer.WriteString("</div>\n")
+	}
+
+	if err := flush(); err != nil {
+		return "", err
+	}
+
+	return buffer.String(), nil
+}
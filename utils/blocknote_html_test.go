@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"testing"
+)
+
+func TestBlocksToHTML(t *testing.T) {
+	tests := []struct {
+		name     string
+		blocks   []Block
+		expected string
+	}{
+		{
+			name: "Heading and paragraph",
+			blocks: []Block{
+				{Type: "heading", Props: map[string]interface{}{"level": float64(2)}, Content: []interface{}{
+					map[string]interface{}{"type": "text", "text": "Title", "styles": map[string]interface{}{}},
+				}},
+				{Type: "paragraph", Content: []interface{}{
+					map[string]interface{}{"type": "text", "text": "Some ", "styles": map[string]interface{}{}},
+					map[string]interface{}{"type": "text", "text": "bold", "styles": map[string]interface{}{"bold": true}},
+				}},
+			},
+			expected: "<h2 id=\"title\">Title</h2>\n<p>Some <strong>bold</strong></p>\n",
+		},
+		{
+			name: "HTML is escaped",
+			blocks: []Block{
+				{Type: "paragraph", Content: []interface{}{
+					map[string]interface{}{"type": "text", "text": "<script>alert(1)</script>", "styles": map[string]interface{}{}},
+				}},
+			},
+			expected: "<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>\n",
+		},
+		{
+			name: "Code is highlighted",
+			blocks: []Block{
+				{Type: "procode", Props: map[string]interface{}{"language": "go", "code": "return nil"}},
+			},
+			expected: "<pre class=\"code\" data-language=\"go\"><code class=\"language-go\">" +
+				"<span class=\"tok-keyword\">return</span> <span class=\"tok-keyword\">nil</span></code></pre>\n",
+		},
+		{
+			name: "Alerts",
+			blocks: []Block{
+				{Type: "alert", Props: map[string]interface{}{"type": "warning"}, Content: []interface{}{
+					map[string]interface{}{"type": "text", "text": "Careful", "styles": map[string]interface{}{}},
+				}},
+			},
+			expected: "<div class=\"alert alert-warning\">\n<p>Careful</p>\n</div>\n",
+		},
+		{
+			name: "Blocks without Markdown are left out",
+			blocks: []Block{
+				{Type: "video", Props: map[string]interface{}{"url": "https://example.com/video.mp4"}},
+				{Type: "paragraph", Content: []interface{}{
+					map[string]interface{}{"type": "text", "text": "After", "styles": map[string]interface{}{}},
+				}},
+			},
+			expected: "<p>After</p>\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := BlocksToHTML(tt.blocks)
+			if err != nil {
+				t.Fatalf("BlocksToHTML() error = %v", err)
+			}
+			if result != tt.expected {
+				t.Errorf("BlocksToHTML() got = %q, want %q", result, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,572 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	east "github.com/yuin/goldmark/extension/ast"
+	"github.com/yuin/goldmark/text"
+)
+
+// rawBlockFence is the info string used for fenced code blocks that carry a
+// BlockNote block verbatim when it has no plain Markdown equivalent.
+const rawBlockFence = "kalmia-block"
+
+var alertMarkers = map[string]string{
+	"warning": "WARNING",
+	"danger":  "CAUTION",
+	"info":    "NOTE",
+	"success": "TIP",
+}
+
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	"`", "\\`",
+	"*", `\*`,
+	"_", `\_`,
+	"[", `\[`,
+	"]", `\]`,
+	"<", `\<`,
+	"|", `\|`,
+)
+
+func defaultBlockProps() map[string]interface{} {
+	return map[string]interface{}{
+		"textColor":       "default",
+		"backgroundColor": "default",
+		"textAlignment":   "left",
+	}
+}
+
+func newBlock(blockType string, props map[string]interface{}, content interface{}) Block {
+	if content == nil {
+		content = []interface{}{}
+	}
+
+	return Block{
+		ID:       uuid.NewString(),
+		Type:     blockType,
+		Props:    props,
+		Content:  content,
+		Children: []Block{},
+	}
+}
+
+func inlineToMarkdown(content interface{}) string {
+	items, ok := content.([]interface{})
+	if !ok {
+		if s, ok := content.(string); ok {
+			return markdownEscaper.Replace(s)
+		}
+		return ""
+	}
+
+	var builder strings.Builder
+	for _, item := range items {
+		itemMap, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		switch itemMap["type"] {
+		case "link":
+			href, _ := itemMap["href"].(string)
+			builder.WriteString(fmt.Sprintf("[%s](%s)", inlineToMarkdown(itemMap["content"]), href))
+		default:
+			txt, _ := itemMap["text"].(string)
+			styles, _ := itemMap["styles"].(map[string]interface{})
+			builder.WriteString(styledTextToMarkdown(txt, styles))
+		}
+	}
+
+	return builder.String()
+}
+
+func styledTextToMarkdown(txt string, styles map[string]interface{}) string {
+	if txt == "" {
+		return ""
+	}
+
+	if code, ok := styles["code"].(bool); ok && code {
+		return "`" + txt + "`"
+	}
+
+	// Keep surrounding whitespace outside of the emphasis markers, otherwise
+	// the result is not valid CommonMark emphasis.
+	trimmed := strings.TrimSpace(txt)
+	if trimmed == "" {
+		return txt
+	}
+	lead := txt[:strings.Index(txt, trimmed)]
+	trail := txt[len(lead)+len(trimmed):]
+
+	out := markdownEscaper.Replace(trimmed)
+	if strike, ok := styles["strike"].(bool); ok && strike {
+		out = "~~" + out + "~~"
+	}
+	if italic, ok := styles["italic"].(bool); ok && italic {
+		out = "_" + out + "_"
+	}
+	if bold, ok := styles["bold"].(bool); ok && bold {
+		out = "**" + out + "**"
+	}
+
+	return lead + out + trail
+}
+
+func rawBlockToMarkdown(block Block) string {
+	blockJSON, err := json.MarshalIndent(block, "", "  ")
+	if err != nil {
+		return ""
+	}
+
+	return fmt.Sprintf("```%s\n%s\n```\n\n", rawBlockFence, string(blockJSON))
+}
+
+func tableToMarkdown(block Block) string {
+	contentMap, ok := block.Content.(map[string]interface{})
+	if !ok {
+		return rawBlockToMarkdown(block)
+	}
+
+	rows, _ := contentMap["rows"].([]interface{})
+	if len(rows) == 0 {
+		return rawBlockToMarkdown(block)
+	}
+
+	var lines []string
+	columns := 0
+
+	for i, row := range rows {
+		rowMap, _ := row.(map[string]interface{})
+		cells, _ := rowMap["cells"].([]interface{})
+
+		var rendered []string
+		for _, cell := range cells {
+			rendered = append(rendered, strings.ReplaceAll(inlineToMarkdown(cell), "\n", " "))
+		}
+
+		if i == 0 {
+			columns = len(rendered)
+		}
+
+		for len(rendered) < columns {
+			rendered = append(rendered, "")
+		}
+
+		lines = append(lines, "| "+strings.Join(rendered, " | ")+" |")
+
+		if i == 0 {
+			lines = append(lines, "|"+strings.Repeat(" --- |", columns))
+		}
+	}
+
+	return strings.Join(lines, "\n") + "\n\n"
+}
+
+func listItemsToMarkdown(blocks []Block, depth int) string {
+	var builder strings.Builder
+	indent := strings.Repeat("  ", depth)
+	number := 1
+
+	for _, block := range blocks {
+		var marker string
+		switch block.Type {
+		case "numberedListItem":
+			marker = fmt.Sprintf("%d.", number)
+			number++
+		case "checkListItem":
+			if checked, ok := block.Props["checked"].(bool); ok && checked {
+				marker = "- [x]"
+			} else {
+				marker = "- [ ]"
+			}
+		default:
+			marker = "-"
+		}
+
+		builder.WriteString(fmt.Sprintf("%s%s %s\n", indent, marker, inlineToMarkdown(block.Content)))
+
+		if len(block.Children) > 0 {
+			builder.WriteString(listItemsToMarkdown(block.Children, depth+1))
+		}
+	}
+
+	return builder.String()
+}
+
+func isListBlock(blockType string) bool {
+	return blockType == "bulletListItem" || blockType == "numberedListItem" || blockType == "checkListItem"
+}
+
+// BlocksToMarkdown renders BlockNote blocks as plain (GitHub flavoured)
+// Markdown. Blocks without a Markdown equivalent are kept as fenced
+// kalmia-block JSON so that MarkdownToBlocks can restore them unchanged.
+func BlocksToMarkdown(blocks []Block) string {
+	var builder strings.Builder
+	var listItems []Block
+
+	flushList := func() {
+		if len(listItems) > 0 {
+			builder.WriteString(listItemsToMarkdown(listItems, 0))
+			builder.WriteString("\n")
+			listItems = nil
+		}
+	}
+
+	for _, block := range blocks {
+		if isListBlock(block.Type) {
+			if len(listItems) > 0 && listItems[len(listItems)-1].Type != block.Type {
+				flushList()
+			}
+			listItems = append(listItems, block)
+			continue
+		}
+
+		flushList()
+
+		switch block.Type {
+		case "heading":
+			level := 1
+			if l, ok := block.Props["level"].(float64); ok {
+				level = int(l)
+			} else if l, ok := block.Props["level"].(int); ok {
+				level = l
+			}
+			builder.WriteString(fmt.Sprintf("%s %s\n\n", strings.Repeat("#", level), inlineToMarkdown(block.Content)))
+		case "paragraph":
+			paragraph := inlineToMarkdown(block.Content)
+			if strings.TrimSpace(paragraph) != "" {
+				builder.WriteString(paragraph + "\n\n")
+			}
+		case "procode":
+			code, _ := block.Props["code"].(string)
+			language, _ := block.Props["language"].(string)
+			builder.WriteString(fmt.Sprintf("```%s\n%s\n```\n\n", language, code))
+		case "image":
+			url, _ := block.Props["url"].(string)
+			caption, _ := block.Props["caption"].(string)
+			builder.WriteString(fmt.Sprintf("![%s](%s)\n\n", markdownEscaper.Replace(caption), url))
+		case "alert":
+			alertType, _ := block.Props["type"].(string)
+			marker, ok := alertMarkers[alertType]
+			if !ok {
+				builder.WriteString(rawBlockToMarkdown(block))
+				continue
+			}
+			builder.WriteString(fmt.Sprintf("> [!%s]\n> %s\n\n", marker, inlineToMarkdown(block.Content)))
+		case "table":
+			builder.WriteString(tableToMarkdown(block))
+		default:
+			builder.WriteString(rawBlockToMarkdown(block))
+		}
+	}
+
+	flushList()
+
+	return strings.TrimRight(builder.String(), "\n") + "\n"
+}
+
+type inlineStyles map[string]interface{}
+
+func (s inlineStyles) with(key string) inlineStyles {
+	next := inlineStyles{}
+	for k, v := range s {
+		next[k] = v
+	}
+	next[key] = true
+	return next
+}
+
+func textItem(txt string, styles inlineStyles) map[string]interface{} {
+	itemStyles := map[string]interface{}{}
+	for k, v := range styles {
+		itemStyles[k] = v
+	}
+
+	return map[string]interface{}{
+		"type":   "text",
+		"text":   txt,
+		"styles": itemStyles,
+	}
+}
+
+func appendText(items []interface{}, txt string, styles inlineStyles) []interface{} {
+	if txt == "" {
+		return items
+	}
+
+	if len(items) > 0 {
+		if last, ok := items[len(items)-1].(map[string]interface{}); ok && last["type"] == "text" {
+			lastStyles, _ := last["styles"].(map[string]interface{})
+			if len(lastStyles) == len(styles) {
+				same := true
+				for k, v := range styles {
+					if lastStyles[k] != v {
+						same = false
+						break
+					}
+				}
+				if same {
+					last["text"] = last["text"].(string) + txt
+					return items
+				}
+			}
+		}
+	}
+
+	return append(items, textItem(txt, styles))
+}
+
+func inlineFromNode(node ast.Node, source []byte, styles inlineStyles, items []interface{}) []interface{} {
+	for child := node.FirstChild(); child != nil; child = child.NextSibling() {
+		switch n := child.(type) {
+		case *ast.Text:
+			items = appendText(items, string(n.Value(source)), styles)
+			if n.SoftLineBreak() || n.HardLineBreak() {
+				items = appendText(items, " ", styles)
+			}
+		case *ast.String:
+			items = appendText(items, string(n.Value), styles)
+		case *ast.CodeSpan:
+			var code strings.Builder
+			for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+				if t, ok := c.(*ast.Text); ok {
+					code.Write(t.Value(source))
+				}
+			}
+			items = appendText(items, code.String(), styles.with("code"))
+		case *ast.Emphasis:
+			if n.Level >= 2 {
+				items = inlineFromNode(n, source, styles.with("bold"), items)
+			} else {
+				items = inlineFromNode(n, source, styles.with("italic"), items)
+			}
+		case *east.Strikethrough:
+			items = inlineFromNode(n, source, styles.with("strike"), items)
+		case *ast.Link:
+			items = append(items, map[string]interface{}{
+				"type":    "link",
+				"href":    string(n.Destination),
+				"content": inlineFromNode(n, source, styles, []interface{}{}),
+			})
+		case *ast.AutoLink:
+			url := string(n.URL(source))
+			items = append(items, map[string]interface{}{
+				"type":    "link",
+				"href":    url,
+				"content": []interface{}{textItem(string(n.Label(source)), styles)},
+			})
+		case *ast.Image:
+			items = append(items, map[string]interface{}{
+				"type":    "link",
+				"href":    string(n.Destination),
+				"content": inlineFromNode(n, source, styles, []interface{}{}),
+			})
+		case *ast.RawHTML:
+			segments := n.Segments
+			for i := 0; i < segments.Len(); i++ {
+				segment := segments.At(i)
+				items = appendText(items, string(segment.Value(source)), styles)
+			}
+		default:
+			items = inlineFromNode(n, source, styles, items)
+		}
+	}
+
+	return items
+}
+
+func plainText(items []interface{}) string {
+	var builder strings.Builder
+	for _, item := range items {
+		itemMap, _ := item.(map[string]interface{})
+		if txt, ok := itemMap["text"].(string); ok {
+			builder.WriteString(txt)
+		}
+	}
+	return builder.String()
+}
+
+func linesText(node ast.Node, source []byte) string {
+	var builder strings.Builder
+	lines := node.Lines()
+	for i := 0; i < lines.Len(); i++ {
+		line := lines.At(i)
+		builder.Write(line.Value(source))
+	}
+	return strings.TrimSuffix(builder.String(), "\n")
+}
+
+func listFromNode(list *ast.List, source []byte) []Block {
+	var blocks []Block
+	for item := list.FirstChild(); item != nil; item = item.NextSibling() {
+		props := defaultBlockProps()
+		blockType := "bulletListItem"
+		if list.IsOrdered() {
+			blockType = "numberedListItem"
+		}
+
+		content := []interface{}{}
+		var children []Block
+
+		for child := item.FirstChild(); child != nil; child = child.NextSibling() {
+			switch c := child.(type) {
+			case *ast.List:
+				children = append(children, listFromNode(c, source)...)
+			case *ast.TextBlock, *ast.Paragraph:
+				if checkBox, ok := c.FirstChild().(*east.TaskCheckBox); ok {
+					blockType = "checkListItem"
+					props["checked"] = checkBox.IsChecked
+				}
+				if len(content) > 0 {
+					content = appendText(content, " ", inlineStyles{})
+				}
+				content = inlineFromNode(c, source, inlineStyles{}, content)
+			default:
+				children = append(children, blocksFromNode(c, source)...)
+			}
+		}
+
+		if len(content) > 0 {
+			if first, ok := content[0].(map[string]interface{}); ok && first["type"] == "text" {
+				first["text"] = strings.TrimLeft(first["text"].(string), " ")
+			}
+		}
+
+		block := newBlock(blockType, props, content)
+		if children != nil {
+			block.Children = children
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks
+}
+
+func tableFromNode(table *east.Table, source []byte) Block {
+	var rows []interface{}
+	for row := table.FirstChild(); row != nil; row = row.NextSibling() {
+		var cells []interface{}
+		for cell := row.FirstChild(); cell != nil; cell = cell.NextSibling() {
+			cells = append(cells, inlineFromNode(cell, source, inlineStyles{}, []interface{}{}))
+		}
+		rows = append(rows, map[string]interface{}{"cells": cells})
+	}
+
+	return newBlock("table", map[string]interface{}{
+		"textColor":       "default",
+		"backgroundColor": "default",
+	}, map[string]interface{}{
+		"type": "tableContent",
+		"rows": rows,
+	})
+}
+
+func blockquoteFromNode(quote *ast.Blockquote, source []byte) []Block {
+	first, ok := quote.FirstChild().(*ast.Paragraph)
+	if ok {
+		content := inlineFromNode(first, source, inlineStyles{}, []interface{}{})
+		txt := plainText(content)
+		for alertType, marker := range alertMarkers {
+			prefix := "[!" + marker + "]"
+			if strings.HasPrefix(txt, prefix) {
+				firstItem := content[0].(map[string]interface{})
+				firstItem["text"] = strings.TrimLeft(strings.TrimPrefix(firstItem["text"].(string), prefix), " ")
+				if firstItem["text"] == "" {
+					content = content[1:]
+				}
+				props := map[string]interface{}{
+					"textColor":     "default",
+					"textAlignment": "left",
+					"type":          alertType,
+				}
+				return []Block{newBlock("alert", props, content)}
+			}
+		}
+	}
+
+	var blocks []Block
+	for child := quote.FirstChild(); child != nil; child = child.NextSibling() {
+		blocks = append(blocks, blocksFromNode(child, source)...)
+	}
+	return blocks
+}
+
+func blocksFromNode(node ast.Node, source []byte) []Block {
+	switch n := node.(type) {
+	case *ast.Heading:
+		props := defaultBlockProps()
+		level := n.Level
+		if level > 3 {
+			level = 3
+		}
+		props["level"] = level
+		return []Block{newBlock("heading", props, inlineFromNode(n, source, inlineStyles{}, []interface{}{}))}
+	case *ast.Paragraph, *ast.TextBlock:
+		if img, ok := n.FirstChild().(*ast.Image); ok && n.ChildCount() == 1 {
+			caption := plainText(inlineFromNode(img, source, inlineStyles{}, []interface{}{}))
+			return []Block{newBlock("image", map[string]interface{}{
+				"backgroundColor": "default",
+				"textAlignment":   "left",
+				"name":            "",
+				"url":             string(img.Destination),
+				"caption":         caption,
+				"showPreview":     true,
+				"previewWidth":    512,
+			}, nil)}
+		}
+		return []Block{newBlock("paragraph", defaultBlockProps(), inlineFromNode(n, source, inlineStyles{}, []interface{}{}))}
+	case *ast.FencedCodeBlock:
+		language := string(n.Language(source))
+		code := linesText(n, source)
+		if language == rawBlockFence {
+			var block Block
+			if err := json.Unmarshal([]byte(code), &block); err == nil && block.Type != "" {
+				return []Block{block}
+			}
+		}
+		return []Block{newBlock("procode", map[string]interface{}{"language": language, "code": code}, nil)}
+	case *ast.CodeBlock:
+		return []Block{newBlock("procode", map[string]interface{}{"language": "", "code": linesText(n, source)}, nil)}
+	case *ast.List:
+		return listFromNode(n, source)
+	case *ast.Blockquote:
+		return blockquoteFromNode(n, source)
+	case *east.Table:
+		return []Block{tableFromNode(n, source)}
+	case *ast.HTMLBlock:
+		return []Block{newBlock("paragraph", defaultBlockProps(), []interface{}{textItem(linesText(n, source), inlineStyles{})})}
+	case *ast.ThematicBreak:
+		return nil
+	default:
+		var blocks []Block
+		for child := node.FirstChild(); child != nil; child = child.NextSibling() {
+			blocks = append(blocks, blocksFromNode(child, source)...)
+		}
+		return blocks
+	}
+}
+
+// MarkdownToBlocks parses (GitHub flavoured) Markdown into BlockNote blocks,
+// the inverse of BlocksToMarkdown.
+func MarkdownToBlocks(markdown string) ([]Block, error) {
+	source := []byte(markdown)
+	gm := goldmark.New(goldmark.WithExtensions(extension.GFM))
+	root := gm.Parser().Parse(text.NewReader(source))
+
+	if root == nil {
+		return nil, fmt.Errorf("failed to parse markdown")
+	}
+
+	blocks := []Block{}
+	for child := root.FirstChild(); child != nil; child = child.NextSibling() {
+		blocks = append(blocks, blocksFromNode(child, source)...)
+	}
+
+	return blocks, nil
+}
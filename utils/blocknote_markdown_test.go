@@ -0,0 +1,148 @@
+package utils
+
+import (
+	"testing"
+)
+
+func TestBlocksToMarkdown(t *testing.T) {
+	tests := []struct {
+		name     string
+		blocks   []Block
+		expected string
+	}{
+		{
+			name: "Heading and paragraph",
+			blocks: []Block{
+				{Type: "heading", Props: map[string]interface{}{"level": float64(2)}, Content: []interface{}{
+					map[string]interface{}{"type": "text", "text": "Title", "styles": map[string]interface{}{}},
+				}},
+				{Type: "paragraph", Content: []interface{}{
+					map[string]interface{}{"type": "text", "text": "Some ", "styles": map[string]interface{}{}},
+					map[string]interface{}{"type": "text", "text": "bold", "styles": map[string]interface{}{"bold": true}},
+				}},
+			},
+			expected: "## Title\n\nSome **bold**\n",
+		},
+		{
+			name: "Code block",
+			blocks: []Block{
+				{Type: "procode", Props: map[string]interface{}{"language": "go", "code": "fmt.Println(1)"}},
+			},
+			expected: "```go\nfmt.Println(1)\n```\n",
+		},
+		{
+			name: "Bullet list",
+			blocks: []Block{
+				{Type: "bulletListItem", Content: []interface{}{
+					map[string]interface{}{"type": "text", "text": "one", "styles": map[string]interface{}{}},
+				}},
+				{Type: "bulletListItem", Content: []interface{}{
+					map[string]interface{}{"type": "text", "text": "two", "styles": map[string]interface{}{}},
+				}},
+			},
+			expected: "- one\n- two\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := BlocksToMarkdown(tt.blocks)
+			if result != tt.expected {
+				t.Errorf("BlocksToMarkdown() got = %q, want %q", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestMarkdownToBlocksRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		markdown string
+	}{
+		{
+			name:     "Headings and paragraphs",
+			markdown: "# Title\n\nSome **bold** and _italic_ text with `code`.\n\n## Section\n\nAnother paragraph with a [link](https://example.com).\n",
+		},
+		{
+			name:     "Lists",
+			markdown: "- one\n- two\n\n1. first\n2. second\n\n- [ ] todo\n- [x] done\n",
+		},
+		{
+			name:     "Code and image",
+			markdown: "```go\nfunc main() {}\n```\n\n![Logo](https://example.com/logo.png)\n",
+		},
+		{
+			name:     "Alert",
+			markdown: "> [!WARNING]\n> Be careful\n",
+		},
+		{
+			name:     "Table",
+			markdown: "| Name | Value |\n| --- | --- |\n| a | 1 |\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			blocks, err := MarkdownToBlocks(tt.markdown)
+			if err != nil {
+				t.Fatalf("MarkdownToBlocks() error = %v", err)
+			}
+
+			result := BlocksToMarkdown(blocks)
+			if result != tt.markdown {
+				t.Errorf("round trip got = %q, want %q", result, tt.markdown)
+			}
+		})
+	}
+}
+
+func TestMarkdownToBlocksRawBlock(t *testing.T) {
+	blocks := []Block{
+		{ID: "1", Type: "cards", Props: map[string]interface{}{"columns": float64(3)}, Content: []interface{}{}, Children: []Block{}},
+	}
+
+	blocksBack, err := MarkdownToBlocks(BlocksToMarkdown(blocks))
+	if err != nil {
+		t.Fatalf("MarkdownToBlocks() error = %v", err)
+	}
+
+	if len(blocksBack) != 1 || blocksBack[0].Type != "cards" || blocksBack[0].Props["columns"] != float64(3) {
+		t.Errorf("raw block not restored, got = %+v", blocksBack)
+	}
+}
+
+func TestFrontmatter(t *testing.T) {
+	type meta struct {
+		ID    uint   `yaml:"id"`
+		Title string `yaml:"title"`
+	}
+
+	content, err := WriteFrontmatter(meta{ID: 4, Title: "Getting Started"}, "# Hello\n")
+	if err != nil {
+		t.Fatalf("WriteFrontmatter() error = %v", err)
+	}
+
+	expected := "---\nid: 4\ntitle: Getting Started\n---\n\n# Hello\n"
+	if content != expected {
+		t.Errorf("WriteFrontmatter() got = %q, want %q", content, expected)
+	}
+
+	var parsed meta
+	body, err := ReadFrontmatter(content, &parsed)
+	if err != nil {
+		t.Fatalf("ReadFrontmatter() error = %v", err)
+	}
+
+	if parsed.ID != 4 || parsed.Title != "Getting Started" || body != "# Hello\n" {
+		t.Errorf("ReadFrontmatter() got = %+v %q", parsed, body)
+	}
+
+	body, err = ReadFrontmatter("no frontmatter\n", &parsed)
+	if err != nil || body != "no frontmatter\n" {
+		t.Errorf("ReadFrontmatter() without frontmatter got = %q, %v", body, err)
+	}
+
+	if _, err := ReadFrontmatter("---\nid: 1\n", &parsed); err == nil {
+		t.Errorf("ReadFrontmatter() expected error for unterminated frontmatter")
+	}
+}
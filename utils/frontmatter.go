@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+func WriteFrontmatter(meta interface{}, body string) (string, error) {
+	var buffer bytes.Buffer
+	encoder := yaml.NewEncoder(&buffer)
+	encoder.SetIndent(2)
+
+	if err := encoder.Encode(meta); err != nil {
+		return "", err
+	}
+
+	if err := encoder.Close(); err != nil {
+		return "", err
+	}
+
+	if body == "" {
+		return fmt.Sprintf("---\n%s---\n", buffer.String()), nil
+	}
+
+	return fmt.Sprintf("---\n%s---\n\n%s", buffer.String(), body), nil
+}
+
+func ReadFrontmatter(content string, meta interface{}) (string, error) {
+	normalized := strings.ReplaceAll(content, "\r\n", "\n")
+
+	if !strings.HasPrefix(normalized, "---\n") {
+		return normalized, nil
+	}
+
+	rest := normalized[len("---\n"):]
+	if strings.HasPrefix(rest, "---") {
+		return strings.TrimLeft(strings.TrimPrefix(rest, "---"), "\n"), nil
+	}
+
+	end := strings.Index(rest, "\n---")
+	if end == -1 {
+		return "", fmt.Errorf("unterminated frontmatter")
+	}
+
+	if err := yaml.Unmarshal([]byte(rest[:end]), meta); err != nil {
+		return "", fmt.Errorf("invalid frontmatter: %w", err)
+	}
+
+	body := rest[end+len("\n---"):]
+	body = strings.TrimPrefix(body, "\n")
+
+	return strings.TrimLeft(body, "\n"), nil
+}
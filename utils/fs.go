@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
@@ -136,6 +137,233 @@ func Tree(dir string) (map[string][]byte, error) {
 	return filesContent, nil
 }
 
+// listFiles returns the paths of the files under dir, relative to it.
+func listFiles(dir string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !entry.IsDir() {
+			relativePath, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			files = append(files, relativePath)
+		}
+
+		return nil
+	})
+
+	return files, err
+}
+
+func sameFileContent(a, b string) bool {
+	aInfo, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+
+	bInfo, err := os.Stat(b)
+	if err != nil || aInfo.Size() != bInfo.Size() {
+		return false
+	}
+
+	aContent, err := os.ReadFile(a)
+	if err != nil {
+		return false
+	}
+
+	bContent, err := os.ReadFile(b)
+	if err != nil {
+		return false
+	}
+
+	return bytes.Equal(aContent, bContent)
+}
+
+// SyncDir makes dst match src by moving over only the files of src that are
+// new or differ from dst and removing the files src no longer has, so that
+// unchanged files in dst are left untouched. src is removed afterwards. The
+// paths of the changed and removed files are returned relative to dst.
+//
+// Pages are moved last and stale files removed after them, so that a page
+// never references an asset that is not there yet or already gone. The files
+// replaced or removed are kept aside until the end and put back if any step
+// fails, leaving dst as it was.
+func SyncDir(src, dst string) ([]string, []string, error) {
+	srcFiles, err := listFiles(src)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := MakeDir(dst); err != nil {
+		return nil, nil, err
+	}
+
+	var assets, pages, removed []string
+	keep := make(map[string]bool, len(srcFiles))
+
+	for _, file := range srcFiles {
+		keep[file] = true
+
+		if sameFileContent(filepath.Join(src, file), filepath.Join(dst, file)) {
+			continue
+		}
+
+		if strings.EqualFold(filepath.Ext(file), ".html") {
+			pages = append(pages, file)
+		} else {
+			assets = append(assets, file)
+		}
+	}
+
+	dstFiles, err := listFiles(dst)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, file := range dstFiles {
+		if !keep[file] {
+			removed = append(removed, file)
+		}
+	}
+
+	changed := append(assets, pages...)
+
+	backup, err := os.MkdirTemp(filepath.Dir(dst), filepath.Base(dst)+".backup-")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	swap := &dirSwap{dst: dst, backup: backup}
+
+	for _, file := range changed {
+		if err := swap.replace(filepath.Join(src, file), file); err != nil {
+			return nil, nil, swap.rollback(err)
+		}
+	}
+
+	for _, file := range removed {
+		if err := swap.replace("", file); err != nil {
+			return nil, nil, swap.rollback(err)
+		}
+	}
+
+	if err := RemoveEmptyDirs(dst); err != nil {
+		return nil, nil, err
+	}
+
+	if err := os.RemoveAll(backup); err != nil {
+		return nil, nil, err
+	}
+
+	return changed, removed, os.RemoveAll(src)
+}
+
+// dirSwap records the files SyncDir has replaced in dst so that they can be
+// put back.
+type dirSwap struct {
+	dst     string
+	backup  string
+	applied []swappedFile
+}
+
+type swappedFile struct {
+	path     string
+	from     string
+	backedUp bool
+}
+
+// replace moves the file at path in dst aside, if there is one, and moves
+// from into its place. An empty from only removes the file.
+func (swap *dirSwap) replace(from string, path string) error {
+	dstPath := filepath.Join(swap.dst, path)
+	applied := swappedFile{path: path, from: from}
+
+	if PathExists(dstPath) {
+		backupPath := filepath.Join(swap.backup, path)
+		if err := MakeDir(filepath.Dir(backupPath)); err != nil {
+			return err
+		}
+
+		if err := os.Rename(dstPath, backupPath); err != nil {
+			return err
+		}
+		applied.backedUp = true
+	}
+	swap.applied = append(swap.applied, applied)
+
+	if from == "" {
+		return nil
+	}
+
+	if err := MakeDir(filepath.Dir(dstPath)); err != nil {
+		return err
+	}
+
+	return os.Rename(from, dstPath)
+}
+
+// rollback moves the new files back where they came from and the replaced
+// ones back into dst, in reverse order, and returns err.
+func (swap *dirSwap) rollback(err error) error {
+	for i := len(swap.applied) - 1; i >= 0; i-- {
+		applied := swap.applied[i]
+		dstPath := filepath.Join(swap.dst, applied.path)
+
+		if applied.from != "" && PathExists(dstPath) {
+			if mvErr := os.Rename(dstPath, applied.from); mvErr != nil {
+				return fmt.Errorf("%w (rollback failed: %v)", err, mvErr)
+			}
+		}
+
+		if !applied.backedUp {
+			continue
+		}
+
+		if mvErr := os.Rename(filepath.Join(swap.backup, applied.path), dstPath); mvErr != nil {
+			return fmt.Errorf("%w (rollback failed: %v)", err, mvErr)
+		}
+	}
+
+	RemoveEmptyDirs(swap.dst)
+	os.RemoveAll(swap.backup)
+
+	return err
+}
+
+// RemoveEmptyDirs removes the directories under dir, but not dir itself,
+// that are left without any files.
+func RemoveEmptyDirs(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		if err := RemoveEmptyDirs(path); err != nil {
+			return err
+		}
+
+		if empty, err := IsEmptyDir(path); err != nil {
+			return err
+		} else if empty {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
 func FileHash(input interface{}) (string, error) {
 	var reader io.Reader
 	switch v := input.(type) {
@@ -195,7 +423,43 @@ func IsEmptyDir(path string) (bool, error) {
 	return false, err
 }
 
-func WritePnpmStoreConfig(projectDir, storeDir string) error {
-	content := fmt.Sprintf("store-dir=%s\n", filepath.ToSlash(storeDir))
-	return os.WriteFile(filepath.Join(projectDir, ".npmrc"), []byte(content), 0644)
+// PnpmConfig is the configuration written to the .npmrc of the projects
+// pnpm installs packages for.
+type PnpmConfig struct {
+	StoreDir  string
+	Registry  string
+	AuthToken string
+	// Offline installs packages from the store alone, without the registry
+	Offline bool
+}
+
+const defaultNpmRegistry = "https://registry.npmjs.org/"
+
+func (pnpmConfig PnpmConfig) npmrc() string {
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "store-dir=%s\n", filepath.ToSlash(pnpmConfig.StoreDir))
+
+	registry := defaultNpmRegistry
+	if pnpmConfig.Registry != "" {
+		registry = strings.TrimSuffix(pnpmConfig.Registry, "/") + "/"
+		fmt.Fprintf(&builder, "registry=%s\n", registry)
+	}
+
+	if pnpmConfig.AuthToken != "" {
+		// Tokens are scoped to the registry they are for, without its scheme
+		host := registry[strings.Index(registry, "//"):]
+		fmt.Fprintf(&builder, "%s:_authToken=%s\n", host, pnpmConfig.AuthToken)
+	}
+
+	if pnpmConfig.Offline {
+		builder.WriteString("offline=true\n")
+	}
+
+	return builder.String()
+}
+
+// WritePnpmConfig writes the .npmrc of projectDir. It is only readable by
+// its owner, as it may hold the registry token.
+func WritePnpmConfig(projectDir string, pnpmConfig PnpmConfig) error {
+	return os.WriteFile(filepath.Join(projectDir, ".npmrc"), []byte(pnpmConfig.npmrc()), 0600)
 }
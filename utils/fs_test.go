@@ -447,3 +447,166 @@ func TestTree(t *testing.T) {
 		t.Errorf("Tree result does not match expected output.\nGot: %v\nExpected: %v", result, expected)
 	}
 }
+
+func TestSyncDir(t *testing.T) {
+	tempDir := t.TempDir()
+	src := filepath.Join(tempDir, "build_tmp")
+	dst := filepath.Join(tempDir, "build")
+
+	files := map[string]map[string]string{
+		src: {
+			"index.html":        "home",
+			"guides/intro.html": "intro v2",
+			"guides/new.html":   "new",
+			"static/main.2.js":  "main v2",
+		},
+		dst: {
+			"index.html":          "home",
+			"guides/intro.html":   "intro v1",
+			"static/main.1.js":    "main v1",
+			"old/removed.html":    "removed",
+			"guides/removed.html": "removed",
+		},
+	}
+
+	for dir, contents := range files {
+		for name, content := range contents {
+			path := filepath.Join(dir, name)
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatalf("Failed to create directory: %v", err)
+			}
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatalf("Failed to write file: %v", err)
+			}
+		}
+	}
+
+	unchanged, err := os.Stat(filepath.Join(dst, "index.html"))
+	if err != nil {
+		t.Fatalf("Failed to stat file: %v", err)
+	}
+
+	changed, removed, err := SyncDir(src, dst)
+	if err != nil {
+		t.Fatalf("SyncDir failed: %v", err)
+	}
+
+	// Assets are moved before the pages referencing them
+	expectedChanged := []string{filepath.Join("static", "main.2.js"), filepath.Join("guides", "intro.html"), filepath.Join("guides", "new.html")}
+	if !reflect.DeepEqual(changed, expectedChanged) {
+		t.Errorf("Expected changed files %v, got %v", expectedChanged, changed)
+	}
+
+	expectedRemoved := []string{filepath.Join("guides", "removed.html"), filepath.Join("old", "removed.html"), filepath.Join("static", "main.1.js")}
+	if !reflect.DeepEqual(removed, expectedRemoved) {
+		t.Errorf("Expected removed files %v, got %v", expectedRemoved, removed)
+	}
+
+	content, err := os.ReadFile(filepath.Join(dst, "guides", "intro.html"))
+	if err != nil || string(content) != "intro v2" {
+		t.Errorf("Expected updated content, got %q (%v)", content, err)
+	}
+
+	if info, err := os.Stat(filepath.Join(dst, "index.html")); err != nil || !os.SameFile(info, unchanged) {
+		t.Error("Expected unchanged file to be left in place")
+	}
+
+	if PathExists(filepath.Join(dst, "old")) {
+		t.Error("Expected empty directory to be removed")
+	}
+
+	if PathExists(src) {
+		t.Error("Expected source directory to be removed")
+	}
+
+	if entries, _ := os.ReadDir(tempDir); len(entries) != 1 {
+		t.Errorf("Expected no backup left next to the destination, got %d entries", len(entries))
+	}
+}
+
+func TestSyncDirRollback(t *testing.T) {
+	tempDir := t.TempDir()
+	src := filepath.Join(tempDir, "build_tmp")
+	dst := filepath.Join(tempDir, "build")
+
+	files := map[string]string{
+		filepath.Join(src, "static", "main.js"):   "main v2",
+		filepath.Join(src, "index.html"):          "home v2",
+		filepath.Join(src, "pages", "intro.html"): "intro",
+		filepath.Join(dst, "static", "main.js"):   "main v1",
+		filepath.Join(dst, "index.html"):          "home v1",
+		// A file where src has a directory makes moving pages/intro.html fail
+		filepath.Join(dst, "pages"): "pages",
+	}
+
+	for path, content := range files {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+
+	if _, _, err := SyncDir(src, dst); err == nil {
+		t.Fatal("Expected SyncDir to fail")
+	}
+
+	for path, content := range files {
+		got, err := os.ReadFile(path)
+		if err != nil || string(got) != content {
+			t.Errorf("Expected %s to be restored to %q, got %q (%v)", path, content, got, err)
+		}
+	}
+
+	if entries, _ := os.ReadDir(tempDir); len(entries) != 2 {
+		t.Errorf("Expected no backup left next to the destination, got %d entries", len(entries))
+	}
+}
+
+func TestWritePnpmConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   PnpmConfig
+		expected string
+	}{
+		{
+			name:     "Store only",
+			config:   PnpmConfig{StoreDir: "/data/pnpm-store"},
+			expected: "store-dir=/data/pnpm-store\n",
+		},
+		{
+			name:     "Registry with token",
+			config:   PnpmConfig{StoreDir: "/data/pnpm-store", Registry: "https://npm.example.com/repository/npm", AuthToken: "secret"},
+			expected: "store-dir=/data/pnpm-store\nregistry=https://npm.example.com/repository/npm/\n//npm.example.com/repository/npm/:_authToken=secret\n",
+		},
+		{
+			name:     "Token for the public registry",
+			config:   PnpmConfig{StoreDir: "/data/pnpm-store", AuthToken: "secret"},
+			expected: "store-dir=/data/pnpm-store\n//registry.npmjs.org/:_authToken=secret\n",
+		},
+		{
+			name:     "Offline",
+			config:   PnpmConfig{StoreDir: "/data/pnpm-store", Offline: true},
+			expected: "store-dir=/data/pnpm-store\noffline=true\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := WritePnpmConfig(dir, tt.config); err != nil {
+				t.Fatalf("WritePnpmConfig() error = %v", err)
+			}
+
+			content, err := os.ReadFile(filepath.Join(dir, ".npmrc"))
+			if err != nil {
+				t.Fatalf("Failed to read .npmrc: %v", err)
+			}
+
+			if string(content) != tt.expected {
+				t.Errorf("WritePnpmConfig() got = %q, want %q", content, tt.expected)
+			}
+		})
+	}
+}
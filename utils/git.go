@@ -1,26 +1,50 @@
 package utils
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"net"
 	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
 
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing/transport"
 	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
+var scpLikeGitURL = regexp.MustCompile(`^[A-Za-z0-9._-]+@[A-Za-z0-9.-]+:[A-Za-z0-9._~/-]+$`)
+
 func IsValidGitURL(str string) bool {
+	if IsSSHGitURL(str) {
+		return true
+	}
+
 	parsedURL, err := url.Parse(str)
 	return err == nil && (parsedURL.Scheme == "http" || parsedURL.Scheme == "https")
 }
 
-func IsRepoAccessible(url, username, password string) error {
-	remote := git.NewRemote(nil, &config.RemoteConfig{
-		Name: "origin",
-		URLs: []string{url},
-	})
+func IsSSHGitURL(str string) bool {
+	if scpLikeGitURL.MatchString(str) {
+		return true
+	}
+
+	parsedURL, err := url.Parse(str)
+	return err == nil && parsedURL.Scheme == "ssh" && parsedURL.Host != ""
+}
 
-	var auth *http.BasicAuth
+func IsRepoAccessible(url, username, password string) error {
+	var auth transport.AuthMethod
 
 	if username != "" && password != "" {
 		auth = &http.BasicAuth{
@@ -29,6 +53,15 @@ func IsRepoAccessible(url, username, password string) error {
 		}
 	}
 
+	return IsRepoAccessibleWithAuth(url, auth)
+}
+
+func IsRepoAccessibleWithAuth(url string, auth transport.AuthMethod) error {
+	remote := git.NewRemote(nil, &config.RemoteConfig{
+		Name: "origin",
+		URLs: []string{url},
+	})
+
 	_, err := remote.List(&git.ListOptions{
 		Auth: auth,
 	})
@@ -39,3 +72,153 @@ func IsRepoAccessible(url, username, password string) error {
 
 	return nil
 }
+
+// GenerateSSHKey creates an ed25519 key pair, returning the private key in
+// OpenSSH PEM format and the public key in authorized_keys format.
+func GenerateSSHKey(comment string) (string, string, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+
+	block, err := ssh.MarshalPrivateKey(privateKey, comment)
+	if err != nil {
+		return "", "", err
+	}
+
+	sshPublicKey, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	authorizedKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPublicKey)))
+	if comment != "" {
+		authorizedKey += " " + comment
+	}
+
+	return string(pem.EncodeToMemory(block)), authorizedKey, nil
+}
+
+// SSHPublicKey returns the authorized_keys line for a PEM private key.
+func SSHPublicKey(privateKey string) (string, error) {
+	signer, err := ssh.ParsePrivateKey([]byte(privateKey))
+	if err != nil {
+		return "", fmt.Errorf("invalid ssh private key: %v", err)
+	}
+
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey()))), nil
+}
+
+// ValidateKnownHosts checks that pins are known_hosts lines, each one naming
+// the hosts its key belongs to ("host key-type base64").
+func ValidateKnownHosts(pins string) error {
+	rest := []byte(pins)
+
+	for len(bytes.TrimSpace(rest)) > 0 {
+		var err error
+		if _, _, _, _, rest, err = ssh.ParseKnownHosts(rest); err != nil {
+			return fmt.Errorf("invalid known_hosts: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// knownHostsCallback loads pins into a known_hosts host key callback.
+func knownHostsCallback(pins string) (ssh.HostKeyCallback, error) {
+	file, err := os.CreateTemp("", "kalmia-known-hosts-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.WriteString(pins)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return knownhosts.New(file.Name())
+}
+
+// GitSSHAuth builds go-git SSH auth from a PEM private key. The server's host
+// key is checked against pins, a known_hosts list. A host with no pinned key
+// is only trusted when onNewHostKey is set: the presented key is handed to it
+// as a known_hosts line so that the caller can pin it for that host.
+func GitSSHAuth(repoURL, privateKey, pins string, onNewHostKey func(string)) (transport.AuthMethod, error) {
+	user := "git"
+	endpoint, err := transport.NewEndpoint(repoURL)
+	if err == nil && endpoint.User != "" {
+		user = endpoint.User
+	}
+
+	auth, err := gitssh.NewPublicKeys(user, []byte(privateKey), "")
+	if err != nil {
+		return nil, fmt.Errorf("invalid ssh private key: %v", err)
+	}
+
+	checkHostKey, err := knownHostsCallback(pins)
+	if err != nil {
+		return nil, err
+	}
+
+	auth.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := checkHostKey(hostname, remote, key)
+
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) {
+			if len(keyErr.Want) > 0 {
+				return fmt.Errorf("host key mismatch for %s: got %s", hostname, ssh.FingerprintSHA256(key))
+			}
+
+			if onNewHostKey == nil {
+				return fmt.Errorf("unknown host key for %s: %s", hostname, ssh.FingerprintSHA256(key))
+			}
+
+			onNewHostKey(knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key))
+			return nil
+		}
+
+		return err
+	}
+
+	if endpoint != nil {
+		auth.HostKeyAlgorithms = pinnedHostKeyAlgorithms(checkHostKey, endpoint.Host, endpoint.Port)
+	}
+
+	return auth, nil
+}
+
+// pinnedHostKeyAlgorithms lists the algorithms of the keys pinned for host,
+// so that the server presents one of those rather than another of its keys.
+func pinnedHostKeyAlgorithms(checkHostKey ssh.HostKeyCallback, host string, port int) []string {
+	if port == 0 {
+		port = 22
+	}
+
+	// No real host key matches this one, so the error lists every pin for host
+	probe, err := ssh.NewPublicKey(ed25519.PublicKey(make([]byte, ed25519.PublicKeySize)))
+	if err != nil {
+		return nil
+	}
+
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+	remote := &net.TCPAddr{IP: net.IPv4zero, Port: port}
+
+	var keyErr *knownhosts.KeyError
+	if !errors.As(checkHostKey(address, remote, probe), &keyErr) {
+		return nil
+	}
+
+	var algorithms []string
+	for _, pinned := range keyErr.Want {
+		if pinned.Key.Type() == ssh.KeyAlgoRSA {
+			algorithms = append(algorithms, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256)
+		}
+		algorithms = append(algorithms, pinned.Key.Type())
+	}
+
+	return algorithms
+}
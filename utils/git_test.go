@@ -1,6 +1,16 @@
 package utils
 
-import "testing"
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"strings"
+	"testing"
+
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
 
 func TestIsValidGitURL(t *testing.T) {
 	tests := []struct {
@@ -12,6 +22,9 @@ func TestIsValidGitURL(t *testing.T) {
 		{"ftp://github.com/user/repo.git", false},
 		{"file:///path/to/repo", false},
 		{"invalid_url", false},
+		{"git@github.com:user/repo.git", true},
+		{"ssh://git@git.example.com:2222/user/repo.git", true},
+		{"ssh:///no-host", false},
 	}
 
 	for _, test := range tests {
@@ -40,3 +53,101 @@ func TestIsRepoAccessible(t *testing.T) {
 		}
 	}
 }
+
+func TestGenerateSSHKey(t *testing.T) {
+	privateKey, publicKey, err := GenerateSSHKey("kalmia-test")
+	if err != nil {
+		t.Fatalf("GenerateSSHKey() error = %v", err)
+	}
+
+	if !strings.HasPrefix(publicKey, "ssh-ed25519 ") || !strings.HasSuffix(publicKey, " kalmia-test") {
+		t.Errorf("GenerateSSHKey() public key = %q", publicKey)
+	}
+
+	derived, err := SSHPublicKey(privateKey)
+	if err != nil {
+		t.Fatalf("SSHPublicKey() error = %v", err)
+	}
+
+	if !strings.HasPrefix(publicKey, derived) {
+		t.Errorf("SSHPublicKey() = %q, want prefix of %q", derived, publicKey)
+	}
+
+	if _, err := SSHPublicKey("not a key"); err == nil {
+		t.Errorf("SSHPublicKey() expected error for invalid key")
+	}
+}
+
+func TestGitSSHAuthHostKeyPinning(t *testing.T) {
+	privateKey, _, err := GenerateSSHKey("")
+	if err != nil {
+		t.Fatalf("GenerateSSHKey() error = %v", err)
+	}
+
+	newHostKey := func() ssh.PublicKey {
+		public, _, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := ssh.NewPublicKey(public)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+
+	hostKey := newHostKey()
+	otherKey := newHostKey()
+	remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 22}
+	pin := knownhosts.Line([]string{"git.example.com"}, hostKey)
+
+	auth, err := GitSSHAuth("git@git.example.com:user/repo.git", privateKey, pin, nil)
+	if err != nil {
+		t.Fatalf("GitSSHAuth() error = %v", err)
+	}
+
+	callback := auth.(*gitssh.PublicKeys).HostKeyCallback
+	if err := callback("git.example.com:22", remote, hostKey); err != nil {
+		t.Errorf("pinned host key rejected: %v", err)
+	}
+
+	if err := callback("git.example.com:22", remote, otherKey); err == nil {
+		t.Errorf("unpinned host key accepted")
+	}
+
+	if err := callback("mirror.example.com:22", remote, hostKey); err == nil {
+		t.Errorf("host key accepted for a host without a pin")
+	}
+
+	if algorithms := auth.(*gitssh.PublicKeys).HostKeyAlgorithms; len(algorithms) != 1 || algorithms[0] != ssh.KeyAlgoED25519 {
+		t.Errorf("HostKeyAlgorithms = %v, want [%s]", algorithms, ssh.KeyAlgoED25519)
+	}
+
+	var pinned string
+	auth, err = GitSSHAuth("git@mirror.example.com:user/repo.git", privateKey, pin, func(line string) { pinned = line })
+	if err != nil {
+		t.Fatalf("GitSSHAuth() error = %v", err)
+	}
+
+	callback = auth.(*gitssh.PublicKeys).HostKeyCallback
+	if err := callback("mirror.example.com:22", remote, otherKey); err != nil {
+		t.Errorf("first host key rejected: %v", err)
+	}
+
+	if pinned != knownhosts.Line([]string{"mirror.example.com"}, otherKey) {
+		t.Errorf("first host key not reported for pinning, got %q", pinned)
+	}
+
+	if err := ValidateKnownHosts(pin + "\n" + pinned); err != nil {
+		t.Errorf("ValidateKnownHosts() error = %v", err)
+	}
+
+	pinned = ""
+	if err := callback("git.example.com:22", remote, otherKey); err == nil || pinned != "" {
+		t.Errorf("changed host key accepted or re-pinned")
+	}
+
+	if err := ValidateKnownHosts("garbage"); err == nil {
+		t.Errorf("ValidateKnownHosts() expected error for invalid line")
+	}
+}
@@ -0,0 +1,209 @@
+package utils
+
+import (
+	"html"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// highlightSyntax is just enough of the syntax of a language to colour its
+// keywords, strings, numbers and comments.
+type highlightSyntax struct {
+	keywords      map[string]bool
+	lineComments  []string
+	blockComments [][2]string
+	quotes        string
+	caseless      bool
+}
+
+func keywords(list string) map[string]bool {
+	set := make(map[string]bool)
+	for _, word := range strings.Fields(list) {
+		set[word] = true
+	}
+
+	return set
+}
+
+var (
+	cComments     = [][2]string{{"/*", "*/"}}
+	jsKeywords    = "break case catch class const continue debugger default delete do else export extends finally for function if import in instanceof let new return super switch this throw try typeof var void while with yield async await of from as true false null undefined"
+	shellSyntax   = &highlightSyntax{keywords: keywords("if then else elif fi for while until do done case esac function in return export local readonly source exit set unset shift"), lineComments: []string{"#"}, quotes: `"'`}
+	goSyntax      = &highlightSyntax{keywords: keywords("break case chan const continue default defer else fallthrough for func go goto if import interface map package range return select struct switch type var true false nil iota"), lineComments: []string{"//"}, blockComments: cComments, quotes: "\"'`"}
+	jsSyntax      = &highlightSyntax{keywords: keywords(jsKeywords), lineComments: []string{"//"}, blockComments: cComments, quotes: "\"'`"}
+	tsSyntax      = &highlightSyntax{keywords: keywords(jsKeywords + " interface type enum implements namespace declare readonly private public protected abstract keyof any unknown never string number boolean"), lineComments: []string{"//"}, blockComments: cComments, quotes: "\"'`"}
+	pythonSyntax  = &highlightSyntax{keywords: keywords("and as assert async await break class continue def del elif else except finally for from global if import in is lambda nonlocal not or pass raise return try while with yield True False None self"), lineComments: []string{"#"}, quotes: `"'`}
+	rustSyntax    = &highlightSyntax{keywords: keywords("as async await break const continue crate dyn else enum extern false fn for if impl in let loop match mod move mut pub ref return self Self static struct super trait true type unsafe use where while"), lineComments: []string{"//"}, blockComments: cComments, quotes: `"`}
+	javaSyntax    = &highlightSyntax{keywords: keywords("abstract boolean break byte case catch char class const continue default do double else enum extends final finally float for if implements import instanceof int interface long new null package private protected public return short static super switch synchronized this throw throws try void volatile while true false var val fun when object override"), lineComments: []string{"//"}, blockComments: cComments, quotes: `"'`}
+	cSyntax       = &highlightSyntax{keywords: keywords("auto break case char const continue default do double else enum extern float for goto if int long register return short signed sizeof static struct switch typedef union unsigned void volatile while include define ifdef ifndef endif class namespace template typename public private protected virtual override new delete using true false nullptr"), lineComments: []string{"//"}, blockComments: cComments, quotes: `"'`}
+	csharpSyntax  = &highlightSyntax{keywords: keywords("abstract as async await base bool break byte case catch char class const continue decimal default delegate do double else enum event explicit extern false finally float for foreach if implicit in int interface internal is lock long namespace new null object out override private protected public readonly ref return sealed short static string struct switch this throw true try typeof uint ulong using var virtual void while"), lineComments: []string{"//"}, blockComments: cComments, quotes: `"'`}
+	phpSyntax     = &highlightSyntax{keywords: keywords("abstract and array as break case catch class const continue declare default do echo else elseif empty endif extends final finally fn for foreach function global if implements include interface isset list namespace new or print private protected public require return static switch throw trait try unset use var while true false null"), lineComments: []string{"//", "#"}, blockComments: cComments, quotes: `"'`}
+	rubySyntax    = &highlightSyntax{keywords: keywords("alias and begin break case class def defined do else elsif end ensure false for if in module next nil not or redo rescue retry return self super then true undef unless until when while yield require"), lineComments: []string{"#"}, quotes: `"'`}
+	sqlSyntax     = &highlightSyntax{keywords: keywords("select from where insert into values update set delete create table drop alter add column and or not null is in like between join left right inner outer full on as group by order having limit offset primary key foreign references index unique distinct union all case when then else end default exists begin commit rollback"), lineComments: []string{"--"}, blockComments: cComments, quotes: `"'`, caseless: true}
+	jsonSyntax    = &highlightSyntax{keywords: keywords("true false null"), quotes: `"`}
+	yamlSyntax    = &highlightSyntax{keywords: keywords("true false null yes no on off"), lineComments: []string{"#"}, quotes: `"'`}
+	tomlSyntax    = &highlightSyntax{keywords: keywords("true false"), lineComments: []string{"#", ";"}, quotes: `"'`}
+	cssSyntax     = &highlightSyntax{keywords: keywords("important inherit initial unset none auto"), blockComments: cComments, quotes: `"'`}
+	dockerSyntax  = &highlightSyntax{keywords: keywords("FROM RUN CMD COPY ADD ENV EXPOSE WORKDIR ENTRYPOINT ARG USER VOLUME LABEL HEALTHCHECK SHELL STOPSIGNAL ONBUILD AS"), lineComments: []string{"#"}, quotes: `"'`}
+	markupSyntax  = &highlightSyntax{blockComments: [][2]string{{"<!--", "-->"}}, quotes: `"'`}
+	highlightable = map[string]*highlightSyntax{
+		"go":         goSyntax,
+		"golang":     goSyntax,
+		"js":         jsSyntax,
+		"jsx":        jsSyntax,
+		"mjs":        jsSyntax,
+		"javascript": jsSyntax,
+		"ts":         tsSyntax,
+		"tsx":        tsSyntax,
+		"typescript": tsSyntax,
+		"py":         pythonSyntax,
+		"python":     pythonSyntax,
+		"sh":         shellSyntax,
+		"bash":       shellSyntax,
+		"zsh":        shellSyntax,
+		"shell":      shellSyntax,
+		"console":    shellSyntax,
+		"rs":         rustSyntax,
+		"rust":       rustSyntax,
+		"java":       javaSyntax,
+		"kt":         javaSyntax,
+		"kotlin":     javaSyntax,
+		"c":          cSyntax,
+		"h":          cSyntax,
+		"cpp":        cSyntax,
+		"c++":        cSyntax,
+		"cs":         csharpSyntax,
+		"csharp":     csharpSyntax,
+		"php":        phpSyntax,
+		"rb":         rubySyntax,
+		"ruby":       rubySyntax,
+		"sql":        sqlSyntax,
+		"json":       jsonSyntax,
+		"yml":        yamlSyntax,
+		"yaml":       yamlSyntax,
+		"toml":       tomlSyntax,
+		"ini":        tomlSyntax,
+		"css":        cssSyntax,
+		"scss":       cssSyntax,
+		"dockerfile": dockerSyntax,
+		"docker":     dockerSyntax,
+		"html":       markupSyntax,
+		"xml":        markupSyntax,
+	}
+)
+
+func writeToken(builder *strings.Builder, class string, token string) {
+	if class == "" {
+		builder.WriteString(html.EscapeString(token))
+		return
+	}
+
+	builder.WriteString(`<span class="tok-` + class + `">`)
+	builder.WriteString(html.EscapeString(token))
+	builder.WriteString("</span>")
+}
+
+func isIdentRune(r rune) bool {
+	return r == '_' || r == '$' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// quotedEnd returns the length of the string literal at the start of s,
+// which ends at its closing quote or, unless quoted with backticks, at the
+// end of the line.
+func quotedEnd(s string) int {
+	quote := s[0]
+	for i := 1; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quote != '`':
+			i++
+		case s[i] == quote:
+			return i + 1
+		case s[i] == '\n' && quote != '`':
+			return i
+		}
+	}
+
+	return len(s)
+}
+
+func numberEnd(s string) int {
+	for i, r := range s {
+		if !(r == '.' || r == '_' || unicode.IsDigit(r) || unicode.IsLetter(r)) {
+			return i
+		}
+	}
+
+	return len(s)
+}
+
+// HighlightCode returns code as HTML, with its keywords, strings, numbers
+// and comments wrapped in spans of the tok-keyword, tok-string, tok-number
+// and tok-comment classes. Code in a language it does not know is only
+// escaped.
+func HighlightCode(code string, language string) string {
+	syntax, ok := highlightable[strings.ToLower(language)]
+	if !ok {
+		return html.EscapeString(code)
+	}
+
+	var builder strings.Builder
+
+	for i := 0; i < len(code); {
+		rest := code[i:]
+		token, class := "", ""
+
+		for _, prefix := range syntax.lineComments {
+			if token == "" && strings.HasPrefix(rest, prefix) {
+				end := strings.IndexByte(rest, '\n')
+				if end < 0 {
+					end = len(rest)
+				}
+				token, class = rest[:end], "comment"
+			}
+		}
+
+		for _, delimiters := range syntax.blockComments {
+			if token == "" && strings.HasPrefix(rest, delimiters[0]) {
+				end := strings.Index(rest[len(delimiters[0]):], delimiters[1])
+				if end < 0 {
+					end = len(rest)
+				} else {
+					end += len(delimiters[0]) + len(delimiters[1])
+				}
+				token, class = rest[:end], "comment"
+			}
+		}
+
+		r, size := utf8.DecodeRuneInString(rest)
+
+		switch {
+		case token != "":
+		case strings.IndexByte(syntax.quotes, rest[0]) >= 0:
+			token, class = rest[:quotedEnd(rest)], "string"
+		case unicode.IsDigit(r):
+			token, class = rest[:numberEnd(rest)], "number"
+		case isIdentRune(r):
+			end := strings.IndexFunc(rest, func(r rune) bool { return !isIdentRune(r) })
+			if end < 0 {
+				end = len(rest)
+			}
+			token = rest[:end]
+
+			word := token
+			if syntax.caseless {
+				word = strings.ToLower(word)
+			}
+			if syntax.keywords[word] {
+				class = "keyword"
+			}
+		default:
+			token = rest[:size]
+		}
+
+		writeToken(&builder, class, token)
+		i += len(token)
+	}
+
+	return builder.String()
+}
@@ -0,0 +1,48 @@
+package utils
+
+import (
+	"testing"
+)
+
+func TestHighlightCode(t *testing.T) {
+	tests := []struct {
+		name     string
+		code     string
+		language string
+		expected string
+	}{
+		{
+			name:     "Go",
+			code:     "func main() { // start\n\tx := \"a<b\" + 42\n}",
+			language: "go",
+			expected: "<span class=\"tok-keyword\">func</span> main() { <span class=\"tok-comment\">// start</span>\n\tx := <span class=\"tok-string\">&#34;a&lt;b&#34;</span> + <span class=\"tok-number\">42</span>\n}",
+		},
+		{
+			name:     "Escaped quotes stay in the string",
+			code:     `echo "say \"hi\"" # done`,
+			language: "bash",
+			expected: `echo <span class="tok-string">&#34;say \&#34;hi\&#34;&#34;</span> <span class="tok-comment"># done</span>`,
+		},
+		{
+			name:     "Caseless keywords",
+			code:     "Select id1 FROM t",
+			language: "SQL",
+			expected: `<span class="tok-keyword">Select</span> id1 <span class="tok-keyword">FROM</span> t`,
+		},
+		{
+			name:     "Unknown languages are only escaped",
+			code:     "if <x>",
+			language: "brainfuck",
+			expected: "if &lt;x&gt;",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := HighlightCode(tt.code, tt.language)
+			if result != tt.expected {
+				t.Errorf("HighlightCode() got = %q, want %q", result, tt.expected)
+			}
+		})
+	}
+}
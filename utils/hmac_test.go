@@ -0,0 +1,29 @@
+package utils
+
+import "testing"
+
+func TestHMAC(t *testing.T) {
+	body := []byte(`{"event":"ping"}`)
+	signature := SignHMAC("secret", body)
+
+	tests := []struct {
+		name      string
+		secret    string
+		signature string
+		expected  bool
+	}{
+		{"Plain signature", "secret", signature, true},
+		{"GitHub style signature", "secret", "sha256=" + signature, true},
+		{"Wrong secret", "other", signature, false},
+		{"Empty secret", "", SignHMAC("", body), false},
+		{"Malformed signature", "secret", "sha256=zz", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if result := VerifyHMAC(tt.secret, body, tt.signature); result != tt.expected {
+				t.Errorf("VerifyHMAC() = %v, want %v", result, tt.expected)
+			}
+		})
+	}
+}
@@ -1,17 +1,94 @@
 package utils
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"git.difuse.io/Difuse/kalmia/logger"
+	"git.difuse.io/Difuse/kalmia/tracing"
+	"go.opentelemetry.io/otel/attribute"
 	"go.uber.org/zap"
 )
 
+// CommandError is returned when a pnpm or npx command still fails after
+// its retries.
+type CommandError struct {
+	Tool     string
+	Command  string
+	Retries  int
+	ExitCode int
+	Output   string
+}
+
+func (e *CommandError) Error() string {
+	if e.Output == "" {
+		return fmt.Sprintf("%s command '%s' failed after %d retries", e.Tool, e.Command, e.Retries)
+	}
+
+	return fmt.Sprintf("%s command '%s' failed after %d retries with output %s", e.Tool, e.Command, e.Retries, e.Output)
+}
+
+// commandWaitDelay bounds how long a killed command is waited for, in case
+// a process it left behind keeps its output open.
+const commandWaitDelay = 10 * time.Second
+
+// runCommand runs name once in dir, copying its combined output to output
+// when it is not nil. It returns the output and the exit code. The command
+// and the processes it started are killed once ctx is done.
+func runCommand(ctx context.Context, output io.Writer, dir string, name string, args ...string) (_ []byte, exitCode int, err error) {
+	ctx, span := tracing.Start(ctx, "exec "+name,
+		attribute.String("process.executable.name", name),
+		attribute.StringSlice("process.command_args", append([]string{name}, args...)),
+		attribute.String("process.working_directory", dir),
+	)
+	defer func() {
+		span.SetAttributes(attribute.Int("process.exit.code", exitCode))
+		tracing.End(span, err)
+	}()
+
+	var buffer bytes.Buffer
+	var writer io.Writer = &buffer
+	if output != nil {
+		fmt.Fprintf(output, "$ %s %s\n", name, strings.Join(args, " "))
+		writer = io.MultiWriter(&buffer, output)
+	}
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = dir
+	cmd.Stdout = writer
+	cmd.Stderr = writer
+	cmd.WaitDelay = commandWaitDelay
+	killProcessGroup(cmd)
+
+	err = cmd.Run()
+	if err == nil {
+		return buffer.Bytes(), 0, nil
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return buffer.Bytes(), exitErr.ExitCode(), err
+	}
+
+	return buffer.Bytes(), -1, err
+}
+
 func RunNpmCommand(dir string, command string, args ...string) error {
+	return RunNpmCommandContext(context.Background(), nil, dir, command, args...)
+}
+
+// RunNpmCommandContext is RunNpmCommand with a context and an optional
+// writer receiving the command output as it runs. The command is killed and
+// no more retries are made once ctx is done.
+func RunNpmCommandContext(ctx context.Context, output io.Writer, dir string, command string, args ...string) error {
 	if _, err := os.Stat(dir); os.IsNotExist(err) {
 		return fmt.Errorf("directory '%s' does not exist", dir)
 	}
@@ -19,19 +96,21 @@ func RunNpmCommand(dir string, command string, args ...string) error {
 	fullCommand := append([]string{command}, args...)
 	const maxRetries = 3
 
-	var output []byte
+	var commandOutput []byte
+	var exitCode int
 	var err error
 
 	for i := 0; i < maxRetries; i++ {
-		cmd := exec.Command("pnpm", fullCommand...)
-		cmd.Dir = dir
-
-		output, err = cmd.CombinedOutput()
+		commandOutput, exitCode, err = runCommand(ctx, output, dir, "pnpm", fullCommand...)
 
 		if err == nil {
 			return nil
 		}
 
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
 		if len(args) > 0 && args[0] == "install" {
 			nodeModulesPath := filepath.Join(dir, "node_modules")
 			if err := os.RemoveAll(nodeModulesPath); err != nil {
@@ -47,13 +126,23 @@ func RunNpmCommand(dir string, command string, args ...string) error {
 		}
 	}
 
-	return fmt.Errorf("npm command '%s' failed after %d retries with output %s",
-		strings.Join(fullCommand, " "),
-		maxRetries,
-		string(output))
+	return &CommandError{
+		Tool:     "npm",
+		Command:  strings.Join(fullCommand, " "),
+		Retries:  maxRetries,
+		ExitCode: exitCode,
+		Output:   string(commandOutput),
+	}
 }
 
 func RunNpxCommand(dir string, command string, args ...string) error {
+	return RunNpxCommandContext(context.Background(), nil, dir, command, args...)
+}
+
+// RunNpxCommandContext is RunNpxCommand with a context and an optional
+// writer receiving the command output as it runs. The command is killed and
+// no more retries are made once ctx is done.
+func RunNpxCommandContext(ctx context.Context, output io.Writer, dir string, command string, args ...string) error {
 	if _, err := os.Stat(dir); os.IsNotExist(err) {
 		return fmt.Errorf("directory '%s' does not exist", dir)
 	}
@@ -61,16 +150,21 @@ func RunNpxCommand(dir string, command string, args ...string) error {
 	fullCommand := append([]string{command}, args...)
 	const maxRetries = 3
 
-	for i := 0; i < maxRetries; i++ {
-		cmd := exec.Command("npx", fullCommand...)
-		cmd.Dir = dir
+	var exitCode int
 
-		output, err := cmd.CombinedOutput()
+	for i := 0; i < maxRetries; i++ {
+		commandOutput, code, err := runCommand(ctx, output, dir, "npx", fullCommand...)
 
 		if err == nil {
 			return nil
 		}
 
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		exitCode = code
+
 		if command == "rspress" && len(args) > 0 && args[0] == "build" {
 			buildTmpPath := filepath.Join(dir, "build_tmp")
 			if err := os.RemoveAll(buildTmpPath); err != nil {
@@ -78,17 +172,25 @@ func RunNpxCommand(dir string, command string, args ...string) error {
 			}
 		}
 
-		logger.Warn("npx command failed", zap.String("command", strings.Join(fullCommand, " ")), zap.Error(err), zap.String("output", string(output)))
+		logger.WarnContext(ctx, "npx command failed", zap.String("command", strings.Join(fullCommand, " ")), zap.Error(err), zap.String("output", string(commandOutput)))
 	}
 
-	return fmt.Errorf("npx command '%s' failed after %d retries", strings.Join(fullCommand, " "), maxRetries)
+	return &CommandError{
+		Tool:     "npx",
+		Command:  strings.Join(fullCommand, " "),
+		Retries:  maxRetries,
+		ExitCode: exitCode,
+	}
 }
 
-func NpmPing() bool {
+// NpmPing reports whether the registry pnpm is configured with in dir, by
+// its .npmrc, answers.
+func NpmPing(dir string) bool {
 	const maxRetries = 3
 
 	for i := 0; i < maxRetries; i++ {
 		cmd := exec.Command("pnpm", "ping")
+		cmd.Dir = dir
 		output, err := cmd.CombinedOutput()
 
 		if strings.Contains(string(output), "PONG") && err == nil {
@@ -1,8 +1,13 @@
 package utils
 
 import (
+	"bytes"
+	"context"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestRunNpmCommand(t *testing.T) {
@@ -104,7 +109,55 @@ func TestRunNpxCommand(t *testing.T) {
 	}
 }
 
+func TestRunCommand(t *testing.T) {
+	var output bytes.Buffer
+
+	commandOutput, exitCode, err := runCommand(context.Background(), &output, t.TempDir(), "sh", "-c", "echo out; echo err >&2; exit 3")
+	if err == nil {
+		t.Fatalf("Expected an error, but got none")
+	}
+
+	if exitCode != 3 {
+		t.Errorf("runCommand() exit code = %d, want 3", exitCode)
+	}
+
+	if !strings.Contains(string(commandOutput), "out") || !strings.Contains(string(commandOutput), "err") {
+		t.Errorf("runCommand() output = %q, want stdout and stderr", commandOutput)
+	}
+
+	if !strings.HasPrefix(output.String(), "$ sh -c") || !strings.Contains(output.String(), "err") {
+		t.Errorf("runCommand() streamed output = %q", output.String())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, _, err := runCommand(ctx, nil, t.TempDir(), "sh", "-c", "sleep 5"); err == nil {
+		t.Errorf("Expected an error for a cancelled context, but got none")
+	}
+}
+
+func TestRunCommandKillsChildren(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("process groups are not used on windows")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	// The background sleep keeps the output open, so the command is only
+	// waited for shortly if it is killed along with the shell
+	start := time.Now()
+	if _, _, err := runCommand(ctx, &bytes.Buffer{}, t.TempDir(), "sh", "-c", "sleep 30 & wait"); err == nil {
+		t.Errorf("Expected an error for a cancelled context, but got none")
+	}
+
+	if elapsed := time.Since(start); elapsed > commandWaitDelay/2 {
+		t.Errorf("runCommand() returned after %s, want the children killed", elapsed)
+	}
+}
+
 func TestNpmPing(t *testing.T) {
-	result := NpmPing()
+	result := NpmPing("")
 	t.Logf("NpmPing result: %v", result)
 }
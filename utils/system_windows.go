@@ -0,0 +1,9 @@
+//go:build windows
+
+package utils
+
+import "os/exec"
+
+// killProcessGroup leaves cmd as it is, only the command itself is killed
+// when its context is done.
+func killProcessGroup(cmd *exec.Cmd) {}
@@ -0,0 +1,84 @@
+package utils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"git.difuse.io/Difuse/kalmia/config"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// TLSConfig returns the TLS config to serve HTTPS with, as set up in cfg.
+// ACME certificates are cached in the certs folder of dataPath, and only
+// requested for the hosts hostPolicy allows. The returned handler is the one
+// to serve plain HTTP with: it answers ACME HTTP-01 challenges and passes
+// every other request on to fallback.
+func TLSConfig(cfg config.TLS, dataPath string, hostPolicy autocert.HostPolicy, fallback http.Handler) (*tls.Config, http.Handler, error) {
+	var static *tls.Certificate
+	if cfg.CertFile != "" && cfg.KeyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+		}
+		static = &certificate
+	}
+
+	if !cfg.ACME {
+		if static == nil {
+			return nil, nil, fmt.Errorf("no TLS certificate configured")
+		}
+
+		return &tls.Config{Certificates: []tls.Certificate{*static}, MinVersion: tls.VersionTLS12}, fallback, nil
+	}
+
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(filepath.Join(dataPath, "certs")),
+		HostPolicy: hostPolicy,
+		Email:      cfg.Email,
+	}
+
+	if cfg.DirectoryURL != "" || cfg.DirectoryCA != "" {
+		client := &acme.Client{DirectoryURL: cfg.DirectoryURL}
+
+		if cfg.DirectoryCA != "" {
+			caPEM, err := os.ReadFile(cfg.DirectoryCA)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to read ACME directory CA: %w", err)
+			}
+
+			roots := x509.NewCertPool()
+			if !roots.AppendCertsFromPEM(caPEM) {
+				return nil, nil, fmt.Errorf("no certificates found in ACME directory CA")
+			}
+
+			client.HTTPClient = &http.Client{Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: roots},
+			}}
+		}
+
+		manager.Client = client
+	}
+
+	tlsConfig := manager.TLSConfig()
+	tlsConfig.MinVersion = tls.VersionTLS12
+
+	// The certificate files are used for the hosts they cover
+	if static != nil {
+		tlsConfig.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if hello.ServerName == "" || static.Leaf.VerifyHostname(hello.ServerName) == nil {
+				return static, nil
+			}
+
+			return manager.GetCertificate(hello)
+		}
+	}
+
+	return tlsConfig, manager.HTTPHandler(fallback), nil
+}
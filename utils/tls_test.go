@@ -0,0 +1,110 @@
+package utils
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.difuse.io/Difuse/kalmia/config"
+)
+
+// writeTestCertificate writes a self-signed certificate for host to dir.
+func writeTestCertificate(t *testing.T, dir string, host string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCertificate(t, dir, "kalmia.example.com")
+	fallback := http.NotFoundHandler()
+	denyAll := func(ctx context.Context, host string) error { return os.ErrPermission }
+
+	t.Run("Certificate files", func(t *testing.T) {
+		tlsConfig, httpHandler, err := TLSConfig(config.TLS{CertFile: certFile, KeyFile: keyFile}, dir, denyAll, fallback)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(tlsConfig.Certificates) != 1 {
+			t.Errorf("Expected the certificate to be loaded, got %d", len(tlsConfig.Certificates))
+		}
+
+		if httpHandler == nil {
+			t.Error("Expected a handler for plain HTTP")
+		}
+	})
+
+	t.Run("Missing certificates", func(t *testing.T) {
+		if _, _, err := TLSConfig(config.TLS{}, dir, denyAll, fallback); err == nil {
+			t.Error("Expected an error without a certificate")
+		}
+
+		if _, _, err := TLSConfig(config.TLS{CertFile: filepath.Join(dir, "missing.pem"), KeyFile: keyFile}, dir, denyAll, fallback); err == nil {
+			t.Error("Expected an error for a missing certificate file")
+		}
+
+		if _, _, err := TLSConfig(config.TLS{ACME: true, DirectoryCA: keyFile}, dir, denyAll, fallback); err == nil {
+			t.Error("Expected an error for a directory CA without certificates")
+		}
+	})
+
+	t.Run("Certificate files are used for the hosts they cover with ACME", func(t *testing.T) {
+		tlsConfig, _, err := TLSConfig(config.TLS{CertFile: certFile, KeyFile: keyFile, ACME: true, DirectoryCA: certFile}, dir, denyAll, fallback)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		certificate, err := tlsConfig.GetCertificate(&tls.ClientHelloInfo{ServerName: "kalmia.example.com"})
+		if err != nil || certificate == nil || certificate.Leaf.Subject.CommonName != "kalmia.example.com" {
+			t.Errorf("GetCertificate() got = %v, %v, want the certificate files", certificate, err)
+		}
+
+		// Other hosts are left to ACME, which the host policy denies
+		if _, err := tlsConfig.GetCertificate(&tls.ClientHelloInfo{ServerName: "docs.example.com"}); err == nil {
+			t.Error("Expected hosts the host policy denies to get no certificate")
+		}
+	})
+}